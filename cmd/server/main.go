@@ -1,30 +1,162 @@
 package main
 
 import (
+	"context"
 	"example/library-service/internal/auth"
-	"example/library-service/internal/author"
-	"example/library-service/internal/book"
-	"example/library-service/internal/user"
-	"log"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/health"
+	"example/library-service/internal/idempotency"
+	"example/library-service/internal/logging"
+	"example/library-service/internal/mail"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/openapi"
+	"example/library-service/internal/server"
+	"example/library-service/internal/tracing"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
-	log.Println("main.starting app...")
+	logging.Setup()
+	slog.Info("main.starting app...")
+
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		slog.Error("main - cannot set up tracing", "err", err)
+		os.Exit(1)
+	}
+
+	keys, err := auth.SetupKeys()
+	if err != nil {
+		slog.Error("main - cannot load signing keys", "err", err)
+		os.Exit(1)
+	}
+
 	db := Connect()
 	db.Ping()
+	metrics.RegisterDB(db, "postgres")
 	authStore := auth.NewAuthStore(db)
-	bookHandler := book.NewBookHandler(db, authStore)
-	authorHandler := author.NewAuthorHandler(db, authStore)
-	userHandler := user.NewUserHandler(db, authStore)
-	authHandler := auth.NewAuthHandler(authStore)
-	server := http.NewServeMux()
-	server.Handle("/books", bookHandler)
-	server.Handle("/books/", bookHandler)
-	server.Handle("/authors", authorHandler)
-	server.Handle("/authors/", authorHandler)
-	server.Handle("/users", userHandler)
-	server.Handle("/users/", userHandler)
-	server.Handle("/auth/", authHandler)
-	http.ListenAndServe(":8080", server)
+	if err := authStore.LoadRevocations(context.Background()); err != nil {
+		slog.Error("main - cannot load token revocations", "err", err)
+		os.Exit(1)
+	}
+	catalog := cache.NewNamespace(cache.NewLRU(intFromEnv("CACHE_SIZE", 10000)), "catalog",
+		durationFromEnv("CATALOG_CACHE_TTL", 5*time.Minute), durationFromEnv("CATALOG_MAX_AGE", time.Minute))
+	idempotencyStore := idempotency.NewIdempotencyStore(db, durationFromEnv("IDEMPOTENCY_KEY_TTL", 24*time.Hour))
+	blobs, err := blob.NewBlobStoreFromEnv()
+	if err != nil {
+		slog.Error("main - cannot set up blob store", "err", err)
+		os.Exit(1)
+	}
+	mailer, err := mail.NewMailerFromEnv()
+	if err != nil {
+		slog.Error("main - cannot set up mailer", "err", err)
+		os.Exit(1)
+	}
+	healthHandler := health.NewHealthHandler(db, schemaVersion)
+
+	mux := server.New(server.Deps{
+		DB:              db,
+		AuthStore:       authStore,
+		Keys:            keys,
+		Catalog:         catalog,
+		Idempotency:     idempotencyStore,
+		Blobs:           blobs,
+		Mailer:          mailer,
+		OIDC:            auth.NewOIDCProviderFromEnv(),
+		Health:          healthHandler,
+		LoanPeriod:      durationFromEnv("LOAN_PERIOD", 14*24*time.Hour),
+		DownloadLinkTTL: durationFromEnv("DOWNLOAD_LINK_TTL", 15*time.Minute),
+	})
+
+	// The specification documents every route; the openapi tests check the
+	// router of server.New too, so drift is usually caught before it ships.
+	// OPENAPI_STRICT=true turns drift into a startup failure.
+	if drift := openapi.Verify(mux); len(drift) > 0 {
+		for _, d := range drift {
+			slog.Error("main - openapi drift", "route", d)
+		}
+		if os.Getenv("OPENAPI_STRICT") == "true" {
+			os.Exit(1)
+		}
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":8080",
+		Handler: logging.RequestIDMiddleware(logging.AccessLogMiddleware(mux)),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go keys.Watch(ctx, durationFromEnv("JWT_KEYS_RELOAD_INTERVAL", time.Minute))
+	go authStore.WatchRevocations(ctx, connStr, durationFromEnv("REVOCATION_REFRESH_INTERVAL", 30*time.Second))
+
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("main - server stopped", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	drain := durationFromEnv("SHUTDOWN_DRAIN_PERIOD", 5*time.Second)
+	slog.Info("main - shutting down, draining", "drain", drain.String())
+	healthHandler.SetShuttingDown()
+	time.Sleep(drain)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), durationFromEnv("SHUTDOWN_TIMEOUT", 15*time.Second))
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("main - graceful shutdown failed", "err", err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("main - flushing traces failed", "err", err)
+	}
+
+	if err := db.Close(); err != nil {
+		slog.Error("main - closing db failed", "err", err)
+	}
+
+	slog.Info("main - stopped")
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("main - invalid duration, using default", "key", key, "value", value)
+		return fallback
+	}
+
+	return d
+}
+
+func intFromEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("main - invalid number, using default", "key", key, "value", value)
+		return fallback
+	}
+
+	return n
 }
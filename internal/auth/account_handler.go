@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/mail"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const minPasswordLength = 8
+
+var appBaseURL = getEnv("APP_BASE_URL", "http://localhost:8080")
+
+func (authHandler *AuthHandler) verifyMail(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		errors.HandleError(400, "token is required", w)
+		return
+	}
+
+	id, err := authHandler.S.VerifyMail(r.Context(), HashOpaqueToken(req.Token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(400, "invalid or expired token", w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthHandler.verifyMail() - mail verified", "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (authHandler *AuthHandler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mail == "" {
+		errors.HandleError(400, "mail is required", w)
+		return
+	}
+
+	// The response doesn't depend on whether the mail is known,
+	// so the endpoint can't be used to enumerate accounts.
+	user, err := authHandler.S.GetUserByMail(r.Context(), req.Mail)
+	switch {
+	case err == sql.ErrNoRows:
+		slog.InfoContext(r.Context(), "AuthHandler.forgotPassword() - unknown mail")
+	case err != nil:
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	default:
+		if err := sendToken(r.Context(), authHandler.S, authHandler.mailer, user, PurposeResetPassword, resetPasswordTTL, func(token string) mail.Message {
+			return mail.Message{
+				To:      user.Mail,
+				Subject: "Reset your library password",
+				Body: "Somebody requested a password reset for your account.\n" +
+					"Follow the link below within an hour to choose a new password:\n\n" +
+					appBaseURL + "/reset-password?token=" + url.QueryEscape(token) + "\n\n" +
+					"If it wasn't you, ignore this message.",
+			}
+		}); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (authHandler *AuthHandler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		errors.HandleError(400, "token is required", w)
+		return
+	}
+
+	if len(req.Password) < minPasswordLength {
+		errors.HandleError(400, fmt.Sprintf("password must be at least %v characters long", minPasswordLength), w)
+		return
+	}
+
+	hash, err := HashAndSalt([]byte(req.Password))
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	id, err := authHandler.S.ResetPassword(r.Context(), HashOpaqueToken(req.Token), hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(400, "invalid or expired token", w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthHandler.resetPassword() - password reset, sessions revoked", "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendVerificationMail mails the user a link confirming their mail address.
+func SendVerificationMail(ctx context.Context, store *AuthStore, mailer mail.Mailer, user entity.User) error {
+	return sendToken(ctx, store, mailer, user, PurposeVerifyMail, verifyMailTTL, func(token string) mail.Message {
+		return mail.Message{
+			To:      user.Mail,
+			Subject: "Confirm your library account",
+			Body: "Hello " + user.Name + ",\n\nplease confirm your mail address by following the link below:\n\n" +
+				appBaseURL + "/verify?token=" + url.QueryEscape(token) + "\n\n" +
+				"The link is valid for 24 hours.",
+		}
+	})
+}
+
+// sendToken issues a single-use token for the user and mails the message
+// composed around it.
+func sendToken(ctx context.Context, store *AuthStore, mailer mail.Mailer, user entity.User, purpose string, ttl time.Duration, compose func(token string) mail.Message) error {
+	token, hash, err := NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "auth.sendToken() - cannot generate token", "err", err)
+		return err
+	}
+
+	if err := store.CreateUserToken(ctx, user.Id, purpose, hash, time.Now().UTC().Add(ttl)); err != nil {
+		return err
+	}
+
+	if err := mailer.Send(ctx, compose(token)); err != nil {
+		slog.ErrorContext(ctx, "auth.sendToken() - cannot send mail", "err", err, "purpose", purpose)
+		return err
+	}
+
+	return nil
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Mail string `json:"mail"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
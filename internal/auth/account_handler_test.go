@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"example/library-service/internal/mail"
+	"example/library-service/internal/utils"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// outbox is a mailer keeping the messages it's sent.
+type outbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (o *outbox) Send(ctx context.Context, msg mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// lastToken returns the token linked in the last message sent.
+func (o *outbox) lastToken(t *testing.T) string {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.messages) == 0 {
+		t.Fatal("no message was sent")
+	}
+
+	body := o.messages[len(o.messages)-1].Body
+	start := strings.Index(body, "token=")
+	if start < 0 {
+		t.Fatalf("message doesn't link a token: %s", body)
+	}
+	token, _, _ := strings.Cut(body[start+len("token="):], "\n")
+	token, err := url.QueryUnescape(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func post(handler *AuthHandler, path string, body string) int {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestNewOpaqueToken(t *testing.T) {
+	token, hash, err := NewOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != HashOpaqueToken(token) || hash == token {
+		t.Errorf("hash = %q of token %q", hash, token)
+	}
+	if url.QueryEscape(token) != token {
+		t.Errorf("token %q isn't url-safe", token)
+	}
+
+	other, _, err := NewOpaqueToken()
+	if err != nil || other == token {
+		t.Errorf("tokens repeat: %q, %v", other, err)
+	}
+}
+
+// These requests are rejected before any query, so they need no database.
+func TestAccountRequestsReject(t *testing.T) {
+	handler := NewAuthHandler(NewAuthStore(nil), &outbox{}, nil)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"verify without token", utils.VerifyMailPath, `{}`},
+		{"forgot without mail", utils.ForgotPasswordPath, `{"mail": ""}`},
+		{"reset without token", utils.ResetPasswordPath, `{"password": "correct horse"}`},
+		{"reset with short password", utils.ResetPasswordPath, `{"token": "abc", "password": "short"}`},
+		{"not JSON", utils.ResetPasswordPath, `token=abc`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := post(handler, tt.path, tt.body); status != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func insertUser(t *testing.T, db *sql.DB) (uuid.UUID, string) {
+	t.Helper()
+	var id uuid.UUID
+	name := uuid.NewString()
+	if err := db.QueryRow(`
+		insert into users(name, mail, password, role, created_at, failed_logins) values($1, $2, 'hash', 0, now(), 3) returning id
+	`, name, name+"@example.com").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id, name + "@example.com"
+}
+
+func TestResetPasswordTokenIsSingleUse(t *testing.T) {
+	db, _ := testDB(t)
+	mailer := &outbox{}
+	handler := NewAuthHandler(NewAuthStore(db), mailer, nil)
+	id, address := insertUser(t, db)
+
+	// Unknown mails are answered alike.
+	if status := post(handler, utils.ForgotPasswordPath, `{"mail": "nobody-`+uuid.NewString()+`@example.com"}`); status != http.StatusAccepted {
+		t.Errorf("forgot with unknown mail status = %d, want %d", status, http.StatusAccepted)
+	}
+
+	if status := post(handler, utils.ForgotPasswordPath, `{"mail": "`+address+`"}`); status != http.StatusAccepted {
+		t.Fatalf("forgot status = %d", status)
+	}
+	superseded := mailer.lastToken(t)
+
+	// Requesting another reset invalidates the previous token.
+	if status := post(handler, utils.ForgotPasswordPath, `{"mail": "`+address+`"}`); status != http.StatusAccepted {
+		t.Fatalf("forgot status = %d", status)
+	}
+	token := mailer.lastToken(t)
+	if status := post(handler, utils.ResetPasswordPath, `{"token": "`+superseded+`", "password": "correct horse"}`); status != http.StatusBadRequest {
+		t.Errorf("reset with superseded token status = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status := post(handler, utils.ResetPasswordPath, `{"token": "`+token+`", "password": "correct horse"}`); status != http.StatusNoContent {
+		t.Fatalf("reset status = %d", status)
+	}
+	var password string
+	var failedLogins int
+	if err := db.QueryRow(`select password, failed_logins from users where id=$1`, id).Scan(&password, &failedLogins); err != nil {
+		t.Fatal(err)
+	}
+	if password == "hash" || failedLogins != 0 {
+		t.Errorf("password = %q, failed_logins = %d after the reset", password, failedLogins)
+	}
+
+	if status := post(handler, utils.ResetPasswordPath, `{"token": "`+token+`", "password": "battery staple"}`); status != http.StatusBadRequest {
+		t.Errorf("second reset status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestVerifyMailTokenIsSingleUse(t *testing.T) {
+	db, _ := testDB(t)
+	mailer := &outbox{}
+	store := NewAuthStore(db)
+	handler := NewAuthHandler(store, mailer, nil)
+	id, address := insertUser(t, db)
+
+	user, err := store.GetUserByMail(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SendVerificationMail(context.Background(), store, mailer, user); err != nil {
+		t.Fatal(err)
+	}
+	token := mailer.lastToken(t)
+
+	if status := post(handler, utils.VerifyMailPath, `{"token": "`+token+`"}`); status != http.StatusNoContent {
+		t.Fatalf("verify status = %d", status)
+	}
+	var verified bool
+	if err = db.QueryRow(`select mail_verified from users where id=$1`, id).Scan(&verified); err != nil || !verified {
+		t.Errorf("mail_verified = %v, %v", verified, err)
+	}
+
+	if status := post(handler, utils.VerifyMailPath, `{"token": "`+token+`"}`); status != http.StatusBadRequest {
+		t.Errorf("second verify status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestExpiredTokensAreRejected(t *testing.T) {
+	db, _ := testDB(t)
+	store := NewAuthStore(db)
+	handler := NewAuthHandler(store, &outbox{}, nil)
+	id, _ := insertUser(t, db)
+
+	tests := []struct {
+		purpose string
+		path    string
+		body    string
+	}{
+		{PurposeResetPassword, utils.ResetPasswordPath, `{"token": "%s", "password": "correct horse"}`},
+		{PurposeVerifyMail, utils.VerifyMailPath, `{"token": "%s"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.purpose, func(t *testing.T) {
+			token, hash, err := NewOpaqueToken()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.CreateUserToken(context.Background(), id, tt.purpose, hash, time.Now().UTC().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			if status := post(handler, tt.path, fmt.Sprintf(tt.body, token)); status != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/utils"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// APIKeyHandler lets admins manage the keys used by batch jobs and
+// integrations. Keys can't be managed with an API key.
+type APIKeyHandler struct {
+	S *AuthStore
+}
+
+func NewAPIKeyHandler(store *AuthStore) *APIKeyHandler {
+	return &APIKeyHandler{store}
+}
+
+func (apiKeyHandler *APIKeyHandler) Routes(r chi.Router) {
+	r.Get("/api-keys", apiKeyHandler.getAPIKeys)
+	r.Post("/api-keys", apiKeyHandler.createAPIKey)
+	r.Delete("/api-keys/{id}", apiKeyHandler.deleteAPIKey)
+}
+
+func (apiKeyHandler *APIKeyHandler) admin(w http.ResponseWriter, r *http.Request) (invoker entity.User, ok bool) {
+	invoker, err := ValidateTokenAndGetUser(r.Context(), r.Header.Get("Authorization"), apiKeyHandler.S)
+	if err != nil {
+		slog.WarnContext(r.Context(), "APIKeyHandler.admin() - invalid token", "err", err)
+		errors.HandleError(401, err.Error(), w)
+		return invoker, false
+	}
+
+	if invoker.Role != entity.ADMIN {
+		errors.HandleError(403, "403 Forbidden", w)
+		return invoker, false
+	}
+
+	return invoker, true
+}
+
+func (apiKeyHandler *APIKeyHandler) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKeyHandler.admin(w, r); !ok {
+		return
+	}
+
+	keys, err := apiKeyHandler.S.GetAPIKeys(r.Context())
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(keys)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "APIKeyHandler.getAPIKeys() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (apiKeyHandler *APIKeyHandler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	invoker, ok := apiKeyHandler.admin(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	if req.Name == "" {
+		errors.HandleError(400, "name is required", w)
+		return
+	}
+
+	if !validScopes(req.Scopes) {
+		errors.HandleError(400, fmt.Sprintf("scopes must be a non-empty subset of %v", knownScopes), w)
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errors.HandleError(400, "expiresAt must be in the future", w)
+		return
+	}
+
+	// The key acts as the given user, by default as the admin creating it.
+	userId := invoker.Id
+	if req.UserId != nil {
+		userId = *req.UserId
+		if _, err := apiKeyHandler.S.GetUserById(r.Context(), userId); err != nil {
+			errors.HandleError(400, fmt.Sprintf("user with id %v wasn't found", userId), w)
+			return
+		}
+	}
+
+	rawKey, prefix, secretHash, err := NewAPIKey()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "APIKeyHandler.createAPIKey() - cannot generate key", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	key, err := apiKeyHandler.S.CreateAPIKey(r.Context(), entity.APIKey{
+		Name:      req.Name,
+		Prefix:    prefix,
+		UserId:    userId,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+		CreatedBy: invoker.Id,
+	}, secretHash)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	// The key is only ever shown in this response.
+	key.Key = rawKey
+
+	jsonBytes, err := json.Marshal(key)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "APIKeyHandler.createAPIKey() - key created", "id", key.Id, "prefix", key.Prefix, "invoker", invoker.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+func (apiKeyHandler *APIKeyHandler) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	invoker, ok := apiKeyHandler.admin(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid api key id", w)
+		return
+	}
+
+	if err = apiKeyHandler.S.DeleteAPIKey(r.Context(), id); err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("api key with id %v wasn't found", id), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "APIKeyHandler.deleteAPIKey() - key revoked", "id", id, "invoker", invoker.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	UserId    *uuid.UUID `json:"userId"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
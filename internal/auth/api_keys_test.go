@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSplitAPIKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		prefix string
+		secret string
+		ok     bool
+	}{
+		{"valid", "lib_0a1b2c3d4e5f_secret", "0a1b2c3d4e5f", "secret", true},
+		{"secret with underscores", "lib_0a1b2c3d4e5f_se_cr_et", "0a1b2c3d4e5f", "se_cr_et", true},
+		{"wrong prefix", "key_0a1b2c3d4e5f_secret", "", "", false},
+		{"missing secret", "lib_0a1b2c3d4e5f", "", "", false},
+		{"empty secret", "lib_0a1b2c3d4e5f_", "", "", false},
+		{"empty prefix", "lib__secret", "", "", false},
+		{"only the prefix", "lib", "", "", false},
+		{"empty", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, secret, ok := splitAPIKey(tt.key)
+			if prefix != tt.prefix || secret != tt.secret || ok != tt.ok {
+				t.Errorf("splitAPIKey() = %q, %q, %v, want %q, %q, %v", prefix, secret, ok, tt.prefix, tt.secret, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNewAPIKeySplits(t *testing.T) {
+	key, prefix, secretHash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotPrefix, secret, ok := splitAPIKey(key)
+	if !ok || gotPrefix != prefix {
+		t.Fatalf("splitAPIKey(%q) = %q, %v, want prefix %q", key, gotPrefix, ok, prefix)
+	}
+	if HashOpaqueToken(secret) != secretHash {
+		t.Error("the secret doesn't match its hash")
+	}
+}
+
+func TestValidScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		want   bool
+	}{
+		{"known scopes", []string{ScopeCatalogRead, ScopeLoansWrite}, true},
+		{"unknown scope", []string{ScopeCatalogRead, "catalog:delete"}, false},
+		{"no scopes", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validScopes(tt.scopes); got != tt.want {
+				t.Errorf("validScopes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallerOnlyIdentifiesVerifiedCredentials(t *testing.T) {
+	id := uuid.New()
+	token, err := generateToken(id, 0, "", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedId := uuid.New()
+	revoked, err := generateToken(revokedId, 0, "", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyId := uuid.New()
+	deletedId := uuid.New()
+
+	// Without a database, any lookup would panic: Caller must get by with
+	// what's in memory.
+	store := NewAuthStore(nil)
+	store.verifiedKeys.add("0a1b2c", keyId, HashOpaqueToken("secret"), nil, time.Now())
+	store.verifiedKeys.add("3d4e5f", deletedId, HashOpaqueToken("secret"), nil, time.Now())
+	store.verifiedKeys.remove(deletedId)
+	store.revocations.revokeUserTokens(revokedId, time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		caller  string
+		matched bool
+	}{
+		{"valid token", "Authorization", "Bearer " + token, "user:" + id.String(), true},
+		{"revoked token", "Authorization", "Bearer " + revoked, "", false},
+		{"forged token", "Authorization", "Bearer not-a-token", "", false},
+		{"malformed header", "Authorization", token, "", false},
+		{"verified api key", APIKeyHeader, "lib_0a1b2c_secret", "key:" + keyId.String(), true},
+		{"wrong secret of a verified key", APIKeyHeader, "lib_0a1b2c_guess", "", false},
+		{"deleted api key", APIKeyHeader, "lib_3d4e5f_secret", "", false},
+		{"unknown api key", APIKeyHeader, "lib_made_up", "", false},
+		{"malformed api key", APIKeyHeader, "lib_made-up", "", false},
+		{"no credentials", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/books", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			caller, ok := Caller(r, store)
+			if caller != tt.caller || ok != tt.matched {
+				t.Errorf("Caller() = %q, %v, want %q, %v", caller, ok, tt.caller, tt.matched)
+			}
+		})
+	}
+}
+
+func TestVerifiedKeysExpire(t *testing.T) {
+	now := time.Now()
+	id := uuid.New()
+	keyExpiry := now.Add(10 * time.Second)
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		at        time.Time
+		ok        bool
+	}{
+		{"fresh", nil, now.Add(verifiedKeyTTL - time.Second), true},
+		{"past the ttl", nil, now.Add(verifiedKeyTTL), false},
+		{"before the key expires", &keyExpiry, now.Add(5 * time.Second), true},
+		{"after the key expires", &keyExpiry, keyExpiry, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newVerifiedKeys()
+			cache.add("0a1b2c", id, "hash", tt.expiresAt, now)
+
+			if _, ok := cache.lookup("0a1b2c", "hash", tt.at); ok != tt.ok {
+				t.Errorf("lookup() = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -1,56 +1,66 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	stderrors "errors"
 	"example/library-service/internal/entity"
 	"example/library-service/internal/errors"
+	"example/library-service/internal/mail"
+	"example/library-service/internal/metrics"
 	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	S *AuthStore
+	S      *AuthStore
+	mailer mail.Mailer
+	oidc   *OIDCProvider
 }
 
-func NewAuthHandler(s *AuthStore) *AuthHandler {
-	return &AuthHandler{s}
+func NewAuthHandler(s *AuthStore, mailer mail.Mailer, oidc *OIDCProvider) *AuthHandler {
+	return &AuthHandler{s, mailer, oidc}
 }
 
-func (authHandler *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == http.MethodPost && r.URL.Path == utils.RegisterPath:
-		authHandler.register(w, r)
-		return
-	case r.Method == http.MethodPost && r.URL.Path == utils.LoginPath:
-		authHandler.login(w, r)
-		return
-	case r.Method == http.MethodPost && r.URL.Path == utils.LogoutPath:
-		authHandler.logout(w, r)
-		return
-	default:
-		errors.HandleError(405, fmt.Sprintf("Method %v not allowed", r.URL.Path), w)
-		return
-	}
+func (authHandler *AuthHandler) Routes(r chi.Router) {
+	r.Post(utils.RegisterPath, authHandler.register)
+	r.Post(utils.LoginPath, authHandler.login)
+	r.Post(utils.LogoutPath, authHandler.logout)
+	r.Post(utils.VerifyMailPath, authHandler.verifyMail)
+	r.Post(utils.ForgotPasswordPath, authHandler.forgotPassword)
+	r.Post(utils.ResetPasswordPath, authHandler.resetPassword)
+	r.Post(utils.LoginMFAPath, authHandler.loginMFA)
+	r.Post(utils.MFAEnrollPath, authHandler.enrollMFA)
+	r.Post(utils.MFAConfirmPath, authHandler.confirmMFA)
+	r.Post(utils.MFADisablePath, authHandler.disableMFA)
+	r.Get(utils.OIDCLoginPath, authHandler.oidcLogin)
+	r.Get(utils.OIDCCallbackPath, authHandler.oidcCallback)
 }
 
 func (authHandler *AuthHandler) register(w http.ResponseWriter, r *http.Request) {
 	var req ReqisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Println("AuthHandler.register() - error while decoding", err)
+		slog.ErrorContext(r.Context(), "AuthHandler.register() - error while decoding", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthHandler.register() - started to process", req)
+	slog.DebugContext(r.Context(), "AuthHandler.register() - started to process", "req", req)
 
 	var exists bool
 	var err error
-	if exists, err = authHandler.S.ExistsWithNameOrMail(req.Name, req.Mail); err != nil {
+	if exists, err = authHandler.S.ExistsWithNameOrMail(r.Context(), req.Name, req.Mail); err != nil {
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
@@ -62,88 +72,150 @@ func (authHandler *AuthHandler) register(w http.ResponseWriter, r *http.Request)
 
 	req.Password, err = HashAndSalt([]byte(req.Password))
 	if err != nil {
-		log.Println("AuthHandler.register() - error while hashing password", err)
+		slog.ErrorContext(r.Context(), "AuthHandler.register() - error while hashing password", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	if err := authHandler.S.CreateUser(req); err != nil {
+	var id uuid.UUID
+	if id, err = authHandler.S.CreateUser(r.Context(), req); err != nil {
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
+	metrics.Registrations.Inc()
+
+	// The account is usable right away, a failed mail only delays verification.
+	if err := SendVerificationMail(r.Context(), authHandler.S, authHandler.mailer, entity.User{Id: id, Name: req.Name, Mail: req.Mail}); err != nil {
+		slog.WarnContext(r.Context(), "AuthHandler.register() - verification mail wasn't sent", "err", err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 
-	log.Println("AuthHandler.register() - finished to process", req)
+	slog.InfoContext(r.Context(), "AuthHandler.register() - finished to process", "req", req)
 }
 
 func (authHandler *AuthHandler) login(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Println("AuthHandler.login() - error while decoding", err)
+		slog.ErrorContext(r.Context(), "AuthHandler.login() - error while decoding", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthHandler.login() - started to process", req.Name)
+	slog.DebugContext(r.Context(), "AuthHandler.login() - started to process", "name", req.Name)
 
 	var user entity.User
 	var err error
-	if user, err = authHandler.S.GetUserByName(req.Name); err != nil {
+	if user, err = authHandler.S.GetUserByName(r.Context(), req.Name); err != nil {
+		metrics.FailedLogins.WithLabelValues("unknown_user").Inc()
 		errors.HandleError(401, "wrong username", w)
 		return
 	}
 
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		slog.WarnContext(r.Context(), "AuthHandler.login() - account is locked", "id", user.Id)
+		metrics.FailedLogins.WithLabelValues("locked").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(*user.LockedUntil).Seconds()))))
+		errors.HandleError(429, "account is temporarily locked", w)
+		return
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		metrics.FailedLogins.WithLabelValues("wrong_password").Inc()
+		authHandler.recordFailedLogin(r.Context(), user)
 		errors.HandleError(401, "wrong password", w)
 		return
 	}
 
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		if err := authHandler.S.ResetFailedLogins(r.Context(), user.Id); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	if user.TOTPEnabled {
+		authHandler.writeChallenge(w, r, user, ChallengeMFA)
+		return
+	}
+
+	if mfaRequired(user.Role) {
+		slog.InfoContext(r.Context(), "AuthHandler.login() - second factor enrollment required", "id", user.Id)
+		authHandler.writeChallenge(w, r, user, ChallengeEnroll)
+		return
+	}
+
+	authHandler.issueToken(w, r, user)
+
+	slog.InfoContext(r.Context(), "AuthHandler.login() - finished to process", "req", req)
+}
+
+// issueToken finishes a successful login by creating a session token and
+// writing it to the response.
+func (authHandler *AuthHandler) issueToken(w http.ResponseWriter, r *http.Request, user entity.User) {
 	var token string
+	var err error
 
 	if token, err = GenerateToken(user.Id, user.Role); err != nil {
-		log.Println("AuthHandler.login() - received error", err)
+		slog.ErrorContext(r.Context(), "AuthHandler.login() - received error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	user.Token = token
-	if updateErr := authHandler.S.UpdateToken(user); updateErr != nil {
-		log.Println("AuthHandler.login() - received error", err)
+	if updateErr := authHandler.S.UpdateToken(r.Context(), user); updateErr != nil {
+		slog.ErrorContext(r.Context(), "AuthHandler.login() - received error", "err", updateErr)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
+	metrics.Logins.Inc()
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(token))
+}
 
-	log.Println("AuthHandler.login() - finished to process", req)
+func (authHandler *AuthHandler) recordFailedLogin(ctx context.Context, user entity.User) {
+	failedLogins, err := authHandler.S.RecordFailedLogin(ctx, user.Id)
+	if err != nil {
+		return
+	}
 
+	if lockout := LockoutDuration(failedLogins); lockout > 0 {
+		slog.WarnContext(ctx, "AuthHandler.login() - locking account", "id", user.Id, "failed_logins", failedLogins, "lockout", lockout.String())
+		authHandler.S.LockUser(ctx, user.Id, time.Now().UTC().Add(lockout))
+	}
 }
 
 func (authHandler *AuthHandler) logout(w http.ResponseWriter, r *http.Request) {
-	log.Println("AuthHandler.logout() - started to process")
-	token := strings.Split(r.Header.Get("Authorization"), " ")[1]
-	if token == "" {
+	slog.DebugContext(r.Context(), "AuthHandler.logout() - started to process")
+	vals := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(vals) != 2 || vals[1] == "" {
 		errors.HandleError(401, "Authorization header wasn't provided", w)
 		return
 	}
 
-	id, _, err := ParseToken(token)
-	if err != nil && err.Error() != "token is expired!" {
-		errors.HandleError(500, "Internal Server Error", w)
-		return
-	}
-	if err := authHandler.S.DeleteToken(id); err != nil {
-		errors.HandleError(500, "Internal Server Error", w)
+	claims, err := parseClaims(vals[1], "")
+	switch {
+	case stderrors.Is(err, jwt.ErrTokenExpired):
+		// Nothing to revoke.
+	case err != nil:
+		slog.WarnContext(r.Context(), "AuthHandler.logout() - invalid token", "err", err)
+		errors.HandleError(401, "invalid token", w)
 		return
+	default:
+		if err := authHandler.S.RevokeToken(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
-	log.Println("AuthHandler.logout() - successfully ended to process")
+	w.WriteHeader(http.StatusOK)
+	slog.InfoContext(r.Context(), "AuthHandler.logout() - successfully ended to process")
 }
 
 type ReqisterRequest struct {
@@ -1,144 +1,873 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"example/library-service/internal/entity"
-	"log"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
+	"log/slog"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type AuthStore struct {
-	db *sql.DB
+	db           *sql.DB
+	revocations  *RevocationList
+	verifiedKeys *verifiedKeys
 }
 
 func NewAuthStore(db *sql.DB) *AuthStore {
-	return &AuthStore{db}
+	return &AuthStore{db, NewRevocationList(), newVerifiedKeys()}
 }
 
-func (store *AuthStore) ExistsWithNameOrMail(name string, mail string) (bool, error) {
-	statement, err := store.db.Prepare(`
+func (store *AuthStore) ExistsWithNameOrMail(ctx context.Context, name string, mail string) (bool, error) {
+	defer metrics.ObserveQuery("AuthStore.ExistsWithNameOrMail", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.ExistsWithNameOrMail")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
 		select count(*) from users where name=$1 or mail=$2 
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.ExistsWithNameOrMail() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.ExistsWithNameOrMail() - received error from db", "err", err)
 		return true, err
 	}
 
-	row := statement.QueryRow(name, mail)
+	row := statement.QueryRowContext(ctx, name, mail)
 	var count int
 	if scanErr := row.Scan(&count); scanErr != nil {
-		log.Println("AuthStore.ExistsWithNameOrMail() - received error from db", scanErr)
+		slog.ErrorContext(ctx, "AuthStore.ExistsWithNameOrMail() - received error from db", "err", scanErr)
 		return true, scanErr
 	}
 
-	log.Println("AuthStore.ExistsWithNameOrMail() - received from db", count)
+	slog.DebugContext(ctx, "AuthStore.ExistsWithNameOrMail() - received from db", "count", count)
 	if count > 0 {
 		return true, nil
 	}
 	return false, nil
 }
 
-func (store *AuthStore) GetUserByIdAndRole(id uuid.UUID, role int) (u entity.User, err error) {
-	statement, err := store.db.Prepare(`
-		select u.id, u.name, u.mail, u.role, u.created_at, u.password from users u where u.id=$1 and u.role=$2 and u.token is not null 
+func (store *AuthStore) GetUserById(ctx context.Context, id uuid.UUID) (u entity.User, err error) {
+	defer metrics.ObserveQuery("AuthStore.GetUserById", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetUserById")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select u.id, u.name, u.mail, u.role, u.created_at, u.locked_until, u.totp_enabled from users u where u.id=$1
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.GetUserByIdAndRole() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.GetUserById() - received error from db", "err", err)
 		return u, err
 	}
 
-	row := statement.QueryRow(id, role)
-
-	if scanErr := row.Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.Password); scanErr != nil {
-		log.Println("AuthStore.GetUserByIdAndRole() - received error from db", scanErr)
+	if scanErr := statement.QueryRowContext(ctx, id).Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.LockedUntil, &u.TOTPEnabled); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetUserById() - received error from db", "err", scanErr)
 		return u, scanErr
 	}
 
 	return u, nil
 }
 
-func (store *AuthStore) GetUserByName(name string) (u entity.User, e error) {
-	statement, err := store.db.Prepare(`
-		select u.id, u.name, u.mail, u.role, u.created_at, u.password from users u where u.name=$1 
+func (store *AuthStore) GetUserByName(ctx context.Context, name string) (u entity.User, e error) {
+	defer metrics.ObserveQuery("AuthStore.GetUserByName", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetUserByName")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select u.id, u.name, u.mail, u.role, u.created_at, u.password, u.failed_logins, u.locked_until, u.totp_enabled
+		from users u where u.name=$1 
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.GetUserByName() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.GetUserByName() - received error from db", "err", err)
 		return u, err
 	}
 
-	rows := statement.QueryRow(name)
+	rows := statement.QueryRowContext(ctx, name)
 
-	if scanErr := rows.Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.Password); scanErr != nil {
-		log.Println("AuthStore.GetUserByName() - received error from db", scanErr)
+	if scanErr := rows.Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.Password, &u.FailedLogins, &u.LockedUntil, &u.TOTPEnabled); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetUserByName() - received error from db", "err", scanErr)
 		return u, scanErr
 	}
 
-	log.Println("AuthStore.GetUserByName() - received from db", u.Id, u.Name)
+	slog.DebugContext(ctx, "AuthStore.GetUserByName() - received from db", "id", u.Id, "name", u.Name)
 	return u, nil
 }
 
-func (store *AuthStore) CreateUser(user ReqisterRequest) error {
-	statement, err := store.db.Prepare(`
+func (store *AuthStore) CreateUser(ctx context.Context, user ReqisterRequest) (id uuid.UUID, err error) {
+	defer metrics.ObserveQuery("AuthStore.CreateUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.CreateUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
 		insert into users(name, mail, password, role, created_at)
 			values($1, $2, $3, $4, $5) 
+			returning id
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateUser() - received error from db", "err", err)
+		return id, err
+	}
+
+	err = statement.QueryRowContext(ctx, &user.Name, &user.Mail, &user.Password, &user.Role, time.Now().UTC()).Scan(&id)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateUser() - received error from db", "err", err)
+		return id, err
+	}
+
+	return id, nil
+}
+
+func (store *AuthStore) UpdateToken(ctx context.Context, user entity.User) error {
+	defer metrics.ObserveQuery("AuthStore.UpdateToken", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.UpdateToken")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set token=$1 where id=$2
+		returning *
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.UpdateToken() - received error from db", "err", err)
+		return err
+	}
+
+	_, execErr := statement.ExecContext(ctx, &user.Token, &user.Id)
+
+	if execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.UpdateToken() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	return nil
+}
+
+func (store *AuthStore) RecordFailedLogin(ctx context.Context, id uuid.UUID) (failedLogins int, err error) {
+	defer metrics.ObserveQuery("AuthStore.RecordFailedLogin", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.RecordFailedLogin")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set failed_logins=failed_logins+1 where id=$1
+		returning failed_logins
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.RecordFailedLogin() - received error from db", "err", err)
+		return 0, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, id).Scan(&failedLogins); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.RecordFailedLogin() - received error from db", "err", scanErr)
+		return 0, scanErr
+	}
+
+	return failedLogins, nil
+}
+
+func (store *AuthStore) LockUser(ctx context.Context, id uuid.UUID, until time.Time) error {
+	defer metrics.ObserveQuery("AuthStore.LockUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.LockUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set locked_until=$1, version=version+1 where id=$2
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.CreateUser() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.LockUser() - received error from db", "err", err)
 		return err
 	}
 
-	_, err = statement.Exec(&user.Name, &user.Mail, &user.Password, &user.Role, time.Now().UTC())
+	if _, execErr := statement.ExecContext(ctx, until, id); execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.LockUser() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	return nil
+}
+
+func (store *AuthStore) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	defer metrics.ObserveQuery("AuthStore.ResetFailedLogins", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.ResetFailedLogins")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set failed_logins=0, locked_until=null, version=version+1 where id=$1
+	`)
 
 	if err != nil {
-		log.Println("AuthStore.CreateUser() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.ResetFailedLogins() - received error from db", "err", err)
 		return err
 	}
 
+	if _, execErr := statement.ExecContext(ctx, id); execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.ResetFailedLogins() - received error from db", "err", execErr)
+		return execErr
+	}
+
 	return nil
 }
 
-func (store *AuthStore) UpdateToken(user entity.User) error {
-	statement, err := store.db.Prepare(`
-		update users set token=$1 where id=$2
-		returning *
+func (store *AuthStore) GetUserByMail(ctx context.Context, mail string) (u entity.User, e error) {
+	defer metrics.ObserveQuery("AuthStore.GetUserByMail", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetUserByMail")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select u.id, u.name, u.mail, u.role, u.created_at, u.mail_verified from users u where u.mail=$1
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.UpdateToken() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.GetUserByMail() - received error from db", "err", err)
+		return u, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, mail).Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.MailVerified); scanErr != nil {
+		if scanErr != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.GetUserByMail() - received error from db", "err", scanErr)
+		}
+		return u, scanErr
+	}
+
+	return u, nil
+}
+
+// CreateUserToken stores the hash of a single-use token. Previously issued,
+// still unused tokens of the same purpose are invalidated.
+func (store *AuthStore) CreateUserToken(ctx context.Context, userId uuid.UUID, purpose string, tokenHash string, expiresAt time.Time) error {
+	defer metrics.ObserveQuery("AuthStore.CreateUserToken", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.CreateUserToken")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		with invalidated as (
+			update user_tokens set used_at=$5 where user_id=$1 and purpose=$2 and used_at is null
+		)
+		insert into user_tokens(user_id, purpose, token_hash, expires_at, created_at)
+			values($1, $2, $3, $4, $5)
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateUserToken() - received error from db", "err", err)
 		return err
 	}
 
-	_, execErr := statement.Exec(&user.Token, &user.Id)
+	if _, execErr := statement.ExecContext(ctx, userId, purpose, tokenHash, expiresAt, time.Now().UTC()); execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateUserToken() - received error from db", "err", execErr)
+		return execErr
+	}
 
+	return nil
+}
+
+// VerifyMail consumes a mail verification token and marks the mail of its
+// owner as verified. Returns sql.ErrNoRows for unknown, used or expired tokens.
+func (store *AuthStore) VerifyMail(ctx context.Context, tokenHash string) (id uuid.UUID, err error) {
+	defer metrics.ObserveQuery("AuthStore.VerifyMail", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.VerifyMail")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		with consumed as (
+			update user_tokens set used_at=$3
+			where token_hash=$1 and purpose=$2 and used_at is null and expires_at > $3
+			returning user_id
+		)
+		update users set mail_verified=true, version=version+1 from consumed where users.id=consumed.user_id
+		returning users.id
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.VerifyMail() - received error from db", "err", err)
+		return id, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, tokenHash, PurposeVerifyMail, time.Now().UTC()).Scan(&id); scanErr != nil {
+		if scanErr != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.VerifyMail() - received error from db", "err", scanErr)
+		}
+		return id, scanErr
+	}
+
+	return id, nil
+}
+
+// ResetPassword consumes a password reset token, stores the new password
+// hash and revokes all sessions of the user. Returns sql.ErrNoRows for
+// unknown, used or expired tokens.
+func (store *AuthStore) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (id uuid.UUID, err error) {
+	defer metrics.ObserveQuery("AuthStore.ResetPassword", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.ResetPassword")
+	defer span.End()
+
+	// The password mustn't change while the old sessions stay valid, so both
+	// are written in one transaction.
+	revokedAt := time.Now().UTC().Truncate(jwt.TimePrecision)
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		if err := tx.QueryRowContext(ctx, `
+			with consumed as (
+				update user_tokens set used_at=$3
+				where token_hash=$1 and purpose=$2 and used_at is null and expires_at > $3
+				returning user_id
+			)
+			update users set password=$4, token=null, failed_logins=0, locked_until=null, version=version+1
+			from consumed where users.id=consumed.user_id
+			returning users.id
+		`, tokenHash, PurposeResetPassword, time.Now().UTC(), passwordHash).Scan(&id); err != nil {
+			return err
+		}
+
+		return insertRevocation(ctx, tx, sql.NullString{}, uuid.NullUUID{UUID: id, Valid: true}, revokedAt, revokedAt.Add(revocationTTL))
+	})
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.ResetPassword() - received error from db", "err", err)
+		}
+		return id, err
+	}
+
+	store.revocations.revokeUserTokens(id, revokedAt)
+	return id, nil
+}
+
+func (store *AuthStore) GetTOTP(ctx context.Context, id uuid.UUID) (secret string, enabled bool, lastStep int64, err error) {
+	defer metrics.ObserveQuery("AuthStore.GetTOTP", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetTOTP")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select coalesce(totp_secret, ''), totp_enabled, totp_last_step from users where id=$1
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetTOTP() - received error from db", "err", err)
+		return secret, enabled, lastStep, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, id).Scan(&secret, &enabled, &lastStep); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetTOTP() - received error from db", "err", scanErr)
+		return secret, enabled, lastStep, scanErr
+	}
+
+	return secret, enabled, lastStep, nil
+}
+
+// SetPendingTOTPSecret stores a new secret which only becomes active once
+// EnableTOTP confirms the user was able to generate a code with it.
+func (store *AuthStore) SetPendingTOTPSecret(ctx context.Context, id uuid.UUID, secret string) error {
+	defer metrics.ObserveQuery("AuthStore.SetPendingTOTPSecret", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.SetPendingTOTPSecret")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set totp_secret=$1 where id=$2 and totp_enabled=false
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.SetPendingTOTPSecret() - received error from db", "err", err)
+		return err
+	}
+
+	result, execErr := statement.ExecContext(ctx, secret, id)
 	if execErr != nil {
-		log.Println("AuthStore.UpdateToken() - received error from db", execErr)
+		slog.ErrorContext(ctx, "AuthStore.SetPendingTOTPSecret() - received error from db", "err", execErr)
 		return execErr
 	}
 
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
 
-func (store *AuthStore) DeleteToken(id uuid.UUID) (err error) {
-	statement, err := store.db.Prepare(`
-		update users set token=null where id=$1
+// EnableTOTP activates the pending secret and replaces the recovery codes.
+func (store *AuthStore) EnableTOTP(ctx context.Context, id uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	defer metrics.ObserveQuery("AuthStore.EnableTOTP", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.EnableTOTP")
+	defer span.End()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.EnableTOTP() - received error from db", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `update users set totp_enabled=true, totp_last_step=$1, version=version+1 where id=$2`, step, id); err != nil {
+		slog.ErrorContext(ctx, "AuthStore.EnableTOTP() - received error from db", "err", err)
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id=$1`, id); err != nil {
+		slog.ErrorContext(ctx, "AuthStore.EnableTOTP() - received error from db", "err", err)
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.ExecContext(ctx, `
+			insert into recovery_codes(user_id, code_hash, created_at) values($1, $2, $3)
+		`, id, hash, now); err != nil {
+			slog.ErrorContext(ctx, "AuthStore.EnableTOTP() - received error from db", "err", err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *AuthStore) DisableTOTP(ctx context.Context, id uuid.UUID) error {
+	defer metrics.ObserveQuery("AuthStore.DisableTOTP", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.DisableTOTP")
+	defer span.End()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.DisableTOTP() - received error from db", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `update users set totp_enabled=false, totp_secret=null, totp_last_step=0, version=version+1 where id=$1`, id); err != nil {
+		slog.ErrorContext(ctx, "AuthStore.DisableTOTP() - received error from db", "err", err)
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id=$1`, id); err != nil {
+		slog.ErrorContext(ctx, "AuthStore.DisableTOTP() - received error from db", "err", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code. It fails with
+// sql.ErrNoRows when the step was already used, so a code can't be replayed.
+func (store *AuthStore) UseTOTPStep(ctx context.Context, id uuid.UUID, step int64) error {
+	defer metrics.ObserveQuery("AuthStore.UseTOTPStep", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.UseTOTPStep")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set totp_last_step=$1 where id=$2 and totp_last_step < $1
 	`)
 
 	if err != nil {
-		log.Println("AuthStore.DeleteToken() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.UseTOTPStep() - received error from db", "err", err)
 		return err
 	}
-	_, err = statement.Exec(id)
+
+	result, execErr := statement.ExecContext(ctx, step, id)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.UseTOTPStep() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UseRecoveryCode marks a recovery code as used. Returns sql.ErrNoRows for
+// unknown or already used codes.
+func (store *AuthStore) UseRecoveryCode(ctx context.Context, id uuid.UUID, codeHash string) error {
+	defer metrics.ObserveQuery("AuthStore.UseRecoveryCode", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.UseRecoveryCode")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update recovery_codes set used_at=$1 where user_id=$2 and code_hash=$3 and used_at is null
+	`)
 
 	if err != nil {
-		log.Println("AuthStore.DeleteToken() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthStore.UseRecoveryCode() - received error from db", "err", err)
 		return err
 	}
 
+	result, execErr := statement.ExecContext(ctx, time.Now().UTC(), id, codeHash)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.UseRecoveryCode() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetAPIKeyPrincipal looks up an API key by its public prefix together with
+// the user it acts as.
+func (store *AuthStore) GetAPIKeyPrincipal(ctx context.Context, prefix string) (key entity.APIKey, secretHash string, u entity.User, err error) {
+	defer metrics.ObserveQuery("AuthStore.GetAPIKeyPrincipal", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetAPIKeyPrincipal")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select k.id, k.secret_hash, k.scopes, k.expires_at, k.last_used_at, u.id, u.name, u.mail, u.role, u.created_at
+		from api_keys k join users u on u.id=k.user_id
+		where k.prefix=$1 and u.deleted_at is null
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetAPIKeyPrincipal() - received error from db", "err", err)
+		return key, secretHash, u, err
+	}
+
+	row := statement.QueryRowContext(ctx, prefix)
+	if scanErr := row.Scan(&key.Id, &secretHash, pq.Array(&key.Scopes), &key.ExpiresAt, &key.LastUsedAt, &u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt); scanErr != nil {
+		if scanErr != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.GetAPIKeyPrincipal() - received error from db", "err", scanErr)
+		}
+		return key, secretHash, u, scanErr
+	}
+
+	return key, secretHash, u, nil
+}
+
+func (store *AuthStore) TouchAPIKey(ctx context.Context, id uuid.UUID, usedAt time.Time) error {
+	defer metrics.ObserveQuery("AuthStore.TouchAPIKey", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.TouchAPIKey")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update api_keys set last_used_at=$1 where id=$2
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.TouchAPIKey() - received error from db", "err", err)
+		return err
+	}
+
+	if _, execErr := statement.ExecContext(ctx, usedAt, id); execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.TouchAPIKey() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	return nil
+}
+
+func (store *AuthStore) GetAPIKeys(ctx context.Context) (keys []entity.APIKey, err error) {
+	defer metrics.ObserveQuery("AuthStore.GetAPIKeys", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetAPIKeys")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select id, name, prefix, user_id, scopes, expires_at, last_used_at, created_at, created_by
+		from api_keys order by created_at
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetAPIKeys() - received error from db", "err", err)
+		return keys, err
+	}
+
+	rows, err := statement.QueryContext(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetAPIKeys() - received error from db", "err", err)
+		return keys, err
+	}
+	defer rows.Close()
+
+	keys = []entity.APIKey{}
+	for rows.Next() {
+		var key entity.APIKey
+		if scanErr := rows.Scan(&key.Id, &key.Name, &key.Prefix, &key.UserId, pq.Array(&key.Scopes), &key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt, &key.CreatedBy); scanErr != nil {
+			slog.ErrorContext(ctx, "AuthStore.GetAPIKeys() - received error from db", "err", scanErr)
+			return keys, scanErr
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (store *AuthStore) CreateAPIKey(ctx context.Context, key entity.APIKey, secretHash string) (entity.APIKey, error) {
+	defer metrics.ObserveQuery("AuthStore.CreateAPIKey", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.CreateAPIKey")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		insert into api_keys(name, prefix, secret_hash, user_id, scopes, expires_at, created_at, created_by)
+		values($1, $2, $3, $4, $5, $6, $7, $8) returning id
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateAPIKey() - received error from db", "err", err)
+		return key, err
+	}
+
+	key.CreatedAt = time.Now().UTC()
+	row := statement.QueryRowContext(ctx, key.Name, key.Prefix, secretHash, key.UserId, pq.Array(key.Scopes), key.ExpiresAt, key.CreatedAt, key.CreatedBy)
+	if scanErr := row.Scan(&key.Id); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateAPIKey() - received error from db", "err", scanErr)
+		return key, scanErr
+	}
+
+	return key, nil
+}
+
+func (store *AuthStore) DeleteAPIKey(ctx context.Context, id uuid.UUID) error {
+	defer metrics.ObserveQuery("AuthStore.DeleteAPIKey", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.DeleteAPIKey")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		delete from api_keys where id=$1
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.DeleteAPIKey() - received error from db", "err", err)
+		return err
+	}
+
+	result, execErr := statement.ExecContext(ctx, id)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.DeleteAPIKey() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	store.verifiedKeys.remove(id)
+	return nil
+}
+
+// GetUserByOIDCSubject returns the user provisioned for an identity of an
+// external OpenID Connect provider.
+func (store *AuthStore) GetUserByOIDCSubject(ctx context.Context, issuer string, subject string) (u entity.User, err error) {
+	defer metrics.ObserveQuery("AuthStore.GetUserByOIDCSubject", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.GetUserByOIDCSubject")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select u.id, u.name, u.mail, u.role, u.created_at, u.locked_until, u.totp_enabled
+		from users u where u.oidc_issuer=$1 and u.oidc_subject=$2 and u.deleted_at is null
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.GetUserByOIDCSubject() - received error from db", "err", err)
+		return u, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, issuer, subject).Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt, &u.LockedUntil, &u.TOTPEnabled); scanErr != nil {
+		if scanErr != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.GetUserByOIDCSubject() - received error from db", "err", scanErr)
+		}
+		return u, scanErr
+	}
+
+	return u, nil
+}
+
+// CreateOIDCUser provisions a user on its first OpenID Connect login. Such
+// users have no password.
+func (store *AuthStore) CreateOIDCUser(ctx context.Context, user entity.User, issuer string, subject string) (id uuid.UUID, err error) {
+	defer metrics.ObserveQuery("AuthStore.CreateOIDCUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.CreateOIDCUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		insert into users(name, mail, password, role, created_at, mail_verified, oidc_issuer, oidc_subject)
+			values($1, $2, '', $3, $4, $5, $6, $7)
+			returning id
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateOIDCUser() - received error from db", "err", err)
+		return id, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, user.Name, user.Mail, user.Role, time.Now().UTC(), user.MailVerified, issuer, subject).Scan(&id); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.CreateOIDCUser() - received error from db", "err", scanErr)
+		return id, scanErr
+	}
+
+	return id, nil
+}
+
+func (store *AuthStore) ExistsWithName(ctx context.Context, name string) (bool, error) {
+	defer metrics.ObserveQuery("AuthStore.ExistsWithName", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.ExistsWithName")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select count(*) from users where name=$1
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.ExistsWithName() - received error from db", "err", err)
+		return true, err
+	}
+
+	var count int
+	if scanErr := statement.QueryRowContext(ctx, name).Scan(&count); scanErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.ExistsWithName() - received error from db", "err", scanErr)
+		return true, scanErr
+	}
+
+	return count > 0, nil
+}
+
+func (store *AuthStore) UpdateRole(ctx context.Context, id uuid.UUID, role int) error {
+	defer metrics.ObserveQuery("AuthStore.UpdateRole", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.UpdateRole")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set role=$1, version=version+1 where id=$2
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.UpdateRole() - received error from db", "err", err)
+		return err
+	}
+
+	if _, execErr := statement.ExecContext(ctx, role, id); execErr != nil {
+		slog.ErrorContext(ctx, "AuthStore.UpdateRole() - received error from db", "err", execErr)
+		return execErr
+	}
+
 	return nil
 }
+
+// LoadRevocations replaces the in-memory revocation list with the
+// revocations which still apply to unexpired tokens.
+func (store *AuthStore) LoadRevocations(ctx context.Context) error {
+	defer metrics.ObserveQuery("AuthStore.LoadRevocations", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.LoadRevocations")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select jti, user_id, revoked_at, expires_at from token_revocations where expires_at > $1
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.LoadRevocations() - received error from db", "err", err)
+		return err
+	}
+
+	rows, err := statement.QueryContext(ctx, time.Now().UTC())
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthStore.LoadRevocations() - received error from db", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	tokens := map[string]time.Time{}
+	validAfter := map[uuid.UUID]time.Time{}
+	for rows.Next() {
+		var jti sql.NullString
+		var userId uuid.NullUUID
+		var revokedAt, expiresAt time.Time
+		if scanErr := rows.Scan(&jti, &userId, &revokedAt, &expiresAt); scanErr != nil {
+			slog.ErrorContext(ctx, "AuthStore.LoadRevocations() - received error from db", "err", scanErr)
+			return scanErr
+		}
+
+		switch {
+		case jti.Valid:
+			tokens[jti.String] = expiresAt
+		case userId.Valid && revokedAt.After(validAfter[userId.UUID]):
+			validAfter[userId.UUID] = revokedAt
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	store.revocations.replace(tokens, validAfter)
+	slog.DebugContext(ctx, "AuthStore.LoadRevocations() - loaded revocations", "tokens", len(tokens), "users", len(validAfter))
+	return nil
+}
+
+// RevokeToken revokes a single token, e.g. on logout.
+func (store *AuthStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	defer metrics.ObserveQuery("AuthStore.RevokeToken", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.RevokeToken")
+	defer span.End()
+
+	if err := insertRevocation(ctx, store.db, sql.NullString{String: jti, Valid: true}, uuid.NullUUID{}, time.Now().UTC(), expiresAt); err != nil {
+		slog.ErrorContext(ctx, "AuthStore.RevokeToken() - received error from db", "err", err)
+		return err
+	}
+
+	store.revocations.revokeToken(jti, expiresAt)
+	return nil
+}
+
+// RevokeUserTokens revokes every token issued to the user so far. It's used
+// whenever the claims of the tokens can't be trusted anymore, e.g. after a
+// password or role change or when the account is deleted.
+func (store *AuthStore) RevokeUserTokens(ctx context.Context, userId uuid.UUID) error {
+	return store.RevokeUserTokensWith(ctx, userId, nil)
+}
+
+// RevokeUserTokensWith runs change, e.g. setting a new password, and revokes
+// the tokens of the user in one transaction, so the change never lands while
+// the old sessions stay valid. Errors of change are returned as they are.
+func (store *AuthStore) RevokeUserTokensWith(ctx context.Context, userId uuid.UUID, change func(tx utils.DBTX) error) error {
+	defer metrics.ObserveQuery("AuthStore.RevokeUserTokens", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthStore.RevokeUserTokens")
+	defer span.End()
+
+	// Revocations are as precise as the issue times of tokens, which they
+	// are compared with.
+	revokedAt := time.Now().UTC().Truncate(jwt.TimePrecision)
+	err := utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		if change != nil {
+			if err := change(tx); err != nil {
+				return err
+			}
+		}
+		return insertRevocation(ctx, tx, sql.NullString{}, uuid.NullUUID{UUID: userId, Valid: true}, revokedAt, revokedAt.Add(revocationTTL))
+	})
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthStore.RevokeUserTokens() - received error from db", "err", err)
+		}
+		return err
+	}
+
+	store.revocations.revokeUserTokens(userId, revokedAt)
+	return nil
+}
+
+// insertRevocation records a revocation and notifies the other instances,
+// on commit when db is a transaction.
+func insertRevocation(ctx context.Context, db utils.DBTX, jti sql.NullString, userId uuid.NullUUID, revokedAt time.Time, expiresAt time.Time) error {
+	return utils.InTx(ctx, db, func(tx utils.DBTX) error {
+		if _, err := tx.ExecContext(ctx, `
+			insert into token_revocations(jti, user_id, revoked_at, expires_at) values($1, $2, $3, $4)
+		`, jti, userId, revokedAt, expiresAt); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `delete from token_revocations where expires_at <= $1`, revokedAt); err != nil {
+			return err
+		}
+
+		// Delivered on commit.
+		_, err := tx.ExecContext(ctx, `select pg_notify($1, '')`, revocationChannel)
+		return err
+	})
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// derivedKeyLength suits HMAC-SHA256.
+const derivedKeyLength = 32
+
+// DeriveKey returns a symmetric key for purpose, e.g. signing download links,
+// derived from the active signing key, together with the kid to verify with.
+// Derived keys rotate along with the signing keys, so no other secret has
+// to be managed.
+func (keys *KeySet) DeriveKey(purpose string) (kid string, key []byte, err error) {
+	signing := keys.signingKey()
+	key, err = deriveKey(signing, purpose)
+	return signing.id, key, err
+}
+
+// DerivedKey returns the key DeriveKey returned for kid. Keys can't be
+// derived from retired keys, whose private half is gone, so values signed
+// with derived keys should be short-lived.
+func (keys *KeySet) DerivedKey(kid string, purpose string) ([]byte, bool) {
+	signing, ok := keys.verificationKey(kid)
+	if !ok || signing.private == nil {
+		return nil, false
+	}
+
+	key, err := deriveKey(signing, purpose)
+	return key, err == nil
+}
+
+func deriveKey(signing signingKey, purpose string) ([]byte, error) {
+	secret, err := x509.MarshalPKCS8PrivateKey(signing.private)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, derivedKeyLength)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(tokenIssuer+" "+purpose)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"encoding/json"
+	"example/library-service/internal/errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// JWKSHandler publishes the public keys, so other services can verify our
+// tokens without calling us.
+type JWKSHandler struct {
+	keys *KeySet
+}
+
+func NewJWKSHandler(keys *KeySet) *JWKSHandler {
+	return &JWKSHandler{keys}
+}
+
+func (jwksHandler *JWKSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(jwksHandler.keys.JWKS())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "JWKSHandler.ServeHTTP() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	// Verifiers may cache the keys for JWKSMaxAge; a new key is published
+	// for activationDelay before it becomes the active one, so they pick it
+	// up in time.
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKSMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a key pair identified by the kid header of the tokens it
+// signs. Retired keys only have the public half and are kept to verify tokens
+// issued before a rotation.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet holds the keys loaded from JWT_KEYS_DIR. Every <kid>.pem file holds
+// a PKCS#8 (or PKCS#1) RSA or Ed25519 private key, every <kid>.pub.pem a
+// public key only. Tokens are signed with JWT_ACTIVE_KID, by default the last
+// private key in lexical order which was published for activationDelay, so a
+// rotation is done by adding a newer key and removing the old one once the
+// tokens signed with it expired.
+type KeySet struct {
+	dir string
+
+	mu     sync.RWMutex
+	keys   map[string]signingKey
+	active string
+}
+
+// JWKSMaxAge is how long verifiers may cache the published keys.
+const JWKSMaxAge = 5 * time.Minute
+
+// activationDelay is how long a new private key is only published before it
+// signs tokens, measured from the modification time of its file: one
+// JWKSMaxAge for the instances to load it, assuming they reload more often,
+// and one for verifiers to refresh their cached keys.
+const activationDelay = 2 * JWKSMaxAge
+
+var activeKeys atomic.Pointer[KeySet]
+
+// SetupKeys loads the signing keys. Without JWT_KEYS_DIR an ephemeral key is
+// generated, which is only fit for development: tokens don't survive a
+// restart and can't be verified by other instances.
+func SetupKeys() (*KeySet, error) {
+	keys := &KeySet{dir: os.Getenv("JWT_KEYS_DIR")}
+	if err := keys.Reload(); err != nil {
+		return nil, err
+	}
+
+	activeKeys.Store(keys)
+	return keys, nil
+}
+
+func currentKeys() (*KeySet, error) {
+	if keys := activeKeys.Load(); keys != nil {
+		return keys, nil
+	}
+
+	keys := &KeySet{}
+	if err := keys.Reload(); err != nil {
+		return nil, err
+	}
+	activeKeys.CompareAndSwap(nil, keys)
+	return activeKeys.Load(), nil
+}
+
+func (keys *KeySet) Reload() error {
+	loaded := map[string]signingKey{}
+	var active string
+
+	if keys.dir == "" {
+		slog.Warn("KeySet.Reload() - JWT_KEYS_DIR isn't set, using an ephemeral signing key")
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		active = "ephemeral"
+		loaded[active] = signingKey{active, jwt.SigningMethodEdDSA, private, public}
+	} else {
+		var err error
+		if loaded, active, err = loadKeys(keys.dir, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if kid := os.Getenv("JWT_ACTIVE_KID"); kid != "" {
+		active = kid
+	}
+
+	if key, ok := loaded[active]; !ok || key.private == nil {
+		return fmt.Errorf("no private key with kid %q", active)
+	}
+
+	keys.mu.Lock()
+	keys.keys = loaded
+	keys.active = active
+	keys.mu.Unlock()
+
+	slog.Info("KeySet.Reload() - loaded signing keys", "count", len(loaded), "active", active)
+	return nil
+}
+
+// Watch reloads the keys periodically, so a rotation doesn't need a restart.
+// A failed reload keeps the previous keys.
+func (keys *KeySet) Watch(ctx context.Context, interval time.Duration) {
+	if keys.dir == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := keys.Reload(); err != nil {
+				slog.Error("KeySet.Watch() - cannot reload keys", "err", err)
+			}
+		}
+	}
+}
+
+// loadKeys returns the keys in dir and the kid of the key to sign with: the
+// last private key which is at least activationDelay old at now. Without
+// one, e.g. on the first deployment, it's the last private key.
+func loadKeys(dir string, now time.Time) (map[string]signingKey, string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(files)
+
+	keys := map[string]signingKey{}
+	var active, newest string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, "", err
+		}
+
+		name := filepath.Base(file)
+		publicOnly := strings.HasSuffix(name, ".pub.pem")
+		kid := strings.TrimSuffix(strings.TrimSuffix(name, ".pem"), ".pub")
+
+		key, err := parseKey(kid, data, publicOnly)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", file, err)
+		}
+
+		if existing, ok := keys[kid]; ok && existing.private != nil {
+			continue
+		}
+		keys[kid] = key
+		if publicOnly {
+			continue
+		}
+		newest = kid
+		if !info.ModTime().Add(activationDelay).After(now) {
+			active = kid
+		}
+	}
+
+	if newest == "" {
+		return nil, "", fmt.Errorf("no private key found in %s", dir)
+	}
+
+	if active == "" {
+		slog.Warn("KeySet.Reload() - no published private key, activating the newest one right away", "kid", newest)
+		return keys, newest, nil
+	}
+	if active != newest {
+		slog.Info("KeySet.Reload() - publishing a new key before activating it", "kid", newest, "active", active)
+	}
+
+	return keys, active, nil
+}
+
+func parseKey(kid string, data []byte, publicOnly bool) (key signingKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return key, fmt.Errorf("no PEM data")
+	}
+
+	key.id = kid
+	if publicOnly {
+		if key.public, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return key, err
+		}
+	} else {
+		var parsed any
+		if parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return key, fmt.Errorf("unsupported private key")
+			}
+		}
+
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return key, fmt.Errorf("unsupported private key")
+		}
+		key.private = signer
+		key.public = signer.Public()
+	}
+
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return key, fmt.Errorf("unsupported key type %T, only RSA and Ed25519 are supported", key.public)
+	}
+
+	return key, nil
+}
+
+func (keys *KeySet) signingKey() signingKey {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	return keys.keys[keys.active]
+}
+
+func (keys *KeySet) verificationKey(kid string) (signingKey, bool) {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	key, ok := keys.keys[kid]
+	return key, ok
+}
+
+// JWKS returns the public keys in the JSON Web Key Set format of RFC 7517.
+func (keys *KeySet) JWKS() JWKS {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range keys.keys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
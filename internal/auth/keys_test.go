@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKey(t *testing.T, dir string, name string, modTime time.Time) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var block *pem.Block
+	if strings.HasSuffix(name, ".pub.pem") {
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeysActivation(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	fresh := now.Add(-time.Minute)
+
+	tests := []struct {
+		name   string
+		files  map[string]time.Time
+		active string
+		kids   []string
+	}{
+		{
+			name:   "single published key",
+			files:  map[string]time.Time{"2024-01.pem": old},
+			active: "2024-01",
+			kids:   []string{"2024-01"},
+		},
+		{
+			name:   "new key is published before it signs",
+			files:  map[string]time.Time{"2024-01.pem": old, "2024-02.pem": fresh},
+			active: "2024-01",
+			kids:   []string{"2024-01", "2024-02"},
+		},
+		{
+			name:   "new key signs once published for the delay",
+			files:  map[string]time.Time{"2024-01.pem": old, "2024-02.pem": now.Add(-activationDelay)},
+			active: "2024-02",
+			kids:   []string{"2024-01", "2024-02"},
+		},
+		{
+			name:   "first deployment activates the newest key",
+			files:  map[string]time.Time{"2024-01.pem": fresh},
+			active: "2024-01",
+			kids:   []string{"2024-01"},
+		},
+		{
+			name:   "retired keys only verify",
+			files:  map[string]time.Time{"2023-12.pub.pem": old, "2024-01.pem": old},
+			active: "2024-01",
+			kids:   []string{"2023-12", "2024-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, modTime := range tt.files {
+				writeKey(t, dir, name, modTime)
+			}
+
+			keys, active, err := loadKeys(dir, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active != tt.active {
+				t.Errorf("active = %q, want %q", active, tt.active)
+			}
+			if len(keys) != len(tt.kids) {
+				t.Errorf("loaded %d keys, want %d", len(keys), len(tt.kids))
+			}
+			for _, kid := range tt.kids {
+				if _, ok := keys[kid]; !ok {
+					t.Errorf("key %q wasn't loaded", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadKeysWithoutPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2024-01.pub.pem", time.Now())
+
+	if _, _, err := loadKeys(dir, time.Now()); err == nil {
+		t.Error("loadKeys() succeeded without a private key")
+	}
+}
+
+func TestJWKSPublishesAllKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2024-01.pem", time.Now().Add(-time.Hour))
+	writeKey(t, dir, "2024-02.pem", time.Now())
+
+	keys := &KeySet{dir: dir}
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if kid := keys.signingKey().id; kid != "2024-01" {
+		t.Errorf("signing with %q, want the published key 2024-01", kid)
+	}
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "2024-01" || set.Keys[1].Kid != "2024-02" {
+		t.Errorf("JWKS() = %+v, want both keys", set.Keys)
+	}
+}
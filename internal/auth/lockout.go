@@ -0,0 +1,30 @@
+package auth
+
+import "time"
+
+const (
+	// maxFailedLogins is the number of consecutive wrong passwords after
+	// which an account gets locked.
+	maxFailedLogins = 5
+	baseLockout     = time.Minute
+	maxLockout      = 24 * time.Hour
+)
+
+// LockoutDuration returns how long an account stays locked after the given
+// number of consecutive failed logins. The lock doubles with every failure
+// past maxFailedLogins: 1m, 2m, 4m, ... capped at maxLockout.
+func LockoutDuration(failedLogins int) time.Duration {
+	if failedLogins < maxFailedLogins {
+		return 0
+	}
+
+	lockout := baseLockout
+	for i := maxFailedLogins; i < failedLogins; i++ {
+		lockout *= 2
+		if lockout >= maxLockout {
+			return maxLockout
+		}
+	}
+
+	return lockout
+}
@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failedLogins int
+		want         time.Duration
+	}{
+		{0, 0},
+		{maxFailedLogins - 1, 0},
+		{maxFailedLogins, time.Minute},
+		{maxFailedLogins + 1, 2 * time.Minute},
+		{maxFailedLogins + 2, 4 * time.Minute},
+		{maxFailedLogins + 10, 1024 * time.Minute},
+		{maxFailedLogins + 11, maxLockout},
+		{1000, maxLockout},
+	}
+
+	for _, tt := range tests {
+		if got := LockoutDuration(tt.failedLogins); got != tt.want {
+			t.Errorf("LockoutDuration(%d) = %v, want %v", tt.failedLogins, got, tt.want)
+		}
+	}
+}
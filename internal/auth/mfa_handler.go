@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/metrics"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// mfaRequiredRoles lists the roles which can't log in without a second
+// factor. Enforcement can be switched off with MFA_ENFORCED=false, e.g. for
+// local development.
+var mfaRequiredRoles = map[int]bool{
+	entity.MODERATOR: true,
+	entity.ADMIN:     true,
+}
+
+var mfaEnforced = os.Getenv("MFA_ENFORCED") != "false"
+
+func mfaRequired(role int) bool {
+	return mfaEnforced && mfaRequiredRoles[role]
+}
+
+func (authHandler *AuthHandler) writeChallenge(w http.ResponseWriter, r *http.Request, user entity.User, purpose string) {
+	challenge, err := GenerateChallengeToken(user.Id, user.Role, purpose)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(ChallengeResponse{
+		Challenge:          challenge,
+		ExpiresIn:          challengeExpirationTime,
+		EnrollmentRequired: purpose == ChallengeEnroll,
+	})
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonBytes)
+}
+
+func (authHandler *AuthHandler) loginMFA(w http.ResponseWriter, r *http.Request) {
+	var req LoginMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	id, _, err := ParseChallengeToken(req.Challenge, ChallengeMFA)
+	if err != nil {
+		errors.HandleError(401, "invalid or expired challenge", w)
+		return
+	}
+
+	var user entity.User
+	if user, err = authHandler.S.GetUserById(r.Context(), id); err != nil {
+		errors.HandleError(401, "invalid or expired challenge", w)
+		return
+	}
+
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		metrics.FailedLogins.WithLabelValues("locked").Inc()
+		errors.HandleError(429, "account is temporarily locked", w)
+		return
+	}
+
+	if !authHandler.verifySecondFactor(r, user, req.Code, req.RecoveryCode) {
+		metrics.FailedLogins.WithLabelValues("wrong_second_factor").Inc()
+		authHandler.recordFailedLogin(r.Context(), user)
+		errors.HandleError(401, "wrong code", w)
+		return
+	}
+
+	authHandler.issueToken(w, r, user)
+
+	slog.InfoContext(r.Context(), "AuthHandler.loginMFA() - finished to process", "id", user.Id)
+}
+
+func (authHandler *AuthHandler) enrollMFA(w http.ResponseWriter, r *http.Request) {
+	user, _, err := authHandler.mfaSubject(r)
+	if err != nil {
+		errors.HandleError(401, err.Error(), w)
+		return
+	}
+
+	if user.TOTPEnabled {
+		errors.HandleError(409, "two-factor authentication is already enabled", w)
+		return
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err = authHandler.S.SetPendingTOTPSecret(r.Context(), user.Id, secret); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(EnrollMFAResponse{Secret: secret, URI: TOTPURI(user.Name, secret)})
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthHandler.enrollMFA() - enrollment started", "id", user.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (authHandler *AuthHandler) confirmMFA(w http.ResponseWriter, r *http.Request) {
+	user, viaChallenge, err := authHandler.mfaSubject(r)
+	if err != nil {
+		errors.HandleError(401, err.Error(), w)
+		return
+	}
+
+	var req MFACodeRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	secret, enabled, _, err := authHandler.S.GetTOTP(r.Context(), user.Id)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if enabled {
+		errors.HandleError(409, "two-factor authentication is already enabled", w)
+		return
+	}
+
+	if secret == "" {
+		errors.HandleError(400, "enrollment wasn't started", w)
+		return
+	}
+
+	step, ok := VerifyTOTP(secret, req.Code, time.Now())
+	if !ok {
+		errors.HandleError(400, "wrong code", w)
+		return
+	}
+
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err = authHandler.S.EnableTOTP(r.Context(), user.Id, step, hashes); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthHandler.confirmMFA() - two-factor authentication enabled", "id", user.Id)
+
+	response := ConfirmMFAResponse{RecoveryCodes: codes}
+	if viaChallenge {
+		// Enrollment was forced during login, so it also completes the login.
+		if response.Token, err = GenerateToken(user.Id, user.Role); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+
+		user.Token = response.Token
+		if err = authHandler.S.UpdateToken(r.Context(), user); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+		metrics.Logins.Inc()
+	}
+
+	jsonBytes, err := json.Marshal(response)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (authHandler *AuthHandler) disableMFA(w http.ResponseWriter, r *http.Request) {
+	user, err := ValidateTokenAndGetUser(r.Context(), r.Header.Get("Authorization"), authHandler.S)
+	if err != nil {
+		errors.HandleError(401, err.Error(), w)
+		return
+	}
+
+	if mfaRequired(user.Role) {
+		errors.HandleError(403, "two-factor authentication is mandatory for your role", w)
+		return
+	}
+
+	var req MFACodeRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	if !authHandler.verifySecondFactor(r, user, req.Code, req.RecoveryCode) {
+		errors.HandleError(403, "wrong code", w)
+		return
+	}
+
+	if err = authHandler.S.DisableTOTP(r.Context(), user.Id); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthHandler.disableMFA() - two-factor authentication disabled", "id", user.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mfaSubject resolves the user enrolling a second factor, either from a
+// regular session token or from the enrollment challenge issued by login.
+func (authHandler *AuthHandler) mfaSubject(r *http.Request) (user entity.User, viaChallenge bool, err error) {
+	header := r.Header.Get("Authorization")
+	vals := strings.Split(header, " ")
+	if len(vals) == 2 {
+		if id, _, challengeErr := ParseChallengeToken(vals[1], ChallengeEnroll); challengeErr == nil {
+			if user, err = authHandler.S.GetUserById(r.Context(), id); err != nil {
+				return user, false, fmt.Errorf("invalid token")
+			}
+			return user, true, nil
+		}
+	}
+
+	if user, err = ValidateTokenAndGetUser(r.Context(), header, authHandler.S); err != nil {
+		return user, false, err
+	}
+
+	if user, err = authHandler.S.GetUserById(r.Context(), user.Id); err != nil {
+		return user, false, fmt.Errorf("invalid token")
+	}
+
+	return user, false, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Both can only be used once.
+func (authHandler *AuthHandler) verifySecondFactor(r *http.Request, user entity.User, code string, recoveryCode string) bool {
+	if recoveryCode != "" {
+		err := authHandler.S.UseRecoveryCode(r.Context(), user.Id, HashOpaqueToken(normalizeRecoveryCode(recoveryCode)))
+		if err == nil {
+			slog.WarnContext(r.Context(), "AuthHandler.verifySecondFactor() - recovery code used", "id", user.Id)
+		}
+		return err == nil
+	}
+
+	secret, enabled, _, err := authHandler.S.GetTOTP(r.Context(), user.Id)
+	if err != nil || !enabled {
+		return false
+	}
+
+	step, ok := VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	if err = authHandler.S.UseTOTPStep(r.Context(), user.Id, step); err != nil {
+		if err == sql.ErrNoRows {
+			slog.WarnContext(r.Context(), "AuthHandler.verifySecondFactor() - code replayed", "id", user.Id)
+		}
+		return false
+	}
+
+	return true
+}
+
+type ChallengeResponse struct {
+	Challenge          string `json:"challenge"`
+	ExpiresIn          int64  `json:"expiresIn"`
+	EnrollmentRequired bool   `json:"enrollmentRequired"`
+}
+
+type LoginMFARequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type EnrollMFAResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+type ConfirmMFAResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	Token         string   `json:"token,omitempty"`
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"example/library-service/internal/entity"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcFlowCookie   = "oidc_flow"
+	oidcFlowAudience = "oidc-flow"
+	oidcFlowTTL      = 10 * time.Minute
+)
+
+var errMailTaken = fmt.Errorf("mail is already taken")
+
+// OIDCProvider logs users in against an external OpenID Connect identity
+// provider using the authorization code flow with PKCE. It's configured with
+// OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL;
+// without OIDC_ISSUER the endpoints are disabled.
+type OIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	// roleClaim names the ID token claim, a string or a list of strings,
+	// which is mapped to the library roles.
+	roleClaim       string
+	adminValues     []string
+	moderatorValues []string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDCProviderFromEnv() *OIDCProvider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	return &OIDCProvider{
+		issuer:          issuer,
+		clientID:        os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret:    os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:     getEnv("OIDC_REDIRECT_URL", appBaseURL+"/auth/oidc/callback"),
+		roleClaim:       getEnv("OIDC_ROLE_CLAIM", "roles"),
+		adminValues:     strings.Split(getEnv("OIDC_ADMIN_VALUES", "library-admin"), ","),
+		moderatorValues: strings.Split(getEnv("OIDC_MODERATOR_VALUES", "library-moderator"), ","),
+	}
+}
+
+// discover fetches the provider metadata on first use, so the service still
+// starts while the identity provider is unreachable.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.provider = provider
+	}
+
+	return p.provider, nil
+}
+
+func (p *OIDCProvider) config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  p.redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// role maps the role claim to the highest matching library role.
+func (p *OIDCProvider) role(claims map[string]any) int {
+	var values []string
+	switch claim := claims[p.roleClaim].(type) {
+	case string:
+		values = []string{claim}
+	case []any:
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	role := entity.USER
+	for _, value := range values {
+		if slices.Contains(p.adminValues, value) {
+			return entity.ADMIN
+		}
+		if slices.Contains(p.moderatorValues, value) {
+			role = entity.MODERATOR
+		}
+	}
+	return role
+}
+
+// oidcFlowClaims carry the state of a login between the redirect to the
+// identity provider and the callback. They're kept in a signed cookie, so
+// any instance can complete the flow.
+type oidcFlowClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+func newOIDCFlow() (flow oidcFlowClaims, cookie string, err error) {
+	if flow.State, _, err = NewOpaqueToken(); err != nil {
+		return flow, "", err
+	}
+	if flow.Nonce, _, err = NewOpaqueToken(); err != nil {
+		return flow, "", err
+	}
+	flow.Verifier = oauth2.GenerateVerifier()
+
+	now := time.Now()
+	flow.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Audience:  jwt.ClaimStrings{oidcFlowAudience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(oidcFlowTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+
+	cookie, err = signClaims(flow)
+	return flow, cookie, err
+}
+
+func parseOIDCFlow(cookie string) (flow oidcFlowClaims, err error) {
+	if _, err = jwt.ParseWithClaims(cookie, &flow, verificationKey, parserOptions(oidcFlowAudience)...); err != nil {
+		return flow, err
+	}
+
+	if flow.State == "" || flow.Nonce == "" || flow.Verifier == "" {
+		return flow, fmt.Errorf("invalid login state")
+	}
+
+	return flow, nil
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"database/sql"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+func (authHandler *AuthHandler) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if authHandler.oidc == nil {
+		errors.HandleError(404, "OpenID Connect login isn't configured", w)
+		return
+	}
+
+	provider, err := authHandler.oidc.discover(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthHandler.oidcLogin() - provider discovery failed", "err", err)
+		errors.HandleError(502, "identity provider is unavailable", w)
+		return
+	}
+
+	flow, cookie, err := newOIDCFlow()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthHandler.oidcLogin() - cannot start flow", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    cookie,
+		Path:     utils.OIDCPathPrefix,
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(appBaseURL, "https://"),
+		// Lax, as the callback is a top-level navigation coming from the
+		// identity provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	url := authHandler.oidc.config(provider).AuthCodeURL(flow.State, oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func (authHandler *AuthHandler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if authHandler.oidc == nil {
+		errors.HandleError(404, "OpenID Connect login isn't configured", w)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		slog.WarnContext(r.Context(), "AuthHandler.oidcCallback() - provider returned an error", "error", providerErr)
+		errors.HandleError(401, "login was rejected by the identity provider", w)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		errors.HandleError(400, "login wasn't started or has expired", w)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: utils.OIDCPathPrefix, MaxAge: -1})
+
+	flow, err := parseOIDCFlow(cookie.Value)
+	if err != nil || query.Get("state") != flow.State {
+		slog.WarnContext(r.Context(), "AuthHandler.oidcCallback() - state mismatch", "err", err)
+		errors.HandleError(400, "invalid login state", w)
+		return
+	}
+
+	provider, err := authHandler.oidc.discover(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthHandler.oidcCallback() - provider discovery failed", "err", err)
+		errors.HandleError(502, "identity provider is unavailable", w)
+		return
+	}
+
+	token, err := authHandler.oidc.config(provider).Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "AuthHandler.oidcCallback() - code exchange failed", "err", err)
+		errors.HandleError(401, "code exchange failed", w)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		errors.HandleError(401, "identity provider didn't return an ID token", w)
+		return
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: authHandler.oidc.clientID}).Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != flow.Nonce {
+		slog.WarnContext(r.Context(), "AuthHandler.oidcCallback() - invalid ID token", "err", err)
+		errors.HandleError(401, "invalid ID token", w)
+		return
+	}
+
+	var claims map[string]any
+	if err = idToken.Claims(&claims); err != nil {
+		errors.HandleError(401, "invalid ID token", w)
+		return
+	}
+
+	user, err := authHandler.provisionOIDCUser(r, idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		if err == errMailTaken {
+			errors.HandleError(409, "an account with this mail already exists, log in with your password", w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		metrics.FailedLogins.WithLabelValues("locked").Inc()
+		errors.HandleError(429, "account is temporarily locked", w)
+		return
+	}
+
+	// The second factor is the identity provider's business, so the local
+	// MFA policy doesn't apply to these logins.
+	authHandler.issueToken(w, r, user)
+
+	slog.InfoContext(r.Context(), "AuthHandler.oidcCallback() - finished to process", "id", user.Id)
+}
+
+// provisionOIDCUser returns the user linked to the issuer and subject,
+// creating it on the first login. The role follows the identity provider on
+// every login.
+func (authHandler *AuthHandler) provisionOIDCUser(r *http.Request, issuer string, subject string, claims map[string]any) (entity.User, error) {
+	role := authHandler.oidc.role(claims)
+
+	user, err := authHandler.S.GetUserByOIDCSubject(r.Context(), issuer, subject)
+	switch {
+	case err == nil:
+		if user.Role != role {
+			slog.InfoContext(r.Context(), "AuthHandler.provisionOIDCUser() - role changed", "id", user.Id, "from", user.Role, "to", role)
+			if err = authHandler.S.UpdateRole(r.Context(), user.Id, role); err != nil {
+				return user, err
+			}
+			if err = authHandler.S.RevokeUserTokens(r.Context(), user.Id); err != nil {
+				return user, err
+			}
+			user.Role = role
+		}
+		return user, nil
+	case err != sql.ErrNoRows:
+		return user, err
+	}
+
+	mail, _ := claims["email"].(string)
+	mailVerified, _ := claims["email_verified"].(bool)
+	name, _ := claims["preferred_username"].(string)
+	if name == "" {
+		name = subject
+	}
+
+	// Local accounts are never linked by mail, as the identity provider
+	// may not have verified it.
+	if mail != "" {
+		if _, err = authHandler.S.GetUserByMail(r.Context(), mail); err == nil {
+			return user, errMailTaken
+		} else if err != sql.ErrNoRows {
+			return user, err
+		}
+	}
+
+	if taken, err := authHandler.S.ExistsWithName(r.Context(), name); err != nil {
+		return user, err
+	} else if taken {
+		name = name + "-" + HashOpaqueToken(issuer + subject)[:6]
+	}
+
+	user = entity.User{Name: name, Mail: mail, MailVerified: mailVerified, Role: role}
+	if user.Id, err = authHandler.S.CreateOIDCUser(r.Context(), user, issuer, subject); err != nil {
+		return user, err
+	}
+
+	metrics.Registrations.Inc()
+	slog.InfoContext(r.Context(), "AuthHandler.provisionOIDCUser() - user provisioned", "id", user.Id, "role", role)
+
+	return user, nil
+}
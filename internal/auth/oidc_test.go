@@ -0,0 +1,371 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"example/library-service/internal/entity"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testClientID = "library"
+
+// mockIssuer is an OpenID Connect provider serving discovery, its keys and a
+// token endpoint. Codes are granted by the tests rather than by a login page.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (issuer *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	url := issuer.server.URL
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                url,
+		"authorization_endpoint":                url + "/authorize",
+		"token_endpoint":                        url + "/token",
+		"jwks_uri":                              url + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems a code once, provided the verifier matches the challenge it
+// was granted for.
+func (issuer *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	issuer.mu.Lock()
+	grant, ok := issuer.grants[r.PostForm.Get("code")]
+	delete(issuer.grants, r.PostForm.Get("code"))
+	issuer.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(issuer.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// grant issues a code for the login whose authorization URL is given, as
+// if the user had logged in. The ID token carries the claims on top of the
+// ones every token has.
+func (issuer *mockIssuer) grant(t *testing.T, authURL *url.URL, subject string, claims jwt.MapClaims) string {
+	t.Helper()
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+
+	now := time.Now()
+	idClaims := jwt.MapClaims{
+		"iss":   issuer.server.URL,
+		"sub":   subject,
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	code := uuid.NewString()
+	issuer.mu.Lock()
+	issuer.grants[code] = mockGrant{challenge: query.Get("code_challenge"), claims: idClaims}
+	issuer.mu.Unlock()
+	return code
+}
+
+func (issuer *mockIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		issuer:          issuer.server.URL,
+		clientID:        testClientID,
+		clientSecret:    "secret",
+		redirectURL:     "http://localhost:8080/auth/oidc/callback",
+		roleClaim:       "roles",
+		adminValues:     []string{"library-admin"},
+		moderatorValues: []string{"library-moderator"},
+	}
+}
+
+// startOIDCLogin returns the authorization URL and the flow cookie of a new
+// login.
+func startOIDCLogin(t *testing.T, handler *AuthHandler) (*url.URL, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.oidcLogin(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d", w.Code, http.StatusFound)
+	}
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcFlowCookie {
+			return authURL, cookie
+		}
+	}
+	t.Fatal("login didn't set the flow cookie")
+	return nil, nil
+}
+
+func oidcCallback(handler *AuthHandler, query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.oidcCallback(w, r)
+	return w
+}
+
+func TestOIDCLoginRedirects(t *testing.T) {
+	issuer := newMockIssuer(t)
+	handler := NewAuthHandler(NewAuthStore(nil), nil, issuer.provider())
+
+	authURL, cookie := startOIDCLogin(t, handler)
+	flow, err := parseOIDCFlow(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := authURL.Query()
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	tests := []struct {
+		param string
+		want  string
+	}{
+		{"client_id", testClientID},
+		{"response_type", "code"},
+		{"state", flow.State},
+		{"nonce", flow.Nonce},
+		{"code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])},
+		{"code_challenge_method", "S256"},
+	}
+	for _, tt := range tests {
+		if got := query.Get(tt.param); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.param, got, tt.want)
+		}
+	}
+	if authURL.Scheme+"://"+authURL.Host+authURL.Path != issuer.server.URL+"/authorize" {
+		t.Errorf("redirected to %s", authURL)
+	}
+	if query.Has("code_verifier") {
+		t.Error("the verifier was sent to the browser")
+	}
+}
+
+// The callback is rejected in each of these cases before a user is looked
+// up, so they need no database.
+func TestOIDCCallbackRejects(t *testing.T) {
+	issuer := newMockIssuer(t)
+	handler := NewAuthHandler(NewAuthStore(nil), nil, issuer.provider())
+
+	tests := []struct {
+		name   string
+		status int
+		// callback returns the query and cookie of the callback request.
+		callback func(t *testing.T) (url.Values, *http.Cookie)
+	}{
+		{"provider error", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			_, cookie := startOIDCLogin(t, handler)
+			return url.Values{"error": {"access_denied"}}, cookie
+		}},
+		{"login not started", http.StatusBadRequest, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, _ := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", nil)
+			return url.Values{"code": {code}, "state": {authURL.Query().Get("state")}}, nil
+		}},
+		{"state mismatch", http.StatusBadRequest, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, cookie := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", nil)
+			return url.Values{"code": {code}, "state": {"forged"}}, cookie
+		}},
+		{"forged flow cookie", http.StatusBadRequest, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, _ := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", nil)
+			return url.Values{"code": {code}, "state": {authURL.Query().Get("state")}},
+				&http.Cookie{Name: oidcFlowCookie, Value: "forged"}
+		}},
+		{"verifier of another login", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			// The code was granted to the first login, but is redeemed
+			// with the verifier of the second one.
+			authURL, _ := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", nil)
+			otherURL, otherCookie := startOIDCLogin(t, handler)
+			return url.Values{"code": {code}, "state": {otherURL.Query().Get("state")}}, otherCookie
+		}},
+		{"unknown code", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, cookie := startOIDCLogin(t, handler)
+			return url.Values{"code": {"made-up"}, "state": {authURL.Query().Get("state")}}, cookie
+		}},
+		{"nonce mismatch", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, cookie := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", jwt.MapClaims{"nonce": "replayed"})
+			return url.Values{"code": {code}, "state": {authURL.Query().Get("state")}}, cookie
+		}},
+		{"token for another client", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, cookie := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", jwt.MapClaims{"aud": "other"})
+			return url.Values{"code": {code}, "state": {authURL.Query().Get("state")}}, cookie
+		}},
+		{"expired token", http.StatusUnauthorized, func(t *testing.T) (url.Values, *http.Cookie) {
+			authURL, cookie := startOIDCLogin(t, handler)
+			code := issuer.grant(t, authURL, "alice", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+			return url.Values{"code": {code}, "state": {authURL.Query().Get("state")}}, cookie
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, cookie := tt.callback(t)
+			if w := oidcCallback(handler, query, cookie); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	provider := &OIDCProvider{
+		roleClaim:       "roles",
+		adminValues:     []string{"library-admin", "root"},
+		moderatorValues: []string{"library-moderator"},
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   int
+	}{
+		{"no claim", map[string]any{}, entity.USER},
+		{"unknown value", map[string]any{"roles": "reader"}, entity.USER},
+		{"single value", map[string]any{"roles": "library-moderator"}, entity.MODERATOR},
+		{"list", map[string]any{"roles": []any{"reader", "library-moderator"}}, entity.MODERATOR},
+		{"highest role wins", map[string]any{"roles": []any{"library-moderator", "root"}}, entity.ADMIN},
+		{"non-string values", map[string]any{"roles": []any{1, true}}, entity.USER},
+		{"other claim", map[string]any{"groups": "library-admin"}, entity.USER},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := provider.role(tt.claims); got != tt.want {
+				t.Errorf("role() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackProvisionsUsers(t *testing.T) {
+	db, _ := testDB(t)
+	issuer := newMockIssuer(t)
+	store := NewAuthStore(db)
+	handler := NewAuthHandler(store, nil, issuer.provider())
+
+	login := func(subject string, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		authURL, cookie := startOIDCLogin(t, handler)
+		code := issuer.grant(t, authURL, subject, claims)
+		return oidcCallback(handler, url.Values{"code": {code}, "state": {authURL.Query().Get("state")}}, cookie)
+	}
+
+	subject := uuid.NewString()
+	mail := subject + "@example.com"
+	claims := jwt.MapClaims{"email": mail, "email_verified": true, "preferred_username": subject, "roles": []string{"library-moderator"}}
+	if w := login(subject, claims); w.Code != http.StatusOK {
+		t.Fatalf("first login status = %d: %s", w.Code, w.Body)
+	}
+
+	user, err := store.GetUserByOIDCSubject(context.Background(), issuer.server.URL, subject)
+	if err != nil {
+		t.Fatalf("the user wasn't provisioned: %v", err)
+	}
+	if user.Name != subject || user.Mail != mail || !user.MailVerified || user.Role != entity.MODERATOR {
+		t.Errorf("provisioned %+v", user)
+	}
+
+	// The role follows the identity provider.
+	claims["roles"] = "library-admin"
+	if w := login(subject, claims); w.Code != http.StatusOK {
+		t.Fatalf("second login status = %d: %s", w.Code, w.Body)
+	}
+	if user, err = store.GetUserByOIDCSubject(context.Background(), issuer.server.URL, subject); err != nil || user.Role != entity.ADMIN {
+		t.Errorf("role after the second login = %d, %v, want %d", user.Role, err, entity.ADMIN)
+	}
+
+	// Accounts are never linked by mail.
+	if w := login(uuid.NewString(), jwt.MapClaims{"email": mail}); w.Code != http.StatusConflict {
+		t.Errorf("login of another subject with the same mail status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// revocationChannel is the postgres channel on which instances announce new
+// revocations, so the others refresh their lists right away.
+const revocationChannel = "token_revocations"
+
+func init() {
+	// Tokens carry their issue time in milliseconds rather than seconds, so
+	// a revocation doesn't also catch tokens issued right after it, e.g.
+	// when logging in again after changing the password.
+	jwt.TimePrecision = time.Millisecond
+}
+
+// revocationTTL is how long a revocation has to be kept: afterwards every
+// token it applies to is expired anyway.
+const revocationTTL = time.Duration(expirationTime) * time.Second
+
+// RevocationList is the in-memory copy of the token_revocations table, which
+// lets tokens be validated without a query. A token is revoked either by its
+// jti, e.g. on logout, or together with every other token of its user issued
+// before a point in time, e.g. on a password or role change.
+type RevocationList struct {
+	mu         sync.RWMutex
+	tokens     map[string]time.Time
+	validAfter map[uuid.UUID]time.Time
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{tokens: map[string]time.Time{}, validAfter: map[uuid.UUID]time.Time{}}
+}
+
+func (list *RevocationList) IsRevoked(jti string, userId uuid.UUID, issuedAt time.Time) bool {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+
+	if _, ok := list.tokens[jti]; ok {
+		return true
+	}
+
+	// A token issued at the very time of the revocation may have been issued
+	// before it, so it's revoked as well.
+	validAfter, ok := list.validAfter[userId]
+	return ok && !issuedAt.After(validAfter)
+}
+
+func (list *RevocationList) revokeToken(jti string, expiresAt time.Time) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.tokens[jti] = expiresAt
+}
+
+func (list *RevocationList) revokeUserTokens(userId uuid.UUID, validAfter time.Time) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if validAfter.After(list.validAfter[userId]) {
+		list.validAfter[userId] = validAfter
+	}
+}
+
+func (list *RevocationList) replace(tokens map[string]time.Time, validAfter map[uuid.UUID]time.Time) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.tokens = tokens
+	list.validAfter = validAfter
+}
+
+// WatchRevocations keeps the revocation list in sync with the database. It
+// reloads the list periodically and whenever another instance announces a
+// revocation; the periodic reload also covers missed notifications.
+func (store *AuthStore) WatchRevocations(ctx context.Context, connStr string, interval time.Duration) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("AuthStore.WatchRevocations() - listener event", "event", event, "err", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(revocationChannel); err != nil {
+		slog.Error("AuthStore.WatchRevocations() - cannot listen, falling back to polling", "err", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify:
+		case <-ticker.C:
+		}
+
+		if err := store.LoadRevocations(ctx); err != nil {
+			slog.Error("AuthStore.WatchRevocations() - cannot reload revocations", "err", err)
+		}
+	}
+}
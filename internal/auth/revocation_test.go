@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestIsRevoked(t *testing.T) {
+	revokedAt := time.Date(2024, 3, 1, 12, 0, 0, 250_000_000, time.UTC)
+	userId := uuid.New()
+
+	list := NewRevocationList()
+	list.revokeToken("logged-out", revokedAt.Add(time.Hour))
+	list.revokeUserTokens(userId, revokedAt)
+
+	tests := []struct {
+		name     string
+		jti      string
+		userId   uuid.UUID
+		issuedAt time.Time
+		want     bool
+	}{
+		{"revoked jti", "logged-out", uuid.New(), revokedAt, true},
+		{"issued before the revocation", "a", userId, revokedAt.Add(-time.Millisecond), true},
+		{"issued earlier in the same second", "b", userId, revokedAt.Add(-200 * time.Millisecond), true},
+		{"issued at the revocation", "c", userId, revokedAt, true},
+		{"issued after the revocation", "d", userId, revokedAt.Add(time.Millisecond), false},
+		{"other user", "e", uuid.New(), revokedAt.Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := list.IsRevoked(tt.jti, tt.userId, tt.issuedAt); got != tt.want {
+				t.Errorf("IsRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokeUserTokensNeverMovesBack(t *testing.T) {
+	now := time.Now()
+	userId := uuid.New()
+
+	list := NewRevocationList()
+	list.revokeUserTokens(userId, now)
+	list.revokeUserTokens(userId, now.Add(-time.Minute))
+
+	if !list.IsRevoked("a", userId, now.Add(-time.Second)) {
+		t.Error("an older revocation undid a newer one")
+	}
+}
+
+func TestReplaceRevocations(t *testing.T) {
+	now := time.Now()
+	dropped := uuid.New()
+	kept := uuid.New()
+
+	list := NewRevocationList()
+	list.revokeToken("dropped", now.Add(time.Hour))
+	list.revokeUserTokens(dropped, now)
+	list.replace(map[string]time.Time{"kept": now.Add(time.Hour)}, map[uuid.UUID]time.Time{kept: now})
+
+	if list.IsRevoked("dropped", uuid.New(), now) || list.IsRevoked("a", dropped, now) {
+		t.Error("revocations missing from the new list are still applied")
+	}
+	if !list.IsRevoked("kept", uuid.New(), now) || !list.IsRevoked("a", kept, now) {
+		t.Error("revocations of the new list aren't applied")
+	}
+}
+
+func TestTokenIssuedAfterRevocationIsValid(t *testing.T) {
+	userId := uuid.New()
+	store := NewAuthStore(nil)
+
+	old, err := generateToken(userId, 0, "", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.revocations.revokeUserTokens(userId, time.Now().UTC().Truncate(time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	renewed, err := generateToken(userId, 0, "", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := validateBearer("Bearer "+old, store); err == nil {
+		t.Error("the token issued before the revocation is still valid")
+	}
+	if _, err := validateBearer("Bearer "+renewed, store); err != nil {
+		t.Errorf("the token issued after the revocation was rejected: %v", err)
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, connStr
+}
+
+func TestLoadRevocationsSkipsExpired(t *testing.T) {
+	db, _ := testDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	live := uuid.NewString()
+	expired := uuid.NewString()
+
+	if _, err := db.ExecContext(ctx, `
+		insert into token_revocations(jti, revoked_at, expires_at) values($1, $3, $4), ($2, $3, $3)
+	`, live, expired, now.Add(-time.Minute), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewAuthStore(db)
+	if err := store.LoadRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.revocations.IsRevoked(live, uuid.New(), now) {
+		t.Error("a live revocation wasn't loaded")
+	}
+	if store.revocations.IsRevoked(expired, uuid.New(), now) {
+		t.Error("an expired revocation was loaded")
+	}
+
+	// Expired rows are deleted with the next revocation.
+	if err := store.RevokeToken(ctx, uuid.NewString(), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, `select count(*) from token_revocations where jti=$1`, expired).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("the expired revocation wasn't pruned")
+	}
+}
+
+func TestWatchRevocationsReloadsOnNotify(t *testing.T) {
+	db, connStr := testDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := NewAuthStore(db)
+	// The interval is long enough that only a notification can trigger the
+	// reload in time.
+	go watcher.WatchRevocations(ctx, connStr, time.Hour)
+	// Give the listener time to connect.
+	time.Sleep(500 * time.Millisecond)
+
+	userId := uuid.New()
+	issuedAt := time.Now().UTC().Add(-time.Second)
+	if err := NewAuthStore(db).RevokeUserTokens(ctx, userId); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !watcher.revocations.IsRevoked("a", userId, issuedAt) {
+		if time.Now().After(deadline) {
+			t.Fatal("the revocation of another instance wasn't picked up")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -1,9 +1,11 @@
 package auth
 
 import (
+	"context"
 	"example/library-service/internal/entity"
+	"example/library-service/internal/tracing"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -12,120 +14,206 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var secretKey = []byte("VeryVeryVeryVeryVeryVeryBigSecretKey")
+var (
+	tokenIssuer   = getEnv("JWT_ISSUER", "library-service")
+	tokenAudience = getEnv("JWT_AUDIENCE", "library-api")
+)
+
+// tokenLeeway tolerates clock skew between us and services verifying our
+// tokens with the published keys.
+const tokenLeeway = 30 * time.Second
 
 const expirationTime int64 = 3600
 
-func ValidateTokenAndGetUser(authHeader string, store *AuthStore) (user entity.User, err error) {
-	if authHeader == "" {
-		return user, fmt.Errorf("empty Authorization header")
-	}
+// challengeExpirationTime bounds the time between entering the password and
+// completing the second factor.
+const challengeExpirationTime int64 = 300
 
-	vals := strings.Split(authHeader, " ")
-	if len(vals) < 2 {
-		return user, fmt.Errorf("wrong header value")
-	}
-
-	token := vals[1]
+const (
+	ChallengeMFA    = "mfa"
+	ChallengeEnroll = "mfa_enroll"
+)
 
-	var id uuid.UUID
-	var role int
+// ValidateTokenAndGetUser validates the bearer token without querying the
+// database: the principal is taken from the claims and checked against the
+// in-memory revocation list. Only the id and role of the user are set.
+func ValidateTokenAndGetUser(ctx context.Context, authHeader string, store *AuthStore) (user entity.User, err error) {
+	_, span := tracing.StartSpan(ctx, "auth.ValidateTokenAndGetUser")
+	defer span.End()
 
-	if id, role, err = ParseToken(token); err != nil {
+	var claims tokenClaims
+	if claims, err = validateBearer(authHeader, store); err != nil {
 		return user, err
 	}
 
-	if user, err = store.GetUserByIdAndRole(id, role); err != nil {
+	if user.Id, err = uuid.Parse(claims.Subject); err != nil {
 		return user, fmt.Errorf("invalid token")
 	}
+	user.Role = claims.Role
 
 	return user, nil
 }
 
-func ValidateToken(authHeader string, store *AuthStore) error {
+func ValidateToken(ctx context.Context, authHeader string, store *AuthStore) error {
+	_, span := tracing.StartSpan(ctx, "auth.ValidateToken")
+	defer span.End()
+
+	_, err := validateBearer(authHeader, store)
+	return err
+}
+
+func validateBearer(authHeader string, store *AuthStore) (claims tokenClaims, err error) {
 	if authHeader == "" {
-		return fmt.Errorf("empty Authorization header")
+		return claims, fmt.Errorf("empty Authorization header")
 	}
 
 	vals := strings.Split(authHeader, " ")
 	if len(vals) < 2 {
-		return fmt.Errorf("wrong header value")
+		return claims, fmt.Errorf("wrong header value")
 	}
 
-	token := vals[1]
+	if claims, err = parseClaims(vals[1], ""); err != nil {
+		return claims, err
+	}
 
-	var id uuid.UUID
-	var role int
-	var err error
-	if id, role, err = ParseToken(token); err != nil {
-		return err
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return claims, fmt.Errorf("invalid token")
 	}
 
-	if _, err = store.GetUserByIdAndRole(id, role); err != nil {
-		return fmt.Errorf("invalid token")
+	if store.revocations.IsRevoked(claims.ID, id, claims.IssuedAt.Time) {
+		return claims, fmt.Errorf("token was revoked")
 	}
 
-	return nil
+	return claims, nil
 }
 
 func ParseToken(tokenString string) (uuid.UUID, int, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			log.Println("TokenService.ParseToken() - unexpected signing method")
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+	return parseToken(tokenString, "")
+}
 
-		return secretKey, nil
-	})
+// ParseChallengeToken parses a short-lived token issued for an intermediate
+// step of the login, e.g. the second factor. Such tokens are never accepted
+// by ParseToken and vice versa.
+func ParseChallengeToken(tokenString string, purpose string) (uuid.UUID, int, error) {
+	return parseToken(tokenString, purpose)
+}
 
+func parseToken(tokenString string, purpose string) (uuid.UUID, int, error) {
+	claims, err := parseClaims(tokenString, purpose)
 	if err != nil {
-		log.Println("TokenService.ParseToken() - received error ", err)
 		return uuid.Nil, 0, err
 	}
 
-	var id string
-	var role int
-	var expiredAt int64
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		log.Println("TokenService.ParseToken() - claims", claims)
-		id = claims["id"].(string)
-		role = int(claims["role"].(float64))
-		expiredAt = int64(claims["expired_at"].(float64))
-	} else {
-		log.Println(err)
-		return uuid.Nil, role, err
+	uid, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, 0, fmt.Errorf("invalid token")
+	}
+
+	return uid, claims.Role, nil
+}
+
+func parseClaims(tokenString string, purpose string) (claims tokenClaims, err error) {
+	if _, err = jwt.ParseWithClaims(tokenString, &claims, verificationKey, parserOptions(tokenAudience)...); err != nil {
+		slog.Debug("TokenService.ParseToken() - received error", "err", err)
+		return claims, err
+	}
+
+	if claims.Purpose != purpose || claims.ID == "" || claims.IssuedAt == nil {
+		slog.Debug("TokenService.ParseToken() - unexpected claims")
+		return claims, fmt.Errorf("invalid token")
 	}
 
-	if time.Now().Unix() >= expiredAt {
-		log.Println("TokenService.ParseToken() - token is expired!")
-		return uuid.Nil, role, fmt.Errorf("token is expired!")
+	return claims, nil
+}
+
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	keys, err := currentKeys()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys.verificationKey(kid)
+	if !ok {
+		slog.Warn("TokenService.ParseToken() - unknown key", "kid", kid)
+		return nil, fmt.Errorf("unknown key %q", kid)
 	}
 
-	uid := uuid.MustParse(id)
+	if token.Method.Alg() != key.method.Alg() {
+		slog.Warn("TokenService.ParseToken() - unexpected signing method", "alg", token.Header["alg"])
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
 
-	return uid, role, nil
+	return key.public, nil
+}
+
+func parserOptions(audience string) []jwt.ParserOption {
+	return []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(tokenLeeway),
+	}
 }
 
 func GenerateToken(id uuid.UUID, role int) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":         id,
-		"role":       role,
-		"expired_at": time.Now().Unix() + expirationTime,
-	})
+	return generateToken(id, role, "", expirationTime)
+}
+
+func GenerateChallengeToken(id uuid.UUID, role int, purpose string) (string, error) {
+	return generateToken(id, role, purpose, challengeExpirationTime)
+}
+
+func generateToken(id uuid.UUID, role int, purpose string, ttl int64) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		Role:    role,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   id.String(),
+			Audience:  jwt.ClaimStrings{tokenAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(ttl) * time.Second)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+	}
 
-	tokenString, err := token.SignedString(secretKey)
+	return signClaims(claims)
+}
+
+func signClaims(claims jwt.Claims) (string, error) {
+	keys, err := currentKeys()
 	if err != nil {
-		log.Println("TokenService.GenerateToken() received error while signing", err)
+		slog.Error("TokenService.GenerateToken() cannot load signing keys", "err", err)
+		return "", err
+	}
+	key := keys.signingKey()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+
+	tokenString, err := token.SignedString(key.private)
+	if err != nil {
+		slog.Error("TokenService.GenerateToken() received error while signing", "err", err)
 		return "", err
 	}
 
 	return tokenString, nil
 }
 
+type tokenClaims struct {
+	Role    int    `json:"role"`
+	Purpose string `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
 func HashAndSalt(pwd []byte) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.DefaultCost)
 	if err != nil {
-		log.Println("TokenService.HashAndSalt() - received error while generating password", err)
+		slog.Error("TokenService.HashAndSalt() - received error while generating password", "err", err)
 		return "", err
 	}
 
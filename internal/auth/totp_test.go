@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA1 test vectors.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := totpCode(rfcSecret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("totpCode() at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	tests := []struct {
+		name string
+		code string
+		step int64
+		ok   bool
+	}{
+		{"current code", "005924", step, true},
+		{"spaces are ignored", " 005 924 ", step, true},
+		{"previous period", codeAt(t, step-1), step - 1, true},
+		{"next period", codeAt(t, step+1), step + 1, true},
+		{"beyond the skew", codeAt(t, step-2), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"too short", "05924", 0, false},
+		{"too long", "0059240", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, ok := VerifyTOTP(rfcSecret, tt.code, now)
+			if matched != tt.step || ok != tt.ok {
+				t.Errorf("VerifyTOTP() = %d, %v, want %d, %v", matched, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyTOTPWithInvalidSecret(t *testing.T) {
+	if _, ok := VerifyTOTP("not base32!", "123456", time.Now()); ok {
+		t.Error("VerifyTOTP() accepted a code for an invalid secret")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("generated %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-9]{5}-[a-z2-9]{5}$`)
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q isn't in the form xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+
+		if hashes[i] != HashOpaqueToken(normalizeRecoveryCode(" "+code+" ")) {
+			t.Errorf("hash of %q doesn't match the normalized code", code)
+		}
+	}
+}
+
+func codeAt(t *testing.T, step int64) string {
+	t.Helper()
+	code, err := totpCode(rfcSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	PurposeVerifyMail    = "verify_mail"
+	PurposeResetPassword = "reset_password"
+
+	verifyMailTTL    = 24 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// NewOpaqueToken returns a random url-safe token and the hash under which it
+// is stored. Only the hash is persisted, the token itself is sent to the user.
+func NewOpaqueToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
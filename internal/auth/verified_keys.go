@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// verifiedKeyTTL bounds how long a deleted key may still be told apart
+	// by Caller on other instances. It never authenticates anything.
+	verifiedKeyTTL  = time.Minute
+	maxVerifiedKeys = 10_000
+)
+
+// verifiedKeys remembers API keys which passed verification recently, so
+// Caller can identify their requests without a query. Unknown keys, e.g.
+// made up ones, are never looked up on its behalf.
+type verifiedKeys struct {
+	mu   sync.Mutex
+	keys map[string]verifiedKey
+}
+
+type verifiedKey struct {
+	id         uuid.UUID
+	secretHash string
+	expiresAt  time.Time
+}
+
+func newVerifiedKeys() *verifiedKeys {
+	return &verifiedKeys{keys: map[string]verifiedKey{}}
+}
+
+func (cache *verifiedKeys) add(prefix string, id uuid.UUID, secretHash string, expiresAt *time.Time, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := verifiedKey{id: id, secretHash: secretHash, expiresAt: now.Add(verifiedKeyTTL)}
+	if expiresAt != nil && expiresAt.Before(key.expiresAt) {
+		key.expiresAt = *expiresAt
+	}
+
+	if _, ok := cache.keys[prefix]; !ok && len(cache.keys) >= maxVerifiedKeys {
+		cache.prune(now)
+		if len(cache.keys) >= maxVerifiedKeys {
+			return
+		}
+	}
+	cache.keys[prefix] = key
+}
+
+// lookup returns the id of the key with the prefix if its secret matches.
+func (cache *verifiedKeys) lookup(prefix string, secretHash string, now time.Time) (uuid.UUID, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key, ok := cache.keys[prefix]
+	if !ok || !now.Before(key.expiresAt) || subtle.ConstantTimeCompare([]byte(key.secretHash), []byte(secretHash)) != 1 {
+		return uuid.Nil, false
+	}
+	return key.id, true
+}
+
+func (cache *verifiedKeys) remove(id uuid.UUID) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for prefix, key := range cache.keys {
+		if key.id == id {
+			delete(cache.keys, prefix)
+		}
+	}
+}
+
+func (cache *verifiedKeys) prune(now time.Time) {
+	for prefix, key := range cache.keys {
+		if !now.Before(key.expiresAt) {
+			delete(cache.keys, prefix)
+		}
+	}
+}
@@ -4,14 +4,24 @@ import (
 	"database/sql"
 	"encoding/json"
 	"example/library-service/internal/auth"
+	"example/library-service/internal/cache"
 	"example/library-service/internal/entity"
 	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
 	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
@@ -20,72 +30,73 @@ type AuthorHandler struct {
 	authStore   *auth.AuthStore
 }
 
-func NewAuthorHandler(db *sql.DB, authStore *auth.AuthStore) *AuthorHandler {
-	store := NewAuthorStore(db)
+func NewAuthorHandler(db *sql.DB, authStore *auth.AuthStore, catalog *cache.Namespace) *AuthorHandler {
+	store := NewAuthorStore(db, catalog)
 	return &AuthorHandler{store, authStore}
 }
 
-func (authorHandler *AuthorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == http.MethodGet && utils.AuthorRe.Match([]byte(r.URL.Path)):
-		authorHandler.getAuthors(w, r)
-		return
-	case r.Method == http.MethodGet && utils.AuthorReWithID.Match([]byte(r.URL.Path)):
-		authorHandler.getAuthor(w, r)
-		return
-	case r.Method == http.MethodPost && utils.AuthorRe.Match([]byte(r.URL.Path)):
-		authorHandler.createAuthor(w, r)
-		return
-	case r.Method == http.MethodPut && utils.AuthorRe.Match([]byte(r.URL.Path)):
-		authorHandler.updateAuthor(w, r)
-		return
-	case r.Method == http.MethodDelete && utils.AuthorReWithID.Match([]byte(r.URL.Path)):
-		authorHandler.deleteAuthor(w, r)
-		return
-	default:
-		errors.HandleError(405, fmt.Sprintf("Method %v not allowed", r.URL.Path), w)
-		return
-	}
+// Routes registers the author routes. PUT /authors, with the id in the body,
+// is kept for existing clients.
+func (authorHandler *AuthorHandler) Routes(r chi.Router) {
+	r.Get("/authors", authorHandler.getAuthors)
+	r.Post("/authors", authorHandler.createAuthor)
+	r.Post("/authors:batch", authorHandler.batchAuthors)
+	r.Put("/authors", authorHandler.updateAuthor)
+	r.Get("/authors/duplicates", authorHandler.getDuplicates)
+	r.Get("/authors/{id}", authorHandler.getAuthor)
+	r.Put("/authors/{id}", authorHandler.updateAuthor)
+	r.Patch("/authors/{id}", authorHandler.patchAuthor)
+	r.Delete("/authors/{id}", authorHandler.deleteAuthor)
+	r.Post("/authors/{id}/merge", authorHandler.mergeAuthor)
 }
 
 func (AuthorHandler *AuthorHandler) getAuthor(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var id uuid.UUID
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("AuthorHandler.getAuthor() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "AuthorHandler.getAuthor() - processing request", "path", r.URL.Path)
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), AuthorHandler.authStore); err != nil {
-		log.Println("AuthorHandler.getAuthor() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if _, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.getAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("AuthorHandler.getAuthor() - received error", err)
-		errors.HandleError(500, "Internal Server Error", w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.getAuthor() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
 		return
 	}
 
 	var Author entity.Author
-	if Author, err = AuthorHandler.authorStore.GetAuthor(id); err != nil {
+	if Author, err = AuthorHandler.authorStore.GetAuthor(r.Context(), id); err != nil {
 		if err == sql.ErrNoRows {
+			if AuthorHandler.redirect(w, r, id) {
+				return
+			}
 			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", id), w)
 			return
 		}
-		log.Println("AuthorHandler.getAuthor() - received error from db", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.getAuthor() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(Author)
 	if err != nil {
-		log.Println("AuthorHandler.getAuthor() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.getAuthor() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.getAuthor() - successfully finished req", Author)
+	slog.InfoContext(r.Context(), "AuthorHandler.getAuthor() - successfully finished req", "author", Author)
+
+	AuthorHandler.authorStore.cache.SetHeaders(w)
+
+	if etag.NotModified(w, r, etag.Of(Author.Id, Author.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -97,35 +108,37 @@ func (AuthorHandler *AuthorHandler) getAuthors(w http.ResponseWriter, r *http.Re
 	values := r.URL.Query()
 
 	queryMap := utils.ToMap(values)
-	log.Println("AuthorHandler.getAuthors() - received req", queryMap)
+	slog.DebugContext(r.Context(), "AuthorHandler.getAuthors() - received req", "params", queryMap)
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), AuthorHandler.authStore); err != nil {
-		log.Println("AuthorHandler.getAuthors() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if _, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.getAuthors() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if !utils.ValidParams("author", queryMap) {
-		log.Println("AuthorHandler.getAuthors() - received invalid params!", queryMap)
+		slog.WarnContext(r.Context(), "AuthorHandler.getAuthors() - received invalid params!", "params", queryMap)
 		errors.HandleError(400, "Invalid request params", w)
 		return
 	}
 
 	var Authors []entity.Author
-	if Authors, err = AuthorHandler.authorStore.GetAuthors(queryMap); err != nil {
-		log.Println("AuthorHandler.getAuthors() - received error from db", err)
+	if Authors, err = AuthorHandler.authorStore.GetAuthors(r.Context(), queryMap); err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.getAuthors() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(Authors)
 	if err != nil {
-		log.Println("AuthorHandler.getAuthors() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.getAuthors() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.getAuthors() - successfully finished req", Authors)
+	slog.InfoContext(r.Context(), "AuthorHandler.getAuthors() - successfully finished req", "authors", Authors)
+
+	AuthorHandler.authorStore.cache.SetHeaders(w)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -135,14 +148,14 @@ func (AuthorHandler *AuthorHandler) getAuthors(w http.ResponseWriter, r *http.Re
 func (AuthorHandler *AuthorHandler) createAuthor(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var user entity.User
-	if user, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), AuthorHandler.authStore); err != nil {
-		log.Println("AuthorHandler.createAuthor() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if user, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if user.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.createAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
@@ -150,28 +163,40 @@ func (AuthorHandler *AuthorHandler) createAuthor(w http.ResponseWriter, r *http.
 	var author entity.Author
 
 	if err = json.NewDecoder(r.Body).Decode(&author); err != nil {
-		log.Println("AuthorHandler.createAuthor() - received decode error", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.createAuthor() - received decode error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.createAuthor() - received req", author)
+	slog.DebugContext(r.Context(), "AuthorHandler.createAuthor() - received req", "author", author)
+
+	if err = validateAuthor(&author); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - received invalid author", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
 
 	var savedAuthor entity.Author
-	if savedAuthor, err = AuthorHandler.authorStore.CreateAuthor(author); err != nil {
-		log.Println("AuthorHandler.createAuthor() - received error from db", err)
+	if savedAuthor, err = AuthorHandler.authorStore.CreateAuthor(r.Context(), author); err != nil {
+		if err == errInvalidLifespan {
+			errors.HandleError(400, err.Error(), w)
+			return
+		}
+		slog.ErrorContext(r.Context(), "AuthorHandler.createAuthor() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
+	metrics.AuthorsCreated.Inc()
+
 	jsonBytes, err := json.Marshal(savedAuthor)
 	if err != nil {
-		log.Println("AuthorHandler.createAuthor() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.createAuthor() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.createAuthor() - successfully finished req", savedAuthor)
+	slog.InfoContext(r.Context(), "AuthorHandler.createAuthor() - successfully finished req", "author", savedAuthor)
 	w.WriteHeader(http.StatusCreated)
 	w.Write(jsonBytes)
 	w.Header().Set("Content-Type", "application/json")
@@ -181,14 +206,14 @@ func (AuthorHandler *AuthorHandler) createAuthor(w http.ResponseWriter, r *http.
 func (AuthorHandler *AuthorHandler) updateAuthor(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var user entity.User
-	if user, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), AuthorHandler.authStore); err != nil {
-		log.Println("AuthorHandler.updateAuthor() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if user, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.updateAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if user.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.updateAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.updateAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
@@ -196,18 +221,41 @@ func (AuthorHandler *AuthorHandler) updateAuthor(w http.ResponseWriter, r *http.
 	var author entity.Author
 
 	if err := json.NewDecoder(r.Body).Decode(&author); err != nil {
-		log.Println("AuthorHandler.updateAuthor() - received decode error", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.updateAuthor() - received decode error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.updateAuthor() - received req", author)
+	if utils.PathParam(r, "id") != "" {
+		if author.Id, err = utils.PathUUID(r, "id"); err != nil {
+			slog.WarnContext(r.Context(), "AuthorHandler.updateAuthor() - received invalid id", "err", err)
+			errors.HandleError(400, "invalid id", w)
+			return
+		}
+	}
+
+	slog.DebugContext(r.Context(), "AuthorHandler.updateAuthor() - received req", "author", author)
+
+	if err = validateAuthor(&author); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.updateAuthor() - received invalid author", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	current, ok := AuthorHandler.currentAuthor(w, r, author.Id)
+	if !ok {
+		return
+	}
 
 	var updatedAuthor entity.Author
-	if updatedAuthor, err = AuthorHandler.authorStore.UpdateAuthor(author); err != nil {
-		log.Println("AuthorHandler.updateAuthor() - received error from db", err)
+	if updatedAuthor, err = AuthorHandler.authorStore.UpdateAuthor(r.Context(), author, current.Version); err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.updateAuthor() - received error from db", "err", err)
 		if err == sql.ErrNoRows {
-			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", author.Id), w)
+			etag.Changed(w)
+			return
+		}
+		if err == errInvalidLifespan {
+			errors.HandleError(400, err.Error(), w)
 			return
 		}
 
@@ -217,12 +265,12 @@ func (AuthorHandler *AuthorHandler) updateAuthor(w http.ResponseWriter, r *http.
 
 	jsonBytes, err := json.Marshal(updatedAuthor)
 	if err != nil {
-		log.Println("AuthorHandler.updateAuthor() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "AuthorHandler.updateAuthor() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("AuthorHandler.updateAuthor() - successfully finished req", updatedAuthor)
+	slog.InfoContext(r.Context(), "AuthorHandler.updateAuthor() - successfully finished req", "author", updatedAuthor)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -233,33 +281,37 @@ func (AuthorHandler *AuthorHandler) updateAuthor(w http.ResponseWriter, r *http.
 func (AuthorHandler *AuthorHandler) deleteAuthor(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var id uuid.UUID
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("deleteAuthor() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "deleteAuthor() - processing request", "path", r.URL.Path)
 
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("deleteAuthor() - received error", err)
-		errors.HandleError(500, "Internal Server Error", w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "deleteAuthor() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
 		return
 	}
 
 	var user entity.User
-	if user, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), AuthorHandler.authStore); err != nil {
-		log.Println("AuthorHandler.deleteAuthor() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if user, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.deleteAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if user.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.deleteAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.deleteAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
 
-	if err = AuthorHandler.authorStore.DeleteAuthor(id); err != nil {
-		log.Println("deleteAuthor() - received error from db", err)
+	current, ok := AuthorHandler.currentAuthor(w, r, id)
+	if !ok {
+		return
+	}
+
+	if err = AuthorHandler.authorStore.DeleteAuthor(r.Context(), id, current.Version); err != nil {
+		slog.ErrorContext(r.Context(), "deleteAuthor() - received error from db", "err", err)
 		if err == sql.ErrNoRows {
-			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", id), w)
+			etag.Changed(w)
 			return
 		}
 
@@ -267,7 +319,227 @@ func (AuthorHandler *AuthorHandler) deleteAuthor(w http.ResponseWriter, r *http.
 		return
 	}
 
-	log.Println("AuthorHandler.deleteAuthor() - successfully finished req", id)
+	slog.InfoContext(r.Context(), "AuthorHandler.deleteAuthor() - successfully finished req", "id", id)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (AuthorHandler *AuthorHandler) patchAuthor(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var user entity.User
+	if user, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.patchAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if user.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), "AuthorHandler.patchAuthor() - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	var id uuid.UUID
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.patchAuthor() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	if !patch.Supported(r) {
+		errors.HandleError(415, fmt.Sprintf("Content-Type must be %v", patch.ContentType), w)
+		return
+	}
+
+	var set map[string]any
+	var aliases []string
+	if set, aliases, err = authorColumns(r.Body); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.patchAuthor() - received invalid patch", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "AuthorHandler.patchAuthor() - received req", "id", id, "set", set, "aliases", aliases)
+
+	current, ok := AuthorHandler.currentAuthor(w, r, id)
+	if !ok {
+		return
+	}
+
+	patchedAuthor := current
+	if len(set) > 0 || aliases != nil {
+		patchedAuthor, err = AuthorHandler.authorStore.PatchAuthor(r.Context(), id, current.Version, set, aliases)
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+		if err == errInvalidLifespan {
+			errors.HandleError(400, err.Error(), w)
+			return
+		}
+		slog.ErrorContext(r.Context(), "AuthorHandler.patchAuthor() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(patchedAuthor)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.patchAuthor() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthorHandler.patchAuthor() - successfully finished req", "author", patchedAuthor)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// currentAuthor loads the author a write applies to and checks that the
+// client has seen its current state, books included.
+func (AuthorHandler *AuthorHandler) currentAuthor(w http.ResponseWriter, r *http.Request, id uuid.UUID) (author entity.Author, ok bool) {
+	author, err := AuthorHandler.authorStore.loadAuthor(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", id), w)
+			return author, false
+		}
+		slog.ErrorContext(r.Context(), "AuthorHandler.currentAuthor() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return author, false
+	}
+
+	author.Version, ok = etag.CheckIfMatch(w, r, author.Id, author.Version)
+	return author, ok
+}
+
+// authorColumns maps a merge patch of an author to the columns it changes.
+func authorColumns(body io.Reader) (set map[string]any, aliases []string, err error) {
+	fields := []string{"name", "aliases"}
+	for _, field := range authorFields {
+		fields = append(fields, field.name)
+	}
+
+	p, err := patch.Decode(body, fields...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	set = map[string]any{}
+	if name, ok, err := p.String("name"); err != nil {
+		return nil, nil, err
+	} else if ok {
+		set["name"] = name
+	}
+
+	for _, field := range authorFields {
+		value, ok, err := p.NullableString(field.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if value != nil && !field.valid(*value) {
+			return nil, nil, &patch.Error{Field: field.name, Message: field.message}
+		}
+		set[field.column] = value
+	}
+
+	if value, ok, err := p.Strings("aliases"); err != nil {
+		return nil, nil, err
+	} else if ok {
+		if aliases, err = tidyAliases(value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return set, aliases, nil
+}
+
+var (
+	nationalityRe = regexp.MustCompile(`^[A-Z]{2}$`)
+	viafRe        = regexp.MustCompile(`^[0-9]{1,22}$`)
+	isniRe        = regexp.MustCompile(`^[0-9]{15}[0-9X]$`)
+	wikidataRe    = regexp.MustCompile(`^Q[1-9][0-9]*$`)
+)
+
+const (
+	maxBiographyLength = 10000
+	maxAliases         = 50
+	maxAliasLength     = 255
+)
+
+// authorFields are the optional fields of an author by JSON name, with the
+// columns they're stored in.
+var authorFields = []struct {
+	name    string
+	column  string
+	valid   func(string) bool
+	message string
+}{
+	{"birthDate", "birth_date", isDate, "must be a date like 2006-01-02"},
+	{"deathDate", "death_date", isDate, "must be a date like 2006-01-02"},
+	{"nationality", "nationality", nationalityRe.MatchString, "must be an ISO 3166-1 alpha-2 country code like GB"},
+	{"biography", "biography", func(s string) bool { return utf8.RuneCountInString(s) <= maxBiographyLength }, fmt.Sprintf("must not be longer than %d characters", maxBiographyLength)},
+	{"viaf", "viaf", viafRe.MatchString, "must be a VIAF id, i.e. digits"},
+	{"isni", "isni", isniRe.MatchString, "must be an ISNI of 16 characters without spaces"},
+	{"wikidata", "wikidata", wikidataRe.MatchString, "must be a Wikidata item id like Q42"},
+}
+
+func isDate(s string) bool {
+	_, err := time.Parse(time.DateOnly, s)
+	return err == nil
+}
+
+// optionalValues returns the optional fields of an author by JSON name.
+func optionalValues(a *entity.Author) map[string]**string {
+	return map[string]**string{
+		"birthDate": &a.BirthDate, "deathDate": &a.DeathDate, "nationality": &a.Nationality, "biography": &a.Biography,
+		"viaf": &a.VIAF, "isni": &a.ISNI, "wikidata": &a.Wikidata,
+	}
+}
+
+// validateAuthor checks the optional fields of an author, where empty
+// strings count as missing, and tidies its aliases. The error is safe to
+// return to the client.
+func validateAuthor(a *entity.Author) error {
+	values := optionalValues(a)
+	for _, field := range authorFields {
+		value := values[field.name]
+		if *value != nil && strings.TrimSpace(**value) == "" {
+			*value = nil
+		}
+		if *value != nil && !field.valid(**value) {
+			return &patch.Error{Field: field.name, Message: field.message}
+		}
+	}
+
+	aliases, err := tidyAliases(a.Aliases)
+	a.Aliases = aliases
+	return err
+}
+
+// tidyAliases trims the aliases and drops empty and repeated ones.
+func tidyAliases(aliases []string) ([]string, error) {
+	tidy := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+		if alias == "" || slices.Contains(tidy, alias) {
+			continue
+		}
+		if utf8.RuneCountInString(alias) > maxAliasLength {
+			return nil, &patch.Error{Field: "aliases", Message: fmt.Sprintf("must not be longer than %d characters each", maxAliasLength)}
+		}
+		tidy = append(tidy, alias)
+	}
+
+	if len(tidy) > maxAliases {
+		return nil, &patch.Error{Field: "aliases", Message: fmt.Sprintf("must not be more than %d", maxAliases)}
+	}
+	return tidy, nil
+}
@@ -1,61 +1,190 @@
 package author
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"example/library-service/internal/cache"
 	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+// checkViolation is the postgres error code raised when a row fails a check
+// constraint, e.g. an author dying before they were born.
+const checkViolation = "23514"
+
+var (
+	errDuplicateNotFound = errors.New("duplicate author wasn't found")
+	errInvalidLifespan   = errors.New("deathDate can't be before birthDate")
+	errMergedLifespan    = errors.New("the merged author would die before they were born, correct the dates of either author first")
+)
+
+// DuplicateCandidate is a pair of authors whose normalized names or aliases
+// are similar, e.g. "Lovecraft" and "H. P. Lovecraft".
+type DuplicateCandidate struct {
+	Author     entity.Author `json:"author"`
+	Duplicate  entity.Author `json:"duplicate"`
+	Similarity float64       `json:"similarity"`
+}
+
 type AuthorStore struct {
-	db *sql.DB
+	db    utils.DBTX
+	cache *cache.Namespace
+}
+
+// NewAuthorStore caches reads in the catalog namespace, which writes of books
+// and authors invalidate.
+func NewAuthorStore(db *sql.DB, catalog *cache.Namespace) *AuthorStore {
+	return &AuthorStore{db, catalog}
 }
 
-func NewAuthorStore(db *sql.DB) *AuthorStore {
-	return &AuthorStore{db}
+// WithTx returns a store running its queries in tx. It bypasses the cache;
+// the caller invalidates it once tx is committed.
+func (store *AuthorStore) WithTx(tx utils.DBTX) *AuthorStore {
+	return &AuthorStore{db: tx}
 }
 
-func (store *AuthorStore) GetAuthor(id uuid.UUID) (a entity.Author, e error) {
-	statement, err := store.db.Prepare(`
-		select a.*, b.id, b.name, b.genre, b.publication_date, b.created_at
+// GetAuthor returns the author with their books, from the cache when
+// possible.
+func (store *AuthorStore) GetAuthor(ctx context.Context, id uuid.UUID) (a entity.Author, err error) {
+	err = store.cache.Fetch(ctx, "author:"+id.String(), &a, func() (err error) {
+		a, err = store.loadAuthor(ctx, id)
+		return err
+	})
+	return a, err
+}
+
+// GetAuthors returns the authors matching the params, from the cache when
+// possible.
+func (store *AuthorStore) GetAuthors(ctx context.Context, m map[string]string) (authors []entity.Author, err error) {
+	err = store.cache.Fetch(ctx, "authors?"+cache.Key(m), &authors, func() (err error) {
+		authors, err = store.loadAuthors(ctx, m)
+		return err
+	})
+	return authors, err
+}
+
+// selectAuthor lists the columns read by scanAuthor, of authors aliased as
+// a. Dates are read as text, so they stay dates rather than timestamps.
+const selectAuthor = `a.id, a.name, a.birth_date::text, a.death_date::text, a.nationality, a.biography,
+	a.viaf, a.isni, a.wikidata, a.created_at, a.version,
+	array(select al.name from author_aliases al where al.author_id=a.id order by al.name)`
+
+// scanAuthor reads the columns of selectAuthor into a, followed by dest.
+func scanAuthor(row interface{ Scan(dest ...any) error }, a *entity.Author, dest ...any) error {
+	var birthDate, deathDate, nationality, biography, viaf, isni, wikidata sql.NullString
+	var aliases pq.StringArray
+	columns := []any{&a.Id, &a.Name, &birthDate, &deathDate, &nationality, &biography, &viaf, &isni, &wikidata, &a.CreatedAt, &a.Version, &aliases}
+	if err := row.Scan(append(columns, dest...)...); err != nil {
+		return err
+	}
+
+	a.BirthDate, a.DeathDate = nullable(birthDate), nullable(deathDate)
+	a.Nationality, a.Biography = nullable(nationality), nullable(biography)
+	a.VIAF, a.ISNI, a.Wikidata = nullable(viaf), nullable(isni), nullable(wikidata)
+	a.Aliases = nil
+	if len(aliases) > 0 {
+		a.Aliases = aliases
+	}
+	return nil
+}
+
+func nullable(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+// loadAuthor reads the author from the db, bypassing the cache, e.g. to
+// check preconditions of a write.
+func (store *AuthorStore) loadAuthor(ctx context.Context, id uuid.UUID) (a entity.Author, e error) {
+	defer metrics.ObserveQuery("AuthorStore.GetAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.GetAuthor")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select `+selectAuthor+`, b.id, b.name, b.genre, b.publication_date, b.created_at
 		from authors a 
-		join books b on a.id=b.author_id where a.id=$1
+		left join books b on a.id=b.author_id where a.id=$1
 	`)
 
 	if err != nil {
-		log.Println("AuthorStore.GetAuthor() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthor() - received error from db", "err", err)
 		return a, err
 	}
 
-	rows, rowErr := statement.Query(id.String())
+	rows, rowErr := statement.QueryContext(ctx, id.String())
 
 	if rowErr != nil {
-		log.Println("AuthorStore.GetAuthor() - received error from db", rowErr)
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthor() - received error from db", "err", rowErr)
 		return a, rowErr
 	}
 
+	defer rows.Close()
+
+	found := false
 	var books []entity.AuthorBook
 	for rows.Next() {
-		var book entity.AuthorBook
-		if scanErr := rows.Scan(&a.Id, &a.Name, &a.CreatedAt, &book.Id, &book.Name, &book.Genre, &book.PublicationDate, &book.CreatedAt); scanErr != nil {
-			log.Println("AuthorStore.GetAuthor() - received error from db", scanErr)
+		// An author without books is a single row of nulls on the book side.
+		book, scanErr := scanAuthorBook(rows, &a)
+		if scanErr != nil {
+			slog.ErrorContext(ctx, "AuthorStore.GetAuthor() - received error from db", "err", scanErr)
 			return a, scanErr
 		}
 
-		books = append(books, book)
+		found = true
+		if book != nil {
+			books = append(books, *book)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthor() - received error from db", "err", err)
+		return a, err
+	}
+
+	if !found {
+		return a, sql.ErrNoRows
 	}
 
 	a.Books = books
-	log.Println("AuthorStore.GetAuthor() - received from db", a)
+	slog.DebugContext(ctx, "AuthorStore.GetAuthor() - received from db", "author", a)
 	return a, nil
 }
 
-func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, error) {
-	query := `select a.*, b.id, b.name, b.genre, b.publication_date, b.created_at from authors a 
+// scanAuthorBook reads a row of an author left joined with their books; the
+// book is nil if the author has none.
+func scanAuthorBook(rows *sql.Rows, a *entity.Author) (*entity.AuthorBook, error) {
+	var bookId uuid.NullUUID
+	var name, genre, publicationDate sql.NullString
+	var createdAt sql.NullTime
+	if err := scanAuthor(rows, a, &bookId, &name, &genre, &publicationDate, &createdAt); err != nil {
+		return nil, err
+	}
+
+	if !bookId.Valid {
+		return nil, nil
+	}
+	return &entity.AuthorBook{Id: bookId.UUID, Name: name.String, Genre: genre.String, PublicationDate: publicationDate.String, CreatedAt: createdAt.Time}, nil
+}
+
+func (store *AuthorStore) loadAuthors(ctx context.Context, m map[string]string) ([]entity.Author, error) {
+	defer metrics.ObserveQuery("AuthorStore.GetAuthors", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.GetAuthors")
+	defer span.End()
+
+	query := `select ` + selectAuthor + `, b.id, b.name, b.genre, b.publication_date, b.created_at from authors a 
 		left join books b on a.id = b.author_id`
 	params := make([]any, len(m))
 
@@ -63,17 +192,16 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 		query += " where "
 		var i = 1
 		for k, v := range m {
-			var column string
+			param := "'%' || $" + fmt.Sprint(i) + " || '%'"
 			switch {
 			case k == "author_name":
-				column = "a.name"
+				// Pen names and transliterations find the author as well.
+				query += "(a.name like " + param + " or exists (select 1 from author_aliases al where al.author_id=a.id and al.name like " + param + ")) and "
 			case k == "book_name":
-				column = "b.name"
+				query += "b.name like " + param + " and "
 			default:
-				column = "a." + k
+				query += "a." + k + " like " + param + " and "
 			}
-
-			query += column + " like '%' || $" + fmt.Sprint(i) + " || '%' and "
 			params[i-1] = v
 			i++
 		}
@@ -82,25 +210,25 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 		query = strings.Join(queryArr[:len(queryArr)-1], " ")
 	}
 
-	log.Println("AuthorStore.GetAuthors() - executing query", query, params)
+	slog.DebugContext(ctx, "AuthorStore.GetAuthors() - executing query", "query", query, "params", params)
 
-	statement, err := store.db.Prepare(query)
+	statement, err := store.db.PrepareContext(ctx, query)
 
 	if err != nil {
-		log.Println("AuthorStore.GetAuthors() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthors() - received error from db", "err", err)
 		return nil, err
 	}
 
 	var queryRows *sql.Rows
 	var queryError error
 	if len(params) == 0 {
-		queryRows, queryError = statement.Query()
+		queryRows, queryError = statement.QueryContext(ctx)
 	} else {
-		queryRows, queryError = statement.Query(params...)
+		queryRows, queryError = statement.QueryContext(ctx, params...)
 	}
 
 	if queryError != nil {
-		log.Println("AuthorStore.GetAuthors() - received error from db", queryError)
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthors() - received error from db", "err", queryError)
 		return nil, queryError
 	}
 
@@ -109,9 +237,10 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 	defer queryRows.Close()
 	for queryRows.Next() {
 		var author entity.Author
-		var book entity.AuthorBook
-		if scanErr := queryRows.Scan(&author.Id, &author.Name, &author.CreatedAt, &book.Id, &book.Name, &book.Genre, &book.PublicationDate, &book.CreatedAt); scanErr != nil {
-			log.Println("AuthorStore.GetAuthors() - received error while scanning", err)
+		book, scanErr := scanAuthorBook(queryRows, &author)
+		if scanErr != nil {
+			slog.ErrorContext(ctx, "AuthorStore.GetAuthors() - received error while scanning", "err", scanErr)
+			return nil, scanErr
 		}
 
 		books, ok := booksMap[author.Id]
@@ -119,8 +248,8 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 			books = make([]entity.AuthorBook, 0)
 		}
 
-		if book.Id != uuid.Nil {
-			books = append(books, book)
+		if book != nil {
+			books = append(books, *book)
 		}
 
 		booksMap[author.Id] = books
@@ -128,7 +257,7 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 	}
 
 	if err := queryRows.Err(); err != nil {
-		log.Println("AuthorStore.GetAuthors() - received error from db", err)
+		slog.ErrorContext(ctx, "AuthorStore.GetAuthors() - received error from db", "err", err)
 		return nil, err
 	}
 
@@ -145,76 +274,305 @@ func (store *AuthorStore) GetAuthors(m map[string]string) ([]entity.Author, erro
 	return authors, nil
 }
 
-func (store *AuthorStore) CreateAuthor(author entity.Author) (savedAuthor entity.Author, err error) {
-	statement, err := store.db.Prepare(`
-		insert into authors(name, created_at)
-			values($1, $2) 
-			returning *
-	`)
+func (store *AuthorStore) CreateAuthor(ctx context.Context, author entity.Author) (savedAuthor entity.Author, err error) {
+	defer metrics.ObserveQuery("AuthorStore.CreateAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.CreateAuthor")
+	defer span.End()
+
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var id uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			insert into authors(name, birth_date, death_date, nationality, biography, viaf, isni, wikidata, created_at)
+				values($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				returning id
+		`, author.Name, author.BirthDate, author.DeathDate, author.Nationality, author.Biography,
+			author.VIAF, author.ISNI, author.Wikidata, time.Now().UTC()).Scan(&id); err != nil {
+			return err
+		}
+
+		return saveAliases(ctx, tx, id, author.Aliases, &savedAuthor)
+	})
 
 	if err != nil {
-		log.Println("AuthorStore.CreateAuthor() - received error from db", err)
-		return savedAuthor, err
+		return savedAuthor, writeError(ctx, "AuthorStore.CreateAuthor()", err)
 	}
 
-	row := statement.QueryRow(&author.Name, time.Now().UTC())
+	store.cache.Invalidate(ctx)
+	return savedAuthor, nil
+}
+
+// UpdateAuthor replaces the author, aliases included, if it's still at the
+// given version.
+func (store *AuthorStore) UpdateAuthor(ctx context.Context, author entity.Author, version int) (updatedAuthor entity.Author, err error) {
+	defer metrics.ObserveQuery("AuthorStore.UpdateAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.UpdateAuthor")
+	defer span.End()
+
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var id uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			update authors set name=$1, birth_date=$2, death_date=$3, nationality=$4, biography=$5,
+				viaf=$6, isni=$7, wikidata=$8, version=version+1
+			where id=$9 and version=$10
+			returning id
+		`, author.Name, author.BirthDate, author.DeathDate, author.Nationality, author.Biography,
+			author.VIAF, author.ISNI, author.Wikidata, author.Id, version).Scan(&id); err != nil {
+			return err
+		}
 
-	scanError := row.Scan(&savedAuthor.Id, &savedAuthor.Name, &savedAuthor.CreatedAt)
+		return saveAliases(ctx, tx, id, author.Aliases, &updatedAuthor)
+	})
 
-	if scanError != nil {
-		log.Println("AuthorStore.CreateAuthor() - received error from db", scanError)
-		return savedAuthor, scanError
+	if err != nil {
+		return updatedAuthor, writeError(ctx, "AuthorStore.UpdateAuthor()", err)
 	}
 
-	return savedAuthor, nil
+	store.cache.Invalidate(ctx)
+	return updatedAuthor, nil
 }
 
-func (store *AuthorStore) UpdateAuthor(author entity.Author) (updatedAuthor entity.Author, err error) {
-	statement, err := store.db.Prepare(`
-		update authors set name=$1 where id=$2
-		returning *
-	`)
+// PatchAuthor updates only the given columns of the author if it's still at
+// the given version. Aliases are replaced unless they're nil.
+func (store *AuthorStore) PatchAuthor(ctx context.Context, id uuid.UUID, version int, set map[string]any, aliases []string) (patchedAuthor entity.Author, err error) {
+	defer metrics.ObserveQuery("AuthorStore.PatchAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.PatchAuthor")
+	defer span.End()
+
+	update, args := patch.Update("authors", id, version, set)
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		if err := tx.QueryRowContext(ctx, `
+			with patched_author as (`+update+`)
+			select id from patched_author
+		`, args...).Scan(&id); err != nil {
+			return err
+		}
+
+		if aliases == nil {
+			return scanAuthor(tx.QueryRowContext(ctx, `select `+selectAuthor+` from authors a where a.id=$1`, id), &patchedAuthor)
+		}
+		return saveAliases(ctx, tx, id, aliases, &patchedAuthor)
+	})
 
 	if err != nil {
-		log.Println("AuthorStore.UpdateAuthor() - received error from db", err)
-		return updatedAuthor, err
+		return patchedAuthor, writeError(ctx, "AuthorStore.PatchAuthor()", err)
 	}
 
-	row := statement.QueryRow(&author.Name, &author.Id)
+	store.cache.Invalidate(ctx)
+	return patchedAuthor, nil
+}
 
-	if scanError := row.Scan(&updatedAuthor.Id, &updatedAuthor.Name, &updatedAuthor.CreatedAt); scanError != nil {
-		log.Println("AuthorStore.UpdateAuthor() - received error from db", scanError)
-		return updatedAuthor, scanError
+// saveAliases replaces the aliases of the author and reads the author back
+// into saved.
+func saveAliases(ctx context.Context, tx utils.DBTX, id uuid.UUID, aliases []string, saved *entity.Author) error {
+	if _, err := tx.ExecContext(ctx, `delete from author_aliases where author_id=$1`, id); err != nil {
+		return err
 	}
 
-	return updatedAuthor, nil
+	if len(aliases) > 0 {
+		if _, err := tx.ExecContext(ctx, `
+			insert into author_aliases(author_id, name, created_at)
+				select distinct $1::uuid, alias, $3::timestamp from unnest($2::varchar[]) as alias
+		`, id, pq.Array(aliases), time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return scanAuthor(tx.QueryRowContext(ctx, `select `+selectAuthor+` from authors a where a.id=$1`, id), saved)
 }
 
-func (store *AuthorStore) DeleteAuthor(id uuid.UUID) error {
+// writeError maps a violated lifespan check to errInvalidLifespan and logs
+// unexpected errors of a write.
+func writeError(ctx context.Context, method string, err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == checkViolation {
+		return errInvalidLifespan
+	}
+	if err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, method+" - received error from db", "err", err)
+	}
+	return err
+}
 
-	updateBooksStatement, updateErr := store.db.Prepare("update books set author_id=null where author_id=$1")
+// DeleteAuthor unlinks the author's books and deletes the author if it's
+// still at the given version.
+func (store *AuthorStore) DeleteAuthor(ctx context.Context, id uuid.UUID, version int) error {
+	defer metrics.ObserveQuery("AuthorStore.DeleteAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.DeleteAuthor")
+	defer span.End()
+
+	err := utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		// The row is locked, so the version can't change before it's deleted.
+		var locked uuid.UUID
+		if err := tx.QueryRowContext(ctx, `select id from authors where id=$1 and version=$2 for update`, id, version).Scan(&locked); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `update books set author_id=null, version=version+1 where author_id=$1`, id); err != nil {
+			return err
+		}
 
-	if updateErr != nil {
-		log.Println("AuthorStore.DeleteAuthor() - received error from db", updateErr)
-		return updateErr
+		_, err := tx.ExecContext(ctx, `delete from authors where id=$1`, id)
+		return err
+	})
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthorStore.DeleteAuthor() - received error from db", "err", err)
+		}
+		return err
 	}
 
-	deleteStatement, deleteErr := store.db.Prepare(`delete from authors where id=$1`)
+	store.cache.Invalidate(ctx)
+	return nil
+}
 
-	if deleteErr != nil {
-		log.Println("AuthorStore.DeleteAuthor() - received error from db", deleteErr)
-		return deleteErr
-	}
+// FindDuplicates returns pairs of authors with names or aliases of at least
+// the given trigram similarity, the most similar first. A pair is scored by
+// its most similar names.
+func (store *AuthorStore) FindDuplicates(ctx context.Context, threshold float64, limit int) ([]DuplicateCandidate, error) {
+	defer metrics.ObserveQuery("AuthorStore.FindDuplicates", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.FindDuplicates")
+	defer span.End()
+
+	candidates := make([]DuplicateCandidate, 0)
+	err := utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		// The % operator uses the trigram index but reads its threshold from
+		// the session; it's only set for the transaction.
+		if _, err := tx.ExecContext(ctx, `select set_config('pg_trgm.similarity_threshold', $1, true)`, fmt.Sprint(threshold)); err != nil {
+			return err
+		}
 
-	if _, execErr := updateBooksStatement.Exec(id); execErr != nil {
-		log.Println("AuthorStore.DeleteAuthor() - received error from db", execErr)
-		return execErr
+		rows, err := tx.QueryContext(ctx, `
+			with names as (
+				select id as author_id, name from authors
+				union all
+				select author_id, name from author_aliases
+			), pairs as (
+				select n.author_id, m.author_id as duplicate_id,
+					max(similarity(normalized_name(n.name), normalized_name(m.name))) as score
+				from names n
+				inner join names m on n.author_id < m.author_id and normalized_name(n.name) % normalized_name(m.name)
+				group by n.author_id, m.author_id
+			)
+			select a.id, a.name, a.created_at, d.id, d.name, d.created_at, p.score
+			from pairs p
+			inner join authors a on a.id=p.author_id
+			inner join authors d on d.id=p.duplicate_id
+			order by p.score desc, a.name, d.name
+			limit $1
+		`, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var c DuplicateCandidate
+			if err := rows.Scan(&c.Author.Id, &c.Author.Name, &c.Author.CreatedAt, &c.Duplicate.Id, &c.Duplicate.Name, &c.Duplicate.CreatedAt, &c.Similarity); err != nil {
+				return err
+			}
+			candidates = append(candidates, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "AuthorStore.FindDuplicates() - received error from db", "err", err)
+		return nil, err
 	}
 
-	if _, execErr := deleteStatement.Exec(id); execErr != nil {
-		log.Println("AuthorStore.DeleteAuthor() - received error from db", execErr)
-		return execErr
+	return candidates, nil
+}
+
+// MergeAuthor merges the duplicate into the author if it's still at the
+// given version: the duplicate's books are moved over, its names become
+// aliases, data missing from the author is taken from it and its id
+// redirects to the author.
+func (store *AuthorStore) MergeAuthor(ctx context.Context, id uuid.UUID, version int, duplicateId uuid.UUID) error {
+	defer metrics.ObserveQuery("AuthorStore.MergeAuthor", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.MergeAuthor")
+	defer span.End()
+
+	err := utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var birthDate, deathDate sql.NullTime
+		if err := tx.QueryRowContext(ctx, `select birth_date, death_date from authors where id=$1 and version=$2 for update`, id, version).Scan(&birthDate, &deathDate); err != nil {
+			return err
+		}
+
+		var duplicateName string
+		var duplicateBirthDate, duplicateDeathDate sql.NullTime
+		if err := tx.QueryRowContext(ctx, `select name, birth_date, death_date from authors where id=$1 for update`, duplicateId).Scan(&duplicateName, &duplicateBirthDate, &duplicateDeathDate); err != nil {
+			if err == sql.ErrNoRows {
+				return errDuplicateNotFound
+			}
+			return err
+		}
+
+		if !validMergedLifespan(birthDate, deathDate, duplicateBirthDate, duplicateDeathDate) {
+			return errMergedLifespan
+		}
+
+		now := time.Now().UTC()
+		statements := []struct {
+			query string
+			args  []any
+		}{
+			// Moved books name another author now, so their versions change.
+			{`update books set author_id=$1, version=version+1 where author_id=$2`, []any{id, duplicateId}},
+			// Aliases the author has already are dropped with the duplicate.
+			{`update author_aliases set author_id=$1 where author_id=$2
+				and name not in (select name from author_aliases where author_id=$1)`, []any{id, duplicateId}},
+			{`insert into author_aliases(author_id, name, created_at) values($1, $2, $3) on conflict do nothing`, []any{id, duplicateName, now}},
+			{`update author_redirects set to_id=$1 where to_id=$2`, []any{id, duplicateId}},
+			{`insert into author_redirects(from_id, to_id, created_at) values($1, $2, $3)`, []any{duplicateId, id, now}},
+			// Data only the duplicate has is kept.
+			{`update authors a set birth_date=coalesce(a.birth_date, d.birth_date), death_date=coalesce(a.death_date, d.death_date),
+				nationality=coalesce(a.nationality, d.nationality), biography=coalesce(a.biography, d.biography),
+				viaf=coalesce(a.viaf, d.viaf), isni=coalesce(a.isni, d.isni), wikidata=coalesce(a.wikidata, d.wikidata),
+				version=a.version+1
+			from authors d where a.id=$1 and d.id=$2`, []any{id, duplicateId}},
+			{`delete from authors where id=$1`, []any{duplicateId}},
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement.query, statement.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err != sql.ErrNoRows && err != errDuplicateNotFound && err != errMergedLifespan {
+			slog.ErrorContext(ctx, "AuthorStore.MergeAuthor() - received error from db", "err", err)
+		}
+		return err
 	}
 
+	store.cache.Invalidate(ctx)
 	return nil
 }
+
+// validMergedLifespan reports whether the dates of an author still satisfy
+// the lifespan check once the ones it lacks are taken from the duplicate, as
+// MergeAuthor does.
+func validMergedLifespan(birthDate sql.NullTime, deathDate sql.NullTime, duplicateBirthDate sql.NullTime, duplicateDeathDate sql.NullTime) bool {
+	if !birthDate.Valid {
+		birthDate = duplicateBirthDate
+	}
+	if !deathDate.Valid {
+		deathDate = duplicateDeathDate
+	}
+	return !birthDate.Valid || !deathDate.Valid || !deathDate.Time.Before(birthDate.Time)
+}
+
+// Redirect returns the author a merged author's id resolves to.
+func (store *AuthorStore) Redirect(ctx context.Context, id uuid.UUID) (to uuid.UUID, err error) {
+	defer metrics.ObserveQuery("AuthorStore.Redirect", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "AuthorStore.Redirect")
+	defer span.End()
+
+	if err = store.db.QueryRowContext(ctx, `select to_id from author_redirects where from_id=$1`, id).Scan(&to); err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "AuthorStore.Redirect() - received error from db", "err", err)
+		}
+		return to, err
+	}
+
+	return to, nil
+}
@@ -0,0 +1,203 @@
+package author
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/batch"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/utils"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// AuthorBatchRequest changes many authors at once. Updates and deletes name the
+// author by id and carry its ETag, as If-Match does for single requests.
+type AuthorBatchRequest struct {
+	Mode       string            `json:"mode"`
+	Operations []AuthorOperation `json:"operations"`
+}
+
+type AuthorOperation struct {
+	Op      string         `json:"op"`
+	Id      uuid.UUID      `json:"id,omitempty"`
+	IfMatch string         `json:"ifMatch,omitempty"`
+	Author  *entity.Author `json:"author,omitempty"`
+}
+
+func (AuthorHandler *AuthorHandler) batchAuthors(w http.ResponseWriter, r *http.Request) {
+	var invoker entity.User
+	var err error
+	if invoker, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.batchAuthors() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if invoker.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), "AuthorHandler.batchAuthors() - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	req := AuthorBatchRequest{Mode: batch.Atomic}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.batchAuthors() - received decode error", "err", err)
+		errors.HandleError(400, "batch must be a JSON object", w)
+		return
+	}
+
+	if err = batch.Validate(req.Mode, len(req.Operations)); err != nil {
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "AuthorHandler.batchAuthors() - received req", "mode", req.Mode, "operations", len(req.Operations))
+
+	results, status, err := batch.Run(r.Context(), AuthorHandler.authorStore.db, req.Mode, len(req.Operations), func(tx utils.DBTX, i int) batch.Result {
+		store := AuthorHandler.authorStore
+		if tx != nil {
+			store = store.WithTx(tx)
+		}
+		return AuthorHandler.runOperation(r, store, req.Operations[i])
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.batchAuthors() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	// Stores bound to the transaction leave the cache alone.
+	if req.Mode == batch.Atomic && status == http.StatusOK {
+		AuthorHandler.authorStore.cache.Invalidate(r.Context())
+	}
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			metrics.AuthorsCreated.Inc()
+		}
+	}
+
+	jsonBytes, err := json.Marshal(batch.Response{Results: results})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.batchAuthors() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthorHandler.batchAuthors() - successfully finished req", "mode", req.Mode, "status", status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// runOperation applies one operation of a batch with the store, which may be
+// bound to the batch's transaction.
+func (AuthorHandler *AuthorHandler) runOperation(r *http.Request, store *AuthorStore, op AuthorOperation) batch.Result {
+	ctx := r.Context()
+
+	switch op.Op {
+	case batch.Create:
+		if op.Author == nil {
+			return batch.Failed(400, "author is required")
+		}
+
+		if err := validateAuthor(op.Author); err != nil {
+			return batch.Failed(400, err.Error())
+		}
+
+		savedAuthor, err := store.CreateAuthor(ctx, *op.Author)
+		if err == errInvalidLifespan {
+			return batch.Failed(400, err.Error())
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "AuthorHandler.runOperation() - received error from db", "err", err)
+			return batch.Failed(500, "Internal Server Error")
+		}
+		return batch.Result{Status: 201, Value: savedAuthor}
+
+	case batch.Update, batch.Delete:
+		if op.Op == batch.Update {
+			if op.Author == nil {
+				return batch.Failed(400, "author is required")
+			}
+			if err := validateAuthor(op.Author); err != nil {
+				return batch.Failed(400, err.Error())
+			}
+		}
+
+		current, failure := currentBatchAuthor(r, store, op)
+		if failure != nil {
+			return *failure
+		}
+
+		if op.Op == batch.Delete {
+			if err := store.DeleteAuthor(ctx, op.Id, current.Version); err != nil {
+				return writeFailure(r, err)
+			}
+			return batch.Result{Status: 204}
+		}
+
+		op.Author.Id = op.Id
+		updatedAuthor, err := store.UpdateAuthor(ctx, *op.Author, current.Version)
+		if err != nil {
+			return writeFailure(r, err)
+		}
+		return batch.Result{Status: 200, Value: updatedAuthor}
+	}
+
+	return batch.Failed(400, fmt.Sprintf("op must be %q, %q or %q", batch.Create, batch.Update, batch.Delete))
+}
+
+// currentBatchAuthor loads the author an operation applies to and checks
+// its ETag, like currentAuthor does for single requests.
+func currentBatchAuthor(r *http.Request, store *AuthorStore, op AuthorOperation) (entity.Author, *batch.Result) {
+	if op.Id == uuid.Nil {
+		result := batch.Failed(400, "id is required")
+		return entity.Author{}, &result
+	}
+
+	if op.IfMatch == "" {
+		result := batch.Failed(http.StatusPreconditionRequired, "ifMatch is required, send the ETag of the author")
+		return entity.Author{}, &result
+	}
+
+	author, err := store.loadAuthor(r.Context(), op.Id)
+	if err == sql.ErrNoRows {
+		result := batch.Failed(404, fmt.Sprintf("author with id %v wasn't found", op.Id))
+		return author, &result
+	}
+
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.currentBatchAuthor() - received error", "err", err)
+		result := batch.Failed(500, "Internal Server Error")
+		return author, &result
+	}
+
+	var match bool
+	if author.Version, match = etag.Matches(op.IfMatch, author.Id, author.Version); !match {
+		result := batch.Failed(http.StatusPreconditionFailed, "author has changed, fetch it again")
+		return author, &result
+	}
+
+	return author, nil
+}
+
+// writeFailure maps an error of a batched update or delete to its result.
+func writeFailure(r *http.Request, err error) batch.Result {
+	switch err {
+	case sql.ErrNoRows:
+		return batch.Failed(http.StatusPreconditionFailed, "author has changed, fetch it again")
+	case errInvalidLifespan:
+		return batch.Failed(400, err.Error())
+	}
+
+	slog.ErrorContext(r.Context(), "AuthorHandler.runOperation() - received error from db", "err", err)
+	return batch.Failed(500, "Internal Server Error")
+}
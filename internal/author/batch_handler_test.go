@@ -0,0 +1,148 @@
+package author
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/batch"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+func bearer(t *testing.T, role int) string {
+	t.Helper()
+	token, err := auth.GenerateToken(uuid.New(), role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func newTestHandler(db *sql.DB) *AuthorHandler {
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	return NewAuthorHandler(db, auth.NewAuthStore(db), catalog)
+}
+
+func postBatch(handler *AuthorHandler, authHeader string, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(http.MethodPost, "/authors:batch", strings.NewReader(body))
+	r.Header.Set("Authorization", authHeader)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func decodeResults(t *testing.T, w *httptest.ResponseRecorder) []int {
+	t.Helper()
+	var response batch.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]int, len(response.Results))
+	for i, result := range response.Results {
+		statuses[i] = result.Status
+	}
+	return statuses
+}
+
+// These batches fail before any query, so they need no database.
+func TestBatchAuthorsWithoutQueries(t *testing.T) {
+	handler := newTestHandler(nil)
+	moderator := bearer(t, entity.MODERATOR)
+	tooMany := `{"operations": [` + strings.Repeat(`{"op": "delete"},`, batch.MaxSize) + `{"op": "delete"}]}`
+
+	tests := []struct {
+		name     string
+		header   string
+		body     string
+		status   int
+		statuses []int
+	}{
+		{"anonymous", "", `{"operations": [{"op": "delete"}]}`, http.StatusUnauthorized, nil},
+		{"user", bearer(t, entity.USER), `{"operations": [{"op": "delete"}]}`, http.StatusForbidden, nil},
+		{"not json", moderator, `[`, http.StatusBadRequest, nil},
+		{"unknown mode", moderator, `{"mode": "eventual", "operations": [{"op": "delete"}]}`, http.StatusBadRequest, nil},
+		{"no operations", moderator, `{"operations": []}`, http.StatusBadRequest, nil},
+		{"too many operations", moderator, tooMany, http.StatusBadRequest, nil},
+		{"best effort failures", moderator, fmt.Sprintf(`{"mode": "best_effort", "operations": [
+			{"op": "merge"},
+			{"op": "create"},
+			{"op": "delete"},
+			{"op": "delete", "id": %q}
+		]}`, uuid.New()), http.StatusMultiStatus, []int{400, 400, 400, 428}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postBatch(handler, tt.header, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.statuses == nil {
+				return
+			}
+			if statuses := decodeResults(t, w); fmt.Sprint(statuses) != fmt.Sprint(tt.statuses) {
+				t.Errorf("statuses = %v, want %v", statuses, tt.statuses)
+			}
+		})
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBatchAuthorsRollsBack(t *testing.T) {
+	db := testDB(t)
+	handler := newTestHandler(db)
+	name := uuid.NewString()
+
+	// The update fails as the author doesn't exist, which rolls the create
+	// back.
+	body := fmt.Sprintf(`{"operations": [
+		{"op": "create", "author": {"name": %q}},
+		{"op": "update", "id": %q, "ifMatch": "*", "author": {"name": "Unknown"}}
+	]}`, name, uuid.New())
+	w := postBatch(handler, bearer(t, entity.MODERATOR), body)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+	if statuses := decodeResults(t, w); fmt.Sprint(statuses) != "[424 404]" {
+		t.Errorf("statuses = %v, want [424 404]", statuses)
+	}
+
+	var count int
+	if err := db.QueryRow(`select count(*) from authors where name=$1`, name).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("the author of the rolled back batch was created")
+	}
+}
@@ -0,0 +1,174 @@
+package author
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/utils"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultDuplicateThreshold = 0.5
+	defaultDuplicateLimit     = 50
+	maxDuplicateLimit         = 200
+)
+
+// MergeAuthorRequest names the duplicate merged into the author of the path.
+type MergeAuthorRequest struct {
+	DuplicateId uuid.UUID `json:"duplicateId"`
+}
+
+// getDuplicates lists pairs of authors which are likely the same person,
+// for moderators to merge.
+func (AuthorHandler *AuthorHandler) getDuplicates(w http.ResponseWriter, r *http.Request) {
+	var err error
+	queryMap := utils.ToMap(r.URL.Query())
+
+	if _, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.getDuplicates() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if !utils.ValidParams("author_duplicates", queryMap) {
+		slog.WarnContext(r.Context(), "AuthorHandler.getDuplicates() - received invalid params!", "params", queryMap)
+		errors.HandleError(400, "Invalid request params", w)
+		return
+	}
+
+	threshold := defaultDuplicateThreshold
+	if value, ok := queryMap["threshold"]; ok {
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil || threshold <= 0 || threshold > 1 {
+			errors.HandleError(400, "threshold must be a number greater than 0 and at most 1", w)
+			return
+		}
+	}
+
+	limit := defaultDuplicateLimit
+	if value, ok := queryMap["limit"]; ok {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxDuplicateLimit {
+			errors.HandleError(400, fmt.Sprintf("limit must be between 1 and %d", maxDuplicateLimit), w)
+			return
+		}
+	}
+
+	candidates, err := AuthorHandler.authorStore.FindDuplicates(r.Context(), threshold, limit)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(candidates)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.getDuplicates() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthorHandler.getDuplicates() - successfully finished req", "candidates", len(candidates))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// mergeAuthor merges a duplicate into the author of the path, which is
+// returned with the books of both.
+func (AuthorHandler *AuthorHandler) mergeAuthor(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var user entity.User
+	if user, err = auth.Authenticate(r, AuthorHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.mergeAuthor() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if user.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), "AuthorHandler.mergeAuthor() - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	var id uuid.UUID
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.mergeAuthor() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	var req MergeAuthorRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil || req.DuplicateId == uuid.Nil {
+		slog.WarnContext(r.Context(), "AuthorHandler.mergeAuthor() - received invalid body", "err", err)
+		errors.HandleError(400, "duplicateId is required", w)
+		return
+	}
+
+	if req.DuplicateId == id {
+		errors.HandleError(400, "an author can't be merged into itself", w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "AuthorHandler.mergeAuthor() - received req", "id", id, "duplicate", req.DuplicateId)
+
+	current, ok := AuthorHandler.currentAuthor(w, r, id)
+	if !ok {
+		return
+	}
+
+	if err = AuthorHandler.authorStore.MergeAuthor(r.Context(), id, current.Version, req.DuplicateId); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			etag.Changed(w)
+		case errDuplicateNotFound:
+			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", req.DuplicateId), w)
+		case errMergedLifespan:
+			errors.HandleError(409, err.Error(), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	mergedAuthor, err := AuthorHandler.authorStore.loadAuthor(r.Context(), id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.mergeAuthor() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(mergedAuthor)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "AuthorHandler.mergeAuthor() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "AuthorHandler.mergeAuthor() - successfully finished req", "id", id, "duplicate", req.DuplicateId)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag.Of(mergedAuthor.Id, mergedAuthor.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// redirect answers a read of a merged author with a permanent redirect to
+// the author it was merged into, and reports whether it did.
+func (AuthorHandler *AuthorHandler) redirect(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	to, err := AuthorHandler.authorStore.Redirect(r.Context(), id)
+	if err != nil {
+		return false
+	}
+
+	slog.InfoContext(r.Context(), "AuthorHandler.redirect() - author was merged", "id", id, "to", to)
+	http.Redirect(w, r, fmt.Sprintf("/authors/%v", to), http.StatusPermanentRedirect)
+	return true
+}
@@ -0,0 +1,188 @@
+package author
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/etag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+func date(year int) sql.NullTime {
+	return sql.NullTime{Time: time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+}
+
+func TestValidMergedLifespan(t *testing.T) {
+	none := sql.NullTime{}
+
+	tests := []struct {
+		name                             string
+		birth, death, dupBirth, dupDeath sql.NullTime
+		want                             bool
+	}{
+		{"no dates", none, none, none, none, true},
+		{"dates of the author", date(1890), date(1937), date(1950), date(1940), true},
+		{"dates of the duplicate", none, none, date(1890), date(1937), true},
+		{"completed by the duplicate", date(1890), none, none, date(1937), true},
+		{"death before the duplicate's birth", none, date(1937), date(1950), none, false},
+		{"birth after the duplicate's death", date(1950), none, none, date(1937), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validMergedLifespan(tt.birth, tt.death, tt.dupBirth, tt.dupDeath); got != tt.want {
+				t.Errorf("validMergedLifespan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func request(handler *AuthorHandler, method string, path string, authHeader string, ifMatch string, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", authHeader)
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// These requests are rejected before any query, so they need no database.
+func TestMergeAndDuplicatesReject(t *testing.T) {
+	handler := newTestHandler(nil)
+	moderator := bearer(t, entity.MODERATOR)
+	id := uuid.New()
+	merge := "/authors/" + id.String() + "/merge"
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		body   string
+		status int
+	}{
+		{"merge anonymously", http.MethodPost, merge, "", `{"duplicateId": "` + uuid.NewString() + `"}`, http.StatusUnauthorized},
+		{"merge as user", http.MethodPost, merge, bearer(t, entity.USER), `{"duplicateId": "` + uuid.NewString() + `"}`, http.StatusForbidden},
+		{"merge invalid id", http.MethodPost, "/authors/1/merge", moderator, `{"duplicateId": "` + uuid.NewString() + `"}`, http.StatusBadRequest},
+		{"merge without duplicate", http.MethodPost, merge, moderator, `{}`, http.StatusBadRequest},
+		{"merge into itself", http.MethodPost, merge, moderator, `{"duplicateId": "` + id.String() + `"}`, http.StatusBadRequest},
+		{"duplicates anonymously", http.MethodGet, "/authors/duplicates", "", "", http.StatusUnauthorized},
+		{"duplicates with unknown param", http.MethodGet, "/authors/duplicates?sort=name", moderator, "", http.StatusBadRequest},
+		{"duplicates with zero threshold", http.MethodGet, "/authors/duplicates?threshold=0", moderator, "", http.StatusBadRequest},
+		{"duplicates with threshold above 1", http.MethodGet, "/authors/duplicates?threshold=1.5", moderator, "", http.StatusBadRequest},
+		{"duplicates with invalid limit", http.MethodGet, fmt.Sprintf("/authors/duplicates?limit=%d", maxDuplicateLimit+1), moderator, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(handler, tt.method, tt.path, tt.header, "", tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func insertAuthor(t *testing.T, db *sql.DB, name string, birthDate sql.NullTime, deathDate sql.NullTime) (uuid.UUID, string) {
+	t.Helper()
+	var id uuid.UUID
+	var version int
+	if err := db.QueryRow(`
+		insert into authors(name, birth_date, death_date, created_at) values($1, $2, $3, now()) returning id, version
+	`, name, birthDate, deathDate).Scan(&id, &version); err != nil {
+		t.Fatal(err)
+	}
+	return id, etag.Of(id, version)
+}
+
+func TestMergeAuthor(t *testing.T) {
+	db := testDB(t)
+	handler := newTestHandler(db)
+	moderator := bearer(t, entity.MODERATOR)
+	suffix := uuid.NewString()[:8]
+
+	id, tag := insertAuthor(t, db, "Howard Lovecraft "+suffix, date(1890), sql.NullTime{})
+	duplicateId, _ := insertAuthor(t, db, "H. P. Lovecraft "+suffix, sql.NullTime{}, date(1937))
+	var bookId uuid.UUID
+	if err := db.QueryRow(`
+		insert into books(name, genre, publication_date, created_at, author_id) values('At the Mountains of Madness', 'horror', '1936-01-01', now(), $1) returning id
+	`, duplicateId).Scan(&bookId); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(handler, http.MethodPost, "/authors/"+id.String()+"/merge", moderator, tag, fmt.Sprintf(`{"duplicateId": %q}`, duplicateId))
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge status = %d: %s", w.Code, w.Body)
+	}
+	var merged entity.Author
+	if err := json.Unmarshal(w.Body.Bytes(), &merged); err != nil {
+		t.Fatal(err)
+	}
+	if merged.BirthDate == nil || merged.DeathDate == nil {
+		t.Errorf("merged dates = %v, %v, want both", merged.BirthDate, merged.DeathDate)
+	}
+
+	var authorId uuid.UUID
+	if err := db.QueryRow(`select author_id from books where id=$1`, bookId).Scan(&authorId); err != nil || authorId != id {
+		t.Errorf("book author = %v, %v, want %v", authorId, err, id)
+	}
+	var aliases int
+	if err := db.QueryRow(`select count(*) from author_aliases where author_id=$1 and name=$2`, id, "H. P. Lovecraft "+suffix).Scan(&aliases); err != nil || aliases != 1 {
+		t.Errorf("aliases = %d, %v, want the duplicate's name", aliases, err)
+	}
+
+	// The duplicate's id redirects to the author it was merged into.
+	w = request(handler, http.MethodGet, "/authors/"+duplicateId.String(), moderator, "", "")
+	if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != "/authors/"+id.String() {
+		t.Errorf("get duplicate = %d to %q, want %d to /authors/%v", w.Code, w.Header().Get("Location"), http.StatusPermanentRedirect, id)
+	}
+
+	// A duplicate born after the author died can't be merged.
+	deadId, deadTag := insertAuthor(t, db, "Died "+suffix, sql.NullTime{}, date(1937))
+	bornId, _ := insertAuthor(t, db, "Born "+suffix, date(1950), sql.NullTime{})
+	w = request(handler, http.MethodPost, "/authors/"+deadId.String()+"/merge", moderator, deadTag, fmt.Sprintf(`{"duplicateId": %q}`, bornId))
+	if w.Code != http.StatusConflict {
+		t.Errorf("merge of conflicting dates status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+}
+
+func TestFindDuplicatesMatchesAliases(t *testing.T) {
+	db := testDB(t)
+	store := newTestHandler(db).authorStore
+	suffix := uuid.NewString()[:8]
+
+	// The names differ, but the duplicate is named like an alias of the
+	// author.
+	id, _ := insertAuthor(t, db, "Samuel Clemens "+suffix, sql.NullTime{}, sql.NullTime{})
+	duplicateId, _ := insertAuthor(t, db, "Mark Twain "+suffix, sql.NullTime{}, sql.NullTime{})
+	if _, err := db.Exec(`insert into author_aliases(author_id, name, created_at) values($1, $2, now())`, id, "Mark Twain "+suffix); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates, err := store.FindDuplicates(context.Background(), 0.9, maxDuplicateLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range candidates {
+		if (c.Author.Id == id && c.Duplicate.Id == duplicateId) || (c.Author.Id == duplicateId && c.Duplicate.Id == id) {
+			if c.Similarity != 1 {
+				t.Errorf("similarity = %v, want 1", c.Similarity)
+			}
+			return
+		}
+	}
+	t.Error("the pair wasn't found")
+}
@@ -0,0 +1,113 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"example/library-service/internal/utils"
+	"fmt"
+	"net/http"
+)
+
+// Modes of a batch. Atomic batches are applied completely or not at all,
+// best-effort ones apply every operation which succeeds.
+const (
+	Atomic     = "atomic"
+	BestEffort = "best_effort"
+)
+
+// Kinds of operations.
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+// MaxSize bounds the number of operations of a batch, so a single request
+// can't hold a transaction open for long.
+const MaxSize = 100
+
+// Result is the outcome of one operation of a batch; Status is the one the
+// single request would have been answered with.
+type Result struct {
+	Status int    `json:"status"`
+	Value  any    `json:"value,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Response struct {
+	Results []Result `json:"results"`
+}
+
+func Failed(status int, message string) Result {
+	return Result{Status: status, Error: message}
+}
+
+var errRolledBack = errors.New("batch was rolled back")
+
+// Validate checks the mode and size of a batch; the error is safe to return
+// to the client.
+func Validate(mode string, size int) error {
+	if mode != Atomic && mode != BestEffort {
+		return fmt.Errorf("mode must be %q or %q", Atomic, BestEffort)
+	}
+	if size == 0 || size > MaxSize {
+		return fmt.Errorf("batch must have between 1 and %d operations", MaxSize)
+	}
+	return nil
+}
+
+// Run executes the size operations of a batch with exec. In atomic mode they
+// share a transaction on db, which is rolled back as soon as one fails; the
+// failure keeps its result, the other operations are reported as 424. In
+// best-effort mode exec gets a nil tx and each operation is applied on its
+// own.
+//
+// The returned status answers the whole batch: 200 if every operation
+// succeeded, the status of the failure of an atomic batch, or 207 for a
+// best-effort batch with failures.
+func Run(ctx context.Context, db utils.DBTX, mode string, size int, exec func(tx utils.DBTX, i int) Result) ([]Result, int, error) {
+	results := make([]Result, 0, size)
+
+	if mode == BestEffort {
+		status := http.StatusOK
+		for i := 0; i < size; i++ {
+			result := exec(nil, i)
+			if !succeeded(result) {
+				status = http.StatusMultiStatus
+			}
+			results = append(results, result)
+		}
+		return results, status, nil
+	}
+
+	err := utils.InTx(ctx, db, func(tx utils.DBTX) error {
+		for i := 0; i < size; i++ {
+			result := exec(tx, i)
+			results = append(results, result)
+			if !succeeded(result) {
+				return errRolledBack
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return results, http.StatusOK, nil
+	}
+	if err != errRolledBack {
+		return nil, 0, err
+	}
+
+	failure := results[len(results)-1]
+	for i := range results[:len(results)-1] {
+		results[i] = Failed(http.StatusFailedDependency, errRolledBack.Error())
+	}
+	for i := len(results); i < size; i++ {
+		results = append(results, Failed(http.StatusFailedDependency, errRolledBack.Error()))
+	}
+
+	return results, failure.Status, nil
+}
+
+func succeeded(result Result) bool {
+	return result.Status < 300
+}
@@ -0,0 +1,169 @@
+package batch
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"example/library-service/internal/utils"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// txDriver is a database driver which only supports transactions. It counts
+// how they end, which is all Run decides.
+type txDriver struct {
+	mu        sync.Mutex
+	commits   int
+	rollbacks int
+	// failCommit makes commits fail.
+	failCommit bool
+}
+
+func (d *txDriver) Open(name string) (driver.Conn, error) { return txConn{d}, nil }
+
+type txConn struct{ d *txDriver }
+
+func (c txConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("statements aren't supported")
+}
+func (c txConn) Close() error              { return nil }
+func (c txConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c txConn) Commit() error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.failCommit {
+		return errors.New("commit failed")
+	}
+	c.d.commits++
+	return nil
+}
+
+func (c txConn) Rollback() error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.rollbacks++
+	return nil
+}
+
+var testDriver = &txDriver{}
+
+func init() {
+	sql.Register("batchtest", testDriver)
+}
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("batchtest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	testDriver.mu.Lock()
+	defer testDriver.mu.Unlock()
+	testDriver.commits, testDriver.rollbacks = 0, 0
+	return db
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		size  int
+		valid bool
+	}{
+		{"atomic", Atomic, 1, true},
+		{"best effort", BestEffort, MaxSize, true},
+		{"unknown mode", "eventual", 1, false},
+		{"empty mode", "", 1, false},
+		{"no operations", Atomic, 0, false},
+		{"too many operations", Atomic, MaxSize + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.mode, tt.size); (err == nil) != tt.valid {
+				t.Errorf("Validate() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		// statuses are the results of exec, in order.
+		statuses  []int
+		want      []int
+		status    int
+		executed  int
+		commits   int
+		rollbacks int
+	}{
+		{"atomic success", Atomic, []int{201, 200, 204}, []int{201, 200, 204}, http.StatusOK, 3, 1, 0},
+		{"atomic failure", Atomic, []int{201, 412, 204}, []int{424, 412, 424}, http.StatusPreconditionFailed, 2, 0, 1},
+		{"atomic failure of the first operation", Atomic, []int{404, 201}, []int{404, 424}, http.StatusNotFound, 1, 0, 1},
+		{"atomic failure of the last operation", Atomic, []int{201, 500}, []int{424, 500}, http.StatusInternalServerError, 2, 0, 1},
+		{"best effort success", BestEffort, []int{201, 204}, []int{201, 204}, http.StatusOK, 2, 0, 0},
+		{"best effort failure", BestEffort, []int{201, 412, 204}, []int{201, 412, 204}, http.StatusMultiStatus, 3, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+
+			executed := 0
+			results, status, err := Run(context.Background(), db, tt.mode, len(tt.statuses), func(tx utils.DBTX, i int) Result {
+				executed++
+				if (tx == nil) != (tt.mode == BestEffort) {
+					t.Errorf("operation %d: tx = %v in %s mode", i, tx, tt.mode)
+				}
+				if tt.statuses[i] >= 300 {
+					return Failed(tt.statuses[i], "failed")
+				}
+				return Result{Status: tt.statuses[i], Value: i}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if executed != tt.executed {
+				t.Errorf("executed %d operations, want %d", executed, tt.executed)
+			}
+			if len(results) != len(tt.want) {
+				t.Fatalf("got %d results, want %d", len(results), len(tt.want))
+			}
+			for i, result := range results {
+				if result.Status != tt.want[i] {
+					t.Errorf("result %d status = %d, want %d", i, result.Status, tt.want[i])
+				}
+				if result.Status == http.StatusFailedDependency && result.Value != nil {
+					t.Errorf("result %d of a rolled back batch has value %v", i, result.Value)
+				}
+			}
+			if testDriver.commits != tt.commits || testDriver.rollbacks != tt.rollbacks {
+				t.Errorf("commits = %d, rollbacks = %d, want %d, %d", testDriver.commits, testDriver.rollbacks, tt.commits, tt.rollbacks)
+			}
+		})
+	}
+}
+
+func TestRunReturnsCommitErrors(t *testing.T) {
+	db := testDB(t)
+	testDriver.failCommit = true
+	defer func() { testDriver.failCommit = false }()
+
+	results, _, err := Run(context.Background(), db, Atomic, 1, func(tx utils.DBTX, i int) Result {
+		return Result{Status: 201}
+	})
+	if err == nil || results != nil {
+		t.Errorf("Run() = %v, %v, want the commit error", results, err)
+	}
+}
@@ -0,0 +1,51 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var ErrNotFound = errors.New("blob wasn't found")
+
+// BlobStore keeps binary objects, e.g. cover images, by key. Keys are slash
+// separated paths like covers/<id>/small.jpg, which map directly to object
+// keys of S3-compatible stores. Implementations must be safe for concurrent
+// use.
+type BlobStore interface {
+	// Put stores the object, replacing any object with the same key.
+	Put(ctx context.Context, key string, contentType string, r io.Reader) error
+	// Get opens the object for reading; the caller closes it. It returns
+	// ErrNotFound for unknown keys.
+	Get(ctx context.Context, key string) (body io.ReadCloser, contentType string, err error)
+	// Delete removes the object; unknown keys are ignored.
+	Delete(ctx context.Context, key string) error
+	// Move renames the object, replacing any object with the new key. S3
+	// compatible stores implement it as a copy and a delete.
+	Move(ctx context.Context, from string, to string) error
+}
+
+// NewBlobStoreFromEnv returns the blob store selected by BLOB_STORE:
+//
+//   - file (default): FileStore keeping objects in BLOB_DIR (./blobs by
+//     default)
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "file":
+		dir := getEnv("BLOB_DIR", "blobs")
+		slog.Info("blob.NewBlobStoreFromEnv() - storing blobs in local directory", "dir", dir)
+		return NewFileStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", os.Getenv("BLOB_STORE"))
+	}
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// contentTypeSuffix names the file next to each object which keeps its
+// content type.
+const contentTypeSuffix = ".content-type"
+
+// FileStore keeps every object in a file below Dir. Objects are written to
+// a temporary file first and renamed, so readers never see partial writes.
+type FileStore struct {
+	Dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir}, nil
+}
+
+func (s *FileStore) Put(ctx context.Context, key string, contentType string, r io.Reader) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		slog.ErrorContext(ctx, "FileStore.Put() - received error", "err", err)
+		return err
+	}
+
+	if err = writeFile(name+contentTypeSuffix, strings.NewReader(contentType)); err == nil {
+		err = writeFile(name, r)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "FileStore.Put() - received error", "err", err, "key", key)
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType, err := os.ReadFile(name + contentTypeSuffix)
+	if err != nil {
+		return nil, "", notFound(ctx, err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", notFound(ctx, err)
+	}
+
+	return f, string(contentType), nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{name, name + contentTypeSuffix} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.ErrorContext(ctx, "FileStore.Delete() - received error", "err", err, "key", key)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) Move(ctx context.Context, from string, to string) error {
+	source, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	target, err := s.path(to)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		slog.ErrorContext(ctx, "FileStore.Move() - received error", "err", err)
+		return err
+	}
+
+	if err = os.Rename(source, target); err == nil {
+		err = os.Rename(source+contentTypeSuffix, target+contentTypeSuffix)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "FileStore.Move() - received error", "err", err, "from", from, "to", to)
+		return err
+	}
+
+	return nil
+}
+
+// path maps a key to its file, refusing keys which would escape Dir.
+func (s *FileStore) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || strings.HasPrefix(key, "..") || strings.HasSuffix(key, contentTypeSuffix) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func notFound(ctx context.Context, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	slog.ErrorContext(ctx, "FileStore.Get() - received error", "err", err)
+	return err
+}
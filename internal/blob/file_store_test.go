@@ -0,0 +1,61 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileStoreMove(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		existing bool
+		from     string
+		err      error
+	}{
+		{"new key", false, "uploads/a", nil},
+		{"replaces the existing object", true, "uploads/a", nil},
+		{"unknown source", true, "uploads/missing", ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing {
+				if err := store.Put(ctx, "ebooks/1/pdf", "application/pdf", strings.NewReader("old")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Put(ctx, "uploads/a", "application/epub+zip", strings.NewReader("new")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Move(ctx, tt.from, "ebooks/1/pdf"); err != tt.err {
+				t.Fatalf("Move() error = %v, want %v", err, tt.err)
+			}
+
+			want, wantType := "new", "application/epub+zip"
+			if tt.err != nil {
+				want, wantType = "old", "application/pdf"
+			}
+			body, contentType, err := store.Get(ctx, "ebooks/1/pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			if data, _ := io.ReadAll(body); string(data) != want || contentType != wantType {
+				t.Errorf("Get() = %q, %q, want %q, %q", data, contentType, want, wantType)
+			}
+
+			if _, _, err := store.Get(ctx, "uploads/a"); tt.err == nil && err != ErrNotFound {
+				t.Errorf("source still exists, Get() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package book
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/batch"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/utils"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// BookBatchRequest changes many books at once. Updates and deletes name the
+// book by id and carry its ETag, as If-Match does for single requests.
+type BookBatchRequest struct {
+	Mode       string          `json:"mode"`
+	Operations []BookOperation `json:"operations"`
+}
+
+type BookOperation struct {
+	Op      string       `json:"op"`
+	Id      uuid.UUID    `json:"id,omitempty"`
+	IfMatch string       `json:"ifMatch,omitempty"`
+	Book    *entity.Book `json:"book,omitempty"`
+}
+
+func (BookHandler *BookHandler) batchBooks(w http.ResponseWriter, r *http.Request) {
+	var invoker entity.User
+	var err error
+	if invoker, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.batchBooks() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if invoker.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), "BookHandler.batchBooks() - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	req := BookBatchRequest{Mode: batch.Atomic}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.batchBooks() - received decode error", "err", err)
+		errors.HandleError(400, "batch must be a JSON object", w)
+		return
+	}
+
+	if err = batch.Validate(req.Mode, len(req.Operations)); err != nil {
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "BookHandler.batchBooks() - received req", "mode", req.Mode, "operations", len(req.Operations))
+
+	// Files of deleted books are removed once the deletes are final.
+	var removed []entity.Book
+	results, status, err := batch.Run(r.Context(), BookHandler.bookStore.db, req.Mode, len(req.Operations), func(tx utils.DBTX, i int) batch.Result {
+		store := BookHandler.bookStore
+		if tx != nil {
+			store = store.WithTx(tx)
+		}
+		return BookHandler.runOperation(r, store, req.Operations[i], &removed)
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.batchBooks() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	// Stores bound to the transaction leave the cache alone.
+	if req.Mode == batch.Atomic && status == http.StatusOK {
+		BookHandler.bookStore.cache.Invalidate(r.Context())
+	}
+	if req.Mode == batch.BestEffort || status == http.StatusOK {
+		for _, book := range removed {
+			BookHandler.deleteFiles(r.Context(), book)
+		}
+	}
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			metrics.BooksCreated.Inc()
+		}
+	}
+
+	jsonBytes, err := json.Marshal(batch.Response{Results: results})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.batchBooks() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "BookHandler.batchBooks() - successfully finished req", "mode", req.Mode, "status", status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// runOperation applies one operation of a batch with the store, which may be
+// bound to the batch's transaction. Deleted books are added to removed.
+func (BookHandler *BookHandler) runOperation(r *http.Request, store *BookStore, op BookOperation, removed *[]entity.Book) batch.Result {
+	ctx := r.Context()
+
+	switch op.Op {
+	case batch.Create:
+		if op.Book == nil {
+			return batch.Failed(400, "book is required")
+		}
+
+		savedBook, err := store.CreateBook(ctx, *op.Book)
+		if err == sql.ErrNoRows {
+			return batch.Failed(404, fmt.Sprintf("author with id %v wasn't found", op.Book.Author.Id))
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "BookHandler.runOperation() - received error from db", "err", err)
+			return batch.Failed(500, "Internal Server Error")
+		}
+		return batch.Result{Status: 201, Value: savedBook}
+
+	case batch.Update, batch.Delete:
+		if op.Op == batch.Update && op.Book == nil {
+			return batch.Failed(400, "book is required")
+		}
+
+		current, failure := currentBatchBook(r, store, op)
+		if failure != nil {
+			return *failure
+		}
+
+		if op.Op == batch.Delete {
+			if err := store.Remove(ctx, op.Id, current.Version); err != nil {
+				return writeFailure(r, err, op)
+			}
+			*removed = append(*removed, current)
+			return batch.Result{Status: 204}
+		}
+
+		op.Book.Id = op.Id
+		updatedBook, err := store.UpdateBook(ctx, *op.Book, current.Version)
+		if err != nil {
+			return writeFailure(r, err, op)
+		}
+		return batch.Result{Status: 200, Value: updatedBook}
+	}
+
+	return batch.Failed(400, fmt.Sprintf("op must be %q, %q or %q", batch.Create, batch.Update, batch.Delete))
+}
+
+// currentBatchBook loads the book an operation applies to and checks its
+// ETag, like currentBook does for single requests.
+func currentBatchBook(r *http.Request, store *BookStore, op BookOperation) (entity.Book, *batch.Result) {
+	if op.Id == uuid.Nil {
+		result := batch.Failed(400, "id is required")
+		return entity.Book{}, &result
+	}
+
+	if op.IfMatch == "" {
+		result := batch.Failed(http.StatusPreconditionRequired, "ifMatch is required, send the ETag of the book")
+		return entity.Book{}, &result
+	}
+
+	book, err := store.loadBook(r.Context(), op.Id)
+	if err == sql.ErrNoRows {
+		result := batch.Failed(404, fmt.Sprintf("book with id %v wasn't found", op.Id))
+		return book, &result
+	}
+
+	if err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.currentBatchBook() - received error", "err", err)
+		result := batch.Failed(500, "Internal Server Error")
+		return book, &result
+	}
+
+	var match bool
+	if book.Version, match = etag.Matches(op.IfMatch, book.Id, book.Version); !match {
+		result := batch.Failed(http.StatusPreconditionFailed, "book has changed, fetch it again")
+		return book, &result
+	}
+
+	return book, nil
+}
+
+// writeFailure maps an error of a batched update or delete to its result.
+func writeFailure(r *http.Request, err error, op BookOperation) batch.Result {
+	switch err {
+	case sql.ErrNoRows:
+		return batch.Failed(http.StatusPreconditionFailed, "book has changed, fetch it again")
+	case errAuthorNotFound:
+		return batch.Failed(404, fmt.Sprintf("author with id %v wasn't found", op.Book.Author.Id))
+	}
+
+	slog.ErrorContext(r.Context(), "BookHandler.runOperation() - received error from db", "err", err)
+	return batch.Failed(500, "Internal Server Error")
+}
@@ -0,0 +1,175 @@
+package book
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/batch"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/lending"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+func bearer(t *testing.T, role int) string {
+	t.Helper()
+	token, err := auth.GenerateToken(uuid.New(), role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func newTestHandler(t *testing.T, db *sql.DB) (*BookHandler, blob.BlobStore) {
+	t.Helper()
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	return NewBookHandler(db, auth.NewAuthStore(db), catalog, blobs), blobs
+}
+
+func postBatch(handler *BookHandler, authHeader string, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(http.MethodPost, "/books:batch", strings.NewReader(body))
+	r.Header.Set("Authorization", authHeader)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// These batches are rejected before any operation runs, so they need no
+// database.
+func TestBatchBooksRejects(t *testing.T) {
+	handler, _ := newTestHandler(t, nil)
+	moderator := bearer(t, entity.MODERATOR)
+	tooMany := `{"operations": [` + strings.Repeat(`{"op": "delete"},`, batch.MaxSize) + `{"op": "delete"}]}`
+
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		status int
+	}{
+		{"anonymous", "", `{"operations": [{"op": "delete"}]}`, http.StatusUnauthorized},
+		{"user", bearer(t, entity.USER), `{"operations": [{"op": "delete"}]}`, http.StatusForbidden},
+		{"not json", moderator, `[`, http.StatusBadRequest},
+		{"unknown mode", moderator, `{"mode": "eventual", "operations": [{"op": "delete"}]}`, http.StatusBadRequest},
+		{"no operations", moderator, `{"operations": []}`, http.StatusBadRequest},
+		{"too many operations", moderator, tooMany, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := postBatch(handler, tt.header, tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createBookWithEbook stores a book and its PDF, returning the book and its
+// ETag.
+func createBookWithEbook(t *testing.T, db *sql.DB, blobs blob.BlobStore) (uuid.UUID, string) {
+	t.Helper()
+	var id uuid.UUID
+	var version int
+	if err := db.QueryRow(`
+		insert into books(name, genre, publication_date, created_at) values('Batch', 'novel', '1950-01-01', now()) returning id, version
+	`).Scan(&id, &version); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.Put(context.Background(), lending.Key(id, "pdf"), "application/pdf", strings.NewReader("%PDF")); err != nil {
+		t.Fatal(err)
+	}
+	return id, etag.Of(id, version)
+}
+
+func TestBatchBooks(t *testing.T) {
+	db := testDB(t)
+
+	tests := []struct {
+		name     string
+		mode     string
+		status   int
+		statuses []int
+		deleted  bool
+	}{
+		// The create fails as its author doesn't exist.
+		{"atomic batch is rolled back", batch.Atomic, http.StatusNotFound, []int{424, 404}, false},
+		{"best effort batch keeps what succeeded", batch.BestEffort, http.StatusMultiStatus, []int{204, 404}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, blobs := newTestHandler(t, db)
+			id, tag := createBookWithEbook(t, db, blobs)
+
+			body := fmt.Sprintf(`{"mode": %q, "operations": [
+				{"op": "delete", "id": %q, "ifMatch": %q},
+				{"op": "create", "book": {"name": "New", "genre": "novel", "publicationDate": "2000-01-01", "author": {"id": %q}}}
+			]}`, tt.mode, id, tag, uuid.New())
+			w := postBatch(handler, bearer(t, entity.MODERATOR), body)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var response batch.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			for i, result := range response.Results {
+				if result.Status != tt.statuses[i] {
+					t.Errorf("result %d status = %d, want %d", i, result.Status, tt.statuses[i])
+				}
+			}
+
+			var count int
+			if err := db.QueryRow(`select count(*) from books where id=$1`, id).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if deleted := count == 0; deleted != tt.deleted {
+				t.Errorf("book deleted = %v, want %v", deleted, tt.deleted)
+			}
+
+			// Files are only deleted with their book.
+			_, _, err := blobs.Get(context.Background(), lending.Key(id, "pdf"))
+			if fileDeleted := err == blob.ErrNotFound; fileDeleted != tt.deleted {
+				t.Errorf("ebook deleted = %v, want %v (error %v)", fileDeleted, tt.deleted, err)
+			}
+		})
+	}
+}
@@ -4,87 +4,94 @@ import (
 	"database/sql"
 	"encoding/json"
 	"example/library-service/internal/auth"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/cache"
 	"example/library-service/internal/entity"
 	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
 	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
 type BookHandler struct {
 	bookStore *BookStore
 	authStore *auth.AuthStore
+	blobs     blob.BlobStore
 }
 
-func NewBookHandler(db *sql.DB, authStore *auth.AuthStore) *BookHandler {
-	store := NewBookStore(db)
-	return &BookHandler{store, authStore}
+func NewBookHandler(db *sql.DB, authStore *auth.AuthStore, catalog *cache.Namespace, blobs blob.BlobStore) *BookHandler {
+	store := NewBookStore(db, catalog)
+	return &BookHandler{store, authStore, blobs}
 }
 
-func (bookHandler *BookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == http.MethodGet && utils.BookRe.Match([]byte(r.URL.Path)):
-		bookHandler.getBooks(w, r)
-		return
-	case r.Method == http.MethodGet && utils.BookReWithID.Match([]byte(r.URL.Path)):
-		bookHandler.getBook(w, r)
-		return
-	case r.Method == http.MethodPost && utils.BookRe.Match([]byte(r.URL.Path)):
-		bookHandler.createBook(w, r)
-		return
-	case r.Method == http.MethodPut && utils.BookRe.Match([]byte(r.URL.Path)):
-		bookHandler.updateBook(w, r)
-		return
-	case r.Method == http.MethodDelete && utils.BookReWithID.Match([]byte(r.URL.Path)):
-		bookHandler.deleteBook(w, r)
-		return
-	default:
-		return
-	}
+// Routes registers the book routes. PUT /books, with the id in the body, is
+// kept for existing clients.
+func (bookHandler *BookHandler) Routes(r chi.Router) {
+	r.Get("/books", bookHandler.getBooks)
+	r.Post("/books", bookHandler.createBook)
+	r.Post("/books:batch", bookHandler.batchBooks)
+	r.Put("/books", bookHandler.updateBook)
+	r.Get("/books/{id}", bookHandler.getBook)
+	r.Put("/books/{id}", bookHandler.updateBook)
+	r.Patch("/books/{id}", bookHandler.patchBook)
+	r.Delete("/books/{id}", bookHandler.deleteBook)
+	r.Put("/books/{id}/cover", bookHandler.putCover)
+	r.Delete("/books/{id}/cover", bookHandler.deleteCover)
 }
 
 func (BookHandler *BookHandler) getBook(w http.ResponseWriter, r *http.Request) {
 	var id uuid.UUID
 	var err error
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("BookHandler.getBook() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "BookHandler.getBook() - processing request", "path", r.URL.Path)
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), BookHandler.authStore); err != nil {
-		log.Println("BookHandler.getBook() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if _, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.getBook() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("BookHandler.getBook() - received error", err)
-		errors.HandleError(500, "Internal Server Error", w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.getBook() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
 		return
 	}
 
 	var book entity.Book
-	if book, err = BookHandler.bookStore.GetBook(id); err != nil {
+	if book, err = BookHandler.bookStore.GetBook(r.Context(), id); err != nil {
 		if err == sql.ErrNoRows {
 			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", id), w)
 			return
 		}
-		log.Println("BookHandler.getBook() - received error from db", err)
+		slog.ErrorContext(r.Context(), "BookHandler.getBook() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(book)
 	if err != nil {
-		log.Println("BookHandler.getBook() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "BookHandler.getBook() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.getBook() - successfully finished req", book)
+	slog.InfoContext(r.Context(), "BookHandler.getBook() - successfully finished req", "book", book)
+
+	BookHandler.bookStore.cache.SetHeaders(w)
+
+	if etag.NotModified(w, r, etag.Of(book.Id, book.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -95,37 +102,44 @@ func (BookHandler *BookHandler) getBooks(w http.ResponseWriter, r *http.Request)
 	values := r.URL.Query()
 
 	queryMap := utils.ToMap(values)
-	log.Println("BookHandler.getBooks() - received req", queryMap)
+	slog.DebugContext(r.Context(), "BookHandler.getBooks() - received req", "params", queryMap)
 	var err error
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), BookHandler.authStore); err != nil {
-		log.Println("BookHandler.getBooks() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if _, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.getBooks() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if !utils.ValidParams("book", queryMap) {
-		log.Println("BookHandler.getBooks() - received invalid params!", queryMap)
+		slog.WarnContext(r.Context(), "BookHandler.getBooks() - received invalid params!", "params", queryMap)
 
 		errors.HandleError(400, "Invalid request params", w)
 		return
 	}
 
+	if sort, ok := queryMap["sort"]; ok && sorts[sort] == "" {
+		errors.HandleError(400, "sort must be rating, -rating, review_count or -review_count", w)
+		return
+	}
+
 	var books []entity.Book
-	if books, err = BookHandler.bookStore.GetBooks(queryMap); err != nil {
-		log.Println("BookHandler.getBooks() - received error from db", err)
+	if books, err = BookHandler.bookStore.GetBooks(r.Context(), queryMap); err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.getBooks() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(books)
 	if err != nil {
-		log.Println("BookHandler.getBooks() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "BookHandler.getBooks() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.getBooks() - successfully finished req", books)
+	slog.InfoContext(r.Context(), "BookHandler.getBooks() - successfully finished req", "books", books)
+
+	BookHandler.bookStore.cache.SetHeaders(w)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -135,14 +149,14 @@ func (BookHandler *BookHandler) getBooks(w http.ResponseWriter, r *http.Request)
 func (BookHandler *BookHandler) createBook(w http.ResponseWriter, r *http.Request) {
 	var invoker entity.User
 	var err error
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), BookHandler.authStore); err != nil {
-		log.Println("BookHandler.createBook() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.createBook() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if invoker.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.createAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
@@ -150,16 +164,16 @@ func (BookHandler *BookHandler) createBook(w http.ResponseWriter, r *http.Reques
 	var book entity.Book
 
 	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
-		log.Println("BookHandler.createBook() - received decode error", err)
+		slog.ErrorContext(r.Context(), "BookHandler.createBook() - received decode error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.createBook() - received req", book)
+	slog.DebugContext(r.Context(), "BookHandler.createBook() - received req", "book", book)
 
 	var savedBook entity.Book
-	if savedBook, err = BookHandler.bookStore.CreateBook(book); err != nil {
-		log.Println("BookHandler.createBook() - received error from db", err)
+	if savedBook, err = BookHandler.bookStore.CreateBook(r.Context(), book); err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.createBook() - received error from db", "err", err)
 		if err == sql.ErrNoRows {
 			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", book.Author.Id), w)
 			return
@@ -168,14 +182,16 @@ func (BookHandler *BookHandler) createBook(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	metrics.BooksCreated.Inc()
+
 	jsonBytes, err := json.Marshal(savedBook)
 	if err != nil {
-		log.Println("BookHandler.createBook() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "BookHandler.createBook() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.createBook() - successfully finished req", savedBook)
+	slog.InfoContext(r.Context(), "BookHandler.createBook() - successfully finished req", "book", savedBook)
 	w.WriteHeader(http.StatusCreated)
 	w.Write(jsonBytes)
 	w.Header().Set("Content-Type", "application/json")
@@ -185,33 +201,51 @@ func (BookHandler *BookHandler) createBook(w http.ResponseWriter, r *http.Reques
 func (BookHandler *BookHandler) updateBook(w http.ResponseWriter, r *http.Request) {
 	var invoker entity.User
 	var err error
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), BookHandler.authStore); err != nil {
-		log.Println("BookHandler.updateBook() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.updateBook() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if invoker.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.createAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
 
-	log.Println("BookHandler.updateBook() - received req", r.Body)
-
 	var book entity.Book
 
 	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
-		log.Println("BookHandler.updateBook() - received decode error", err)
+		slog.ErrorContext(r.Context(), "BookHandler.updateBook() - received decode error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
+	// On PUT /{id} the path names the resource, not the body.
+	if utils.PathParam(r, "id") != "" {
+		if book.Id, err = utils.PathUUID(r, "id"); err != nil {
+			slog.WarnContext(r.Context(), "BookHandler.updateBook() - received invalid id", "err", err)
+			errors.HandleError(400, "invalid id", w)
+			return
+		}
+	}
+
+	slog.DebugContext(r.Context(), "BookHandler.updateBook() - received req", "book", book)
+
+	current, ok := BookHandler.currentBook(w, r, book.Id)
+	if !ok {
+		return
+	}
+
 	var updatedBook entity.Book
-	if updatedBook, err = BookHandler.bookStore.UpdateBook(book); err != nil {
-		log.Println("BookHandler.updateBook() - received error from db", err)
+	if updatedBook, err = BookHandler.bookStore.UpdateBook(r.Context(), book, current.Version); err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.updateBook() - received error from db", "err", err)
 		if err == sql.ErrNoRows {
-			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", book.Id), w)
+			etag.Changed(w)
+			return
+		}
+		if err == errAuthorNotFound {
+			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", book.Author.Id), w)
 			return
 		}
 		errors.HandleError(500, "Internal Server Error", w)
@@ -220,12 +254,12 @@ func (BookHandler *BookHandler) updateBook(w http.ResponseWriter, r *http.Reques
 
 	jsonBytes, err := json.Marshal(updatedBook)
 	if err != nil {
-		log.Println("BookHandler.updateBook() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "BookHandler.updateBook() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.updateBook() - successfully finished req", updatedBook)
+	slog.InfoContext(r.Context(), "BookHandler.updateBook() - successfully finished req", "book", updatedBook)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -236,40 +270,183 @@ func (BookHandler *BookHandler) updateBook(w http.ResponseWriter, r *http.Reques
 func (BookHandler *BookHandler) deleteBook(w http.ResponseWriter, r *http.Request) {
 	var id uuid.UUID
 	var err error
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("deleteBook() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "deleteBook() - processing request", "path", r.URL.Path)
 
 	var invoker entity.User
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), BookHandler.authStore); err != nil {
-		log.Println("BookHandler.deleteBook() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.deleteBook() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
 	if invoker.Role != entity.MODERATOR {
-		log.Println("AuthorHandler.createAuthor() - user doesn't have permission to this resource")
+		slog.WarnContext(r.Context(), "AuthorHandler.createAuthor() - user doesn't have permission to this resource")
 		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("deleteBook() - received error", err)
-		errors.HandleError(500, "Internal Server Error", w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "deleteBook() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	current, ok := BookHandler.currentBook(w, r, id)
+	if !ok {
 		return
 	}
 
-	if err = BookHandler.bookStore.Remove(id); err != nil {
+	if err = BookHandler.bookStore.Remove(r.Context(), id, current.Version); err != nil {
 		if err == sql.ErrNoRows {
-			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", id), w)
+			etag.Changed(w)
 			return
 		}
 
-		log.Println("deleteBook() - received error from db", err)
+		slog.ErrorContext(r.Context(), "deleteBook() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("BookHandler.deleteBook() - successfully finished req", id)
+	BookHandler.deleteFiles(r.Context(), current)
+
+	slog.InfoContext(r.Context(), "BookHandler.deleteBook() - successfully finished req", "id", id)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// patchBook applies a JSON merge patch to a book; the author is changed by
+// patching its id, e.g. {"author": {"id": "..."}}.
+func (BookHandler *BookHandler) patchBook(w http.ResponseWriter, r *http.Request) {
+	var invoker entity.User
+	var err error
+	if invoker, err = auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.patchBook() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if invoker.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), "BookHandler.patchBook() - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	var id uuid.UUID
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.patchBook() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	if !patch.Supported(r) {
+		errors.HandleError(415, fmt.Sprintf("Content-Type must be %v", patch.ContentType), w)
+		return
+	}
+
+	var set map[string]any
+	if set, err = bookColumns(r.Body); err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.patchBook() - received invalid patch", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "BookHandler.patchBook() - received req", "id", id, "set", set)
+
+	current, ok := BookHandler.currentBook(w, r, id)
+	if !ok {
+		return
+	}
+
+	patchedBook := current
+	if len(set) > 0 {
+		patchedBook, err = BookHandler.bookStore.PatchBook(r.Context(), id, current.Version, set)
+	}
+
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			etag.Changed(w)
+		case errAuthorNotFound:
+			errors.HandleError(404, fmt.Sprintf("author with id %v wasn't found", set["author_id"]), w)
+		default:
+			slog.ErrorContext(r.Context(), "BookHandler.patchBook() - received error from db", "err", err)
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	jsonBytes, err := json.Marshal(patchedBook)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "BookHandler.patchBook() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "BookHandler.patchBook() - successfully finished req", "book", patchedBook)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// currentBook loads the book a write applies to and checks that the client
+// has seen its current state.
+func (BookHandler *BookHandler) currentBook(w http.ResponseWriter, r *http.Request, id uuid.UUID) (book entity.Book, ok bool) {
+	book, err := BookHandler.bookStore.loadBook(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", id), w)
+			return book, false
+		}
+		slog.ErrorContext(r.Context(), "BookHandler.currentBook() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return book, false
+	}
+
+	book.Version, ok = etag.CheckIfMatch(w, r, book.Id, book.Version)
+	return book, ok
+}
+
+// bookColumns maps a merge patch of a book to the columns it changes.
+func bookColumns(body io.Reader) (map[string]any, error) {
+	p, err := patch.Decode(body, "name", "genre", "publicationDate", "author")
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]any{}
+	if name, ok, err := p.String("name"); err != nil {
+		return nil, err
+	} else if ok {
+		set["name"] = name
+	}
+
+	if genre, ok, err := p.String("genre"); err != nil {
+		return nil, err
+	} else if ok {
+		set["genre"] = genre
+	}
+
+	if date, ok, err := p.String("publicationDate"); err != nil {
+		return nil, err
+	} else if ok {
+		if _, err = time.Parse(time.DateOnly, date); err != nil {
+			return nil, &patch.Error{Field: "publicationDate", Message: "must be a date like 2006-01-02"}
+		}
+		set["publication_date"] = date
+	}
+
+	author, ok, err := p.Object("author", "id")
+	if err != nil {
+		return nil, err
+	} else if ok {
+		authorId, ok, err := author.UUID("id")
+		if err != nil {
+			return nil, patch.Nested("author", err)
+		} else if ok {
+			set["author_id"] = authorId
+		}
+	}
+
+	return set, nil
+}
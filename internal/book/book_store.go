@@ -1,49 +1,128 @@
 package book
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/cover"
 	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+// foreignKeyViolation is the postgres error code raised when a book would
+// reference an author which doesn't exist.
+const foreignKeyViolation = "23503"
+
+var errAuthorNotFound = errors.New("author wasn't found")
+
+// sorts are the orders of book listings by the value of the sort param. A
+// leading - sorts descending. Books without reviews have no rating and come
+// last by rating either way; by review count, they count 0.
+var sorts = map[string]string{
+	"rating":        "(select avg(r.rating) from reviews r where r.book_id=b.id and not r.hidden) asc nulls last",
+	"-rating":       "(select avg(r.rating) from reviews r where r.book_id=b.id and not r.hidden) desc nulls last",
+	"review_count":  "(select count(*) from reviews r where r.book_id=b.id and not r.hidden) asc",
+	"-review_count": "(select count(*) from reviews r where r.book_id=b.id and not r.hidden) desc",
+}
+
 type BookStore struct {
-	db *sql.DB
+	db    utils.DBTX
+	cache *cache.Namespace
+}
+
+// NewBookStore caches reads in the catalog namespace, which writes of books
+// and authors invalidate.
+func NewBookStore(db *sql.DB, catalog *cache.Namespace) *BookStore {
+	return &BookStore{db, catalog}
 }
 
-func NewBookStore(db *sql.DB) *BookStore {
-	return &BookStore{db}
+// WithTx returns a store running its queries in tx. It bypasses the cache;
+// the caller invalidates it once tx is committed.
+func (store *BookStore) WithTx(tx utils.DBTX) *BookStore {
+	return &BookStore{db: tx}
+}
+
+// GetBook returns the book, from the cache when possible.
+func (store *BookStore) GetBook(ctx context.Context, id uuid.UUID) (b entity.Book, err error) {
+	err = store.cache.Fetch(ctx, "book:"+id.String(), &b, func() (err error) {
+		b, err = store.loadBook(ctx, id)
+		return err
+	})
+	return b, err
+}
+
+// GetBooks returns the books matching the params, from the cache when
+// possible.
+func (store *BookStore) GetBooks(ctx context.Context, m map[string]string) (books []entity.Book, err error) {
+	err = store.cache.Fetch(ctx, "books?"+cache.Key(m), &books, func() (err error) {
+		books, err = store.loadBooks(ctx, m)
+		return err
+	})
+	return books, err
 }
 
-func (store *BookStore) GetBook(id uuid.UUID) (b entity.Book, e error) {
+// loadBook reads the book from the db, bypassing the cache, e.g. to check
+// preconditions of a write.
+func (store *BookStore) loadBook(ctx context.Context, id uuid.UUID) (b entity.Book, e error) {
+	defer metrics.ObserveQuery("BookStore.GetBook", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.GetBook")
+	defer span.End()
 
-	statement, err := store.db.Prepare(`
-		select b.id, b.name, b.genre, b.created_at, b.publication_date, a.id, a.name, a.created_at
+	statement, err := store.db.PrepareContext(ctx, `
+		select b.id, b.name, b.genre, b.created_at, b.publication_date, b.version, b.cover_id, a.id, a.name, a.created_at
 		from books b 
 		inner join authors a on b.author_id=a.id where b.id=$1
 	`)
 
 	if err != nil {
-		log.Println("BookStore.GetBook() - received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.GetBook() - received error from db", "err", err)
 		return b, err
 	}
 
-	if scanErr := statement.QueryRow(id.String()).Scan(&b.Id, &b.Name, &b.Genre, &b.CreatedAt, &b.PublicationDate, &b.Author.Id, &b.Author.Name, &b.Author.CreatedAt); scanErr != nil {
-		log.Println("BookStore.GetBook() - received error from db", scanErr)
+	if scanErr := statement.QueryRowContext(ctx, id.String()).Scan(&b.Id, &b.Name, &b.Genre, &b.CreatedAt, &b.PublicationDate, &b.Version, &b.CoverId, &b.Author.Id, &b.Author.Name, &b.Author.CreatedAt); scanErr != nil {
+		slog.ErrorContext(ctx, "BookStore.GetBook() - received error from db", "err", scanErr)
 		return b, scanErr
 	}
 
-	log.Println("BookStore.GetBook() - received from db", b)
+	books := []entity.Book{b}
+	if err = store.embed(ctx, books); err != nil {
+		return b, err
+	}
+	b = books[0]
+
+	slog.DebugContext(ctx, "BookStore.GetBook() - received from db", "book", b)
 	return b, nil
 }
 
-func (store *BookStore) GetBooks(m map[string]string) ([]entity.Book, error) {
-	query := `select b.id, b.name, b.genre, b.publication_date, b.created_at, b.author_id, a.name, a.created_at from books b 
+func (store *BookStore) loadBooks(ctx context.Context, m map[string]string) ([]entity.Book, error) {
+	defer metrics.ObserveQuery("BookStore.GetBooks", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.GetBooks")
+	defer span.End()
+
+	query := `select b.id, b.name, b.genre, b.publication_date, b.created_at, b.cover_id, b.author_id, a.name, a.created_at from books b 
 		left join authors a on b.author_id = a.id`
+
+	sort, sorted := m["sort"]
+	if sorted {
+		filters := make(map[string]string, len(m)-1)
+		for k, v := range m {
+			if k != "sort" {
+				filters[k] = v
+			}
+		}
+		m = filters
+	}
 	params := make([]any, len(m))
 
 	if len(m) != 0 {
@@ -54,7 +133,9 @@ func (store *BookStore) GetBooks(m map[string]string) ([]entity.Book, error) {
 			case k == "publication_date":
 				query += "b." + k + "=$" + fmt.Sprint(i) + " and "
 			case k == "author_name":
-				query += "a.name" + " like '%' || $" + fmt.Sprint(i) + " || '%' and "
+				// Pen names and transliterations find the author's books as well.
+				param := "'%' || $" + fmt.Sprint(i) + " || '%'"
+				query += "(a.name like " + param + " or exists (select 1 from author_aliases al where al.author_id=a.id and al.name like " + param + ")) and "
 			case k == "book_name":
 				query += "b.name" + " like '%' || $" + fmt.Sprint(i) + " || '%' and "
 			default:
@@ -68,25 +149,29 @@ func (store *BookStore) GetBooks(m map[string]string) ([]entity.Book, error) {
 		query = strings.Join(queryArr[:len(queryArr)-1], " ")
 	}
 
-	log.Println("BookStore.GetBooks() - executing query", query, params)
+	if sorted {
+		query += " order by " + sorts[sort] + ", b.name"
+	}
+
+	slog.DebugContext(ctx, "BookStore.GetBooks() - executing query", "query", query, "params", params)
 
-	statement, err := store.db.Prepare(query)
+	statement, err := store.db.PrepareContext(ctx, query)
 
 	if err != nil {
-		log.Println("BookStore.GetBooks() - received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.GetBooks() - received error from db", "err", err)
 		return nil, err
 	}
 
 	var queryRows *sql.Rows
 	var queryError error
 	if len(params) == 0 {
-		queryRows, queryError = statement.Query()
+		queryRows, queryError = statement.QueryContext(ctx)
 	} else {
-		queryRows, queryError = statement.Query(params...)
+		queryRows, queryError = statement.QueryContext(ctx, params...)
 	}
 
 	if queryError != nil {
-		log.Println("BookStore.GetBooks() - received error from db", queryError)
+		slog.ErrorContext(ctx, "BookStore.GetBooks() - received error from db", "err", queryError)
 		return nil, queryError
 	}
 
@@ -94,95 +179,295 @@ func (store *BookStore) GetBooks(m map[string]string) ([]entity.Book, error) {
 	defer queryRows.Close()
 	for queryRows.Next() {
 		var book entity.Book
-		if scanErr := queryRows.Scan(&book.Id, &book.Name, &book.Genre, &book.PublicationDate, &book.CreatedAt, &book.Author.Id, &book.Author.Name, &book.Author.CreatedAt); scanErr != nil {
-			log.Println("BookStore.GetBooks() - received error while scanning", err)
+		if scanErr := queryRows.Scan(&book.Id, &book.Name, &book.Genre, &book.PublicationDate, &book.CreatedAt, &book.CoverId, &book.Author.Id, &book.Author.Name, &book.Author.CreatedAt); scanErr != nil {
+			slog.ErrorContext(ctx, "BookStore.GetBooks() - received error while scanning", "err", scanErr)
 		}
 
 		books = append(books, book)
 	}
 
 	if err := queryRows.Err(); err != nil {
-		log.Println("BookStore.GetBooks() - received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.GetBooks() - received error from db", "err", err)
+		return nil, err
+	}
+
+	if err := store.embed(ctx, books); err != nil {
 		return nil, err
 	}
 
 	return books, nil
 }
 
-func (store *BookStore) Remove(id uuid.UUID) error {
+// embed fills in the cover links of the books, the series each of them
+// belongs to, with the book's position and the size of the series, and
+// their ratings.
+func (store *BookStore) embed(ctx context.Context, books []entity.Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(books))
+	index := make(map[uuid.UUID][]int, len(books))
+	for i, b := range books {
+		ids[i] = b.Id.String()
+		index[b.Id] = append(index[b.Id], i)
+		if b.CoverId != nil {
+			books[i].Cover = cover.URLs(*b.CoverId)
+		}
+	}
+
+	rows, err := store.db.QueryContext(ctx, `
+		select sb.book_id, s.id, s.name, sb.position,
+			(select count(*) from series_books c where c.series_id=s.id)
+		from series_books sb
+		inner join series s on s.id=sb.series_id
+		where sb.book_id = any($1::uuid[])
+		order by s.name, s.id
+	`, pq.Array(ids))
+	if err != nil {
+		slog.ErrorContext(ctx, "BookStore.embed() - received error from db", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookId uuid.UUID
+		var series entity.BookSeries
+		if err := rows.Scan(&bookId, &series.Id, &series.Name, &series.Position, &series.Count); err != nil {
+			slog.ErrorContext(ctx, "BookStore.embed() - received error while scanning", "err", err)
+			return err
+		}
+		for _, i := range index[bookId] {
+			books[i].Series = append(books[i].Series, series)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "BookStore.embed() - received error from db", "err", err)
+		return err
+	}
+
+	return store.embedRatings(ctx, ids, books, index)
+}
+
+// embedRatings fills in the average rating and number of the visible reviews
+// of the books.
+func (store *BookStore) embedRatings(ctx context.Context, ids []string, books []entity.Book, index map[uuid.UUID][]int) error {
+	rows, err := store.db.QueryContext(ctx, `
+		select book_id, avg(rating)::float8, count(*) from reviews
+		where book_id = any($1::uuid[]) and not hidden
+		group by book_id
+	`, pq.Array(ids))
+	if err != nil {
+		slog.ErrorContext(ctx, "BookStore.embed() - received error from db", "err", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookId uuid.UUID
+		var average float64
+		var count int
+		if err := rows.Scan(&bookId, &average, &count); err != nil {
+			slog.ErrorContext(ctx, "BookStore.embed() - received error while scanning", "err", err)
+			return err
+		}
+		for _, i := range index[bookId] {
+			books[i].AverageRating = &average
+			books[i].ReviewCount = count
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "BookStore.embed() - received error from db", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// Remove deletes the book if it's still at the given version.
+func (store *BookStore) Remove(ctx context.Context, id uuid.UUID, version int) error {
+	defer metrics.ObserveQuery("BookStore.Remove", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.Remove")
+	defer span.End()
 
-	statement, err := store.db.Prepare(`delete from books where id=$1`)
+	statement, err := store.db.PrepareContext(ctx, `delete from books where id=$1 and version=$2`)
 
 	if err != nil {
-		log.Println("BookStore.Remove() received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.Remove() received error from db", "err", err)
 		return err
 	}
 
-	if _, execErr := statement.Exec(id); execErr != nil {
-		log.Println("BookStore.Remove() received error from db", execErr)
+	result, execErr := statement.ExecContext(ctx, id, version)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "BookStore.Remove() received error from db", "err", execErr)
 		return execErr
 	}
 
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	store.cache.Invalidate(ctx)
 	return nil
 }
 
-func (store *BookStore) CreateBook(b entity.Book) (savedBook entity.Book, err error) {
+func (store *BookStore) CreateBook(ctx context.Context, b entity.Book) (savedBook entity.Book, err error) {
+	defer metrics.ObserveQuery("BookStore.CreateBook", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.CreateBook")
+	defer span.End()
 
-	statement, err := store.db.Prepare(`
+	statement, err := store.db.PrepareContext(ctx, `
 		with new_book as (	
 			insert into books(name, genre, publication_date, created_at, author_id)
 				select $1, $2, $3, $4, authors.id from authors where authors.id=$5 
 				returning *
 		)
-		select new_book.*, authors.name, authors.created_at from new_book inner join authors on new_book.author_id = authors.id
+		select new_book.id, new_book.name, new_book.genre, new_book.publication_date, new_book.created_at,
+			new_book.version, authors.id, authors.name, authors.created_at
+		from new_book inner join authors on new_book.author_id = authors.id
 	`)
 
 	if err != nil {
-		log.Println("BookStore.CreateBook() received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.CreateBook() received error from db", "err", err)
 		return b, err
 	}
 
-	row := statement.QueryRow(&b.Name, &b.Genre, &b.PublicationDate, time.Now().UTC(), &b.Author.Id)
+	row := statement.QueryRowContext(ctx, &b.Name, &b.Genre, &b.PublicationDate, time.Now().UTC(), &b.Author.Id)
 
 	scanError := row.Scan(&savedBook.Id, &savedBook.Name, &savedBook.Genre, &savedBook.PublicationDate,
-		&savedBook.CreatedAt, &savedBook.Author.Id, &savedBook.Author.Name, &savedBook.Author.CreatedAt)
+		&savedBook.CreatedAt, &savedBook.Version, &savedBook.Author.Id, &savedBook.Author.Name, &savedBook.Author.CreatedAt)
 
 	if scanError != nil {
-		log.Println("BookStore.CreateBook() received error from db", scanError)
+		slog.ErrorContext(ctx, "BookStore.CreateBook() received error from db", "err", scanError)
 		return b, scanError
 	}
 
 	savedBook.Author.Id = b.Author.Id
 
+	store.cache.Invalidate(ctx)
 	return savedBook, nil
 }
 
-func (store *BookStore) UpdateBook(b entity.Book) (updatedBook entity.Book, err error) {
+// UpdateBook replaces the book if it's still at the given version.
+func (store *BookStore) UpdateBook(ctx context.Context, b entity.Book, version int) (updatedBook entity.Book, err error) {
+	defer metrics.ObserveQuery("BookStore.UpdateBook", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.UpdateBook")
+	defer span.End()
 
-	statement, err := store.db.Prepare(`
+	statement, err := store.db.PrepareContext(ctx, `
 		with updated_book as (
-			update books set name=$1, genre=$2, publication_date=$3, author_id=$4 returning *
+			update books set name=$1, genre=$2, publication_date=$3, author_id=$4, version=version+1
+			where id=$5 and version=$6 returning *
 		)
-		select updated_book.*, authors.name, authors.created_at from updated_book
-		inner join authors on updated_book.author_id = authors.id
+		select updated_book.id, updated_book.name, updated_book.genre, updated_book.publication_date,
+			updated_book.created_at, updated_book.version, updated_book.cover_id, authors.id, authors.name, authors.created_at
+		from updated_book inner join authors on updated_book.author_id = authors.id
 	`)
 
 	if err != nil {
-		log.Println("BookStore.UpdateBook() received error from db", err)
+		slog.ErrorContext(ctx, "BookStore.UpdateBook() received error from db", "err", err)
 		return b, err
 	}
 
-	row := statement.QueryRow(&b.Name, &b.Genre, &b.PublicationDate, &b.Author.Id)
+	row := statement.QueryRowContext(ctx, &b.Name, &b.Genre, &b.PublicationDate, &b.Author.Id, &b.Id, version)
 
 	scanError := row.Scan(
 		&updatedBook.Id, &updatedBook.Name, &updatedBook.Genre,
-		&updatedBook.PublicationDate, &updatedBook.CreatedAt,
+		&updatedBook.PublicationDate, &updatedBook.CreatedAt, &updatedBook.Version, &updatedBook.CoverId,
 		&updatedBook.Author.Id, &updatedBook.Author.Name, &updatedBook.Author.CreatedAt)
 
+	if pqErr, ok := scanError.(*pq.Error); ok && pqErr.Code == foreignKeyViolation {
+		return b, errAuthorNotFound
+	}
+
 	if scanError != nil {
-		log.Println("BookStore.UpdateBook() received error from db", scanError)
+		slog.ErrorContext(ctx, "BookStore.UpdateBook() received error from db", "err", scanError)
 		return b, scanError
 	}
 
+	store.cache.Invalidate(ctx)
+
+	books := []entity.Book{updatedBook}
+	if err = store.embed(ctx, books); err != nil {
+		return b, err
+	}
+	return books[0], nil
+}
+
+// PatchBook updates only the given columns of the book if it's still at the
+// given version.
+func (store *BookStore) PatchBook(ctx context.Context, id uuid.UUID, version int, set map[string]any) (patchedBook entity.Book, err error) {
+	defer metrics.ObserveQuery("BookStore.PatchBook", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.PatchBook")
+	defer span.End()
+
+	update, args := patch.Update("books", id, version, set)
+	statement, err := store.db.PrepareContext(ctx, `
+		with patched_book as (`+update+`)
+		select patched_book.id, patched_book.name, patched_book.genre, patched_book.publication_date,
+			patched_book.created_at, patched_book.version, patched_book.cover_id, authors.id, authors.name, authors.created_at
+		from patched_book inner join authors on patched_book.author_id = authors.id
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "BookStore.PatchBook() received error from db", "err", err)
+		return patchedBook, err
+	}
+
+	row := statement.QueryRowContext(ctx, args...)
+
+	scanError := row.Scan(
+		&patchedBook.Id, &patchedBook.Name, &patchedBook.Genre,
+		&patchedBook.PublicationDate, &patchedBook.CreatedAt, &patchedBook.Version, &patchedBook.CoverId,
+		&patchedBook.Author.Id, &patchedBook.Author.Name, &patchedBook.Author.CreatedAt)
+
+	if pqErr, ok := scanError.(*pq.Error); ok && pqErr.Code == foreignKeyViolation {
+		return patchedBook, errAuthorNotFound
+	}
+
+	if scanError != nil {
+		slog.ErrorContext(ctx, "BookStore.PatchBook() received error from db", "err", scanError)
+		return patchedBook, scanError
+	}
+
+	store.cache.Invalidate(ctx)
+
+	books := []entity.Book{patchedBook}
+	if err = store.embed(ctx, books); err != nil {
+		return patchedBook, err
+	}
+	return books[0], nil
+}
+
+// SetCover points the book at the cover with the given id, or at none if id
+// is nil, if the book is still at the given version.
+func (store *BookStore) SetCover(ctx context.Context, id uuid.UUID, version int, coverId *uuid.UUID) (updatedBook entity.Book, err error) {
+	defer metrics.ObserveQuery("BookStore.SetCover", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "BookStore.SetCover")
+	defer span.End()
+
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var updated uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			update books set cover_id=$1, version=version+1 where id=$2 and version=$3 returning id
+		`, coverId, id, version).Scan(&updated); err != nil {
+			return err
+		}
+
+		var err error
+		updatedBook, err = store.WithTx(tx).loadBook(ctx, id)
+		return err
+	})
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "BookStore.SetCover() - received error from db", "err", err)
+		}
+		return updatedBook, err
+	}
+
+	store.cache.Invalidate(ctx)
 	return updatedBook, nil
 }
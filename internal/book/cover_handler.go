@@ -0,0 +1,169 @@
+package book
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/cover"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/lending"
+	"example/library-service/internal/utils"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// putCover replaces the cover of a book with the uploaded image, which is
+// sent as the raw body. Its format is sniffed from the content.
+func (BookHandler *BookHandler) putCover(w http.ResponseWriter, r *http.Request) {
+	id, ok := BookHandler.authorizeCover(w, r, "BookHandler.putCover()")
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cover.MaxSize))
+	if err != nil {
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			errors.HandleError(http.StatusRequestEntityTooLarge, fmt.Sprintf("cover must not be larger than %d bytes", cover.MaxSize), w)
+			return
+		}
+		slog.WarnContext(r.Context(), "BookHandler.putCover() - cannot read body", "err", err)
+		errors.HandleError(400, "cannot read request body", w)
+		return
+	}
+
+	contentType, err := cover.Sniff(data)
+	if err != nil {
+		slog.WarnContext(r.Context(), "BookHandler.putCover() - received unsupported image", "type", http.DetectContentType(data))
+		errors.HandleError(http.StatusUnsupportedMediaType, err.Error(), w)
+		return
+	}
+
+	current, ok := BookHandler.currentBook(w, r, id)
+	if !ok {
+		return
+	}
+
+	coverId, err := cover.Save(r.Context(), BookHandler.blobs, data, contentType)
+	if err != nil {
+		switch err {
+		case cover.ErrUnsupportedType:
+			errors.HandleError(http.StatusUnsupportedMediaType, err.Error(), w)
+		case cover.ErrTooLarge:
+			errors.HandleError(http.StatusRequestEntityTooLarge, err.Error(), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	updatedBook, ok := BookHandler.setCover(w, r, current, &coverId)
+	if !ok {
+		cover.Delete(r.Context(), BookHandler.blobs, coverId)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "BookHandler.putCover() - successfully finished req", "id", id, "cover", coverId, "type", contentType)
+	writeBook(w, r, "BookHandler.putCover()", updatedBook)
+}
+
+func (BookHandler *BookHandler) deleteCover(w http.ResponseWriter, r *http.Request) {
+	id, ok := BookHandler.authorizeCover(w, r, "BookHandler.deleteCover()")
+	if !ok {
+		return
+	}
+
+	current, ok := BookHandler.currentBook(w, r, id)
+	if !ok {
+		return
+	}
+
+	if current.CoverId == nil {
+		errors.HandleError(404, fmt.Sprintf("book with id %v has no cover", id), w)
+		return
+	}
+
+	updatedBook, ok := BookHandler.setCover(w, r, current, nil)
+	if !ok {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "BookHandler.deleteCover() - successfully finished req", "id", id)
+	writeBook(w, r, "BookHandler.deleteCover()", updatedBook)
+}
+
+func (BookHandler *BookHandler) authorizeCover(w http.ResponseWriter, r *http.Request, method string) (id uuid.UUID, ok bool) {
+	invoker, err := auth.Authenticate(r, BookHandler.authStore, auth.ScopeCatalogWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), method+" - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return id, false
+	}
+
+	if invoker.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), method+" - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return id, false
+	}
+
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), method+" - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return id, false
+	}
+
+	return id, true
+}
+
+// setCover points the book at the new cover and deletes the images of the
+// previous one, which nothing references anymore.
+func (BookHandler *BookHandler) setCover(w http.ResponseWriter, r *http.Request, current entity.Book, coverId *uuid.UUID) (entity.Book, bool) {
+	updatedBook, err := BookHandler.bookStore.SetCover(r.Context(), current.Id, current.Version, coverId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return updatedBook, false
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return updatedBook, false
+	}
+
+	if current.CoverId != nil {
+		cover.Delete(r.Context(), BookHandler.blobs, *current.CoverId)
+	}
+	return updatedBook, true
+}
+
+// deleteFiles removes the cover and ebook files of a deleted book from the
+// blob store.
+func (BookHandler *BookHandler) deleteFiles(ctx context.Context, book entity.Book) {
+	if book.CoverId != nil {
+		cover.Delete(ctx, BookHandler.blobs, *book.CoverId)
+	}
+	for format := range lending.Formats {
+		if err := BookHandler.blobs.Delete(ctx, lending.Key(book.Id, format)); err != nil {
+			slog.WarnContext(ctx, "BookHandler.deleteFiles() - cannot delete ebook file", "err", err, "id", book.Id, "format", format)
+		}
+	}
+}
+
+// writeBook answers a write with the book and its ETag.
+func writeBook(w http.ResponseWriter, r *http.Request, method string, book entity.Book) {
+	jsonBytes, err := json.Marshal(book)
+	if err != nil {
+		slog.ErrorContext(r.Context(), method+" - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag.Of(book.Id, book.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
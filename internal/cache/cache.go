@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"example/library-service/internal/metrics"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cache stores encoded values for a limited time. LRU keeps them in process;
+// a Redis-compatible backend can be swapped in by implementing the same
+// three operations, e.g. with GET, SET PX and DEL.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	// Set stores the value; a ttl of 0 keeps it until it's evicted.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	Delete(ctx context.Context, keys ...string)
+}
+
+// Namespace is a group of cached values which are invalidated together, e.g.
+// the catalog, where a renamed author changes every book listing them. Keys
+// are prefixed with a generation kept in the cache itself, so invalidating
+// is a single write which every instance sharing the cache observes.
+//
+// A nil *Namespace caches nothing.
+type Namespace struct {
+	cache  Cache
+	name   string
+	ttl    time.Duration
+	maxAge time.Duration
+}
+
+// NewNamespace caches values for ttl; responses built from them may be
+// cached by clients for maxAge.
+func NewNamespace(cache Cache, name string, ttl time.Duration, maxAge time.Duration) *Namespace {
+	return &Namespace{cache: cache, name: name, ttl: ttl, maxAge: maxAge}
+}
+
+// Fetch decodes the value cached under key into v. On a miss it calls load,
+// which fills v, and caches the result unless load fails. The generation is
+// resolved once, so a value loaded while a write invalidates the namespace
+// is stored under the old generation and never served.
+func (n *Namespace) Fetch(ctx context.Context, key string, v any, load func() error) error {
+	if n == nil {
+		return load()
+	}
+
+	key = n.key(ctx, key)
+	if data, ok := n.cache.Get(ctx, key); ok {
+		// Values are gob encoded, so fields hidden from JSON, e.g. versions,
+		// are kept.
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+		if err == nil {
+			metrics.CacheLookups.WithLabelValues(n.name, "hit").Inc()
+			return nil
+		}
+		slog.WarnContext(ctx, "Namespace.Fetch() - cannot decode cached value", "cache", n.name, "key", key, "err", err)
+	}
+	metrics.CacheLookups.WithLabelValues(n.name, "miss").Inc()
+
+	if err := load(); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(v); err != nil {
+		slog.WarnContext(ctx, "Namespace.Fetch() - cannot encode value", "cache", n.name, "key", key, "err", err)
+		return nil
+	}
+
+	n.cache.Set(ctx, key, data.Bytes(), n.ttl)
+	return nil
+}
+
+// Invalidate drops every value of the namespace. It's called after writes,
+// which are rare compared to reads.
+func (n *Namespace) Invalidate(ctx context.Context) {
+	if n == nil {
+		return
+	}
+
+	n.cache.Set(ctx, n.generationKey(), []byte(uuid.NewString()), 0)
+}
+
+// SetHeaders marks a response built from the namespace as cacheable by the
+// client. Responses depend on the caller's credentials, so shared caches
+// mustn't store them.
+func (n *Namespace) SetHeaders(w http.ResponseWriter) {
+	if n == nil {
+		w.Header().Set("Cache-Control", "private, no-cache")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(n.maxAge.Seconds())))
+}
+
+func (n *Namespace) key(ctx context.Context, key string) string {
+	generation, ok := n.cache.Get(ctx, n.generationKey())
+	if !ok {
+		// Lost or never set; starting a new generation also makes sure no
+		// value of an unknown age is used.
+		generation = []byte(uuid.NewString())
+		n.cache.Set(ctx, n.generationKey(), generation, 0)
+	}
+
+	return fmt.Sprintf("%s:%s:%s", n.name, generation, key)
+}
+
+func (n *Namespace) generationKey() string {
+	return n.name + ":generation"
+}
+
+// Key encodes query params in a stable order, for use in cache keys.
+func Key(params map[string]string) string {
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type cachedBook struct {
+	Name    string
+	Version int `json:"-"`
+}
+
+func TestNamespaceFetch(t *testing.T) {
+	ctx := context.Background()
+	errLoad := errors.New("load failed")
+
+	tests := []struct {
+		name  string
+		run   func(n *Namespace, fetch func(err error) error)
+		loads int
+	}{
+		{
+			name:  "hit after a miss",
+			run:   func(n *Namespace, fetch func(err error) error) { fetch(nil); fetch(nil) },
+			loads: 1,
+		},
+		{
+			name: "invalidation drops values",
+			run: func(n *Namespace, fetch func(err error) error) {
+				fetch(nil)
+				n.Invalidate(ctx)
+				fetch(nil)
+			},
+			loads: 2,
+		},
+		{
+			name:  "failed loads aren't cached",
+			run:   func(n *Namespace, fetch func(err error) error) { fetch(errLoad); fetch(nil) },
+			loads: 2,
+		},
+		{
+			name: "a lost generation starts a new one",
+			run: func(n *Namespace, fetch func(err error) error) {
+				fetch(nil)
+				n.cache.Delete(ctx, n.generationKey())
+				fetch(nil)
+			},
+			loads: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNamespace(NewLRU(10), "catalog", time.Hour, time.Minute)
+			loads := 0
+			fetch := func(err error) error {
+				var book cachedBook
+				return n.Fetch(ctx, "book", &book, func() error {
+					loads++
+					book = cachedBook{Name: "Dune", Version: 3}
+					return err
+				})
+			}
+
+			tt.run(n, fetch)
+
+			if loads != tt.loads {
+				t.Errorf("loaded %d times, want %d", loads, tt.loads)
+			}
+		})
+	}
+}
+
+func TestNamespaceFetchKeepsHiddenFields(t *testing.T) {
+	ctx := context.Background()
+	n := NewNamespace(NewLRU(10), "catalog", time.Hour, time.Minute)
+
+	load := func(book *cachedBook) func() error {
+		return func() error {
+			*book = cachedBook{Name: "Dune", Version: 3}
+			return nil
+		}
+	}
+
+	var first, second cachedBook
+	if err := n.Fetch(ctx, "book", &first, load(&first)); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Fetch(ctx, "book", &second, func() error {
+		t.Error("value wasn't served from the cache")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if second != first {
+		t.Errorf("cached value = %+v, want %+v", second, first)
+	}
+}
+
+func TestNilNamespace(t *testing.T) {
+	var n *Namespace
+	loads := 0
+	for i := 0; i < 2; i++ {
+		var book cachedBook
+		n.Fetch(context.Background(), "book", &book, func() error { loads++; return nil })
+	}
+	n.Invalidate(context.Background())
+
+	if loads != 2 {
+		t.Errorf("loaded %d times, want 2", loads)
+	}
+
+	w := httptest.NewRecorder()
+	n.SetHeaders(w)
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewNamespace(NewLRU(1), "catalog", time.Hour, 90*time.Second).SetHeaders(w)
+
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=90" {
+		t.Errorf("Cache-Control = %q, want %q", got, "private, max-age=90")
+	}
+}
+
+func TestKey(t *testing.T) {
+	a := Key(map[string]string{"page": "2", "genre": "sf", "q": "a b"})
+	b := Key(map[string]string{"q": "a b", "genre": "sf", "page": "2"})
+
+	if a != b || a != "genre=sf&page=2&q=a+b" {
+		t.Errorf("Key() = %q and %q, want both %q", a, b, "genre=sf&page=2&q=a+b")
+	}
+}
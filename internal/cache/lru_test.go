@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		run     func(c *LRU)
+		present []string
+		missing []string
+	}{
+		{
+			name: "evicts the least recently set",
+			run: func(c *LRU) {
+				c.Set(ctx, "a", []byte("1"), 0)
+				c.Set(ctx, "b", []byte("2"), 0)
+				c.Set(ctx, "c", []byte("3"), 0)
+			},
+			present: []string{"b", "c"},
+			missing: []string{"a"},
+		},
+		{
+			name: "reads keep values",
+			run: func(c *LRU) {
+				c.Set(ctx, "a", []byte("1"), 0)
+				c.Set(ctx, "b", []byte("2"), 0)
+				c.Get(ctx, "a")
+				c.Set(ctx, "c", []byte("3"), 0)
+			},
+			present: []string{"a", "c"},
+			missing: []string{"b"},
+		},
+		{
+			name: "overwrites don't grow the cache",
+			run: func(c *LRU) {
+				c.Set(ctx, "a", []byte("1"), 0)
+				c.Set(ctx, "b", []byte("2"), 0)
+				c.Set(ctx, "b", []byte("3"), 0)
+			},
+			present: []string{"a", "b"},
+		},
+		{
+			name: "expired values are dropped",
+			run: func(c *LRU) {
+				c.Set(ctx, "a", []byte("1"), time.Nanosecond)
+				c.Set(ctx, "b", []byte("2"), time.Hour)
+				time.Sleep(time.Millisecond)
+			},
+			present: []string{"b"},
+			missing: []string{"a"},
+		},
+		{
+			name: "deletes",
+			run: func(c *LRU) {
+				c.Set(ctx, "a", []byte("1"), 0)
+				c.Set(ctx, "b", []byte("2"), 0)
+				c.Delete(ctx, "a", "unknown")
+			},
+			present: []string{"b"},
+			missing: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRU(2)
+			tt.run(c)
+
+			for _, key := range tt.present {
+				if _, ok := c.Get(ctx, key); !ok {
+					t.Errorf("%q is missing", key)
+				}
+			}
+			for _, key := range tt.missing {
+				if _, ok := c.Get(ctx, key); ok {
+					t.Errorf("%q is still cached", key)
+				}
+			}
+			if c.order.Len() != len(c.entries) {
+				t.Errorf("%d entries in the order but %d in the map", c.order.Len(), len(c.entries))
+			}
+		})
+	}
+}
+
+func TestLRUReturnsLatestValue(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(1)
+	c.Set(ctx, "a", []byte("1"), 0)
+	c.Set(ctx, "a", []byte("2"), 0)
+
+	if value, _ := c.Get(ctx, "a"); string(value) != "2" {
+		t.Errorf("Get() = %q, want %q", value, "2")
+	}
+}
@@ -0,0 +1,148 @@
+package cover
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/entity"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxSize bounds uploads in bytes.
+const MaxSize = 10 << 20
+
+// maxPixels bounds the dimensions of uploads, as a small file may decode to
+// a huge image: 4096x4096 takes 64 MiB as RGBA, plenty for a cover.
+const (
+	maxDimension = 4096
+	maxPixels    = maxDimension * maxDimension
+)
+
+const Original = "original"
+
+// Size is a thumbnail size. Thumbnails fit into Width x Width*3/2, the
+// proportions of a typical cover, and are never scaled up.
+type Size struct {
+	Name  string
+	Width int
+}
+
+var Sizes = []Size{{"small", 160}, {"medium", 320}, {"large", 640}}
+
+// ContentTypes are the accepted formats; uploads are sniffed, the
+// Content-Type sent by the client isn't trusted.
+var ContentTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+var (
+	ErrUnsupportedType = errors.New("cover must be a JPEG, PNG or WebP image")
+	ErrTooLarge        = fmt.Errorf("cover must not have more than %d pixels, e.g. %dx%d", maxPixels, maxDimension, maxDimension)
+)
+
+// Sniff returns the content type of an upload, or ErrUnsupportedType.
+func Sniff(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	for _, accepted := range ContentTypes {
+		if contentType == accepted {
+			return contentType, nil
+		}
+	}
+	return "", ErrUnsupportedType
+}
+
+// Save stores the upload and its thumbnails under a new id, which the book
+// references. Images are stored under new ids rather than replaced, so URLs
+// never change their content and may be cached forever.
+func Save(ctx context.Context, blobs blob.BlobStore, data []byte, contentType string) (uuid.UUID, error) {
+	// The header is checked first, so oversized images are never decoded.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return uuid.Nil, ErrUnsupportedType
+	}
+	if config.Width*config.Height > maxPixels {
+		return uuid.Nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return uuid.Nil, ErrUnsupportedType
+	}
+
+	id := uuid.New()
+	if err = save(ctx, blobs, id, img, data, contentType); err != nil {
+		Delete(ctx, blobs, id)
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
+
+func save(ctx context.Context, blobs blob.BlobStore, id uuid.UUID, img image.Image, data []byte, contentType string) error {
+	if err := blobs.Put(ctx, key(id, Original), contentType, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	for _, size := range Sizes {
+		var thumbnail bytes.Buffer
+		if err := jpeg.Encode(&thumbnail, resize(img, size.Width), &jpeg.Options{Quality: 85}); err != nil {
+			slog.ErrorContext(ctx, "cover.Save() - received error while encoding", "err", err, "size", size.Name)
+			return err
+		}
+		if err := blobs.Put(ctx, key(id, size.Name), "image/jpeg", &thumbnail); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the images of a cover, logging failures: a leftover image
+// wastes space but is no longer referenced.
+func Delete(ctx context.Context, blobs blob.BlobStore, id uuid.UUID) {
+	for _, name := range append([]string{Original}, sizeNames()...) {
+		if err := blobs.Delete(ctx, key(id, name)); err != nil {
+			slog.WarnContext(ctx, "cover.Delete() - cannot delete image", "err", err, "id", id, "size", name)
+		}
+	}
+}
+
+// URLs returns the links to the images of a cover.
+func URLs(id uuid.UUID) *entity.BookCover {
+	url := func(size string) string { return fmt.Sprintf("/covers/%v/%s", id, size) }
+	return &entity.BookCover{Original: url(Original), Small: url("small"), Medium: url("medium"), Large: url("large")}
+}
+
+// resize scales img to fit into width x width*3/2. Transparent areas become
+// white, as JPEG has no alpha channel.
+func resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	height := width * 3 / 2
+	scale := min(1, float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale))))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Over, nil)
+	return dst
+}
+
+func key(id uuid.UUID, size string) string {
+	return fmt.Sprintf("covers/%v/%s", id, size)
+}
+
+func sizeNames() []string {
+	var names []string
+	for _, size := range Sizes {
+		names = append(names, size.Name)
+	}
+	return names
+}
@@ -0,0 +1,61 @@
+package cover
+
+import (
+	"example/library-service/internal/blob"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CoverHandler serves the cover images. They're public, so browsers can
+// load them with plain img tags.
+type CoverHandler struct {
+	blobs blob.BlobStore
+}
+
+func NewCoverHandler(blobs blob.BlobStore) *CoverHandler {
+	return &CoverHandler{blobs}
+}
+
+func (coverHandler *CoverHandler) Routes(r chi.Router) {
+	r.Get("/covers/{id}/{size}", coverHandler.getCover)
+}
+
+func (CoverHandler *CoverHandler) getCover(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	size := utils.PathParam(r, "size")
+	if size != Original && !slices.Contains(sizeNames(), size) {
+		errors.HandleError(404, "size must be original, small, medium or large", w)
+		return
+	}
+
+	body, contentType, err := CoverHandler.blobs.Get(r.Context(), key(id, size))
+	if err != nil {
+		if err == blob.ErrNotFound {
+			errors.HandleError(404, "cover wasn't found", w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	// A cover id always refers to the same images, a new upload gets a new
+	// id.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, body); err != nil {
+		slog.WarnContext(r.Context(), "CoverHandler.getCover() - cannot send image", "err", err)
+	}
+}
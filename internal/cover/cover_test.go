@@ -0,0 +1,77 @@
+package cover
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"example/library-service/internal/blob"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// pngWithSize returns a PNG whose header claims the given dimensions. Only
+// the header is valid for large sizes, which is all the size check may read.
+func pngWithSize(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length, type, width,
+	// height and more fields, then the CRC of type and data.
+	binary.BigEndian.PutUint32(data[16:20], uint32(width))
+	binary.BigEndian.PutUint32(data[20:24], uint32(height))
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestSaveRejectsLargeImages(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		height int
+	}{
+		{"too wide", maxDimension + 1, maxDimension},
+		{"too high", maxDimension, maxDimension + 1},
+		{"decompression bomb", 100_000, 100_000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := pngWithSize(t, tt.width, tt.height)
+			if _, err := Save(context.Background(), nil, data, "image/png"); err != ErrTooLarge {
+				t.Errorf("Save() error = %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+}
+
+func TestSaveStoresThumbnails(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 600))); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := Save(context.Background(), blobs, buf.Bytes(), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range append([]string{Original}, sizeNames()...) {
+		body, _, err := blobs.Get(context.Background(), key(id, name))
+		if err != nil {
+			t.Errorf("%s image wasn't stored: %v", name, err)
+			continue
+		}
+		body.Close()
+	}
+}
@@ -6,11 +6,26 @@ import (
 	"github.com/google/uuid"
 )
 
+// Author is a person credited with books. Aliases are the other names they
+// are known by, e.g. pen names or transliterations; both the name and the
+// aliases match the author_name filter.
 type Author struct {
-	Id        uuid.UUID    `json:"id"`
-	Name      string       `json:"name"`
+	Id   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	// Dates are formatted like 2006-01-02.
+	BirthDate *string `json:"birthDate,omitempty"`
+	DeathDate *string `json:"deathDate,omitempty"`
+	// Nationality is an ISO 3166-1 alpha-2 country code.
+	Nationality *string `json:"nationality,omitempty"`
+	Biography   *string `json:"biography,omitempty"`
+	// External identifiers: VIAF, ISNI and Wikidata item ids.
+	VIAF      *string      `json:"viaf,omitempty"`
+	ISNI      *string      `json:"isni,omitempty"`
+	Wikidata  *string      `json:"wikidata,omitempty"`
+	Aliases   []string     `json:"aliases,omitempty"`
 	CreatedAt time.Time    `json:"createdAt"`
 	Books     []AuthorBook `json:"books"`
+	Version   int          `json:"-"`
 }
 
 type AuthorBook struct {
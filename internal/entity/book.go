@@ -7,10 +7,27 @@ import (
 )
 
 type Book struct {
-	Id              uuid.UUID `json:"id"`
-	Name            string    `json:"name"`
-	PublicationDate string    `json:"publicationDate"`
-	CreatedAt       time.Time `json:"createdAt"`
-	Genre           string    `json:"genre"`
-	Author          Author    `json:"author"`
+	Id              uuid.UUID    `json:"id"`
+	Name            string       `json:"name"`
+	PublicationDate string       `json:"publicationDate"`
+	CreatedAt       time.Time    `json:"createdAt"`
+	Genre           string       `json:"genre"`
+	Author          Author       `json:"author"`
+	Series          []BookSeries `json:"series,omitempty"`
+	Cover           *BookCover   `json:"cover,omitempty"`
+	// AverageRating and ReviewCount summarize the visible reviews; the
+	// average is null for books without reviews.
+	AverageRating *float64   `json:"averageRating"`
+	ReviewCount   int        `json:"reviewCount"`
+	CoverId       *uuid.UUID `json:"-"`
+	Version       int        `json:"-"`
+}
+
+// BookCover links to the cover image of a book as uploaded and to its
+// thumbnails, which are JPEGs.
+type BookCover struct {
+	Original string `json:"original"`
+	Small    string `json:"small"`
+	Medium   string `json:"medium"`
+	Large    string `json:"large"`
 }
@@ -0,0 +1,33 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EbookFile is a digital edition of a book, which users with an active loan
+// may download.
+type EbookFile struct {
+	Format      string    `json:"format"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Loan grants a user access to the ebook files of a book until EndsAt.
+// Returning a book early ends the loan.
+type Loan struct {
+	Id         uuid.UUID  `json:"id"`
+	Book       LoanBook   `json:"book"`
+	StartedAt  time.Time  `json:"startedAt"`
+	EndsAt     time.Time  `json:"endsAt"`
+	ReturnedAt *time.Time `json:"returnedAt,omitempty"`
+	Downloads  int        `json:"downloads"`
+	Active     bool       `json:"active"`
+}
+
+type LoanBook struct {
+	Id   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Review is a rating of a book from 1 to 5 stars, optionally with a text.
+// Every user reviews a book at most once.
+type Review struct {
+	Id     uuid.UUID `json:"id"`
+	BookId uuid.UUID `json:"bookId"`
+	Rating int       `json:"rating"`
+	Text   *string   `json:"text,omitempty"`
+	// Reviewer is missing for reviews of anonymized users.
+	Reviewer  *Reviewer `json:"reviewer,omitempty"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UserId    uuid.UUID `json:"-"`
+	Version   int       `json:"-"`
+}
+
+type Reviewer struct {
+	Id   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
@@ -0,0 +1,36 @@
+package entity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Series is an ordered group of books, e.g. the Cthulhu Mythos. Positions
+// may be fractional, so novellas set between two books, e.g. 2.5, fit in.
+type Series struct {
+	Id          uuid.UUID    `json:"id"`
+	Name        string       `json:"name"`
+	Description *string      `json:"description,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	Books       []SeriesBook `json:"books"`
+	Version     int          `json:"-"`
+}
+
+// SeriesBook is a book of a series with its position in the reading order.
+type SeriesBook struct {
+	Position        float64   `json:"position"`
+	Id              uuid.UUID `json:"id"`
+	Name            string    `json:"name"`
+	PublicationDate string    `json:"publicationDate"`
+	Genre           string    `json:"genre"`
+}
+
+// BookSeries is a series a book belongs to, as embedded in the book, e.g.
+// to show "Book 3 of 7".
+type BookSeries struct {
+	Id       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Position float64   `json:"position"`
+	Count    int       `json:"count"`
+}
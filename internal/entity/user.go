@@ -1,6 +1,10 @@
 package entity
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 const (
 	USER      = iota
@@ -9,11 +13,17 @@ const (
 )
 
 type User struct {
-	Id        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	Mail      string    `json:"mail"`
-	Role      int       `json:"role"`
-	Password  string    `json:"-"`
-	CreatedAt string    `json:"createdAt"`
-	Token     string    `json:"-"`
+	Id           uuid.UUID  `json:"id"`
+	Name         string     `json:"name"`
+	Mail         string     `json:"mail"`
+	MailVerified bool       `json:"mailVerified"`
+	Role         int        `json:"role"`
+	Password     string     `json:"-"`
+	CreatedAt    string     `json:"createdAt"`
+	Token        string     `json:"-"`
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"lockedUntil,omitempty"`
+	TOTPEnabled  bool       `json:"totpEnabled"`
+	Scopes       []string   `json:"-"`
+	Version      int        `json:"-"`
 }
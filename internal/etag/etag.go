@@ -0,0 +1,99 @@
+package etag
+
+import (
+	"example/library-service/internal/errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Of returns the strong entity tag of a resource at a version,
+// "<id>-<version>". The version is the one stores compare in their updates,
+// and every write bumps it.
+func Of(id uuid.UUID, version int) string {
+	return fmt.Sprintf(`"%s-%d"`, id, version)
+}
+
+// NotModified sets the ETag header and reports whether the tag matches
+// If-None-Match, i.e. the client's copy is current and a 304 should be sent
+// instead of the body.
+func NotModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	// If-None-Match uses the weak comparison.
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckIfMatch makes writes conditional on the client having seen the
+// current version of the resource. It answers 428 when If-Match is missing
+// and 412 when it names another version, and otherwise returns the version
+// for the store to compare in its update, which catches concurrent writes.
+func CheckIfMatch(w http.ResponseWriter, r *http.Request, id uuid.UUID, current int) (version int, ok bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		errors.HandleError(http.StatusPreconditionRequired, "If-Match header is required, send the ETag of the resource", w)
+		return 0, false
+	}
+
+	if version, ok = Matches(header, id, current); !ok {
+		Changed(w)
+	}
+	return version, ok
+}
+
+// Matches returns the version an If-Match value names for the resource with
+// the given id and current version, and reports whether it's the current
+// one. "*" names the current version. If-Match uses the strong comparison,
+// so weak tags never match.
+func Matches(ifMatch string, id uuid.UUID, current int) (version int, ok bool) {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return current, true
+		}
+
+		if v, ok := parse(candidate, id); ok && v == current {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// parse returns the version of a tag built by Of for the resource with id.
+func parse(tag string, id uuid.UUID) (int, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+
+	prefix := id.String() + "-"
+	value, found := strings.CutPrefix(tag[1:len(tag)-1], prefix)
+	if !found {
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// Changed answers a write which lost the race against a concurrent one,
+// i.e. the version checked by the store no longer matched.
+func Changed(w http.ResponseWriter) {
+	errors.HandleError(http.StatusPreconditionFailed, "resource has changed, fetch it again", w)
+}
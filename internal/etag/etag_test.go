@@ -0,0 +1,117 @@
+package etag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestOf(t *testing.T) {
+	id := uuid.MustParse("6f1c2b4e-0d6a-4c1e-9a57-2f7d3c8b9e10")
+
+	if tag := Of(id, 3); tag != `"6f1c2b4e-0d6a-4c1e-9a57-2f7d3c8b9e10-3"` {
+		t.Errorf("Of() = %s", tag)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	id := uuid.New()
+	other := uuid.New()
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		version int
+		ok      bool
+	}{
+		{"current version", Of(id, 2), 2, true},
+		{"any version", "*", 2, true},
+		{"weak form", "W/" + Of(id, 2), 0, false},
+		{"one of several tags", Of(other, 2) + ", " + Of(id, 2), 2, true},
+		{"stale version", Of(id, 1), 0, false},
+		{"newer version", Of(id, 3), 0, false},
+		{"other resource", Of(other, 2), 0, false},
+		{"unquoted tag", id.String() + "-2", 0, false},
+		{"invalid version", `"` + id.String() + `-x"`, 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, ok := Matches(tt.ifMatch, id, 2)
+			if version != tt.version || ok != tt.ok {
+				t.Errorf("Matches() = %d, %v, want %d, %v", version, ok, tt.version, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	id := uuid.New()
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{"no header", "", false},
+		{"current tag", Of(id, 1), true},
+		{"weak form", "W/" + Of(id, 1), true},
+		{"any tag", "*", true},
+		{"stale tag", Of(id, 0), false},
+		{"one of several tags", Of(uuid.New(), 1) + ", " + Of(id, 1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+
+			if got := NotModified(w, r, Of(id, 1)); got != tt.want {
+				t.Errorf("NotModified() = %v, want %v", got, tt.want)
+			}
+			if tag := w.Header().Get("ETag"); tag != Of(id, 1) {
+				t.Errorf("ETag = %s, want %s", tag, Of(id, 1))
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	id := uuid.New()
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		status  int
+		ok      bool
+	}{
+		{"missing", "", http.StatusPreconditionRequired, false},
+		{"stale", Of(id, 1), http.StatusPreconditionFailed, false},
+		{"weak", "W/" + Of(id, 2), http.StatusPreconditionFailed, false},
+		{"current", Of(id, 2), http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+
+			version, ok := CheckIfMatch(w, r, id, 2)
+			if ok != tt.ok || w.Code != tt.status {
+				t.Errorf("CheckIfMatch() = %v with status %d, want %v with %d", ok, w.Code, tt.ok, tt.status)
+			}
+			if ok && version != 2 {
+				t.Errorf("version = %d, want 2", version)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/utils"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const checkTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	db              *sql.DB
+	schemaVersion   int
+	shuttingDown    atomic.Bool
+	lastReadyStatus atomic.Bool
+}
+
+func NewHealthHandler(db *sql.DB, schemaVersion int) *HealthHandler {
+	return &HealthHandler{db: db, schemaVersion: schemaVersion}
+}
+
+// SetShuttingDown makes readiness fail, so the orchestrator stops routing
+// traffic to the instance while in-flight requests are drained.
+func (h *HealthHandler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func (h *HealthHandler) Routes(r chi.Router) {
+	r.Get(utils.HealthPath, h.healthz)
+	r.Get(utils.ReadyPath, h.readyz)
+	r.Get(utils.VersionPath, h.version)
+}
+
+func (h *HealthHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *HealthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if h.shuttingDown.Load() {
+		checks["shutdown"] = "draining"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	if err := h.db.PingContext(ctx); err != nil {
+		slog.WarnContext(r.Context(), "HealthHandler.readyz() - db ping failed", "err", err)
+		checks["database"] = "unreachable"
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	if err := h.checkSchemaVersion(ctx); err != nil {
+		slog.WarnContext(r.Context(), "HealthHandler.readyz() - schema check failed", "err", err)
+		checks["migrations"] = err.Error()
+		ready = false
+	} else {
+		checks["migrations"] = "ok"
+	}
+
+	if h.lastReadyStatus.Swap(ready) != ready {
+		slog.InfoContext(r.Context(), "HealthHandler.readyz() - readiness changed", "ready", ready)
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, checks)
+}
+
+func (h *HealthHandler) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, GetBuildInfo())
+}
+
+func (h *HealthHandler) checkSchemaVersion(ctx context.Context) error {
+	var version sql.NullInt64
+	if err := h.db.QueryRowContext(ctx, "select max(version) from schema_migrations").Scan(&version); err != nil {
+		return fmt.Errorf("cannot read schema version")
+	}
+
+	if !version.Valid || int(version.Int64) != h.schemaVersion {
+		return fmt.Errorf("schema version %v, expected %v", version.Int64, h.schemaVersion)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
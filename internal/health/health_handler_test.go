@@ -0,0 +1,138 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"example/library-service/internal/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// schemaDB is a database connector answering pings, unless it's down, and
+// the query of the schema version with version.
+type schemaDB struct {
+	down    bool
+	version int64
+}
+
+func (c *schemaDB) Connect(ctx context.Context) (driver.Conn, error) { return schemaConn{c}, nil }
+func (c *schemaDB) Driver() driver.Driver                            { return nil }
+
+type schemaConn struct{ c *schemaDB }
+
+func (conn schemaConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("statements aren't supported")
+}
+func (conn schemaConn) Close() error { return nil }
+func (conn schemaConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions aren't supported")
+}
+
+func (conn schemaConn) Ping(ctx context.Context) error {
+	if conn.c.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (conn schemaConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := conn.Ping(ctx); err != nil {
+		return nil, err
+	}
+	return &versionRows{version: conn.c.version}, nil
+}
+
+type versionRows struct {
+	version int64
+	read    bool
+}
+
+func (rows *versionRows) Columns() []string { return []string{"max"} }
+func (rows *versionRows) Close() error      { return nil }
+
+func (rows *versionRows) Next(dest []driver.Value) error {
+	if rows.read {
+		return io.EOF
+	}
+	rows.read = true
+	dest[0] = rows.version
+	return nil
+}
+
+func get[T any](t *testing.T, h *HealthHandler, path string) (status int, body T) {
+	t.Helper()
+	router := chi.NewRouter()
+	h.Routes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return w.Code, body
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name   string
+		db     schemaDB
+		status int
+		checks map[string]string
+	}{
+		{"ready", schemaDB{version: 3}, http.StatusOK, map[string]string{"database": "ok", "migrations": "ok"}},
+		{"database down", schemaDB{down: true, version: 3}, http.StatusServiceUnavailable, map[string]string{"database": "unreachable", "migrations": "cannot read schema version"}},
+		{"migrations behind", schemaDB{version: 2}, http.StatusServiceUnavailable, map[string]string{"database": "ok", "migrations": "schema version 2, expected 3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := sql.OpenDB(&tt.db)
+			defer db.Close()
+
+			status, checks := get[map[string]string](t, NewHealthHandler(db, 3), utils.ReadyPath)
+			if status != tt.status || !reflect.DeepEqual(checks, tt.checks) {
+				t.Errorf("readyz = %d %v, want %d %v", status, checks, tt.status, tt.checks)
+			}
+		})
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	db := sql.OpenDB(&schemaDB{version: 3})
+	defer db.Close()
+	h := NewHealthHandler(db, 3)
+
+	if status, _ := get[map[string]string](t, h, utils.ReadyPath); status != http.StatusOK {
+		t.Fatalf("readyz before shutdown = %d, want %d", status, http.StatusOK)
+	}
+
+	h.SetShuttingDown()
+
+	status, checks := get[map[string]string](t, h, utils.ReadyPath)
+	if status != http.StatusServiceUnavailable || checks["shutdown"] != "draining" {
+		t.Errorf("readyz while draining = %d %v, want %d with the shutdown check", status, checks, http.StatusServiceUnavailable)
+	}
+
+	// The instance is still alive while it drains.
+	if status, _ := get[map[string]string](t, h, utils.HealthPath); status != http.StatusOK {
+		t.Errorf("healthz while draining = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(commit, buildTime string) { Commit, BuildTime = commit, buildTime }(Commit, BuildTime)
+	Commit, BuildTime = "abc123", "2024-01-02T03:04:05Z"
+
+	status, info := get[BuildInfo](t, NewHealthHandler(nil, 0), utils.VersionPath)
+	if status != http.StatusOK || info.Commit != "abc123" || info.BuildTime != "2024-01-02T03:04:05Z" || info.GoVersion == "" {
+		t.Errorf("version = %d %+v", status, info)
+	}
+}
@@ -0,0 +1,127 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/tracing"
+	"log/slog"
+	"time"
+)
+
+// IdempotencyStore keeps idempotency keys with the request they were first
+// used for and, once it finished, its response, for ttl.
+type IdempotencyStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// Record is a stored key. Status is 0 while the first request is still in
+// progress. Role is the role of the caller when it claimed the key.
+type Record struct {
+	RequestHash string
+	Role        int
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+func NewIdempotencyStore(db *sql.DB, ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{db, ttl}
+}
+
+// Claim stores the key for a request unless the caller already used it; it
+// reports whether the request may be executed. Expired keys are dropped on
+// the way.
+func (store *IdempotencyStore) Claim(ctx context.Context, caller string, key string, requestHash string, role int) (bool, error) {
+	defer metrics.ObserveQuery("IdempotencyStore.Claim", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "IdempotencyStore.Claim")
+	defer span.End()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Claim() - received error from db", "err", err)
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err = tx.ExecContext(ctx, `delete from idempotency_keys where expires_at <= $1`, now); err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Claim() - received error from db", "err", err)
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		insert into idempotency_keys(caller, key, request_hash, role, created_at, expires_at) values($1, $2, $3, $4, $5, $6)
+			on conflict (caller, key) do nothing
+	`, caller, key, requestHash, role, now, now.Add(store.ttl))
+	if err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Claim() - received error from db", "err", err)
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Claim() - received error from db", "err", err)
+		return false, err
+	}
+
+	return count == 1, tx.Commit()
+}
+
+func (store *IdempotencyStore) Get(ctx context.Context, caller string, key string) (Record, error) {
+	defer metrics.ObserveQuery("IdempotencyStore.Get", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "IdempotencyStore.Get")
+	defer span.End()
+
+	var record Record
+	var status sql.NullInt32
+	var contentType sql.NullString
+	err := store.db.QueryRowContext(ctx, `
+		select request_hash, role, status, content_type, body from idempotency_keys
+			where caller=$1 and key=$2 and expires_at > $3
+	`, caller, key, time.Now()).Scan(&record.RequestHash, &record.Role, &status, &contentType, &record.Body)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "IdempotencyStore.Get() - received error from db", "err", err)
+		}
+		return Record{}, err
+	}
+
+	record.Status = int(status.Int32)
+	record.ContentType = contentType.String
+	return record, nil
+}
+
+// Complete stores the response of the request which claimed the key.
+func (store *IdempotencyStore) Complete(ctx context.Context, caller string, key string, status int, contentType string, body []byte) error {
+	defer metrics.ObserveQuery("IdempotencyStore.Complete", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "IdempotencyStore.Complete")
+	defer span.End()
+
+	if _, err := store.db.ExecContext(ctx, `
+		update idempotency_keys set status=$3, content_type=$4, body=$5 where caller=$1 and key=$2
+	`, caller, key, status, contentType, body); err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Complete() - received error from db", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// Release drops a key whose request failed in a way worth retrying, so the
+// retry is executed again.
+func (store *IdempotencyStore) Release(ctx context.Context, caller string, key string) error {
+	defer metrics.ObserveQuery("IdempotencyStore.Release", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "IdempotencyStore.Release")
+	defer span.End()
+
+	if _, err := store.db.ExecContext(ctx, `
+		delete from idempotency_keys where caller=$1 and key=$2 and status is null
+	`, caller, key); err != nil {
+		slog.ErrorContext(ctx, "IdempotencyStore.Release() - received error from db", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/utils"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Header carries the key a client picks for a request it may retry, e.g. a
+// random uuid.
+const Header = "Idempotency-Key"
+
+const MaxKeyLength = 255
+
+// Middleware makes POST requests carrying an Idempotency-Key safe to retry:
+// the first request with a key is executed and its response stored, retries
+// get the stored response replayed. Reusing a key for a different request
+// is answered with 422, a retry racing the first request with 409.
+//
+// Keys are scoped to the user authorize verifies, which has to be allowed to
+// run the route; requests it refuses are passed through for the handler to
+// refuse as well. A replay additionally requires the user to still have the
+// role the response was stored for.
+func Middleware(store *IdempotencyStore, authorize Authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > MaxKeyLength {
+			errors.HandleError(400, fmt.Sprintf("%s must not be longer than %d characters", Header, MaxKeyLength), w)
+			return
+		}
+
+		user, err := authorize(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		caller := "user:" + user.Id.String()
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.WarnContext(r.Context(), "idempotency.Middleware() - cannot read body", "err", err)
+			errors.HandleError(400, "cannot read request body", w)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := requestHash(r, body)
+		claimed, err := store.Claim(r.Context(), caller, key, hash, user.Role)
+		if err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+
+		if !claimed {
+			replay(w, r, store, user, caller, key, hash)
+			return
+		}
+
+		// The response is stored even if the client is gone: a timed out
+		// client is exactly the one which retries.
+		ctx := context.WithoutCancel(r.Context())
+		recorder := &responseRecorder{StatusRecorder: utils.NewStatusRecorder(w)}
+		completed := false
+		defer func() {
+			if !completed || !storable(recorder.Status) {
+				store.Release(ctx, caller, key)
+				return
+			}
+			store.Complete(ctx, caller, key, recorder.Status, w.Header().Get("Content-Type"), recorder.body.Bytes())
+		}()
+
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// Authorizer authenticates the caller of a request and checks it may run the
+// route, e.g. that its API key has the scope the route requires.
+type Authorizer func(r *http.Request) (entity.User, error)
+
+func replay(w http.ResponseWriter, r *http.Request, store *IdempotencyStore, user entity.User, caller string, key string, hash string) {
+	record, err := store.Get(r.Context(), caller, key)
+	if err == sql.ErrNoRows {
+		// Released by a failed first request in the meantime.
+		metrics.IdempotentRequests.WithLabelValues("in_progress").Inc()
+		errors.HandleError(409, "request with this Idempotency-Key failed, retry it", w)
+		return
+	}
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if record.RequestHash != hash {
+		slog.WarnContext(r.Context(), "idempotency.Middleware() - key reused for a different request", "key", key)
+		metrics.IdempotentRequests.WithLabelValues("mismatch").Inc()
+		errors.HandleError(422, "Idempotency-Key was already used for a different request", w)
+		return
+	}
+
+	if user.Role < record.Role {
+		slog.WarnContext(r.Context(), "idempotency.Middleware() - caller lost the role of the stored request", "key", key)
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	if record.Status == 0 {
+		metrics.IdempotentRequests.WithLabelValues("in_progress").Inc()
+		w.Header().Set("Retry-After", "1")
+		errors.HandleError(409, "request with this Idempotency-Key is still in progress", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "idempotency.Middleware() - replaying response", "key", key, "status", record.Status)
+	metrics.IdempotentRequests.WithLabelValues("replayed").Inc()
+
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// requestHash identifies a request by its target and body; retries have to
+// match it.
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", r.Method, r.URL.RequestURI())
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// storable reports whether a response is final. Server errors are worth a
+// retry, and a refused authorization says nothing about the request: the
+// handler may check permissions which authorize doesn't, e.g. the role.
+func storable(status int) bool {
+	return status < 500 && status != http.StatusUnauthorized && status != http.StatusForbidden
+}
+
+// responseRecorder keeps a copy of the body for the store.
+type responseRecorder struct {
+	*utils.StatusRecorder
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.StatusRecorder.Write(b)
+}
@@ -0,0 +1,101 @@
+package idempotency
+
+import (
+	"errors"
+	"example/library-service/internal/entity"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewarePassesThrough(t *testing.T) {
+	refuse := func(r *http.Request) (entity.User, error) { return entity.User{}, errors.New("invalid token") }
+
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		status int
+		served bool
+	}{
+		{"without a key", http.MethodPost, "", http.StatusCreated, true},
+		{"other methods", http.MethodPut, "retry-1", http.StatusCreated, true},
+		{"unauthorized callers reach the handler", http.MethodPost, "retry-1", http.StatusCreated, true},
+		{"too long key", http.MethodPost, strings.Repeat("k", MaxKeyLength+1), http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			served := false
+			// Without a store, any lookup would panic: none of these requests
+			// may touch stored responses.
+			handler := Middleware(nil, refuse, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+				w.WriteHeader(http.StatusCreated)
+			}))
+
+			r := httptest.NewRequest(tt.method, "/books", strings.NewReader(`{"name":"Dune"}`))
+			if tt.key != "" {
+				r.Header.Set(Header, tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status || served != tt.served {
+				t.Errorf("status = %d, served = %v, want %d, %v", w.Code, served, tt.status, tt.served)
+			}
+		})
+	}
+}
+
+func TestRequestHash(t *testing.T) {
+	hash := func(method string, target string, body string) string {
+		return requestHash(httptest.NewRequest(method, target, nil), []byte(body))
+	}
+	base := hash(http.MethodPost, "/books", `{"name":"Dune"}`)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		same   bool
+	}{
+		{"same request", http.MethodPost, "/books", `{"name":"Dune"}`, true},
+		{"other body", http.MethodPost, "/books", `{"name":"Emma"}`, false},
+		{"other path", http.MethodPost, "/authors", `{"name":"Dune"}`, false},
+		{"other query", http.MethodPost, "/books?dry_run=true", `{"name":"Dune"}`, false},
+		{"other method", http.MethodPut, "/books", `{"name":"Dune"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := hash(tt.method, tt.target, tt.body) == base; same != tt.same {
+				t.Errorf("hash matches = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusCreated, true},
+		{http.StatusBadRequest, true},
+		{http.StatusConflict, true},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		if got := storable(tt.status); got != tt.want {
+			t.Errorf("storable(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package lending
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// MaxEbookSize bounds uploads of ebook files in bytes.
+const MaxEbookSize = 200 << 20
+
+// Formats maps the accepted ebook formats to their content types.
+var Formats = map[string]string{
+	"epub": "application/epub+zip",
+	"pdf":  "application/pdf",
+}
+
+// sniffFormat returns the format of a file from its first bytes. An EPUB is
+// a zip archive whose first entry is an uncompressed file named mimetype
+// holding the content type.
+func sniffFormat(head []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return "pdf", true
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) && len(head) >= 58 &&
+		string(head[30:38]) == "mimetype" && string(head[38:58]) == Formats["epub"]:
+		return "epub", true
+	}
+	return "", false
+}
+
+// Key names the file of the format of a book in the blob store.
+func Key(bookId uuid.UUID, format string) string {
+	return fmt.Sprintf("ebooks/%v/%s", bookId, format)
+}
+
+// uploadKey names a file being uploaded, which is moved to Key once the
+// database knows about it, so a failed upload never replaces the file.
+func uploadKey(bookId uuid.UUID, format string) string {
+	return fmt.Sprintf("ebooks/%v/%s.upload-%v", bookId, format, uuid.New())
+}
@@ -0,0 +1,407 @@
+package lending
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/utils"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// DownloadLink is a signed URL to download an ebook file. It stops working
+// when it expires or when the loan ends, whichever comes first.
+type DownloadLink struct {
+	Url       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LendingHandler struct {
+	lendingStore *LendingStore
+	authStore    *auth.AuthStore
+	blobs        blob.BlobStore
+	keys         *auth.KeySet
+	// period is the length of a loan, linkTTL the lifetime of download
+	// links.
+	period  time.Duration
+	linkTTL time.Duration
+}
+
+func NewLendingHandler(db *sql.DB, authStore *auth.AuthStore, blobs blob.BlobStore, keys *auth.KeySet, period time.Duration, linkTTL time.Duration) *LendingHandler {
+	store := NewLendingStore(db)
+	return &LendingHandler{store, authStore, blobs, keys, period, linkTTL}
+}
+
+// Routes registers the lending routes. Downloads are authorized by the
+// signed link alone, so they work in browsers and e-readers.
+func (lendingHandler *LendingHandler) Routes(r chi.Router) {
+	r.Get("/books/{id}/ebooks", lendingHandler.getEbooks)
+	r.Put("/books/{id}/ebooks/{format}", lendingHandler.putEbook)
+	r.Delete("/books/{id}/ebooks/{format}", lendingHandler.deleteEbook)
+	r.Post("/books/{id}/loans", lendingHandler.borrow)
+	r.Get("/me/loans", lendingHandler.getLoans)
+	r.Post("/me/loans/{id}/return", lendingHandler.returnLoan)
+	r.Get("/me/loans/{id}/download", lendingHandler.getDownloadLink)
+	r.Get("/downloads/{token}", lendingHandler.download)
+}
+
+func (LendingHandler *LendingHandler) getEbooks(w http.ResponseWriter, r *http.Request) {
+	if _, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.getEbooks() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	bookId, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	files, err := LendingHandler.lendingStore.GetEbookFiles(r.Context(), bookId)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	writeJSON(w, r, "LendingHandler.getEbooks()", http.StatusOK, files)
+}
+
+// putEbook attaches the uploaded file, sent as the raw body, to the book.
+// Its content has to match the format of the path. The file replaces the
+// previous one only after the database is updated, so a failed upload
+// leaves both untouched.
+func (LendingHandler *LendingHandler) putEbook(w http.ResponseWriter, r *http.Request) {
+	bookId, format, ok := LendingHandler.authorizeEbook(w, r, "LendingHandler.putEbook()")
+	if !ok {
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, MaxEbookSize))
+	head, _ := body.Peek(512)
+	if sniffed, ok := sniffFormat(head); !ok || sniffed != format {
+		slog.WarnContext(r.Context(), "LendingHandler.putEbook() - received unsupported file", "format", format, "sniffed", sniffed)
+		errors.HandleError(http.StatusUnsupportedMediaType, fmt.Sprintf("file isn't a valid %s", format), w)
+		return
+	}
+
+	upload := uploadKey(bookId, format)
+	counter := &countingReader{r: body}
+	if err := LendingHandler.blobs.Put(r.Context(), upload, Formats[format], counter); err != nil {
+		var tooLarge *http.MaxBytesError
+		if stderrors.As(err, &tooLarge) {
+			errors.HandleError(http.StatusRequestEntityTooLarge, fmt.Sprintf("file must not be larger than %d bytes", MaxEbookSize), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	file, err := LendingHandler.lendingStore.SaveEbookFile(r.Context(), bookId,
+		entity.EbookFile{Format: format, ContentType: Formats[format], Size: counter.n})
+	if err != nil {
+		LendingHandler.blobs.Delete(r.Context(), upload)
+		if err == errBookNotFound {
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", bookId), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err := LendingHandler.blobs.Move(r.Context(), upload, Key(bookId, format)); err != nil {
+		// The row is saved already; until the upload is retried, downloads
+		// get the previous file, if there is one.
+		slog.ErrorContext(r.Context(), "LendingHandler.putEbook() - cannot move uploaded file", "err", err, "book", bookId, "format", format)
+		LendingHandler.blobs.Delete(r.Context(), upload)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "LendingHandler.putEbook() - successfully finished req", "book", bookId, "format", format, "size", file.Size)
+	writeJSON(w, r, "LendingHandler.putEbook()", http.StatusOK, file)
+}
+
+func (LendingHandler *LendingHandler) deleteEbook(w http.ResponseWriter, r *http.Request) {
+	bookId, format, ok := LendingHandler.authorizeEbook(w, r, "LendingHandler.deleteEbook()")
+	if !ok {
+		return
+	}
+
+	if err := LendingHandler.lendingStore.DeleteEbookFile(r.Context(), bookId, format); err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("book with id %v has no %s file", bookId, format), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err := LendingHandler.blobs.Delete(r.Context(), Key(bookId, format)); err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.deleteEbook() - cannot delete file", "err", err)
+	}
+
+	slog.InfoContext(r.Context(), "LendingHandler.deleteEbook() - successfully finished req", "book", bookId, "format", format)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (LendingHandler *LendingHandler) authorizeEbook(w http.ResponseWriter, r *http.Request, method string) (bookId uuid.UUID, format string, ok bool) {
+	user, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeCatalogWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), method+" - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return bookId, format, false
+	}
+
+	if user.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), method+" - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return bookId, format, false
+	}
+
+	if bookId, err = utils.PathUUID(r, "id"); err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return bookId, format, false
+	}
+
+	format = utils.PathParam(r, "format")
+	if _, ok := Formats[format]; !ok {
+		errors.HandleError(400, "format must be epub or pdf", w)
+		return bookId, format, false
+	}
+
+	return bookId, format, true
+}
+
+// borrow lends the book to the caller.
+func (LendingHandler *LendingHandler) borrow(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeLoansWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.borrow() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	bookId, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	loan, err := LendingHandler.lendingStore.Borrow(r.Context(), user.Id, bookId, LendingHandler.period)
+	if err != nil {
+		switch err {
+		case errBookNotFound:
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", bookId), w)
+		case errNoEbook:
+			errors.HandleError(409, "book has no ebook files to lend", w)
+		case errAlreadyLent:
+			errors.HandleError(409, "book is already lent to you", w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "LendingHandler.borrow() - successfully finished req", "loan", loan.Id, "book", bookId)
+	writeJSON(w, r, "LendingHandler.borrow()", http.StatusCreated, loan)
+}
+
+func (LendingHandler *LendingHandler) getLoans(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeLoansRead)
+	if err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.getLoans() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	loans, err := LendingHandler.lendingStore.GetLoans(r.Context(), user.Id)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	writeJSON(w, r, "LendingHandler.getLoans()", http.StatusOK, loans)
+}
+
+// returnLoan ends a loan of the caller early.
+func (LendingHandler *LendingHandler) returnLoan(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeLoansWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.returnLoan() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	loan, err := LendingHandler.lendingStore.ReturnLoan(r.Context(), user.Id, id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			errors.HandleError(404, fmt.Sprintf("loan with id %v wasn't found", id), w)
+		case errLoanEnded:
+			errors.HandleError(409, errLoanEnded.Error(), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "LendingHandler.returnLoan() - successfully finished req", "loan", id)
+	writeJSON(w, r, "LendingHandler.returnLoan()", http.StatusOK, loan)
+}
+
+// getDownloadLink signs a link to download a file of an active loan of the
+// caller. Links expire after linkTTL, and at the end of the loan at the
+// latest.
+func (LendingHandler *LendingHandler) getDownloadLink(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, LendingHandler.authStore, auth.ScopeLoansRead)
+	if err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.getDownloadLink() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	queryMap := utils.ToMap(r.URL.Query())
+	if !utils.ValidParams("loan_download", queryMap) {
+		errors.HandleError(400, "Invalid request params", w)
+		return
+	}
+	format := queryMap["format"]
+	if _, ok := Formats[format]; !ok {
+		errors.HandleError(400, "format must be epub or pdf", w)
+		return
+	}
+
+	loan, err := LendingHandler.lendingStore.GetLoan(r.Context(), user.Id, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("loan with id %v wasn't found", id), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if !loan.Active {
+		errors.HandleError(409, errLoanEnded.Error(), w)
+		return
+	}
+
+	expiresAt := time.Now().Add(LendingHandler.linkTTL).UTC().Truncate(time.Second)
+	if loan.EndsAt.Before(expiresAt) {
+		expiresAt = loan.EndsAt
+	}
+
+	token, err := signToken(LendingHandler.keys, downloadClaims{Loan: loan.Id, Format: format, Expires: expiresAt.Unix()})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "LendingHandler.getDownloadLink() - cannot sign link", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "LendingHandler.getDownloadLink() - successfully finished req", "loan", id, "format", format)
+
+	// The link grants access on its own.
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, "LendingHandler.getDownloadLink()", http.StatusOK, DownloadLink{Url: "/downloads/" + token, ExpiresAt: expiresAt})
+}
+
+// download serves a file to the holder of a valid link, as long as the loan
+// it was signed for is active.
+func (LendingHandler *LendingHandler) download(w http.ResponseWriter, r *http.Request) {
+	claims, err := parseToken(LendingHandler.keys, utils.PathParam(r, "token"), time.Now())
+	if err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.download() - received invalid link", "err", err)
+		if err == errTokenExpired {
+			errors.HandleError(http.StatusGone, err.Error(), w)
+			return
+		}
+		errors.HandleError(403, err.Error(), w)
+		return
+	}
+
+	file, bookId, bookName, err := LendingHandler.lendingStore.CountDownload(r.Context(), claims.Loan, claims.Format)
+	if err != nil {
+		switch err {
+		case errLoanNotActive:
+			errors.HandleError(http.StatusGone, errLoanEnded.Error(), w)
+		case errFileNotFound:
+			errors.HandleError(404, fmt.Sprintf("book has no %s file", claims.Format), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	body, _, err := LendingHandler.blobs.Get(r.Context(), Key(bookId, file.Format))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "LendingHandler.download() - cannot open file", "err", err, "book", bookId, "format", file.Format)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+	defer body.Close()
+
+	metrics.EbookDownloads.WithLabelValues(file.Format).Inc()
+	slog.InfoContext(r.Context(), "LendingHandler.download() - serving file", "loan", claims.Loan, "format", file.Format)
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": bookName + "." + file.Format}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, body); err != nil {
+		slog.WarnContext(r.Context(), "LendingHandler.download() - cannot send file", "err", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, method string, status int, value any) {
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		slog.ErrorContext(r.Context(), method+" - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// countingReader counts the bytes read through it, e.g. the size of an
+// upload streamed to the blob store.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
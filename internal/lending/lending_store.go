@@ -0,0 +1,297 @@
+package lending
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// foreignKeyViolation is the postgres error code raised when a file would be
+// attached to a book which doesn't exist.
+const foreignKeyViolation = "23503"
+
+var (
+	errBookNotFound  = errors.New("book wasn't found")
+	errNoEbook       = errors.New("book has no ebook files")
+	errAlreadyLent   = errors.New("book is already lent to the user")
+	errLoanEnded     = errors.New("loan has ended")
+	errFileNotFound  = errors.New("ebook file wasn't found")
+	errLoanNotActive = errors.New("loan isn't active")
+)
+
+type LendingStore struct {
+	db utils.DBTX
+}
+
+func NewLendingStore(db *sql.DB) *LendingStore {
+	return &LendingStore{db}
+}
+
+// GetEbookFiles returns the ebook files of the book.
+func (store *LendingStore) GetEbookFiles(ctx context.Context, bookId uuid.UUID) ([]entity.EbookFile, error) {
+	defer metrics.ObserveQuery("LendingStore.GetEbookFiles", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.GetEbookFiles")
+	defer span.End()
+
+	rows, err := store.db.QueryContext(ctx, `
+		select format, content_type, size, created_at from ebook_files where book_id=$1 order by format
+	`, bookId)
+	if err != nil {
+		slog.ErrorContext(ctx, "LendingStore.GetEbookFiles() - received error from db", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []entity.EbookFile{}
+	for rows.Next() {
+		var file entity.EbookFile
+		if err := rows.Scan(&file.Format, &file.ContentType, &file.Size, &file.CreatedAt); err != nil {
+			slog.ErrorContext(ctx, "LendingStore.GetEbookFiles() - received error while scanning", "err", err)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "LendingStore.GetEbookFiles() - received error from db", "err", err)
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// SaveEbookFile attaches the file to the book, replacing the file of the
+// same format.
+func (store *LendingStore) SaveEbookFile(ctx context.Context, bookId uuid.UUID, file entity.EbookFile) (savedFile entity.EbookFile, err error) {
+	defer metrics.ObserveQuery("LendingStore.SaveEbookFile", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.SaveEbookFile")
+	defer span.End()
+
+	err = store.db.QueryRowContext(ctx, `
+		insert into ebook_files(book_id, format, content_type, size, created_at) values($1, $2, $3, $4, $5)
+		on conflict (book_id, format) do update
+			set content_type=excluded.content_type, size=excluded.size, created_at=excluded.created_at
+		returning format, content_type, size, created_at
+	`, bookId, file.Format, file.ContentType, file.Size, time.Now().UTC()).Scan(
+		&savedFile.Format, &savedFile.ContentType, &savedFile.Size, &savedFile.CreatedAt)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == foreignKeyViolation {
+		return savedFile, errBookNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "LendingStore.SaveEbookFile() - received error from db", "err", err)
+		return savedFile, err
+	}
+
+	return savedFile, nil
+}
+
+// DeleteEbookFile detaches the file of the format from the book.
+func (store *LendingStore) DeleteEbookFile(ctx context.Context, bookId uuid.UUID, format string) error {
+	defer metrics.ObserveQuery("LendingStore.DeleteEbookFile", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.DeleteEbookFile")
+	defer span.End()
+
+	result, err := store.db.ExecContext(ctx, `delete from ebook_files where book_id=$1 and format=$2`, bookId, format)
+	if err != nil {
+		slog.ErrorContext(ctx, "LendingStore.DeleteEbookFile() - received error from db", "err", err)
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// selectLoan lists the columns read by scanLoan, of loans aliased as l
+// joined with their books as b.
+const selectLoan = `l.id, b.id, b.name, l.started_at, l.ends_at, l.returned_at, l.downloads`
+
+func scanLoan(row interface{ Scan(dest ...any) error }, loan *entity.Loan) error {
+	if err := row.Scan(&loan.Id, &loan.Book.Id, &loan.Book.Name, &loan.StartedAt, &loan.EndsAt, &loan.ReturnedAt, &loan.Downloads); err != nil {
+		return err
+	}
+	loan.Active = loan.EndsAt.After(time.Now())
+	return nil
+}
+
+// Borrow lends the book to the user for the given period. A user borrows a
+// book at most once at a time, and only books with ebook files.
+func (store *LendingStore) Borrow(ctx context.Context, userId uuid.UUID, bookId uuid.UUID, period time.Duration) (loan entity.Loan, err error) {
+	defer metrics.ObserveQuery("LendingStore.Borrow", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.Borrow")
+	defer span.End()
+
+	now := time.Now().UTC()
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		// Locking the book serializes concurrent loans of it, so the check
+		// for an active loan holds until the new one is inserted.
+		var files int
+		if err := tx.QueryRowContext(ctx, `
+			select (select count(*) from ebook_files f where f.book_id=b.id) from books b where b.id=$1 for update
+		`, bookId).Scan(&files); err != nil {
+			if err == sql.ErrNoRows {
+				return errBookNotFound
+			}
+			return err
+		}
+		if files == 0 {
+			return errNoEbook
+		}
+
+		var lent bool
+		if err := tx.QueryRowContext(ctx, `
+			select exists (select 1 from loans where user_id=$1 and book_id=$2 and ends_at > $3)
+		`, userId, bookId, now).Scan(&lent); err != nil {
+			return err
+		}
+		if lent {
+			return errAlreadyLent
+		}
+
+		var id uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			insert into loans(user_id, book_id, started_at, ends_at) values($1, $2, $3, $4) returning id
+		`, userId, bookId, now, now.Add(period)).Scan(&id); err != nil {
+			return err
+		}
+
+		return scanLoan(tx.QueryRowContext(ctx, `
+			select `+selectLoan+` from loans l inner join books b on b.id=l.book_id where l.id=$1
+		`, id), &loan)
+	})
+
+	if err != nil && err != errBookNotFound && err != errNoEbook && err != errAlreadyLent {
+		slog.ErrorContext(ctx, "LendingStore.Borrow() - received error from db", "err", err)
+	}
+	return loan, err
+}
+
+// GetLoans returns the loans of the user, the latest first.
+func (store *LendingStore) GetLoans(ctx context.Context, userId uuid.UUID) ([]entity.Loan, error) {
+	defer metrics.ObserveQuery("LendingStore.GetLoans", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.GetLoans")
+	defer span.End()
+
+	rows, err := store.db.QueryContext(ctx, `
+		select `+selectLoan+` from loans l inner join books b on b.id=l.book_id
+		where l.user_id=$1 order by l.started_at desc
+	`, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "LendingStore.GetLoans() - received error from db", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	loans := []entity.Loan{}
+	for rows.Next() {
+		var loan entity.Loan
+		if err := scanLoan(rows, &loan); err != nil {
+			slog.ErrorContext(ctx, "LendingStore.GetLoans() - received error while scanning", "err", err)
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "LendingStore.GetLoans() - received error from db", "err", err)
+		return nil, err
+	}
+
+	return loans, nil
+}
+
+// GetLoan returns the loan if it belongs to the user.
+func (store *LendingStore) GetLoan(ctx context.Context, userId uuid.UUID, id uuid.UUID) (loan entity.Loan, err error) {
+	defer metrics.ObserveQuery("LendingStore.GetLoan", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.GetLoan")
+	defer span.End()
+
+	err = scanLoan(store.db.QueryRowContext(ctx, `
+		select `+selectLoan+` from loans l inner join books b on b.id=l.book_id where l.id=$1 and l.user_id=$2
+	`, id, userId), &loan)
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, "LendingStore.GetLoan() - received error from db", "err", err)
+	}
+	return loan, err
+}
+
+// ReturnLoan ends the active loan of the user now, which revokes its
+// download links.
+func (store *LendingStore) ReturnLoan(ctx context.Context, userId uuid.UUID, id uuid.UUID) (loan entity.Loan, err error) {
+	defer metrics.ObserveQuery("LendingStore.ReturnLoan", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.ReturnLoan")
+	defer span.End()
+
+	now := time.Now().UTC()
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var endsAt time.Time
+		if err := tx.QueryRowContext(ctx, `
+			select ends_at from loans where id=$1 and user_id=$2 for update
+		`, id, userId).Scan(&endsAt); err != nil {
+			return err
+		}
+		if !endsAt.After(now) {
+			return errLoanEnded
+		}
+
+		if _, err := tx.ExecContext(ctx, `update loans set ends_at=$1, returned_at=$1 where id=$2`, now, id); err != nil {
+			return err
+		}
+
+		return scanLoan(tx.QueryRowContext(ctx, `
+			select `+selectLoan+` from loans l inner join books b on b.id=l.book_id where l.id=$1
+		`, id), &loan)
+	})
+
+	if err != nil && err != sql.ErrNoRows && err != errLoanEnded {
+		slog.ErrorContext(ctx, "LendingStore.ReturnLoan() - received error from db", "err", err)
+	}
+	return loan, err
+}
+
+// CountDownload records a download of the file of the format with the loan
+// and returns the file and the name of the book. It's the check guarding
+// every download: once the loan ended, it fails with errLoanNotActive.
+func (store *LendingStore) CountDownload(ctx context.Context, loanId uuid.UUID, format string) (file entity.EbookFile, bookId uuid.UUID, bookName string, err error) {
+	defer metrics.ObserveQuery("LendingStore.CountDownload", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "LendingStore.CountDownload")
+	defer span.End()
+
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		if err := tx.QueryRowContext(ctx, `
+			update loans set downloads=downloads+1 where id=$1 and ends_at > $2 returning book_id
+		`, loanId, time.Now().UTC()).Scan(&bookId); err != nil {
+			if err == sql.ErrNoRows {
+				return errLoanNotActive
+			}
+			return err
+		}
+
+		err := tx.QueryRowContext(ctx, `
+			select f.format, f.content_type, f.size, f.created_at, b.name
+			from ebook_files f inner join books b on b.id=f.book_id
+			where f.book_id=$1 and f.format=$2
+		`, bookId, format).Scan(&file.Format, &file.ContentType, &file.Size, &file.CreatedAt, &bookName)
+		if err == sql.ErrNoRows {
+			return errFileNotFound
+		}
+		return err
+	})
+
+	if err != nil && err != errLoanNotActive && err != errFileNotFound {
+		slog.ErrorContext(ctx, "LendingStore.CountDownload() - received error from db", "err", err)
+	}
+	return file, bookId, bookName, err
+}
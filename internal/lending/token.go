@@ -0,0 +1,87 @@
+package lending
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"example/library-service/internal/auth"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tokenPurpose separates the key signing download links from keys derived
+// for other purposes.
+const tokenPurpose = "ebook downloads"
+
+var (
+	errInvalidToken = errors.New("invalid download link")
+	errTokenExpired = errors.New("download link has expired")
+)
+
+// downloadClaims are the contents of a download link: the loan and the
+// format to download, and the time the link expires.
+type downloadClaims struct {
+	Loan    uuid.UUID `json:"loan"`
+	Format  string    `json:"format"`
+	Expires int64     `json:"exp"`
+}
+
+// signToken encodes the claims as <kid>.<claims>.<signature>, signed with
+// HMAC-SHA256 and a key derived from the active signing key.
+func signToken(keys *auth.KeySet, claims downloadClaims) (string, error) {
+	kid, key, err := keys.DeriveKey(tokenPurpose)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(kid)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key, signed)), nil
+}
+
+// parseToken verifies the signature and expiry of a download link.
+func parseToken(keys *auth.KeySet, token string, now time.Time) (claims downloadClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errInvalidToken
+	}
+
+	kid, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+
+	key, ok := keys.DerivedKey(string(kid), tokenPurpose)
+	if !ok || !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return claims, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errInvalidToken
+	}
+
+	if now.Unix() >= claims.Expires {
+		return claims, errTokenExpired
+	}
+
+	return claims, nil
+}
+
+func sign(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
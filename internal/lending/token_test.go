@@ -0,0 +1,76 @@
+package lending
+
+import (
+	"encoding/base64"
+	"example/library-service/internal/auth"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func setupKeys(t *testing.T) *auth.KeySet {
+	t.Helper()
+	t.Setenv("JWT_KEYS_DIR", "")
+	keys, err := auth.SetupKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestParseToken(t *testing.T) {
+	keys := setupKeys(t)
+	otherKeys := setupKeys(t)
+	now := time.Now()
+	claims := downloadClaims{Loan: uuid.New(), Format: "epub", Expires: now.Add(time.Hour).Unix()}
+
+	token, err := signToken(keys, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	forged := claims
+	forged.Format = "pdf"
+	forgedToken, err := signToken(keys, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedPayload := strings.Split(forgedToken, ".")[1]
+
+	otherToken, err := signToken(otherKeys, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		err   error
+	}{
+		{"valid", token, now, nil},
+		{"expired", token, now.Add(time.Hour), errTokenExpired},
+		{"tampered claims", parts[0] + "." + forgedPayload + "." + parts[2], now, errInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("signature")), now, errInvalidToken},
+		{"unknown kid", base64.RawURLEncoding.EncodeToString([]byte("unknown")) + "." + parts[1] + "." + parts[2], now, errInvalidToken},
+		{"signed with another key", otherToken, now, errInvalidToken},
+		{"missing part", parts[0] + "." + parts[1], now, errInvalidToken},
+		{"invalid encoding", parts[0] + "." + parts[1] + ".!", now, errInvalidToken},
+		{"empty", "", now, errInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseToken(keys, tt.token, tt.now)
+			if err != tt.err {
+				t.Fatalf("parseToken() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && parsed != claims {
+				t.Errorf("parseToken() = %+v, want %+v", parsed, claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"context"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestIDMiddleware propagates the X-Request-ID header of the incoming
+// request or generates a new id. The id is stored in the request context and
+// echoed in the response, so it ends up in every log line and error response.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// accessLogKey holds the path logged by AccessLogMiddleware, which
+// RedactPathMiddleware replaces once the request has been routed.
+type accessLogKey struct{}
+
+// AccessLogMiddleware writes one log line per served request.
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := utils.NewStatusRecorder(w)
+		path := Scrub(r.URL.Path)
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, &path)))
+
+		level := slog.LevelInfo
+		if recorder.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		slog.Log(r.Context(), level, "access",
+			"method", r.Method,
+			"path", path,
+			"status", recorder.Status,
+			"bytes", recorder.Bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
+// RedactPathMiddleware makes the access log show the path of routed requests
+// as RedactPath does. It belongs in a route group, where the path
+// parameters are known.
+func RedactPathMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path, ok := r.Context().Value(accessLogKey{}).(*string); ok {
+			*path = RedactPath(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RedactPath returns the path of the request with the values of sensitive
+// path parameters redacted, e.g. the credential in /downloads/{token}.
+func RedactPath(r *http.Request) string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		for i, key := range rctx.URLParams.Keys {
+			if isSensitive(key) && rctx.URLParams.Values[i] != "" {
+				path = strings.Replace(path, rctx.URLParams.Values[i], redacted, 1)
+			}
+		}
+	}
+	return Scrub(path)
+}
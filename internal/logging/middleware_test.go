@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAccessLogRedactsPathParameters(t *testing.T) {
+	const token = "MjAyNC0wMQ.eyJsb2FuIjoiMSJ9.c2lnbmF0dXJl"
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"token parameter", "/downloads/" + token, `"path":"/downloads/[REDACTED]"`},
+		{"other parameters are kept", "/books/42", `"path":"/books/42"`},
+		{"unrouted paths are scrubbed", "/unknown/lib_abc123_secret", `"path":"/unknown/[REDACTED]"`},
+	}
+
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(RedactPathMiddleware)
+		r.Get("/downloads/{token}", func(w http.ResponseWriter, r *http.Request) {})
+		r.Get("/books/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	handler := AccessLogMiddleware(r)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("access log = %s, want %s", out.String(), tt.want)
+			}
+			if strings.Contains(out.String(), token) {
+				t.Errorf("access log contains the token: %s", out.String())
+			}
+		})
+	}
+}
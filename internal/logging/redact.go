@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are matched case-insensitively against attribute keys and
+// keys of nested JSON objects; any key containing one of them is redacted.
+var sensitiveKeys = []string{
+	"password",
+	"token",
+	"secret",
+	"authorization",
+	"cookie",
+	"api_key",
+	"apikey",
+	"api-key",
+	"mail",
+}
+
+var (
+	jwtRe    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bearerRe = regexp.MustCompile(`(?i)bearer\s+\S+`)
+	apiKeyRe = regexp.MustCompile(`\blib_[0-9a-f]+_[A-Za-z0-9_-]+`)
+	mailRe   = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrub replaces tokens and mail addresses found in free-form text.
+func Scrub(s string) string {
+	s = bearerRe.ReplaceAllString(s, "Bearer "+redacted)
+	s = jwtRe.ReplaceAllString(s, redacted)
+	s = apiKeyRe.ReplaceAllString(s, redacted)
+	return mailRe.ReplaceAllString(s, redacted)
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(Scrub(a.Value.String()))
+	case slog.KindAny:
+		a.Value = redactAny(a.Value.Any())
+	}
+
+	return a
+}
+
+func redactAny(v any) slog.Value {
+	if err, ok := v.(error); ok {
+		return slog.StringValue(Scrub(err.Error()))
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return slog.AnyValue(v)
+	}
+
+	var decoded any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return slog.AnyValue(v)
+	}
+
+	redactedRaw, err := json.Marshal(redactJSON(decoded))
+	if err != nil || bytes.Equal(raw, redactedRaw) {
+		return slog.AnyValue(v)
+	}
+
+	return slog.AnyValue(json.RawMessage(redactedRaw))
+}
+
+func redactJSON(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, inner := range val {
+			if isSensitive(k) {
+				val[k] = redacted
+				continue
+			}
+			val[k] = redactJSON(inner)
+		}
+		return val
+	case []any:
+		for i := range val {
+			val[i] = redactJSON(val[i])
+		}
+		return val
+	case string:
+		return Scrub(val)
+	default:
+		return val
+	}
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer writes every message into its own file in Dir instead of
+// delivering it. Meant for local development.
+type FileMailer struct {
+	Dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	name := fmt.Sprintf("%s-%s.txt", time.Now().UTC().Format("20060102T150405"), uuid.NewString())
+	path := filepath.Join(m.Dir, name)
+
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		slog.ErrorContext(ctx, "FileMailer.Send() - received error", "err", err)
+		return err
+	}
+
+	slog.InfoContext(ctx, "FileMailer.Send() - message written", "file", path, "subject", msg.Subject)
+	return nil
+}
@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages to users. Implementations must be safe for
+// concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewMailerFromEnv returns the mailer selected by MAILER:
+//
+//   - smtp: SMTPMailer configured with SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+//     SMTP_PASSWORD and MAIL_FROM
+//   - file (default): FileMailer writing messages to MAIL_OUTBOX_DIR
+//     (./mail-outbox by default), for development
+func NewMailerFromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		mailer := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if mailer.Host == "" || mailer.From == "" {
+			return nil, fmt.Errorf("SMTP_HOST and MAIL_FROM are required for the smtp mailer")
+		}
+		return mailer, nil
+	case "", "file":
+		dir := getEnv("MAIL_OUTBOX_DIR", "mail-outbox")
+		slog.Info("mail.NewMailerFromEnv() - writing mails to local outbox", "dir", dir)
+		return NewFileMailer(dir)
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", os.Getenv("MAILER"))
+	}
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"database/sql"
+	"example/library-service/internal/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "library"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests currently being served.",
+	})
+
+	storeQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of store queries by store method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"method"})
+
+	// Logins counts successful logins.
+	Logins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of successful logins.",
+	})
+
+	// FailedLogins counts rejected logins by reason.
+	FailedLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_logins_total",
+		Help:      "Number of failed logins by reason.",
+	}, []string{"reason"})
+
+	// RateLimited counts requests rejected by the rate limiter per policy.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by the rate limiter.",
+	}, []string{"policy"})
+
+	// Registrations counts successfully registered users.
+	Registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Number of registered users.",
+	})
+
+	// BooksCreated counts books added to the catalog.
+	BooksCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "books_created_total",
+		Help:      "Number of books created.",
+	})
+
+	// AuthorsCreated counts authors added to the catalog.
+	AuthorsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authors_created_total",
+		Help:      "Number of authors created.",
+	})
+
+	// CacheLookups counts cache reads per cache namespace by result, hit or
+	// miss.
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "lookups_total",
+		Help:      "Number of cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+
+	// IdempotentRequests counts requests carrying an idempotency key which
+	// weren't executed, by outcome: replayed, in_progress or mismatch.
+	IdempotentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idempotent_requests_total",
+		Help:      "Number of requests answered from a stored idempotency key by outcome.",
+	}, []string{"outcome"})
+
+	// EbookDownloads counts downloads of ebook files by format.
+	EbookDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ebook_downloads_total",
+		Help:      "Number of ebook files downloaded by format.",
+	}, []string{"format"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		httpRequestsInFlight,
+		storeQueryDuration,
+		Logins,
+		FailedLogins,
+		RateLimited,
+		Registrations,
+		BooksCreated,
+		AuthorsCreated,
+		CacheLookups,
+		IdempotentRequests,
+		EbookDownloads,
+	)
+}
+
+// RegisterDB exposes sql.DBStats of the connection pool as gauges.
+func RegisterDB(db *sql.DB, name string) {
+	registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Handler serves the registered metrics in Prometheus text exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records duration and status of every request served by next.
+// The route pattern returned by route is used as a label instead of the raw
+// path to keep cardinality bounded; it's read once the request is served, so
+// the router has matched it by then.
+func Middleware(route func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		recorder := utils.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		httpRequestDuration.
+			WithLabelValues(route(r), r.Method, strconv.Itoa(recorder.Status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveQuery records the time elapsed since start for the given store method.
+// Intended to be deferred at the top of a store method:
+//
+//	defer metrics.ObserveQuery("BookStore.GetBook", time.Now())
+func ObserveQuery(method string, start time.Time) {
+	storeQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
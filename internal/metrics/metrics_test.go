@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"example/library-service/internal/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// scrape returns the metrics as served to Prometheus.
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMiddlewareLabelsRoutes(t *testing.T) {
+	mux := router.New()
+	mux.Group(func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler { return Middleware(router.Pattern, next) })
+		r.Get("/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	})
+
+	for _, path := range []string{"/metrics-test/1", "/metrics-test/2"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Both requests are counted under the pattern, not their paths.
+	body := scrape(t)
+	want := `library_http_request_duration_seconds_count{method="GET",route="/metrics-test/{id}",status="418"} 2`
+	if !strings.Contains(body, want) {
+		t.Errorf("metrics don't contain %s", want)
+	}
+	if strings.Contains(body, `route="/metrics-test/1"`) {
+		t.Error("metrics are labelled with the raw path")
+	}
+	if !strings.Contains(body, "library_http_requests_in_flight 0") {
+		t.Error("requests in flight aren't back to 0")
+	}
+}
+
+func TestObserveQuery(t *testing.T) {
+	ObserveQuery("TestStore.Query", time.Now().Add(-time.Second))
+
+	body := scrape(t)
+	for _, want := range []string{
+		`library_store_query_duration_seconds_count{method="TestStore.Query"} 1`,
+		`library_store_query_duration_seconds_bucket{method="TestStore.Query",le="1"} 0`,
+		`library_store_query_duration_seconds_bucket{method="TestStore.Query",le="2.5"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestBusinessMetrics(t *testing.T) {
+	FailedLogins.WithLabelValues("test").Inc()
+	EbookDownloads.WithLabelValues("test").Add(2)
+
+	body := scrape(t)
+	for _, want := range []string{
+		`library_failed_logins_total{reason="test"} 1`,
+		`library_ebook_downloads_total{format="test"} 2`,
+		"library_logins_total",
+		"go_goroutines",
+		"process_start_time_seconds",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Renders /openapi.json. It's served by the service itself, so the page works
+// offline and under a Content-Security-Policy allowing only its own origin.
+// Everything from the specification is set as text, never as markup.
+"use strict";
+
+const methods = ["get", "post", "put", "patch", "delete"];
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    node.setAttribute(name, value);
+  }
+  for (const child of children) {
+    if (child !== null && child !== undefined) {
+      node.append(child);
+    }
+  }
+  return node;
+}
+
+function schemaName(ref) {
+  return ref.substring(ref.lastIndexOf("/") + 1);
+}
+
+// describe returns a node naming the type of a schema, linking to referenced
+// schemas.
+function describe(schema) {
+  if (!schema) {
+    return "";
+  }
+  if (schema.$ref) {
+    const name = schemaName(schema.$ref);
+    return el("a", { href: "#schema-" + name }, name);
+  }
+  if (schema.type === "array" || (Array.isArray(schema.type) && schema.type.includes("array"))) {
+    return el("span", {}, describe(schema.items), "[]");
+  }
+  let type = Array.isArray(schema.type) ? schema.type.join(" | ") : schema.type || "object";
+  if (schema.format) {
+    type += " (" + schema.format + ")";
+  }
+  if (schema.enum) {
+    type += ": " + schema.enum.join(", ");
+  }
+  return el("code", {}, type);
+}
+
+function contentTable(content) {
+  const table = el("table");
+  for (const [type, media] of Object.entries(content || {})) {
+    table.append(el("tr", {}, el("td", {}, el("code", {}, type)), el("td", {}, describe(media.schema))));
+  }
+  return table;
+}
+
+function renderOperation(path, method, op) {
+  const section = el("section", { id: op.operationId, class: "operation" + (op.deprecated ? " deprecated" : "") },
+    el("h3", {}, el("span", { class: "method " + method }, method), el("span", { class: "path" }, path)),
+    el("p", {}, op.summary || ""));
+
+  if (op.deprecated) {
+    section.append(el("p", { class: "muted" }, "Deprecated"));
+  }
+
+  if (op.security && op.security.length > 0) {
+    const schemes = op.security.map((requirement) => Object.entries(requirement)
+      .map(([name, scopes]) => scopes.length > 0 ? name + " (" + scopes.join(", ") + ")" : name)
+      .join(" + "));
+    section.append(el("p", {}, "Authorization: ", el("code", {}, schemes.join(" or "))));
+  }
+
+  if (op.parameters && op.parameters.length > 0) {
+    const table = el("table", {}, el("tr", {}, el("th", {}, "Parameter"), el("th", {}, "In"), el("th", {}, "Type")));
+    for (const param of op.parameters) {
+      table.append(el("tr", {},
+        el("td", {}, el("code", {}, param.name), param.required ? " *" : ""),
+        el("td", {}, param.in),
+        el("td", {}, describe(param.schema))));
+    }
+    section.append(table);
+  }
+
+  if (op.requestBody) {
+    section.append(el("h4", {}, "Request body"), contentTable(op.requestBody.content));
+  }
+
+  const responses = el("table", {}, el("tr", {}, el("th", {}, "Status"), el("th", {}, "Description"), el("th", {}, "Body")));
+  for (const [status, response] of Object.entries(op.responses || {})) {
+    responses.append(el("tr", {},
+      el("td", {}, status),
+      el("td", {}, response.description || ""),
+      el("td", {}, response.content ? contentTable(response.content) : "")));
+  }
+  section.append(el("h4", {}, "Responses"), responses);
+
+  return section;
+}
+
+function renderSchema(name, schema) {
+  const section = el("section", { id: "schema-" + name, class: "operation" }, el("h3", {}, name));
+  const required = new Set(schema.required || []);
+  const properties = Object.entries(schema.properties || {});
+  if (properties.length === 0) {
+    section.append(el("p", {}, describe(schema)));
+    return section;
+  }
+
+  const table = el("table", {}, el("tr", {}, el("th", {}, "Property"), el("th", {}, "Type")));
+  for (const [property, propertySchema] of properties) {
+    table.append(el("tr", {},
+      el("td", {}, el("code", {}, property), required.has(property) ? " *" : ""),
+      el("td", {}, describe(propertySchema))));
+  }
+  section.append(table);
+  return section;
+}
+
+function render(spec) {
+  const nav = document.getElementById("nav");
+  const main = document.getElementById("main");
+  main.replaceChildren(el("h1", {}, spec.info.title), el("p", { class: "muted" },
+    "Version " + spec.info.version + ", ", el("a", { href: "/openapi.json" }, "OpenAPI document")));
+  nav.replaceChildren();
+
+  const tags = new Map();
+  for (const [path, item] of Object.entries(spec.paths)) {
+    for (const method of methods) {
+      const op = item[method];
+      if (!op) {
+        continue;
+      }
+      const tag = (op.tags && op.tags[0]) || "other";
+      if (!tags.has(tag)) {
+        tags.set(tag, []);
+      }
+      tags.get(tag).push({ path, method, op });
+    }
+  }
+
+  for (const [tag, operations] of [...tags].sort(([a], [b]) => a.localeCompare(b))) {
+    nav.append(el("h2", {}, tag));
+    main.append(el("h2", { id: "tag-" + tag }, tag));
+    for (const { path, method, op } of operations) {
+      nav.append(el("a", { href: "#" + op.operationId }, el("span", { class: "method " + method }, method), path));
+      main.append(renderOperation(path, method, op));
+    }
+  }
+
+  const schemas = Object.entries((spec.components && spec.components.schemas) || {});
+  if (schemas.length > 0) {
+    nav.append(el("h2", {}, "schemas"));
+    main.append(el("h2", { id: "schemas" }, "Schemas"));
+    for (const [name, schema] of schemas) {
+      nav.append(el("a", { href: "#schema-" + name }, name));
+      main.append(renderSchema(name, schema));
+    }
+  }
+
+  if (location.hash) {
+    const target = document.getElementById(location.hash.substring(1));
+    if (target) {
+      target.scrollIntoView();
+    }
+  }
+}
+
+fetch("/openapi.json")
+  .then((response) => {
+    if (!response.ok) {
+      throw new Error(response.status + " " + response.statusText);
+    }
+    return response.json();
+  })
+  .then(render)
+  .catch((err) => {
+    document.getElementById("main").replaceChildren(el("p", {}, "Cannot load the specification: " + err.message));
+  });
@@ -0,0 +1,85 @@
+package openapi
+
+import (
+	"embed"
+	"encoding/json"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// docsAssets hold the documentation page with its script and styles, which
+// are served by the service itself rather than loaded from a CDN.
+//
+//go:embed docs
+var docsAssets embed.FS
+
+// docsPolicy restricts the documentation page to the assets and the
+// specification of the service.
+const docsPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; img-src 'self' data:; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// OpenAPIHandler serves the specification and a documentation page rendering
+// it.
+type OpenAPIHandler struct {
+	once sync.Once
+	body []byte
+	err  error
+}
+
+func NewOpenAPIHandler() *OpenAPIHandler {
+	return &OpenAPIHandler{}
+}
+
+func (h *OpenAPIHandler) Routes(r chi.Router) {
+	r.Get(utils.OpenAPIPath, h.spec)
+	r.Get(utils.DocsPath, h.docs)
+	r.Get(utils.DocsPath+"/{asset}", h.docsAsset)
+}
+
+func (h *OpenAPIHandler) spec(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() { h.body, h.err = json.Marshal(Spec()) })
+	if h.err != nil {
+		slog.ErrorContext(r.Context(), "OpenAPIHandler.spec() - received error while marshaling", "err", h.err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.body)
+}
+
+func (h *OpenAPIHandler) docs(w http.ResponseWriter, r *http.Request) {
+	page, err := docsAssets.ReadFile("docs/index.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OpenAPIHandler.docs() - cannot read page", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", docsPolicy)
+	w.WriteHeader(http.StatusOK)
+	w.Write(page)
+}
+
+func (h *OpenAPIHandler) docsAsset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "asset")
+	contentType := mime.TypeByExtension(path.Ext(name))
+	asset, err := docsAssets.ReadFile("docs/" + name)
+	if err != nil || contentType == "" || name == "index.html" {
+		errors.HandleError(404, "Not Found", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(asset)
+}
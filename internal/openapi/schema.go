@@ -0,0 +1,100 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+// schemaOf derives the JSON schema of a Go value from its type and json tags.
+// Named structs are added to components and referenced, so every entity is
+// described once.
+func schemaOf(t reflect.Type, components map[string]any) map[string]any {
+	nullable := false
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var schema map[string]any
+	switch {
+	case t == timeType:
+		schema = map[string]any{"type": "string", "format": "date-time"}
+	case t == uuidType:
+		schema = map[string]any{"type": "string", "format": "uuid"}
+	case t.Kind() == reflect.String:
+		schema = map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		schema = map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema = map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = map[string]any{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		schema = map[string]any{"type": "array", "items": schemaOf(t.Elem(), components)}
+	case t.Kind() == reflect.Map:
+		schema = map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), components)}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := components[t.Name()]; !ok {
+			// Registered before recursing, so self-references terminate.
+			components[t.Name()] = nil
+			components[t.Name()] = structSchema(t, components)
+		}
+		schema = map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		schema = structSchema(t, components)
+	default:
+		schema = map[string]any{}
+	}
+
+	if nullable {
+		if ref, ok := schema["$ref"]; ok {
+			return map[string]any{"oneOf": []any{map[string]any{"$ref": ref}, map[string]any{"type": "null"}}}
+		}
+		if typ, ok := schema["type"].(string); ok {
+			schema["type"] = []string{typ, "null"}
+		}
+	}
+
+	return schema
+}
+
+func structSchema(t reflect.Type, components map[string]any) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaOf(field.Type, components)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,346 @@
+package openapi
+
+import (
+	"example/library-service/internal/auth"
+	"example/library-service/internal/author"
+	"example/library-service/internal/batch"
+	"example/library-service/internal/book"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/health"
+	"example/library-service/internal/idempotency"
+	"example/library-service/internal/lending"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/review"
+	"example/library-service/internal/series"
+	"example/library-service/internal/user"
+	"example/library-service/internal/utils"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Security requirements of an operation.
+const (
+	Public = iota
+	// Session operations need a JWT.
+	Session
+	// Principal operations accept a JWT or an API key with the given scope.
+	Principal
+)
+
+// Operation documents one route. Request and Response are zero values of the
+// types the handler decodes and encodes; their schemas are derived from them.
+type Operation struct {
+	Method   string
+	Path     string
+	Tag      string
+	Summary  string
+	Security int
+	Scope    string
+	// Query names the utils params set accepted as query parameters.
+	Query   string
+	Request any
+	// RequestType is used for bodies which aren't plain JSON, e.g. merge
+	// patches. Without Request, the body is an upload of that type.
+	RequestType string
+	Status      int
+	Response    any
+	// ResponseType is used for bodies which aren't JSON.
+	ResponseType string
+	Deprecated   bool
+	// Conditional operations send an ETag on reads and require If-Match on
+	// writes.
+	Conditional bool
+	// Cached operations are served from the catalog cache and may be cached
+	// by clients, see Cache-Control.
+	Cached bool
+	// Idempotent operations may be retried safely with an Idempotency-Key.
+	Idempotent bool
+	// Batch operations answer 207 with per-operation results when a
+	// best-effort batch partly fails, and the status of the failure when an
+	// atomic one is rolled back.
+	Batch bool
+}
+
+var operations = []Operation{
+	{Method: http.MethodGet, Path: "/books", Tag: "books", Summary: "List books", Security: Principal, Scope: auth.ScopeCatalogRead, Query: "book", Status: 200, Response: []entity.Book{}, Cached: true},
+	{Method: http.MethodPost, Path: "/books", Tag: "books", Summary: "Create a book", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Book{}, Status: 201, Response: entity.Book{}, Idempotent: true},
+	{Method: http.MethodPost, Path: "/books:batch", Tag: "books", Summary: "Create, update and delete many books, atomically or best-effort", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: book.BookBatchRequest{}, Status: 200, Response: batch.Response{}, Idempotent: true, Batch: true},
+	{Method: http.MethodPut, Path: "/books", Tag: "books", Summary: "Replace a book, identified by the id in the body", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Book{}, Status: 200, Response: entity.Book{}, Deprecated: true, Conditional: true},
+	{Method: http.MethodGet, Path: "/books/{id}", Tag: "books", Summary: "Get a book", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: entity.Book{}, Conditional: true, Cached: true},
+	{Method: http.MethodPut, Path: "/books/{id}", Tag: "books", Summary: "Replace a book", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Book{}, Status: 200, Response: entity.Book{}, Conditional: true},
+	{Method: http.MethodPatch, Path: "/books/{id}", Tag: "books", Summary: "Change fields of a book with a JSON merge patch", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Book{}, RequestType: patch.ContentType, Status: 200, Response: entity.Book{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/books/{id}", Tag: "books", Summary: "Delete a book", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 204, Conditional: true},
+	{Method: http.MethodPut, Path: "/books/{id}/cover", Tag: "books", Summary: "Upload the cover of a book as a JPEG, PNG or WebP image; thumbnails are generated", Security: Principal, Scope: auth.ScopeCatalogWrite, RequestType: "image/*", Status: 200, Response: entity.Book{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/books/{id}/cover", Tag: "books", Summary: "Remove the cover of a book", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 200, Response: entity.Book{}, Conditional: true},
+
+	{Method: http.MethodGet, Path: "/authors", Tag: "authors", Summary: "List authors", Security: Principal, Scope: auth.ScopeCatalogRead, Query: "author", Status: 200, Response: []entity.Author{}, Cached: true},
+	{Method: http.MethodPost, Path: "/authors", Tag: "authors", Summary: "Create an author", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Author{}, Status: 201, Response: entity.Author{}, Idempotent: true},
+	{Method: http.MethodPost, Path: "/authors:batch", Tag: "authors", Summary: "Create, update and delete many authors, atomically or best-effort", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: author.AuthorBatchRequest{}, Status: 200, Response: batch.Response{}, Idempotent: true, Batch: true},
+	{Method: http.MethodPut, Path: "/authors", Tag: "authors", Summary: "Replace an author, identified by the id in the body", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Author{}, Status: 200, Response: entity.Author{}, Deprecated: true, Conditional: true},
+	{Method: http.MethodGet, Path: "/authors/{id}", Tag: "authors", Summary: "Get an author with their books; ids of merged authors redirect with 308", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: entity.Author{}, Conditional: true, Cached: true},
+	{Method: http.MethodPut, Path: "/authors/{id}", Tag: "authors", Summary: "Replace an author", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Author{}, Status: 200, Response: entity.Author{}, Conditional: true},
+	{Method: http.MethodPatch, Path: "/authors/{id}", Tag: "authors", Summary: "Change fields of an author with a JSON merge patch", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Author{}, RequestType: patch.ContentType, Status: 200, Response: entity.Author{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/authors/{id}", Tag: "authors", Summary: "Delete an author", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 204, Conditional: true},
+	{Method: http.MethodGet, Path: "/authors/duplicates", Tag: "authors", Summary: "List pairs of authors with similar names or aliases, likely duplicates", Security: Principal, Scope: auth.ScopeCatalogRead, Query: "author_duplicates", Status: 200, Response: []author.DuplicateCandidate{}},
+	{Method: http.MethodPost, Path: "/authors/{id}/merge", Tag: "authors", Summary: "Merge a duplicate into the author; its books move over, its name becomes an alias and its id redirects; 409 if their dates contradict each other", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: author.MergeAuthorRequest{}, Status: 200, Response: entity.Author{}, Conditional: true, Idempotent: true},
+	{Method: http.MethodGet, Path: "/series", Tag: "series", Summary: "List series with their books in reading order", Security: Principal, Scope: auth.ScopeCatalogRead, Query: "series", Status: 200, Response: []entity.Series{}, Cached: true},
+	{Method: http.MethodPost, Path: "/series", Tag: "series", Summary: "Create a series", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Series{}, Status: 201, Response: entity.Series{}, Idempotent: true},
+	{Method: http.MethodGet, Path: "/series/{id}", Tag: "series", Summary: "Get a series with its books in reading order", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: entity.Series{}, Conditional: true, Cached: true},
+	{Method: http.MethodPut, Path: "/series/{id}", Tag: "series", Summary: "Rename a series or replace its description; its books are kept", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Series{}, Status: 200, Response: entity.Series{}, Conditional: true},
+	{Method: http.MethodPatch, Path: "/series/{id}", Tag: "series", Summary: "Change the name or description of a series with a JSON merge patch", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: entity.Series{}, RequestType: patch.ContentType, Status: 200, Response: entity.Series{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/series/{id}", Tag: "series", Summary: "Delete a series; its books are kept", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 204, Conditional: true},
+	{Method: http.MethodPut, Path: "/series/{id}/books/{bookId}", Tag: "series", Summary: "Add a book to a series at a position, e.g. 2.5, or move it there; 409 if the position is taken", Security: Principal, Scope: auth.ScopeCatalogWrite, Request: series.SeriesBookRequest{}, Status: 200, Response: entity.Series{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/series/{id}/books/{bookId}", Tag: "series", Summary: "Take a book out of a series", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 200, Response: entity.Series{}, Conditional: true},
+	{Method: http.MethodGet, Path: "/covers/{id}/{size}", Tag: "books", Summary: "Get a cover image; size is original, small, medium or large, thumbnails are JPEGs", Status: 200, ResponseType: "image/*"},
+	{Method: http.MethodGet, Path: "/books/{id}/ebooks", Tag: "lending", Summary: "List the ebook files of a book", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: []entity.EbookFile{}},
+	{Method: http.MethodPut, Path: "/books/{id}/ebooks/{format}", Tag: "lending", Summary: "Upload the epub or pdf file of a book", Security: Principal, Scope: auth.ScopeCatalogWrite, RequestType: "application/octet-stream", Status: 200, Response: entity.EbookFile{}},
+	{Method: http.MethodDelete, Path: "/books/{id}/ebooks/{format}", Tag: "lending", Summary: "Remove the epub or pdf file of a book", Security: Principal, Scope: auth.ScopeCatalogWrite, Status: 204},
+	{Method: http.MethodPost, Path: "/books/{id}/loans", Tag: "lending", Summary: "Borrow the ebook files of a book; 409 if it has none or is already lent to you", Security: Principal, Scope: auth.ScopeLoansWrite, Status: 201, Response: entity.Loan{}, Idempotent: true},
+	{Method: http.MethodGet, Path: "/me/loans", Tag: "lending", Summary: "List your loans, the latest first", Security: Principal, Scope: auth.ScopeLoansRead, Status: 200, Response: []entity.Loan{}},
+	{Method: http.MethodPost, Path: "/me/loans/{id}/return", Tag: "lending", Summary: "Return a book early, which revokes its download links", Security: Principal, Scope: auth.ScopeLoansWrite, Status: 200, Response: entity.Loan{}, Idempotent: true},
+	{Method: http.MethodGet, Path: "/me/loans/{id}/download", Tag: "lending", Summary: "Get a signed, expiring link to download a file of an active loan", Security: Principal, Scope: auth.ScopeLoansRead, Query: "loan_download", Status: 200, Response: lending.DownloadLink{}},
+	{Method: http.MethodGet, Path: "/downloads/{token}", Tag: "lending", Summary: "Download an ebook file with a signed link; 410 once the link expired or the loan ended", Status: 200, ResponseType: "application/octet-stream"},
+	{Method: http.MethodGet, Path: "/books/{id}/reviews", Tag: "reviews", Summary: "List the reviews of a book, the latest first; moderators also see hidden ones", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: []entity.Review{}},
+	{Method: http.MethodPost, Path: "/books/{id}/reviews", Tag: "reviews", Summary: "Rate and review a book; 409 if you have already reviewed it", Security: Principal, Scope: auth.ScopeReviewsWrite, Request: review.ReviewRequest{}, Status: 201, Response: entity.Review{}, Idempotent: true},
+	{Method: http.MethodGet, Path: "/books/{id}/reviews/{reviewId}", Tag: "reviews", Summary: "Get a review of a book", Security: Principal, Scope: auth.ScopeCatalogRead, Status: 200, Response: entity.Review{}, Conditional: true},
+	{Method: http.MethodPut, Path: "/books/{id}/reviews/{reviewId}", Tag: "reviews", Summary: "Change the rating and text of your review", Security: Principal, Scope: auth.ScopeReviewsWrite, Request: review.ReviewRequest{}, Status: 200, Response: entity.Review{}, Conditional: true},
+	{Method: http.MethodPatch, Path: "/books/{id}/reviews/{reviewId}", Tag: "reviews", Summary: "Change the rating or text of your review with a JSON merge patch", Security: Principal, Scope: auth.ScopeReviewsWrite, Request: review.ReviewRequest{}, RequestType: patch.ContentType, Status: 200, Response: entity.Review{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/books/{id}/reviews/{reviewId}", Tag: "reviews", Summary: "Delete your review", Security: Principal, Scope: auth.ScopeReviewsWrite, Status: 204, Conditional: true},
+	{Method: http.MethodPost, Path: "/books/{id}/reviews/{reviewId}/hide", Tag: "reviews", Summary: "Hide a review from everyone but its author and moderators", Security: Principal, Scope: auth.ScopeReviewsWrite, Status: 200, Response: entity.Review{}},
+	{Method: http.MethodPost, Path: "/books/{id}/reviews/{reviewId}/unhide", Tag: "reviews", Summary: "Show a hidden review again", Security: Principal, Scope: auth.ScopeReviewsWrite, Status: 200, Response: entity.Review{}},
+
+	{Method: http.MethodGet, Path: "/users", Tag: "users", Summary: "List users (admin)", Security: Principal, Scope: auth.ScopeUsersRead, Query: "user", Status: 200, Response: []entity.User{}},
+	{Method: http.MethodPut, Path: "/users", Tag: "users", Summary: "Update a user, identified by the id in the body (admin)", Security: Principal, Scope: auth.ScopeUsersWrite, Request: entity.User{}, Status: 200, Response: entity.User{}, Deprecated: true, Conditional: true},
+	{Method: http.MethodGet, Path: "/users/{id}", Tag: "users", Summary: "Get a user (admin or the user themselves)", Security: Principal, Scope: auth.ScopeUsersRead, Status: 200, Response: entity.User{}, Conditional: true},
+	{Method: http.MethodPut, Path: "/users/{id}", Tag: "users", Summary: "Update a user (admin)", Security: Principal, Scope: auth.ScopeUsersWrite, Request: entity.User{}, Status: 200, Response: entity.User{}, Conditional: true},
+	{Method: http.MethodPatch, Path: "/users/{id}", Tag: "users", Summary: "Change fields of a user with a JSON merge patch (admin)", Security: Principal, Scope: auth.ScopeUsersWrite, Request: entity.User{}, RequestType: patch.ContentType, Status: 200, Response: entity.User{}, Conditional: true},
+	{Method: http.MethodDelete, Path: "/users/{id}", Tag: "users", Summary: "Delete a user (admin)", Security: Principal, Scope: auth.ScopeUsersWrite, Status: 204, Conditional: true},
+	{Method: http.MethodPost, Path: "/users/{id}/unlock", Tag: "users", Summary: "Lift a login lockout (admin)", Security: Principal, Scope: auth.ScopeUsersWrite, Status: 204},
+
+	{Method: http.MethodGet, Path: utils.MePath, Tag: "profile", Summary: "Get the own profile", Security: Principal, Scope: auth.ScopeUsersRead, Status: 200, Response: entity.User{}, Conditional: true},
+	{Method: http.MethodPatch, Path: utils.MePath, Tag: "profile", Summary: "Update name or mail", Security: Principal, Scope: auth.ScopeUsersWrite, Request: user.UpdateMeRequest{}, Status: 200, Response: entity.User{}, Conditional: true},
+	{Method: http.MethodDelete, Path: utils.MePath, Tag: "profile", Summary: "Delete and anonymize the own account", Security: Principal, Scope: auth.ScopeUsersWrite, Status: 204},
+	{Method: http.MethodPost, Path: utils.MePasswordPath, Tag: "profile", Summary: "Change the password", Security: Principal, Scope: auth.ScopeUsersWrite, Request: user.ChangePasswordRequest{}, Status: 204},
+
+	{Method: http.MethodGet, Path: "/api-keys", Tag: "api-keys", Summary: "List API keys (admin)", Security: Session, Status: 200, Response: []entity.APIKey{}},
+	{Method: http.MethodPost, Path: "/api-keys", Tag: "api-keys", Summary: "Create an API key; the key is only returned once (admin)", Security: Session, Request: auth.CreateAPIKeyRequest{}, Status: 201, Response: entity.APIKey{}},
+	{Method: http.MethodDelete, Path: "/api-keys/{id}", Tag: "api-keys", Summary: "Revoke an API key (admin)", Security: Session, Status: 204},
+
+	{Method: http.MethodPost, Path: utils.RegisterPath, Tag: "auth", Summary: "Register an account", Request: auth.ReqisterRequest{}, Status: 200},
+	{Method: http.MethodPost, Path: utils.LoginPath, Tag: "auth", Summary: "Log in; returns the token, or a challenge when a second factor is needed", Request: auth.LoginRequest{}, Status: 200, ResponseType: "text/plain"},
+	{Method: http.MethodPost, Path: utils.LogoutPath, Tag: "auth", Summary: "Revoke the current token", Security: Session, Status: 200},
+	{Method: http.MethodPost, Path: utils.VerifyMailPath, Tag: "auth", Summary: "Confirm the mail address", Request: auth.TokenRequest{}, Status: 204},
+	{Method: http.MethodPost, Path: utils.ForgotPasswordPath, Tag: "auth", Summary: "Request a password reset mail", Request: auth.ForgotPasswordRequest{}, Status: 202},
+	{Method: http.MethodPost, Path: utils.ResetPasswordPath, Tag: "auth", Summary: "Set a new password with a reset token", Request: auth.ResetPasswordRequest{}, Status: 204},
+	{Method: http.MethodPost, Path: utils.LoginMFAPath, Tag: "auth", Summary: "Complete a login with the second factor", Request: auth.LoginMFARequest{}, Status: 200, ResponseType: "text/plain"},
+	{Method: http.MethodPost, Path: utils.MFAEnrollPath, Tag: "auth", Summary: "Start TOTP enrollment", Security: Session, Status: 200, Response: auth.EnrollMFAResponse{}},
+	{Method: http.MethodPost, Path: utils.MFAConfirmPath, Tag: "auth", Summary: "Confirm TOTP enrollment and receive recovery codes", Security: Session, Request: auth.MFACodeRequest{}, Status: 200, Response: auth.ConfirmMFAResponse{}},
+	{Method: http.MethodPost, Path: utils.MFADisablePath, Tag: "auth", Summary: "Disable TOTP", Security: Session, Request: auth.MFACodeRequest{}, Status: 204},
+	{Method: http.MethodGet, Path: utils.OIDCLoginPath, Tag: "auth", Summary: "Start an OpenID Connect login", Status: 302},
+	{Method: http.MethodGet, Path: utils.OIDCCallbackPath, Tag: "auth", Summary: "OpenID Connect redirect target; returns the token", Status: 200, ResponseType: "text/plain"},
+	{Method: http.MethodGet, Path: utils.JWKSPath, Tag: "auth", Summary: "Public keys verifying our tokens", Status: 200, Response: auth.JWKS{}},
+
+	{Method: http.MethodGet, Path: utils.HealthPath, Tag: "operations", Summary: "Liveness", Status: 200, Response: map[string]string{}},
+	{Method: http.MethodGet, Path: utils.ReadyPath, Tag: "operations", Summary: "Readiness", Status: 200, Response: map[string]string{}},
+	{Method: http.MethodGet, Path: utils.VersionPath, Tag: "operations", Summary: "Build information", Status: 200, Response: health.BuildInfo{}},
+	{Method: http.MethodGet, Path: "/metrics", Tag: "operations", Summary: "Prometheus metrics", Status: 200, ResponseType: "text/plain"},
+	{Method: http.MethodGet, Path: utils.OpenAPIPath, Tag: "operations", Summary: "This document", Status: 200, Response: map[string]any{}},
+	{Method: http.MethodGet, Path: utils.DocsPath, Tag: "operations", Summary: "Interactive API documentation", Status: 200, ResponseType: "text/html"},
+	{Method: http.MethodGet, Path: utils.DocsPath + "/{asset}", Tag: "operations", Summary: "Script and styles of the documentation page", Status: 200, ResponseType: "text/*"},
+}
+
+// ScopeOf returns the scope an API key needs for the operation with the
+// method and route pattern, or "" for undocumented operations and those which
+// don't accept API keys.
+func ScopeOf(method string, path string) string {
+	for _, op := range operations {
+		if op.Method == method && op.Path == path {
+			return op.Scope
+		}
+	}
+	return ""
+}
+
+func Operations() []Operation {
+	return operations
+}
+
+var pathParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// Spec builds the OpenAPI 3.1 document.
+func Spec() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+
+	for _, op := range operations {
+		item, ok := paths[op.Path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation(op, schemas)
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Library service",
+			"version": health.GetBuildInfo().Commit,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": auth.APIKeyHeader},
+			},
+		},
+	}
+}
+
+func operation(op Operation, schemas map[string]any) map[string]any {
+	result := map[string]any{
+		"tags":        []string{op.Tag},
+		"summary":     op.Summary,
+		"operationId": operationID(op),
+	}
+	if op.Deprecated {
+		result["deprecated"] = true
+	}
+
+	var parameters []any
+	for _, match := range pathParamRe.FindAllStringSubmatch(op.Path, -1) {
+		schema := map[string]any{"type": "string"}
+		if match[1] == "id" || strings.HasSuffix(match[1], "Id") {
+			schema["format"] = "uuid"
+		}
+		parameters = append(parameters, map[string]any{
+			"name": match[1], "in": "path", "required": true, "schema": schema,
+		})
+	}
+	if op.Conditional && op.Method == http.MethodGet {
+		parameters = append(parameters, map[string]any{
+			"name": "If-None-Match", "in": "header", "schema": map[string]any{"type": "string"},
+		})
+	} else if op.Conditional {
+		parameters = append(parameters, map[string]any{
+			"name": "If-Match", "in": "header", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	if op.Idempotent {
+		parameters = append(parameters, map[string]any{
+			"name": idempotency.Header, "in": "header", "schema": map[string]any{"type": "string", "maxLength": idempotency.MaxKeyLength},
+		})
+	}
+	for _, name := range utils.Params(op.Query) {
+		parameters = append(parameters, map[string]any{
+			"name": name, "in": "query", "schema": map[string]any{"type": "string"},
+		})
+	}
+	if parameters != nil {
+		result["parameters"] = parameters
+	}
+
+	switch {
+	case op.Request != nil:
+		requestType := op.RequestType
+		if requestType == "" {
+			requestType = "application/json"
+		}
+		result["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{requestType: map[string]any{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)}},
+		}
+	case op.RequestType != "":
+		// Uploads, e.g. images, are sent as they are.
+		result["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{op.RequestType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}},
+		}
+	}
+
+	success := map[string]any{"description": http.StatusText(op.Status)}
+	switch {
+	case op.Response != nil:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Response), schemas)}}
+	case op.ResponseType != "":
+		success["content"] = map[string]any{op.ResponseType: map[string]any{"schema": map[string]any{"type": "string"}}}
+	}
+
+	responses := map[string]any{strconv.Itoa(op.Status): success}
+	errorResponse := func(status int) {
+		responses[strconv.Itoa(status)] = map[string]any{
+			"description": http.StatusText(status),
+			"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+		}
+	}
+
+	if op.Request != nil || op.Query != "" || strings.Contains(op.Path, "{") {
+		errorResponse(http.StatusBadRequest)
+	}
+	switch op.Security {
+	case Session:
+		result["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+		errorResponse(http.StatusUnauthorized)
+	case Principal:
+		result["security"] = []any{map[string]any{"bearerAuth": []string{}}, map[string]any{"apiKeyAuth": []string{op.Scope}}}
+		errorResponse(http.StatusUnauthorized)
+		errorResponse(http.StatusForbidden)
+	}
+	if strings.Contains(op.Path, "{") {
+		errorResponse(http.StatusNotFound)
+	}
+	if op.RequestType != "" {
+		errorResponse(http.StatusUnsupportedMediaType)
+	}
+	if op.RequestType != "" && op.Request == nil {
+		errorResponse(http.StatusRequestEntityTooLarge)
+	}
+	if op.Conditional && op.Method == http.MethodGet {
+		success["headers"] = map[string]any{"ETag": map[string]any{"schema": map[string]any{"type": "string"}}}
+		responses[strconv.Itoa(http.StatusNotModified)] = map[string]any{"description": http.StatusText(http.StatusNotModified)}
+	} else if op.Conditional {
+		errorResponse(http.StatusPreconditionFailed)
+		errorResponse(http.StatusPreconditionRequired)
+	}
+	if op.Batch {
+		responses[strconv.Itoa(http.StatusMultiStatus)] = map[string]any{
+			"description": http.StatusText(http.StatusMultiStatus),
+			"content":     success["content"],
+		}
+		errorResponse(http.StatusNotFound)
+		errorResponse(http.StatusPreconditionFailed)
+		errorResponse(http.StatusPreconditionRequired)
+	}
+	if op.Idempotent {
+		errorResponse(http.StatusConflict)
+		errorResponse(http.StatusUnprocessableEntity)
+	}
+	if op.Cached {
+		headers, _ := success["headers"].(map[string]any)
+		if headers == nil {
+			headers = map[string]any{}
+			success["headers"] = headers
+		}
+		headers["Cache-Control"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	}
+	if op.Tag != "operations" {
+		errorResponse(http.StatusTooManyRequests)
+		errorResponse(http.StatusInternalServerError)
+	}
+
+	result["responses"] = responses
+	return result
+}
+
+func operationID(op Operation) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		id.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return id.String()
+}
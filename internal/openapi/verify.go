@@ -0,0 +1,40 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Verify reports documented operations which the router doesn't serve and
+// routes which aren't documented. It's run on startup, so the specification
+// can't silently drift from the routes.
+func Verify(routes chi.Routes) []string {
+	documented := map[string]bool{}
+	for _, op := range operations {
+		documented[op.Method+" "+op.Path] = true
+	}
+
+	routed := map[string]bool{}
+	err := chi.Walk(routes, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		return []string{fmt.Sprintf("cannot walk routes: %v", err)}
+	}
+
+	var drift []string
+	for _, op := range operations {
+		if !routed[op.Method+" "+op.Path] {
+			drift = append(drift, fmt.Sprintf("%s %s is documented but not routed", op.Method, op.Path))
+		}
+	}
+	for route := range routed {
+		if !documented[route] {
+			drift = append(drift, fmt.Sprintf("%s is routed but not documented", route))
+		}
+	}
+	return drift
+}
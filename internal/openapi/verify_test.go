@@ -0,0 +1,116 @@
+package openapi_test
+
+import (
+	"example/library-service/internal/auth"
+	"example/library-service/internal/health"
+	"example/library-service/internal/openapi"
+	"example/library-service/internal/router"
+	"example/library-service/internal/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newServer returns the router main serves. The handlers aren't called, so
+// they get no database.
+func newServer(t *testing.T) *chi.Mux {
+	keys, err := auth.SetupKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server.New(server.Deps{
+		AuthStore: auth.NewAuthStore(nil),
+		Keys:      keys,
+		Health:    health.NewHealthHandler(nil, 0),
+	})
+}
+
+func TestVerify(t *testing.T) {
+	for _, drift := range openapi.Verify(newServer(t)) {
+		t.Error(drift)
+	}
+}
+
+func TestVerifyReportsDrift(t *testing.T) {
+	tests := []struct {
+		name  string
+		route func(r chi.Router)
+		want  string
+	}{
+		{
+			name:  "undocumented route",
+			route: func(r chi.Router) { r.Get("/undocumented", http.NotFound) },
+			want:  "GET /undocumented is routed but not documented",
+		},
+		{
+			name:  "undocumented method",
+			route: func(r chi.Router) { r.Put("/metrics", http.NotFound) },
+			want:  "PUT /metrics is routed but not documented",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t)
+			tt.route(s)
+
+			drift := openapi.Verify(s)
+			if len(drift) != 1 || drift[0] != tt.want {
+				t.Errorf("Verify() = %q, want [%q]", drift, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyReportsMissingRoutes(t *testing.T) {
+	drift := openapi.Verify(router.New())
+	if len(drift) != len(openapi.Operations()) {
+		t.Errorf("Verify() of an empty router reported %d drifts, want one per operation (%d)", len(drift), len(openapi.Operations()))
+	}
+}
+
+func TestDocsAreServedLocally(t *testing.T) {
+	s := newServer(t)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /docs status = %d", w.Code)
+	}
+	if policy := w.Header().Get("Content-Security-Policy"); !strings.Contains(policy, "script-src 'self'") {
+		t.Errorf("Content-Security-Policy = %q", policy)
+	}
+	page := w.Body.String()
+	if strings.Contains(page, "://") {
+		t.Error("the page loads resources of other origins")
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/docs/docs.js", http.StatusOK, "text/javascript"},
+		{"/docs/docs.css", http.StatusOK, "text/css"},
+		{"/docs/index.html", http.StatusNotFound, ""},
+		{"/docs/missing.js", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if tt.status == http.StatusOK && !strings.Contains(page, `"`+tt.path+`"`) {
+				t.Errorf("the page doesn't reference %s", tt.path)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status || !strings.HasPrefix(w.Header().Get("Content-Type"), tt.contentType) {
+				t.Errorf("status = %d, Content-Type = %q, want %d, %q", w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType)
+			}
+		})
+	}
+}
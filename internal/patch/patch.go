@@ -0,0 +1,202 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ContentType is the media type of RFC 7396 merge patches. Plain
+// application/json is accepted as well.
+const ContentType = "application/merge-patch+json"
+
+// Patch is a JSON merge patch: the members of the patch document by name. A
+// missing member is left unchanged, a null one is removed.
+type Patch map[string]json.RawMessage
+
+// Error describes a patch which can't be applied; it's safe to return to the
+// client.
+type Error struct {
+	Field   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Supported reports whether the request carries a merge patch.
+func Supported(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == ContentType || mediaType == "application/json")
+}
+
+// Decode reads a patch document, which has to be a JSON object whose members
+// are all in fields.
+func Decode(body io.Reader, fields ...string) (Patch, error) {
+	var p Patch
+	if err := json.NewDecoder(body).Decode(&p); err != nil || p == nil {
+		return nil, &Error{Message: "patch must be a JSON object"}
+	}
+
+	for name := range p {
+		if !slices.Contains(fields, name) {
+			return nil, &Error{Field: name, Message: "can't be patched"}
+		}
+	}
+
+	return p, nil
+}
+
+// String returns the patched value of a field which can't be removed.
+func (p Patch) String(name string) (value string, ok bool, err error) {
+	raw, ok := p[name]
+	if !ok {
+		return "", false, nil
+	}
+
+	if isNull(raw) {
+		return "", true, &Error{Field: name, Message: "can't be removed"}
+	}
+	if json.Unmarshal(raw, &value) != nil {
+		return "", true, &Error{Field: name, Message: "must be a string"}
+	}
+	if strings.TrimSpace(value) == "" {
+		return "", true, &Error{Field: name, Message: "can't be empty"}
+	}
+
+	return value, true, nil
+}
+
+// NullableString returns the patched value of a field which may be removed,
+// in which case value is nil.
+func (p Patch) NullableString(name string) (value *string, ok bool, err error) {
+	if raw, ok := p[name]; ok && isNull(raw) {
+		return nil, true, nil
+	}
+
+	s, ok, err := p.String(name)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return &s, true, nil
+}
+
+// Strings returns the patched value of a list of strings; removing the field
+// empties the list.
+func (p Patch) Strings(name string) (value []string, ok bool, err error) {
+	raw, ok := p[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if isNull(raw) {
+		return []string{}, true, nil
+	}
+	if json.Unmarshal(raw, &value) != nil {
+		return nil, true, &Error{Field: name, Message: "must be a list of strings"}
+	}
+	if value == nil {
+		value = []string{}
+	}
+
+	return value, true, nil
+}
+
+// Int returns the patched value of a numeric field which can't be removed.
+func (p Patch) Int(name string) (value int, ok bool, err error) {
+	raw, ok := p[name]
+	if !ok {
+		return 0, false, nil
+	}
+
+	if isNull(raw) {
+		return 0, true, &Error{Field: name, Message: "can't be removed"}
+	}
+	if json.Unmarshal(raw, &value) != nil {
+		return 0, true, &Error{Field: name, Message: "must be an integer"}
+	}
+
+	return value, true, nil
+}
+
+// Object returns the nested patch of an object field, e.g. {"author": {"id": ...}},
+// restricted to fields.
+func (p Patch) Object(name string, fields ...string) (nested Patch, ok bool, err error) {
+	raw, ok := p[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if isNull(raw) {
+		return nil, true, &Error{Field: name, Message: "can't be removed"}
+	}
+
+	if nested, err = Decode(strings.NewReader(string(raw)), fields...); err != nil {
+		return nil, true, Nested(name, err)
+	}
+
+	return nested, true, nil
+}
+
+// Nested qualifies an error of a nested patch with the field holding it.
+func Nested(name string, err error) error {
+	if patchErr, ok := err.(*Error); ok {
+		if patchErr.Field == "" {
+			return &Error{Field: name, Message: patchErr.Message}
+		}
+		return &Error{Field: name + "." + patchErr.Field, Message: patchErr.Message}
+	}
+	return err
+}
+
+// UUID returns the patched value of an id field which can't be removed.
+func (p Patch) UUID(name string) (value uuid.UUID, ok bool, err error) {
+	s, ok, err := p.String(name)
+	if !ok || err != nil {
+		return value, ok, err
+	}
+
+	if value, err = uuid.Parse(s); err != nil {
+		return value, true, &Error{Field: name, Message: "must be a uuid"}
+	}
+
+	return value, true, nil
+}
+
+// Update builds a parameterized update of the given columns of the row with
+// the id and version, which is bumped, returning every column, so stores can
+// select from it in a common table expression. Columns are set in a stable
+// order; their names come from the stores, never from the request.
+func Update(table string, id uuid.UUID, version int, set map[string]any) (query string, args []any) {
+	columns := make([]string, 0, len(set))
+	for column := range set {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	assignments := make([]string, len(columns))
+	for i, column := range columns {
+		assignments[i] = fmt.Sprintf("%s=$%d", column, i+1)
+		args = append(args, set[column])
+	}
+	assignments = append(assignments, "version=version+1")
+	args = append(args, id, version)
+
+	query = fmt.Sprintf("update %s set %s where id=$%d and version=$%d returning *", table, strings.Join(assignments, ", "), len(args)-1, len(args))
+	return query, args
+}
+
+func isNull(raw json.RawMessage) bool {
+	return strings.TrimSpace(string(raw)) == "null"
+}
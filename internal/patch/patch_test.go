@@ -0,0 +1,138 @@
+package patch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSupported(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{ContentType, true},
+		{ContentType + "; charset=utf-8", true},
+		{"application/json", true},
+		{"application/json-patch+json", false},
+		{"text/plain", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			if got := Supported(r); got != tt.want {
+				t.Errorf("Supported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"known fields", `{"name": "Dune", "genre": null}`, ""},
+		{"empty object", `{}`, ""},
+		{"unknown field", `{"id": "x"}`, "id: can't be patched"},
+		{"array", `[]`, "patch must be a JSON object"},
+		{"null", `null`, "patch must be a JSON object"},
+		{"invalid JSON", `{`, "patch must be a JSON object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(tt.body), "name", "genre")
+			if got := errorString(err); got != tt.err {
+				t.Errorf("Decode() error = %q, want %q", got, tt.err)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	p, err := Decode(strings.NewReader(`{
+		"name": "Dune", "blank": " ", "number": 3, "nothing": null,
+		"list": ["a", "b"], "id": "6f1c2b4e-0d6a-4c1e-9a57-2f7d3c8b9e10", "badId": "42",
+		"author": {"id": "6f1c2b4e-0d6a-4c1e-9a57-2f7d3c8b9e10", "name": "x"}
+	}`), "name", "blank", "number", "nothing", "list", "id", "badId", "author")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		get   func() (any, bool, error)
+		value any
+		ok    bool
+		err   string
+	}{
+		{"string", func() (any, bool, error) { return p.String("name") }, "Dune", true, ""},
+		{"missing string", func() (any, bool, error) { return p.String("missing") }, "", false, ""},
+		{"removed string", func() (any, bool, error) { return p.String("nothing") }, "", true, "nothing: can't be removed"},
+		{"blank string", func() (any, bool, error) { return p.String("blank") }, "", true, "blank: can't be empty"},
+		{"number as string", func() (any, bool, error) { return p.String("number") }, "", true, "number: must be a string"},
+		{"removed nullable string", func() (any, bool, error) {
+			v, ok, err := p.NullableString("nothing")
+			return v == nil, ok, err
+		}, true, true, ""},
+		{"nullable string", func() (any, bool, error) {
+			v, ok, err := p.NullableString("name")
+			return *v, ok, err
+		}, "Dune", true, ""},
+		{"strings", func() (any, bool, error) { return p.Strings("list") }, []string{"a", "b"}, true, ""},
+		{"removed strings", func() (any, bool, error) { return p.Strings("nothing") }, []string{}, true, ""},
+		{"int", func() (any, bool, error) { return p.Int("number") }, 3, true, ""},
+		{"string as int", func() (any, bool, error) { return p.Int("name") }, 0, true, "name: must be an integer"},
+		{"uuid", func() (any, bool, error) { return p.UUID("id") }, uuid.MustParse("6f1c2b4e-0d6a-4c1e-9a57-2f7d3c8b9e10"), true, ""},
+		{"invalid uuid", func() (any, bool, error) { return p.UUID("badId") }, uuid.UUID{}, true, "badId: must be a uuid"},
+		{"object with unknown field", func() (any, bool, error) {
+			nested, ok, err := p.Object("author", "id")
+			return nested == nil, ok, err
+		}, true, true, "author.name: can't be patched"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok, err := tt.get()
+			if got := errorString(err); got != tt.err {
+				t.Fatalf("error = %q, want %q", got, tt.err)
+			}
+			if ok != tt.ok {
+				t.Errorf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(value, tt.value) {
+				t.Errorf("value = %#v, want %#v", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	id := uuid.New()
+
+	query, args := Update("books", id, 4, map[string]any{"name": "Dune", "genre": nil})
+
+	wantQuery := "update books set genre=$1, name=$2, version=version+1 where id=$3 and version=$4 returning *"
+	if query != wantQuery {
+		t.Errorf("query = %q, want %q", query, wantQuery)
+	}
+	if wantArgs := []any{nil, "Dune", id, 4}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
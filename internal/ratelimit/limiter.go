@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy describes a token bucket: Burst requests may be made at once and
+// the bucket refills at Rate requests per second.
+type Policy struct {
+	Name  string
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter keeps one token bucket per key for a single policy.
+type Limiter struct {
+	policy  Policy
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// Decision is the outcome of Allow, used to fill RateLimit-* headers.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+const idleTTL = 10 * time.Minute
+
+func NewLimiter(policy Policy) *Limiter {
+	l := &Limiter{policy: policy, buckets: make(map[string]*bucket), now: time.Now}
+	go l.cleanup()
+	return l
+}
+
+func (l *Limiter) Allow(key string) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := float64(l.policy.Burst)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(burst, b.tokens+elapsed*l.policy.Rate)
+	b.lastSeen = now
+
+	decision := Decision{Limit: l.policy.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = l.secondsFor(1 - b.tokens)
+	}
+
+	decision.Remaining = int(math.Floor(b.tokens))
+	decision.Reset = l.secondsFor(burst - b.tokens)
+	return decision
+}
+
+func (l *Limiter) secondsFor(tokens float64) time.Duration {
+	if l.policy.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens/l.policy.Rate)) * time.Second
+}
+
+func (l *Limiter) cleanup() {
+	ticker := time.NewTicker(idleTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if l.now().Sub(b.lastSeen) > idleTTL {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a manually advanced time source for the limiter.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(policy Policy) (*Limiter, *clock) {
+	c := &clock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter(policy)
+	l.now = c.Now
+	return l, c
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l, _ := newTestLimiter(Policy{Name: "test", Rate: 1, Burst: 3})
+
+	tests := []struct {
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{true, 2, time.Second, 0},
+		{true, 1, 2 * time.Second, 0},
+		{true, 0, 3 * time.Second, 0},
+		{false, 0, 3 * time.Second, time.Second},
+	}
+
+	for i, tt := range tests {
+		d := l.Allow("a")
+		if d.Allowed != tt.allowed || d.Remaining != tt.remaining || d.Reset != tt.reset || d.RetryAfter != tt.retryAfter || d.Limit != 3 {
+			t.Errorf("request %d: Allow() = %+v, want allowed %v, remaining %d, reset %v, retry after %v",
+				i+1, d, tt.allowed, tt.remaining, tt.reset, tt.retryAfter)
+		}
+	}
+
+	if d := l.Allow("b"); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("other key: Allow() = %+v, want a full bucket", d)
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{"too early", 500 * time.Millisecond, false, 0, 2 * time.Second},
+		{"one token", 2 * time.Second, true, 0, 0},
+		{"two tokens", 4 * time.Second, true, 1, 0},
+		{"never past the burst", time.Hour, true, 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, c := newTestLimiter(Policy{Name: "test", Rate: 0.5, Burst: 3})
+			for i := 0; i < 3; i++ {
+				l.Allow("a")
+			}
+
+			c.now = c.now.Add(tt.elapsed)
+			d := l.Allow("a")
+			if d.Allowed != tt.allowed || d.Remaining != tt.remaining || d.RetryAfter != tt.retryAfter {
+				t.Errorf("Allow() = %+v, want allowed %v, remaining %d, retry after %v", d, tt.allowed, tt.remaining, tt.retryAfter)
+			}
+		})
+	}
+}
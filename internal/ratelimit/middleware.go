@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"example/library-service/internal/auth"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/logging"
+	"example/library-service/internal/metrics"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+
+// Middleware throttles requests with the given limiter. Requests carrying a
+// valid bearer token or an API key verified recently are limited per user or
+// key, all others per client IP, including those with invalid credentials.
+// Telling them apart takes no query, so made up keys can't load the database
+// before they are throttled.
+func Middleware(limiter *Limiter, authStore *auth.AuthStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decision := limiter.Allow(key(r, authStore))
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(decision.Reset.Seconds())))
+		w.Header().Set("RateLimit-Policy", limiter.policy.Name)
+
+		if !decision.Allowed {
+			slog.WarnContext(r.Context(), "ratelimit.Middleware() - rate limit exceeded", "policy", limiter.policy.Name, "path", logging.RedactPath(r))
+			metrics.RateLimited.WithLabelValues(limiter.policy.Name).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(decision.RetryAfter.Seconds())))
+			errors.HandleError(429, "Too Many Requests", w)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func key(r *http.Request, authStore *auth.AuthStore) string {
+	if caller, ok := auth.Caller(r, authStore); ok {
+		return caller
+	}
+
+	return "ip:" + ClientIP(r)
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only
+// honoured when TRUST_PROXY_HEADERS=true, i.e. behind a trusted proxy.
+func ClientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"example/library-service/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMiddlewareHeaders(t *testing.T) {
+	l, _ := newTestLimiter(Policy{Name: "auth", Rate: 0.1, Burst: 2})
+	handler := Middleware(l, auth.NewAuthStore(nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		status     int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusNoContent, "1", "10", ""},
+		{http.StatusNoContent, "0", "20", ""},
+		{http.StatusTooManyRequests, "0", "20", "10"},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		headers := map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": tt.remaining,
+			"RateLimit-Reset":     tt.reset,
+			"RateLimit-Policy":    "auth",
+			"Retry-After":         tt.retryAfter,
+		}
+		if w.Code != tt.status {
+			t.Errorf("request %d: status = %d, want %d", i+1, w.Code, tt.status)
+		}
+		for name, want := range headers {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("request %d: %s = %q, want %q", i+1, name, got, want)
+			}
+		}
+	}
+}
+
+func TestMiddlewareKeys(t *testing.T) {
+	token, err := auth.GenerateToken(uuid.New(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, _ := newTestLimiter(Policy{Name: "test", Rate: 0.1, Burst: 1})
+	handler := Middleware(l, auth.NewAuthStore(nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		addr   string
+		header string
+		status int
+	}{
+		{"first request of an ip", "192.0.2.1:1234", "", http.StatusOK},
+		{"same ip, other port", "192.0.2.1:5678", "", http.StatusTooManyRequests},
+		{"invalid credentials count against the ip", "192.0.2.1:1234", "Bearer forged", http.StatusTooManyRequests},
+		{"other ip", "192.0.2.2:1234", "", http.StatusOK},
+		{"user has an own bucket", "192.0.2.1:1234", "Bearer " + token, http.StatusOK},
+		{"user from another ip", "192.0.2.3:1234", "Bearer " + token, http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/books", nil)
+			r.RemoteAddr = tt.addr
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package review
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/utils"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const maxTextLength = 5000
+
+// ReviewRequest rates a book from 1 to 5 stars; the text is optional.
+type ReviewRequest struct {
+	Rating int     `json:"rating"`
+	Text   *string `json:"text"`
+}
+
+type ReviewHandler struct {
+	reviewStore *ReviewStore
+	authStore   *auth.AuthStore
+}
+
+func NewReviewHandler(db *sql.DB, authStore *auth.AuthStore, catalog *cache.Namespace) *ReviewHandler {
+	store := NewReviewStore(db, catalog)
+	return &ReviewHandler{store, authStore}
+}
+
+// Routes registers the review routes. Users edit and delete their own
+// reviews, moderators hide and unhide those of anyone.
+func (reviewHandler *ReviewHandler) Routes(r chi.Router) {
+	r.Get("/books/{id}/reviews", reviewHandler.getReviews)
+	r.Post("/books/{id}/reviews", reviewHandler.createReview)
+	r.Get("/books/{id}/reviews/{reviewId}", reviewHandler.getReview)
+	r.Put("/books/{id}/reviews/{reviewId}", reviewHandler.updateReview)
+	r.Patch("/books/{id}/reviews/{reviewId}", reviewHandler.patchReview)
+	r.Delete("/books/{id}/reviews/{reviewId}", reviewHandler.deleteReview)
+	r.Post("/books/{id}/reviews/{reviewId}/hide", reviewHandler.hideReview)
+	r.Post("/books/{id}/reviews/{reviewId}/unhide", reviewHandler.unhideReview)
+}
+
+// getReviews lists the reviews of a book, the latest first. Moderators see
+// hidden reviews as well.
+func (ReviewHandler *ReviewHandler) getReviews(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, ReviewHandler.authStore, auth.ScopeCatalogRead)
+	if err != nil {
+		slog.WarnContext(r.Context(), "ReviewHandler.getReviews() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	bookId, err := utils.PathUUID(r, "id")
+	if err != nil {
+		slog.WarnContext(r.Context(), "ReviewHandler.getReviews() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	reviews, err := ReviewHandler.reviewStore.GetReviews(r.Context(), bookId, user.Role == entity.MODERATOR)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", bookId), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(reviews)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ReviewHandler.getReviews() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.getReviews() - successfully finished req", "book", bookId, "reviews", len(reviews))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (ReviewHandler *ReviewHandler) getReview(w http.ResponseWriter, r *http.Request) {
+	user, err := auth.Authenticate(r, ReviewHandler.authStore, auth.ScopeCatalogRead)
+	if err != nil {
+		slog.WarnContext(r.Context(), "ReviewHandler.getReview() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	bookId, id, ok := reviewIds(w, r)
+	if !ok {
+		return
+	}
+
+	review, ok := ReviewHandler.loadReview(w, r, user, bookId, id)
+	if !ok {
+		return
+	}
+
+	jsonBytes, err := json.Marshal(review)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ReviewHandler.getReview() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.getReview() - successfully finished req", "id", review.Id)
+
+	if etag.NotModified(w, r, etag.Of(review.Id, review.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (ReviewHandler *ReviewHandler) createReview(w http.ResponseWriter, r *http.Request) {
+	user, ok := ReviewHandler.authorize(w, r, "ReviewHandler.createReview()")
+	if !ok {
+		return
+	}
+
+	bookId, err := utils.PathUUID(r, "id")
+	if err != nil {
+		slog.WarnContext(r.Context(), "ReviewHandler.createReview() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	review, ok := decodeReview(w, r, "ReviewHandler.createReview()")
+	if !ok {
+		return
+	}
+	review.BookId = bookId
+	review.UserId = user.Id
+
+	savedReview, err := ReviewHandler.reviewStore.CreateReview(r.Context(), review)
+	if err != nil {
+		switch err {
+		case errAlreadyReviewed:
+			errors.HandleError(409, "you have already reviewed this book, edit your review instead", w)
+		case errBookNotFound:
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", bookId), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.createReview() - successfully finished req", "id", savedReview.Id)
+	writeReview(w, r, "ReviewHandler.createReview()", http.StatusCreated, savedReview)
+}
+
+func (ReviewHandler *ReviewHandler) updateReview(w http.ResponseWriter, r *http.Request) {
+	user, ok := ReviewHandler.authorize(w, r, "ReviewHandler.updateReview()")
+	if !ok {
+		return
+	}
+
+	bookId, id, ok := reviewIds(w, r)
+	if !ok {
+		return
+	}
+
+	review, ok := decodeReview(w, r, "ReviewHandler.updateReview()")
+	if !ok {
+		return
+	}
+	review.Id = id
+
+	current, ok := ReviewHandler.ownReview(w, r, user, bookId, id)
+	if !ok {
+		return
+	}
+
+	updatedReview, err := ReviewHandler.reviewStore.UpdateReview(r.Context(), review, current.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.updateReview() - successfully finished req", "id", updatedReview.Id)
+	writeReview(w, r, "ReviewHandler.updateReview()", http.StatusOK, updatedReview)
+}
+
+// patchReview changes the rating or text of the user's own review with a
+// JSON merge patch.
+func (ReviewHandler *ReviewHandler) patchReview(w http.ResponseWriter, r *http.Request) {
+	user, ok := ReviewHandler.authorize(w, r, "ReviewHandler.patchReview()")
+	if !ok {
+		return
+	}
+
+	bookId, id, ok := reviewIds(w, r)
+	if !ok {
+		return
+	}
+
+	if !patch.Supported(r) {
+		errors.HandleError(415, fmt.Sprintf("Content-Type must be %v", patch.ContentType), w)
+		return
+	}
+
+	set, err := reviewColumns(r.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "ReviewHandler.patchReview() - received invalid patch", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	current, ok := ReviewHandler.ownReview(w, r, user, bookId, id)
+	if !ok {
+		return
+	}
+
+	patchedReview := current
+	if len(set) > 0 {
+		if patchedReview, err = ReviewHandler.reviewStore.PatchReview(r.Context(), id, current.Version, set); err != nil {
+			if err == sql.ErrNoRows {
+				etag.Changed(w)
+				return
+			}
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.patchReview() - successfully finished req", "id", id)
+	writeReview(w, r, "ReviewHandler.patchReview()", http.StatusOK, patchedReview)
+}
+
+func (ReviewHandler *ReviewHandler) deleteReview(w http.ResponseWriter, r *http.Request) {
+	user, ok := ReviewHandler.authorize(w, r, "ReviewHandler.deleteReview()")
+	if !ok {
+		return
+	}
+
+	bookId, id, ok := reviewIds(w, r)
+	if !ok {
+		return
+	}
+
+	current, ok := ReviewHandler.ownReview(w, r, user, bookId, id)
+	if !ok {
+		return
+	}
+
+	if err := ReviewHandler.reviewStore.DeleteReview(r.Context(), id, current.Version); err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "ReviewHandler.deleteReview() - successfully finished req", "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ReviewHandler *ReviewHandler) hideReview(w http.ResponseWriter, r *http.Request) {
+	ReviewHandler.setHidden(w, r, "ReviewHandler.hideReview()", true)
+}
+
+func (ReviewHandler *ReviewHandler) unhideReview(w http.ResponseWriter, r *http.Request) {
+	ReviewHandler.setHidden(w, r, "ReviewHandler.unhideReview()", false)
+}
+
+// setHidden hides or unhides a review. Only moderators do so, and as both
+// end in the same state when repeated, they don't need If-Match.
+func (ReviewHandler *ReviewHandler) setHidden(w http.ResponseWriter, r *http.Request, method string, hidden bool) {
+	user, ok := ReviewHandler.authorize(w, r, method)
+	if !ok {
+		return
+	}
+
+	if user.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), method+" - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	bookId, id, ok := reviewIds(w, r)
+	if !ok {
+		return
+	}
+
+	updatedReview, err := ReviewHandler.reviewStore.SetHidden(r.Context(), bookId, id, hidden)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("review with id %v wasn't found", id), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), method+" - successfully finished req", "id", id, "hidden", hidden)
+	writeReview(w, r, method, http.StatusOK, updatedReview)
+}
+
+func (ReviewHandler *ReviewHandler) authorize(w http.ResponseWriter, r *http.Request, method string) (entity.User, bool) {
+	user, err := auth.Authenticate(r, ReviewHandler.authStore, auth.ScopeReviewsWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), method+" - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return user, false
+	}
+	return user, true
+}
+
+// loadReview loads a review of the book. Hidden reviews are only visible to
+// their author and to moderators, and are missing for everyone else.
+func (ReviewHandler *ReviewHandler) loadReview(w http.ResponseWriter, r *http.Request, user entity.User, bookId uuid.UUID, id uuid.UUID) (review entity.Review, ok bool) {
+	review, err := ReviewHandler.reviewStore.GetReview(r.Context(), bookId, id)
+	if err == nil && review.Hidden && review.UserId != user.Id && user.Role != entity.MODERATOR {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("review with id %v wasn't found", id), w)
+			return review, false
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return review, false
+	}
+	return review, true
+}
+
+// ownReview loads the review a write applies to, checks that the user wrote
+// it and that the client has seen its current state.
+func (ReviewHandler *ReviewHandler) ownReview(w http.ResponseWriter, r *http.Request, user entity.User, bookId uuid.UUID, id uuid.UUID) (review entity.Review, ok bool) {
+	if review, ok = ReviewHandler.loadReview(w, r, user, bookId, id); !ok {
+		return review, false
+	}
+
+	if review.UserId != user.Id {
+		slog.WarnContext(r.Context(), "ReviewHandler.ownReview() - user doesn't own the review", "id", id)
+		errors.HandleError(403, "403 Forbidden", w)
+		return review, false
+	}
+
+	review.Version, ok = etag.CheckIfMatch(w, r, review.Id, review.Version)
+	return review, ok
+}
+
+// writeReview answers a write with the review and its ETag, so the client
+// can chain writes without reading it again.
+func writeReview(w http.ResponseWriter, r *http.Request, method string, status int, review entity.Review) {
+	jsonBytes, err := json.Marshal(review)
+	if err != nil {
+		slog.ErrorContext(r.Context(), method+" - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag.Of(review.Id, review.Version))
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+func reviewIds(w http.ResponseWriter, r *http.Request) (bookId uuid.UUID, id uuid.UUID, ok bool) {
+	var err error
+	if bookId, err = utils.PathUUID(r, "id"); err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return bookId, id, false
+	}
+	if id, err = utils.PathUUID(r, "reviewId"); err != nil {
+		errors.HandleError(400, "invalid reviewId", w)
+		return bookId, id, false
+	}
+	return bookId, id, true
+}
+
+// decodeReview reads and validates the rating and text of a review, where
+// an empty text counts as missing.
+func decodeReview(w http.ResponseWriter, r *http.Request, method string) (review entity.Review, ok bool) {
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), method+" - received decode error", "err", err)
+		errors.HandleError(400, "review must be a JSON object", w)
+		return review, false
+	}
+
+	if req.Rating < 1 || req.Rating > 5 {
+		errors.HandleError(400, "rating must be between 1 and 5", w)
+		return review, false
+	}
+
+	if req.Text != nil && strings.TrimSpace(*req.Text) == "" {
+		req.Text = nil
+	}
+	if req.Text != nil && utf8.RuneCountInString(*req.Text) > maxTextLength {
+		errors.HandleError(400, fmt.Sprintf("text must not be longer than %d characters", maxTextLength), w)
+		return review, false
+	}
+
+	return entity.Review{Rating: req.Rating, Text: req.Text}, true
+}
+
+// reviewColumns maps a merge patch of a review to the columns it sets, with
+// the checks of decodeReview. A text is removed with null.
+func reviewColumns(body io.Reader) (set map[string]any, err error) {
+	p, err := patch.Decode(body, "rating", "text")
+	if err != nil {
+		return nil, err
+	}
+
+	set = map[string]any{}
+	if rating, ok, err := p.Int("rating"); err != nil {
+		return nil, err
+	} else if ok {
+		if rating < 1 || rating > 5 {
+			return nil, &patch.Error{Field: "rating", Message: "must be between 1 and 5"}
+		}
+		set["rating"] = rating
+	}
+
+	if text, ok, err := p.NullableString("text"); err != nil {
+		return nil, err
+	} else if ok {
+		if text != nil && utf8.RuneCountInString(*text) > maxTextLength {
+			return nil, &patch.Error{Field: "text", Message: fmt.Sprintf("must not be longer than %d characters", maxTextLength)}
+		}
+		set["text"] = text
+	}
+
+	return set, nil
+}
@@ -0,0 +1,247 @@
+package review
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/book"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+func bearer(t *testing.T, role int) string {
+	t.Helper()
+	token, err := auth.GenerateToken(uuid.New(), role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func newTestHandler(db *sql.DB) *ReviewHandler {
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	return NewReviewHandler(db, auth.NewAuthStore(db), catalog)
+}
+
+func request(handler *ReviewHandler, method string, path string, authHeader string, contentType string, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", authHeader)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestReviewColumns(t *testing.T) {
+	text := "A delight"
+
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]any
+		wantErr bool
+	}{
+		{"empty patch", `{}`, map[string]any{}, false},
+		{"rating", `{"rating": 4}`, map[string]any{"rating": 4}, false},
+		{"text", `{"text": "A delight"}`, map[string]any{"text": &text}, false},
+		{"removed text", `{"text": null}`, map[string]any{"text": (*string)(nil)}, false},
+		{"removed rating", `{"rating": null}`, nil, true},
+		{"rating too low", `{"rating": 0}`, nil, true},
+		{"rating too high", `{"rating": 6}`, nil, true},
+		{"fractional rating", `{"rating": 4.5}`, nil, true},
+		{"text too long", `{"text": "` + strings.Repeat("a", maxTextLength+1) + `"}`, nil, true},
+		{"hidden", `{"hidden": true}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := reviewColumns(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reviewColumns() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reviewColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// These requests are rejected before any query, so they need no database.
+func TestPatchReviewRejects(t *testing.T) {
+	handler := newTestHandler(nil)
+	user := bearer(t, entity.USER)
+	path := "/books/" + uuid.NewString() + "/reviews/" + uuid.NewString()
+
+	tests := []struct {
+		name        string
+		path        string
+		header      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"anonymous", path, "", "application/merge-patch+json", `{"rating": 4}`, http.StatusUnauthorized},
+		{"invalid id", "/books/1/reviews/" + uuid.NewString(), user, "application/merge-patch+json", `{"rating": 4}`, http.StatusBadRequest},
+		{"invalid reviewId", "/books/" + uuid.NewString() + "/reviews/1", user, "application/merge-patch+json", `{"rating": 4}`, http.StatusBadRequest},
+		{"other content type", path, user, "text/plain", `{"rating": 4}`, http.StatusUnsupportedMediaType},
+		{"invalid rating", path, user, "application/merge-patch+json", `{"rating": 9}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(handler, http.MethodPatch, tt.path, tt.header, tt.contentType, tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertUser returns the bearer token of a new user.
+func insertUser(t *testing.T, db *sql.DB, role int) string {
+	t.Helper()
+	var id uuid.UUID
+	name := uuid.NewString()
+	if err := db.QueryRow(`
+		insert into users(name, mail, password, role, created_at) values($1, $2, 'hash', $3, now()) returning id
+	`, name, name+"@example.com", role).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := auth.GenerateToken(id, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return v
+}
+
+func TestReviews(t *testing.T) {
+	db := testDB(t)
+	// Books are read from the catalog the reviews invalidate.
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	handler := NewReviewHandler(db, auth.NewAuthStore(db), catalog)
+	books := book.NewBookStore(db, catalog)
+	alice, bob, moderator := insertUser(t, db, entity.USER), insertUser(t, db, entity.USER), insertUser(t, db, entity.MODERATOR)
+
+	var bookId uuid.UUID
+	if err := db.QueryRow(`
+		insert into books(name, genre, publication_date, created_at) values('Mort', 'fantasy', '1987-11-12', now()) returning id
+	`).Scan(&bookId); err != nil {
+		t.Fatal(err)
+	}
+	reviews := "/books/" + bookId.String() + "/reviews"
+
+	w := request(handler, http.MethodPost, reviews, alice, "application/json", `{"rating": 5, "text": "Death takes an apprentice"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	own := decode[entity.Review](t, w)
+	ownTag := w.Header().Get("ETag")
+
+	w = request(handler, http.MethodPost, reviews, bob, "application/json", `{"rating": 2}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	other := decode[entity.Review](t, w)
+
+	// Every user reviews a book once.
+	if w = request(handler, http.MethodPost, reviews, alice, "application/json", `{"rating": 1}`); w.Code != http.StatusConflict {
+		t.Errorf("second review status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	assertRatings := func(average float64, count int) {
+		t.Helper()
+		b, err := books.GetBook(context.Background(), bookId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.AverageRating == nil || *b.AverageRating != average || b.ReviewCount != count {
+			t.Errorf("ratings = %v, %d, want %v, %d", b.AverageRating, b.ReviewCount, average, count)
+		}
+	}
+	assertRatings(3.5, 2)
+
+	// Only its author changes a review, even with its current ETag.
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		r := httptest.NewRequest(method, reviews+"/"+own.Id.String(), strings.NewReader(`{"rating": 1}`))
+		r.Header.Set("Authorization", bob)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("If-Match", ownTag)
+		w = httptest.NewRecorder()
+		router := chi.NewRouter()
+		handler.Routes(router)
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s of another user's review status = %d, want %d", method, w.Code, http.StatusForbidden)
+		}
+	}
+
+	if w = request(handler, http.MethodPost, reviews+"/"+other.Id.String()+"/hide", bob, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("hide by user status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w = request(handler, http.MethodPost, reviews+"/"+other.Id.String()+"/hide", moderator, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("hide status = %d: %s", w.Code, w.Body)
+	}
+
+	// A hidden review is only visible to its author and moderators, and
+	// doesn't count towards the ratings.
+	visibility := []struct {
+		name   string
+		header string
+		status int
+		listed int
+	}{
+		{"another user", alice, http.StatusNotFound, 1},
+		{"its author", bob, http.StatusOK, 1},
+		{"moderator", moderator, http.StatusOK, 2},
+	}
+	for _, v := range visibility {
+		if w = request(handler, http.MethodGet, reviews+"/"+other.Id.String(), v.header, "", ""); w.Code != v.status {
+			t.Errorf("get hidden review as %s status = %d, want %d", v.name, w.Code, v.status)
+		}
+		if w = request(handler, http.MethodGet, reviews, v.header, "", ""); len(decode[[]entity.Review](t, w)) != v.listed {
+			t.Errorf("reviews listed to %s = %s, want %d", v.name, w.Body, v.listed)
+		}
+	}
+	assertRatings(5, 1)
+}
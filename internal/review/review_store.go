@@ -0,0 +1,251 @@
+package review
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Postgres error codes raised when a user reviews a book twice, or reviews
+// a book which doesn't exist.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+var (
+	errAlreadyReviewed = errors.New("book was already reviewed by the user")
+	errBookNotFound    = errors.New("book wasn't found")
+)
+
+type ReviewStore struct {
+	db    utils.DBTX
+	cache *cache.Namespace
+}
+
+// NewReviewStore invalidates the catalog namespace on writes, as books embed
+// their ratings. Reviews themselves aren't cached, moderators see more of
+// them than others.
+func NewReviewStore(db *sql.DB, catalog *cache.Namespace) *ReviewStore {
+	return &ReviewStore{db, catalog}
+}
+
+// selectReview lists the columns read by scanReview, of reviews aliased as r
+// joined with their users as u. Anonymized users aren't shown.
+const selectReview = `r.id, r.book_id, r.user_id, r.rating, r.text, r.hidden, r.created_at, r.updated_at, r.version,
+	case when u.deleted_at is null then u.name end`
+
+func scanReview(row interface{ Scan(dest ...any) error }, review *entity.Review) error {
+	var reviewer sql.NullString
+	if err := row.Scan(&review.Id, &review.BookId, &review.UserId, &review.Rating, &review.Text, &review.Hidden,
+		&review.CreatedAt, &review.UpdatedAt, &review.Version, &reviewer); err != nil {
+		return err
+	}
+
+	review.Reviewer = nil
+	if reviewer.Valid {
+		review.Reviewer = &entity.Reviewer{Id: review.UserId, Name: reviewer.String}
+	}
+	return nil
+}
+
+// GetReviews returns the reviews of the book, the latest first. Hidden ones
+// are only included if withHidden is set. It returns sql.ErrNoRows if the
+// book doesn't exist.
+func (store *ReviewStore) GetReviews(ctx context.Context, bookId uuid.UUID, withHidden bool) ([]entity.Review, error) {
+	defer metrics.ObserveQuery("ReviewStore.GetReviews", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.GetReviews")
+	defer span.End()
+
+	var exists bool
+	if err := store.db.QueryRowContext(ctx, `select exists (select 1 from books where id=$1)`, bookId).Scan(&exists); err != nil {
+		slog.ErrorContext(ctx, "ReviewStore.GetReviews() - received error from db", "err", err)
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := store.db.QueryContext(ctx, `
+		select `+selectReview+` from reviews r inner join users u on u.id=r.user_id
+		where r.book_id=$1 and ($2 or not r.hidden)
+		order by r.created_at desc
+	`, bookId, withHidden)
+	if err != nil {
+		slog.ErrorContext(ctx, "ReviewStore.GetReviews() - received error from db", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []entity.Review{}
+	for rows.Next() {
+		var review entity.Review
+		if err := scanReview(rows, &review); err != nil {
+			slog.ErrorContext(ctx, "ReviewStore.GetReviews() - received error while scanning", "err", err)
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "ReviewStore.GetReviews() - received error from db", "err", err)
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+// GetReview returns the review of the book.
+func (store *ReviewStore) GetReview(ctx context.Context, bookId uuid.UUID, id uuid.UUID) (review entity.Review, err error) {
+	defer metrics.ObserveQuery("ReviewStore.GetReview", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.GetReview")
+	defer span.End()
+
+	err = scanReview(store.db.QueryRowContext(ctx, `
+		select `+selectReview+` from reviews r inner join users u on u.id=r.user_id
+		where r.id=$1 and r.book_id=$2
+	`, id, bookId), &review)
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, "ReviewStore.GetReview() - received error from db", "err", err)
+	}
+	return review, err
+}
+
+func (store *ReviewStore) CreateReview(ctx context.Context, review entity.Review) (savedReview entity.Review, err error) {
+	defer metrics.ObserveQuery("ReviewStore.CreateReview", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.CreateReview")
+	defer span.End()
+
+	now := time.Now().UTC()
+	err = scanReview(store.db.QueryRowContext(ctx, `
+		with new_review as (
+			insert into reviews(book_id, user_id, rating, text, created_at, updated_at)
+				values($1, $2, $3, $4, $5, $5)
+				returning *
+		)
+		select `+selectReview+` from new_review r inner join users u on u.id=r.user_id
+	`, review.BookId, review.UserId, review.Rating, review.Text, now), &savedReview)
+
+	if err != nil {
+		return savedReview, writeError(ctx, "ReviewStore.CreateReview()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return savedReview, nil
+}
+
+// UpdateReview replaces the rating and text of the review if it's still at
+// the given version.
+func (store *ReviewStore) UpdateReview(ctx context.Context, review entity.Review, version int) (updatedReview entity.Review, err error) {
+	defer metrics.ObserveQuery("ReviewStore.UpdateReview", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.UpdateReview")
+	defer span.End()
+
+	err = scanReview(store.db.QueryRowContext(ctx, `
+		with updated_review as (
+			update reviews set rating=$1, text=$2, updated_at=$3, version=version+1
+			where id=$4 and version=$5
+			returning *
+		)
+		select `+selectReview+` from updated_review r inner join users u on u.id=r.user_id
+	`, review.Rating, review.Text, time.Now().UTC(), review.Id, version), &updatedReview)
+
+	if err != nil {
+		return updatedReview, writeError(ctx, "ReviewStore.UpdateReview()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return updatedReview, nil
+}
+
+// PatchReview sets the given columns of the review if it's still at the
+// given version.
+func (store *ReviewStore) PatchReview(ctx context.Context, id uuid.UUID, version int, set map[string]any) (patchedReview entity.Review, err error) {
+	defer metrics.ObserveQuery("ReviewStore.PatchReview", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.PatchReview")
+	defer span.End()
+
+	set["updated_at"] = time.Now().UTC()
+	update, args := patch.Update("reviews", id, version, set)
+	err = scanReview(store.db.QueryRowContext(ctx, `
+		with updated_review as (`+update+`)
+		select `+selectReview+` from updated_review r inner join users u on u.id=r.user_id
+	`, args...), &patchedReview)
+
+	if err != nil {
+		return patchedReview, writeError(ctx, "ReviewStore.PatchReview()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return patchedReview, nil
+}
+
+// SetHidden hides the review from everyone but moderators, or shows it
+// again. It bumps the version, as hidden is part of the review's ETag.
+func (store *ReviewStore) SetHidden(ctx context.Context, bookId uuid.UUID, id uuid.UUID, hidden bool) (updatedReview entity.Review, err error) {
+	defer metrics.ObserveQuery("ReviewStore.SetHidden", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.SetHidden")
+	defer span.End()
+
+	err = scanReview(store.db.QueryRowContext(ctx, `
+		with updated_review as (
+			update reviews set hidden=$1, version=version+1 where id=$2 and book_id=$3 returning *
+		)
+		select `+selectReview+` from updated_review r inner join users u on u.id=r.user_id
+	`, hidden, id, bookId), &updatedReview)
+
+	if err != nil {
+		return updatedReview, writeError(ctx, "ReviewStore.SetHidden()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return updatedReview, nil
+}
+
+// DeleteReview deletes the review if it's still at the given version.
+func (store *ReviewStore) DeleteReview(ctx context.Context, id uuid.UUID, version int) error {
+	defer metrics.ObserveQuery("ReviewStore.DeleteReview", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "ReviewStore.DeleteReview")
+	defer span.End()
+
+	result, err := store.db.ExecContext(ctx, `delete from reviews where id=$1 and version=$2`, id, version)
+	if err != nil {
+		slog.ErrorContext(ctx, "ReviewStore.DeleteReview() - received error from db", "err", err)
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	store.cache.Invalidate(ctx)
+	return nil
+}
+
+// writeError maps constraint violations of a write to the errors the
+// handler reports and logs unexpected ones.
+func writeError(ctx context.Context, method string, err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case uniqueViolation:
+			return errAlreadyReviewed
+		case foreignKeyViolation:
+			return errBookNotFound
+		}
+	}
+	if err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, method+" - received error from db", "err", err)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"example/library-service/internal/errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// methods are the methods checked when building the Allow header.
+var methods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// New returns the router every handler registers its routes on. Trailing
+// slashes are ignored, HEAD is served by the GET route and OPTIONS lists the
+// allowed methods. Unknown paths get a 404, known paths requested with a
+// method they don't support get a 405 with an Allow header.
+func New() *chi.Mux {
+	mux := chi.NewRouter()
+	mux.Use(middleware.StripSlashes, middleware.GetHead)
+
+	mux.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		errors.HandleError(404, "Not Found", w)
+	})
+
+	mux.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowed(mux, r), ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		errors.HandleError(405, fmt.Sprintf("Method %v not allowed", r.Method), w)
+	})
+
+	return mux
+}
+
+// Pattern returns the pattern of the route matched by the request, e.g.
+// "/books/{id}", or "unmatched". It's only complete once the request has been
+// routed, so it's meant for middlewares of route groups.
+func Pattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return "unmatched"
+}
+
+func allowed(mux *chi.Mux, r *http.Request) []string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		path = rctx.RoutePath
+	}
+
+	var allow []string
+	for _, method := range methods {
+		if mux.Match(chi.NewRouteContext(), method, path) {
+			allow = append(allow, method)
+			if method == http.MethodGet {
+				allow = append(allow, http.MethodHead)
+			}
+		}
+	}
+	return append(allow, http.MethodOptions)
+}
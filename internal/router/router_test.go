@@ -0,0 +1,73 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestRouter() *chi.Mux {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Route", Pattern(r))
+	}
+
+	mux := New()
+	// Routes are registered in groups with middlewares, like the handlers
+	// are in main.
+	mux.Group(func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler { return next })
+		r.Get("/books", ok)
+		r.Post("/books", ok)
+		r.Get("/books/{id}", ok)
+		r.Put("/books/{id}", ok)
+		r.Patch("/books/{id}", ok)
+		r.Delete("/books/{id}", ok)
+	})
+	mux.Post("/auth/login", ok)
+	return mux
+}
+
+func TestRouter(t *testing.T) {
+	mux := newTestRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		allow  string
+		route  string
+	}{
+		{"get", http.MethodGet, "/books", http.StatusOK, "", "/books"},
+		{"trailing slash", http.MethodGet, "/books/", http.StatusOK, "", "/books"},
+		{"path parameter", http.MethodDelete, "/books/1", http.StatusOK, "", "/books/{id}"},
+		{"head is served by get", http.MethodHead, "/books/1", http.StatusOK, "", "/books/{id}"},
+		{"unknown path", http.MethodGet, "/shelves", http.StatusNotFound, "", ""},
+		{"unknown nested path", http.MethodGet, "/books/1/pages", http.StatusNotFound, "", ""},
+		{"unsupported method", http.MethodDelete, "/books", http.StatusMethodNotAllowed, "GET, HEAD, POST, OPTIONS", ""},
+		{"unsupported method with trailing slash", http.MethodPost, "/books/1/", http.StatusMethodNotAllowed, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", ""},
+		{"head without get", http.MethodHead, "/auth/login", http.StatusMethodNotAllowed, "POST, OPTIONS", ""},
+		{"options", http.MethodOptions, "/books/1", http.StatusNoContent, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", ""},
+		{"options without get", http.MethodOptions, "/auth/login", http.StatusNoContent, "POST, OPTIONS", ""},
+		{"options of an unknown path", http.MethodOptions, "/shelves", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if allow := w.Header().Get("Allow"); allow != tt.allow {
+				t.Errorf("Allow = %q, want %q", allow, tt.allow)
+			}
+			if route := w.Header().Get("X-Route"); route != tt.route {
+				t.Errorf("route = %q, want %q", route, tt.route)
+			}
+		})
+	}
+}
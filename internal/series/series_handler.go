@@ -0,0 +1,485 @@
+package series
+
+import (
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/utils"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const maxDescriptionLength = 10000
+
+// SeriesBookRequest places a book in a series. Positions may be fractional,
+// e.g. 2.5 for a novella set between the second and third book.
+type SeriesBookRequest struct {
+	Position float64 `json:"position"`
+}
+
+type SeriesHandler struct {
+	seriesStore *SeriesStore
+	authStore   *auth.AuthStore
+}
+
+func NewSeriesHandler(db *sql.DB, authStore *auth.AuthStore, catalog *cache.Namespace) *SeriesHandler {
+	store := NewSeriesStore(db, catalog)
+	return &SeriesHandler{store, authStore}
+}
+
+// Routes registers the series routes. Books are added to a series, or moved
+// within it, with a PUT of their position.
+func (seriesHandler *SeriesHandler) Routes(r chi.Router) {
+	r.Get("/series", seriesHandler.getSeriesList)
+	r.Post("/series", seriesHandler.createSeries)
+	r.Get("/series/{id}", seriesHandler.getSeries)
+	r.Put("/series/{id}", seriesHandler.updateSeries)
+	r.Patch("/series/{id}", seriesHandler.patchSeries)
+	r.Delete("/series/{id}", seriesHandler.deleteSeries)
+	r.Put("/series/{id}/books/{bookId}", seriesHandler.putSeriesBook)
+	r.Delete("/series/{id}/books/{bookId}", seriesHandler.deleteSeriesBook)
+}
+
+func (SeriesHandler *SeriesHandler) getSeries(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var id uuid.UUID
+
+	if _, err = auth.Authenticate(r, SeriesHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.getSeries() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.getSeries() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	var series entity.Series
+	if series, err = SeriesHandler.seriesStore.GetSeries(r.Context(), id); err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("series with id %v wasn't found", id), w)
+			return
+		}
+		slog.ErrorContext(r.Context(), "SeriesHandler.getSeries() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(series)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "SeriesHandler.getSeries() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.getSeries() - successfully finished req", "series", series)
+
+	SeriesHandler.seriesStore.cache.SetHeaders(w)
+
+	if etag.NotModified(w, r, etag.Of(series.Id, series.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (SeriesHandler *SeriesHandler) getSeriesList(w http.ResponseWriter, r *http.Request) {
+	var err error
+	queryMap := utils.ToMap(r.URL.Query())
+
+	if _, err = auth.Authenticate(r, SeriesHandler.authStore, auth.ScopeCatalogRead); err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.getSeriesList() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if !utils.ValidParams("series", queryMap) {
+		slog.WarnContext(r.Context(), "SeriesHandler.getSeriesList() - received invalid params!", "params", queryMap)
+		errors.HandleError(400, "Invalid request params", w)
+		return
+	}
+
+	var series []entity.Series
+	if series, err = SeriesHandler.seriesStore.GetSeriesList(r.Context(), queryMap); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(series)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "SeriesHandler.getSeriesList() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.getSeriesList() - successfully finished req", "series", len(series))
+
+	SeriesHandler.seriesStore.cache.SetHeaders(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (SeriesHandler *SeriesHandler) createSeries(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.createSeries()") {
+		return
+	}
+
+	var series entity.Series
+	if err := json.NewDecoder(r.Body).Decode(&series); err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.createSeries() - received decode error", "err", err)
+		errors.HandleError(400, "series must be a JSON object", w)
+		return
+	}
+
+	if err := validateSeries(&series); err != nil {
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	savedSeries, err := SeriesHandler.seriesStore.CreateSeries(r.Context(), series)
+	if err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.createSeries() - successfully finished req", "series", savedSeries)
+	SeriesHandler.writeSeries(w, r, "SeriesHandler.createSeries()", http.StatusCreated, savedSeries)
+}
+
+func (SeriesHandler *SeriesHandler) updateSeries(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.updateSeries()") {
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.updateSeries() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	var series entity.Series
+	if err = json.NewDecoder(r.Body).Decode(&series); err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.updateSeries() - received decode error", "err", err)
+		errors.HandleError(400, "series must be a JSON object", w)
+		return
+	}
+	series.Id = id
+
+	if err = validateSeries(&series); err != nil {
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	current, ok := SeriesHandler.currentSeries(w, r, id)
+	if !ok {
+		return
+	}
+
+	updatedSeries, err := SeriesHandler.seriesStore.UpdateSeries(r.Context(), series, current.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.updateSeries() - successfully finished req", "series", updatedSeries)
+	SeriesHandler.writeSeries(w, r, "SeriesHandler.updateSeries()", http.StatusOK, updatedSeries)
+}
+
+// patchSeries changes the name or description of a series with a JSON
+// merge patch; its books are moved with their own routes.
+func (SeriesHandler *SeriesHandler) patchSeries(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.patchSeries()") {
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.patchSeries() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	if !patch.Supported(r) {
+		errors.HandleError(415, fmt.Sprintf("Content-Type must be %v", patch.ContentType), w)
+		return
+	}
+
+	set, err := seriesColumns(r.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.patchSeries() - received invalid patch", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "SeriesHandler.patchSeries() - received req", "id", id, "set", set)
+
+	current, ok := SeriesHandler.currentSeries(w, r, id)
+	if !ok {
+		return
+	}
+
+	patchedSeries := current
+	if len(set) > 0 {
+		if patchedSeries, err = SeriesHandler.seriesStore.PatchSeries(r.Context(), id, current.Version, set); err != nil {
+			if err == sql.ErrNoRows {
+				etag.Changed(w)
+				return
+			}
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.patchSeries() - successfully finished req", "id", id)
+	SeriesHandler.writeSeries(w, r, "SeriesHandler.patchSeries()", http.StatusOK, patchedSeries)
+}
+
+func (SeriesHandler *SeriesHandler) deleteSeries(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.deleteSeries()") {
+		return
+	}
+
+	id, err := utils.PathUUID(r, "id")
+	if err != nil {
+		slog.WarnContext(r.Context(), "SeriesHandler.deleteSeries() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	current, ok := SeriesHandler.currentSeries(w, r, id)
+	if !ok {
+		return
+	}
+
+	if err = SeriesHandler.seriesStore.DeleteSeries(r.Context(), id, current.Version); err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.deleteSeries() - successfully finished req", "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putSeriesBook adds the book to the series at the given position, or moves
+// it there.
+func (SeriesHandler *SeriesHandler) putSeriesBook(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.putSeriesBook()") {
+		return
+	}
+
+	id, bookId, ok := seriesBookIds(w, r)
+	if !ok {
+		return
+	}
+
+	var req SeriesBookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validPosition(req.Position) {
+		slog.WarnContext(r.Context(), "SeriesHandler.putSeriesBook() - received invalid body", "err", err)
+		errors.HandleError(400, "position must be a number greater than 0", w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "SeriesHandler.putSeriesBook() - received req", "id", id, "book", bookId, "position", req.Position)
+
+	current, ok := SeriesHandler.currentSeries(w, r, id)
+	if !ok {
+		return
+	}
+
+	updatedSeries, err := SeriesHandler.seriesStore.SetPosition(r.Context(), id, current.Version, bookId, req.Position)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			etag.Changed(w)
+		case errPositionTaken:
+			errors.HandleError(409, fmt.Sprintf("position %v is taken by another book of the series", req.Position), w)
+		case errBookNotFound:
+			errors.HandleError(404, fmt.Sprintf("book with id %v wasn't found", bookId), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.putSeriesBook() - successfully finished req", "id", id, "book", bookId)
+	SeriesHandler.writeSeries(w, r, "SeriesHandler.putSeriesBook()", http.StatusOK, updatedSeries)
+}
+
+// deleteSeriesBook takes the book out of the series; the book itself is
+// kept.
+func (SeriesHandler *SeriesHandler) deleteSeriesBook(w http.ResponseWriter, r *http.Request) {
+	if !SeriesHandler.authorize(w, r, "SeriesHandler.deleteSeriesBook()") {
+		return
+	}
+
+	id, bookId, ok := seriesBookIds(w, r)
+	if !ok {
+		return
+	}
+
+	current, ok := SeriesHandler.currentSeries(w, r, id)
+	if !ok {
+		return
+	}
+
+	updatedSeries, err := SeriesHandler.seriesStore.RemoveBook(r.Context(), id, current.Version, bookId)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			etag.Changed(w)
+		case errNotInSeries:
+			errors.HandleError(404, fmt.Sprintf("book with id %v isn't part of the series", bookId), w)
+		default:
+			errors.HandleError(500, "Internal Server Error", w)
+		}
+		return
+	}
+
+	slog.InfoContext(r.Context(), "SeriesHandler.deleteSeriesBook() - successfully finished req", "id", id, "book", bookId)
+	SeriesHandler.writeSeries(w, r, "SeriesHandler.deleteSeriesBook()", http.StatusOK, updatedSeries)
+}
+
+// authorize lets moderators through, who are the only ones to change the
+// catalog.
+func (SeriesHandler *SeriesHandler) authorize(w http.ResponseWriter, r *http.Request, method string) bool {
+	user, err := auth.Authenticate(r, SeriesHandler.authStore, auth.ScopeCatalogWrite)
+	if err != nil {
+		slog.WarnContext(r.Context(), method+" - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return false
+	}
+
+	if user.Role != entity.MODERATOR {
+		slog.WarnContext(r.Context(), method+" - user doesn't have permission to this resource")
+		errors.HandleError(403, "403 Forbidden", w)
+		return false
+	}
+
+	return true
+}
+
+// currentSeries loads the series a write applies to and checks that the
+// client has seen its current state, books included.
+func (SeriesHandler *SeriesHandler) currentSeries(w http.ResponseWriter, r *http.Request, id uuid.UUID) (series entity.Series, ok bool) {
+	series, err := SeriesHandler.seriesStore.loadSeries(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("series with id %v wasn't found", id), w)
+			return series, false
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return series, false
+	}
+
+	series.Version, ok = etag.CheckIfMatch(w, r, series.Id, series.Version)
+	return series, ok
+}
+
+// writeSeries answers a write with the series and its ETag, so the client
+// can chain writes without reading it again.
+func (SeriesHandler *SeriesHandler) writeSeries(w http.ResponseWriter, r *http.Request, method string, status int, series entity.Series) {
+	jsonBytes, err := json.Marshal(series)
+	if err != nil {
+		slog.ErrorContext(r.Context(), method+" - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag.Of(series.Id, series.Version))
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+func seriesBookIds(w http.ResponseWriter, r *http.Request) (id uuid.UUID, bookId uuid.UUID, ok bool) {
+	var err error
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		errors.HandleError(400, "invalid id", w)
+		return id, bookId, false
+	}
+	if bookId, err = utils.PathUUID(r, "bookId"); err != nil {
+		errors.HandleError(400, "invalid bookId", w)
+		return id, bookId, false
+	}
+	return id, bookId, true
+}
+
+func validPosition(position float64) bool {
+	return position > 0 && !math.IsInf(position, 0)
+}
+
+// validateSeries checks the name and description of a series, where an
+// empty description counts as missing. The error is safe to return to the
+// client.
+func validateSeries(s *entity.Series) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	if s.Description != nil && strings.TrimSpace(*s.Description) == "" {
+		s.Description = nil
+	}
+	if s.Description != nil && utf8.RuneCountInString(*s.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must not be longer than %d characters", maxDescriptionLength)
+	}
+
+	return nil
+}
+
+// seriesColumns maps a merge patch of a series to the columns it sets, with
+// the checks of validateSeries. A description is removed with null.
+func seriesColumns(body io.Reader) (set map[string]any, err error) {
+	p, err := patch.Decode(body, "name", "description")
+	if err != nil {
+		return nil, err
+	}
+
+	set = map[string]any{}
+	if name, ok, err := p.String("name"); err != nil {
+		return nil, err
+	} else if ok {
+		set["name"] = strings.TrimSpace(name)
+	}
+
+	if description, ok, err := p.NullableString("description"); err != nil {
+		return nil, err
+	} else if ok {
+		if description != nil && utf8.RuneCountInString(*description) > maxDescriptionLength {
+			return nil, &patch.Error{Field: "description", Message: fmt.Sprintf("must not be longer than %d characters", maxDescriptionLength)}
+		}
+		set["description"] = description
+	}
+
+	return set, nil
+}
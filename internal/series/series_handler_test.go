@@ -0,0 +1,305 @@
+package series
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/book"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+func bearer(t *testing.T, role int) string {
+	t.Helper()
+	token, err := auth.GenerateToken(uuid.New(), role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func newTestHandler(db *sql.DB) *SeriesHandler {
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	return NewSeriesHandler(db, auth.NewAuthStore(db), catalog)
+}
+
+func request(handler *SeriesHandler, method string, path string, authHeader string, contentType string, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", authHeader)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestSeriesColumns(t *testing.T) {
+	description := "Novels set on Discworld"
+
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]any
+		wantErr bool
+	}{
+		{"empty patch", `{}`, map[string]any{}, false},
+		{"name", `{"name": " Discworld "}`, map[string]any{"name": "Discworld"}, false},
+		{"description", `{"description": "Novels set on Discworld"}`, map[string]any{"description": &description}, false},
+		{"removed description", `{"description": null}`, map[string]any{"description": (*string)(nil)}, false},
+		{"removed name", `{"name": null}`, nil, true},
+		{"blank name", `{"name": "  "}`, nil, true},
+		{"description too long", `{"description": "` + strings.Repeat("a", maxDescriptionLength+1) + `"}`, nil, true},
+		{"books", `{"books": []}`, nil, true},
+		{"not an object", `[]`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := seriesColumns(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("seriesColumns() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("seriesColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// These requests are rejected before any query, so they need no database.
+func TestPatchSeriesRejects(t *testing.T) {
+	handler := newTestHandler(nil)
+	moderator := bearer(t, entity.MODERATOR)
+	path := "/series/" + uuid.NewString()
+
+	tests := []struct {
+		name        string
+		path        string
+		header      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"anonymous", path, "", "application/merge-patch+json", `{"name": "Discworld"}`, http.StatusUnauthorized},
+		{"user", path, bearer(t, entity.USER), "application/merge-patch+json", `{"name": "Discworld"}`, http.StatusForbidden},
+		{"invalid id", "/series/1", moderator, "application/merge-patch+json", `{"name": "Discworld"}`, http.StatusBadRequest},
+		{"other content type", path, moderator, "text/plain", `{"name": "Discworld"}`, http.StatusUnsupportedMediaType},
+		{"unknown field", path, moderator, "application/merge-patch+json", `{"version": 2}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(handler, http.MethodPatch, tt.path, tt.header, tt.contentType, tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestValidPosition(t *testing.T) {
+	tests := []struct {
+		position float64
+		want     bool
+	}{
+		{1, true},
+		{2.5, true},
+		{0.25, true},
+		{0, false},
+		{-1, false},
+		{math.Inf(1), false},
+	}
+
+	for _, tt := range tests {
+		if got := validPosition(tt.position); got != tt.want {
+			t.Errorf("validPosition(%v) = %v, want %v", tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSeries(t *testing.T) {
+	blank := "  "
+	long := strings.Repeat("a", maxDescriptionLength+1)
+
+	tests := []struct {
+		name            string
+		series          entity.Series
+		wantName        string
+		wantDescription bool
+		wantErr         bool
+	}{
+		{"trimmed name", entity.Series{Name: " Discworld "}, "Discworld", false, false},
+		{"blank description", entity.Series{Name: "Discworld", Description: &blank}, "Discworld", false, false},
+		{"missing name", entity.Series{Name: " "}, "", false, true},
+		{"description too long", entity.Series{Name: "Discworld", Description: &long}, "Discworld", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSeries(&tt.series)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateSeries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.series.Name != tt.wantName || (tt.series.Description != nil) != tt.wantDescription {
+				t.Errorf("validateSeries() left %q, %v", tt.series.Name, tt.series.Description)
+			}
+		})
+	}
+}
+
+// These requests are rejected before any query, so they need no database.
+func TestPutSeriesBookRejects(t *testing.T) {
+	handler := newTestHandler(nil)
+	moderator := bearer(t, entity.MODERATOR)
+	path := "/series/" + uuid.NewString() + "/books/" + uuid.NewString()
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		body   string
+		status int
+	}{
+		{"anonymous", path, "", `{"position": 1}`, http.StatusUnauthorized},
+		{"user", path, bearer(t, entity.USER), `{"position": 1}`, http.StatusForbidden},
+		{"invalid bookId", "/series/" + uuid.NewString() + "/books/1", moderator, `{"position": 1}`, http.StatusBadRequest},
+		{"missing position", path, moderator, `{}`, http.StatusBadRequest},
+		{"zero position", path, moderator, `{"position": 0}`, http.StatusBadRequest},
+		{"negative position", path, moderator, `{"position": -2.5}`, http.StatusBadRequest},
+		{"position as string", path, moderator, `{"position": "2"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(handler, http.MethodPut, tt.path, tt.header, "application/json", tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSeriesReadingOrder(t *testing.T) {
+	db := testDB(t)
+	// Books are read from the catalog the series invalidate.
+	catalog := cache.NewNamespace(cache.NewLRU(100), "catalog", time.Minute, time.Minute)
+	handler := NewSeriesHandler(db, auth.NewAuthStore(db), catalog)
+	books := book.NewBookStore(db, catalog)
+	moderator := bearer(t, entity.MODERATOR)
+
+	router := chi.NewRouter()
+	handler.Routes(router)
+	tag := ""
+	write := func(method string, path string, body string) (int, entity.Series) {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", moderator)
+		r.Header.Set("If-Match", tag)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var s entity.Series
+		if w.Code < 300 {
+			tag = w.Header().Get("ETag")
+			if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, s
+	}
+
+	status, s := write(http.MethodPost, "/series", `{"name": "Discworld `+uuid.NewString()+`"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create status = %d", status)
+	}
+	bookPath := "/series/" + s.Id.String() + "/books/"
+
+	ids := map[string]uuid.UUID{}
+	for _, name := range []string{"The Light Fantastic", "The Colour of Magic", "Troll Bridge"} {
+		var id uuid.UUID
+		if err := db.QueryRow(`
+			insert into books(name, genre, publication_date, created_at) values($1, 'fantasy', '1986-01-01', now()) returning id
+		`, name).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	// Books are ordered by position, whatever order they're added in; a
+	// novella fits between two novels.
+	for name, position := range map[string]string{"The Light Fantastic": "2", "The Colour of Magic": "1", "Troll Bridge": "1.5"} {
+		if status, s = write(http.MethodPut, bookPath+ids[name].String(), `{"position": `+position+`}`); status != http.StatusOK {
+			t.Fatalf("put %s status = %d", name, status)
+		}
+	}
+	assertOrder := func(s entity.Series, want ...string) {
+		t.Helper()
+		var got []string
+		for _, b := range s.Books {
+			got = append(got, fmt.Sprintf("%v %s", b.Position, b.Name))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("books = %v, want %v", got, want)
+		}
+	}
+	assertOrder(s, "1 The Colour of Magic", "1.5 Troll Bridge", "2 The Light Fantastic")
+
+	b, err := books.GetBook(context.Background(), ids["Troll Bridge"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Series) != 1 || b.Series[0].Position != 1.5 || b.Series[0].Count != 3 {
+		t.Errorf("series of the book = %+v, want position 1.5 of 3", b.Series)
+	}
+
+	if status, _ = write(http.MethodPut, bookPath+ids["Troll Bridge"].String(), `{"position": 2}`); status != http.StatusConflict {
+		t.Errorf("put at a taken position status = %d, want %d", status, http.StatusConflict)
+	}
+
+	// Moving a book keeps it once in the series.
+	if status, s = write(http.MethodPut, bookPath+ids["Troll Bridge"].String(), `{"position": 0.5}`); status != http.StatusOK {
+		t.Fatalf("move status = %d", status)
+	}
+	assertOrder(s, "0.5 Troll Bridge", "1 The Colour of Magic", "2 The Light Fantastic")
+
+	if status, s = write(http.MethodDelete, bookPath+ids["Troll Bridge"].String(), ""); status != http.StatusOK {
+		t.Fatalf("remove status = %d", status)
+	}
+	assertOrder(s, "1 The Colour of Magic", "2 The Light Fantastic")
+
+	tag = `"stale"`
+	if status, _ = write(http.MethodDelete, bookPath+ids["The Colour of Magic"].String(), ""); status != http.StatusPreconditionFailed {
+		t.Errorf("remove with a stale ETag status = %d, want %d", status, http.StatusPreconditionFailed)
+	}
+}
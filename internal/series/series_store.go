@@ -0,0 +1,347 @@
+package series
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Postgres error codes raised when a book would be added at a position
+// which is taken, or a book which doesn't exist would be added.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+var (
+	errPositionTaken = errors.New("position is taken by another book of the series")
+	errBookNotFound  = errors.New("book wasn't found")
+	errNotInSeries   = errors.New("book isn't part of the series")
+)
+
+type SeriesStore struct {
+	db    utils.DBTX
+	cache *cache.Namespace
+}
+
+// NewSeriesStore caches reads in the catalog namespace, as books embed the
+// series they belong to.
+func NewSeriesStore(db *sql.DB, catalog *cache.Namespace) *SeriesStore {
+	return &SeriesStore{db, catalog}
+}
+
+// WithTx returns a store running its queries in tx. It bypasses the cache;
+// the caller invalidates it once tx is committed.
+func (store *SeriesStore) WithTx(tx utils.DBTX) *SeriesStore {
+	return &SeriesStore{db: tx}
+}
+
+// GetSeries returns the series with its books in reading order, from the
+// cache when possible.
+func (store *SeriesStore) GetSeries(ctx context.Context, id uuid.UUID) (s entity.Series, err error) {
+	err = store.cache.Fetch(ctx, "series:"+id.String(), &s, func() (err error) {
+		s, err = store.loadSeries(ctx, id)
+		return err
+	})
+	return s, err
+}
+
+// GetSeriesList returns the series matching the params, from the cache when
+// possible.
+func (store *SeriesStore) GetSeriesList(ctx context.Context, m map[string]string) (series []entity.Series, err error) {
+	err = store.cache.Fetch(ctx, "series?"+cache.Key(m), &series, func() (err error) {
+		series, err = store.loadSeriesList(ctx, m)
+		return err
+	})
+	return series, err
+}
+
+// loadSeries reads the series from the db, bypassing the cache, e.g. to
+// check preconditions of a write.
+func (store *SeriesStore) loadSeries(ctx context.Context, id uuid.UUID) (s entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.GetSeries", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.GetSeries")
+	defer span.End()
+
+	series, err := store.query(ctx, "SeriesStore.GetSeries()", `where s.id=$1`, id)
+	if err != nil {
+		return s, err
+	}
+	if len(series) == 0 {
+		return s, sql.ErrNoRows
+	}
+
+	slog.DebugContext(ctx, "SeriesStore.GetSeries() - received from db", "series", series[0])
+	return series[0], nil
+}
+
+func (store *SeriesStore) loadSeriesList(ctx context.Context, m map[string]string) ([]entity.Series, error) {
+	defer metrics.ObserveQuery("SeriesStore.GetSeriesList", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.GetSeriesList")
+	defer span.End()
+
+	if name, ok := m["name"]; ok {
+		return store.query(ctx, "SeriesStore.GetSeriesList()", `where s.name like '%' || $1 || '%'`, name)
+	}
+	return store.query(ctx, "SeriesStore.GetSeriesList()", ``)
+}
+
+// query reads the series matching where with their books, which are ordered
+// by position.
+func (store *SeriesStore) query(ctx context.Context, method string, where string, args ...any) ([]entity.Series, error) {
+	rows, err := store.db.QueryContext(ctx, `
+		select s.id, s.name, s.description, s.created_at, s.version,
+			sb.position, b.id, b.name, b.publication_date, b.genre
+		from series s
+		left join series_books sb on sb.series_id=s.id
+		left join books b on b.id=sb.book_id
+		`+where+`
+		order by s.name, s.id, sb.position
+	`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, method+" - received error from db", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []entity.Series
+	for rows.Next() {
+		var s entity.Series
+		var description sql.NullString
+		var position sql.NullFloat64
+		var bookId uuid.NullUUID
+		var bookName, publicationDate, genre sql.NullString
+		if err := rows.Scan(&s.Id, &s.Name, &description, &s.CreatedAt, &s.Version,
+			&position, &bookId, &bookName, &publicationDate, &genre); err != nil {
+			slog.ErrorContext(ctx, method+" - received error while scanning", "err", err)
+			return nil, err
+		}
+
+		if len(series) == 0 || series[len(series)-1].Id != s.Id {
+			if description.Valid {
+				s.Description = &description.String
+			}
+			s.Books = []entity.SeriesBook{}
+			series = append(series, s)
+		}
+
+		// A series without books is a single row of nulls on the book side.
+		if bookId.Valid {
+			current := &series[len(series)-1]
+			current.Books = append(current.Books, entity.SeriesBook{
+				Position:        position.Float64,
+				Id:              bookId.UUID,
+				Name:            bookName.String,
+				PublicationDate: publicationDate.String,
+				Genre:           genre.String,
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, method+" - received error from db", "err", err)
+		return nil, err
+	}
+
+	return series, nil
+}
+
+func (store *SeriesStore) CreateSeries(ctx context.Context, s entity.Series) (savedSeries entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.CreateSeries", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.CreateSeries")
+	defer span.End()
+
+	err = store.db.QueryRowContext(ctx, `
+		insert into series(name, description, created_at) values($1, $2, $3)
+		returning id, name, description, created_at, version
+	`, s.Name, s.Description, time.Now().UTC()).Scan(
+		&savedSeries.Id, &savedSeries.Name, &savedSeries.Description, &savedSeries.CreatedAt, &savedSeries.Version)
+	if err != nil {
+		slog.ErrorContext(ctx, "SeriesStore.CreateSeries() - received error from db", "err", err)
+		return savedSeries, err
+	}
+
+	savedSeries.Books = []entity.SeriesBook{}
+
+	store.cache.Invalidate(ctx)
+	return savedSeries, nil
+}
+
+// UpdateSeries replaces the name and description of the series if it's
+// still at the given version; its books are kept.
+func (store *SeriesStore) UpdateSeries(ctx context.Context, s entity.Series, version int) (updatedSeries entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.UpdateSeries", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.UpdateSeries")
+	defer span.End()
+
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var id uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			update series set name=$1, description=$2, version=version+1
+			where id=$3 and version=$4
+			returning id
+		`, s.Name, s.Description, s.Id, version).Scan(&id); err != nil {
+			return err
+		}
+
+		var err error
+		updatedSeries, err = store.WithTx(tx).loadSeries(ctx, id)
+		return err
+	})
+
+	if err != nil {
+		return updatedSeries, writeError(ctx, "SeriesStore.UpdateSeries()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return updatedSeries, nil
+}
+
+// PatchSeries sets the given columns of the series if it's still at the
+// given version; its books are kept.
+func (store *SeriesStore) PatchSeries(ctx context.Context, id uuid.UUID, version int, set map[string]any) (patchedSeries entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.PatchSeries", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.PatchSeries")
+	defer span.End()
+
+	update, args := patch.Update("series", id, version, set)
+	err = utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		if err := tx.QueryRowContext(ctx, `
+			with patched_series as (`+update+`)
+			select id from patched_series
+		`, args...).Scan(&id); err != nil {
+			return err
+		}
+
+		var err error
+		patchedSeries, err = store.WithTx(tx).loadSeries(ctx, id)
+		return err
+	})
+
+	if err != nil {
+		return patchedSeries, writeError(ctx, "SeriesStore.PatchSeries()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return patchedSeries, nil
+}
+
+// DeleteSeries deletes the series if it's still at the given version; its
+// books are kept.
+func (store *SeriesStore) DeleteSeries(ctx context.Context, id uuid.UUID, version int) error {
+	defer metrics.ObserveQuery("SeriesStore.DeleteSeries", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.DeleteSeries")
+	defer span.End()
+
+	result, err := store.db.ExecContext(ctx, `delete from series where id=$1 and version=$2`, id, version)
+	if err != nil {
+		slog.ErrorContext(ctx, "SeriesStore.DeleteSeries() - received error from db", "err", err)
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	store.cache.Invalidate(ctx)
+	return nil
+}
+
+// SetPosition adds the book to the series at position, or moves it there if
+// it's already part of it, if the series is still at the given version.
+func (store *SeriesStore) SetPosition(ctx context.Context, id uuid.UUID, version int, bookId uuid.UUID, position float64) (updatedSeries entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.SetPosition", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.SetPosition")
+	defer span.End()
+
+	err = store.changeBooks(ctx, id, version, &updatedSeries, func(tx utils.DBTX) error {
+		_, err := tx.ExecContext(ctx, `
+			insert into series_books(series_id, book_id, position) values($1, $2, $3)
+			on conflict (series_id, book_id) do update set position=excluded.position
+		`, id, bookId, position)
+		return err
+	})
+
+	if err != nil {
+		return updatedSeries, writeError(ctx, "SeriesStore.SetPosition()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return updatedSeries, nil
+}
+
+// RemoveBook takes the book out of the series if the series is still at the
+// given version.
+func (store *SeriesStore) RemoveBook(ctx context.Context, id uuid.UUID, version int, bookId uuid.UUID) (updatedSeries entity.Series, err error) {
+	defer metrics.ObserveQuery("SeriesStore.RemoveBook", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "SeriesStore.RemoveBook")
+	defer span.End()
+
+	err = store.changeBooks(ctx, id, version, &updatedSeries, func(tx utils.DBTX) error {
+		result, err := tx.ExecContext(ctx, `delete from series_books where series_id=$1 and book_id=$2`, id, bookId)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return errNotInSeries
+		}
+		return nil
+	})
+
+	if err != nil {
+		return updatedSeries, writeError(ctx, "SeriesStore.RemoveBook()", err)
+	}
+
+	store.cache.Invalidate(ctx)
+	return updatedSeries, nil
+}
+
+// changeBooks runs change in a transaction after bumping the version of the
+// series, so its ETag covers its books, and reads the series back into
+// updated.
+func (store *SeriesStore) changeBooks(ctx context.Context, id uuid.UUID, version int, updated *entity.Series, change func(tx utils.DBTX) error) error {
+	return utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		var locked uuid.UUID
+		if err := tx.QueryRowContext(ctx, `
+			update series set version=version+1 where id=$1 and version=$2 returning id
+		`, id, version).Scan(&locked); err != nil {
+			return err
+		}
+
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		var err error
+		*updated, err = store.WithTx(tx).loadSeries(ctx, id)
+		return err
+	})
+}
+
+// writeError maps constraint violations of a write to the errors the
+// handler reports and logs unexpected ones.
+func writeError(ctx context.Context, method string, err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case uniqueViolation:
+			return errPositionTaken
+		case foreignKeyViolation:
+			return errBookNotFound
+		}
+	}
+	if err != sql.ErrNoRows && err != errNotInSeries {
+		slog.ErrorContext(ctx, method+" - received error from db", "err", err)
+	}
+	return err
+}
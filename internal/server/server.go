@@ -0,0 +1,117 @@
+package server
+
+import (
+	"database/sql"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/author"
+	"example/library-service/internal/blob"
+	"example/library-service/internal/book"
+	"example/library-service/internal/cache"
+	"example/library-service/internal/cover"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/health"
+	"example/library-service/internal/idempotency"
+	"example/library-service/internal/lending"
+	"example/library-service/internal/logging"
+	"example/library-service/internal/mail"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/openapi"
+	"example/library-service/internal/ratelimit"
+	"example/library-service/internal/review"
+	"example/library-service/internal/router"
+	"example/library-service/internal/series"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/user"
+	"example/library-service/internal/utils"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Deps are what the handlers of the service are built from. main sets them
+// up from the environment; tests may leave out what their requests don't
+// reach, e.g. the database.
+type Deps struct {
+	DB          *sql.DB
+	AuthStore   *auth.AuthStore
+	Keys        *auth.KeySet
+	Catalog     *cache.Namespace
+	Idempotency *idempotency.IdempotencyStore
+	Blobs       blob.BlobStore
+	Mailer      mail.Mailer
+	OIDC        *auth.OIDCProvider
+	Health      *health.HealthHandler
+
+	LoanPeriod      time.Duration
+	DownloadLinkTTL time.Duration
+}
+
+// New returns the router of the service with every route registered behind
+// its middlewares.
+func New(deps Deps) *chi.Mux {
+	bookHandler := book.NewBookHandler(deps.DB, deps.AuthStore, deps.Catalog, deps.Blobs)
+	authorHandler := author.NewAuthorHandler(deps.DB, deps.AuthStore, deps.Catalog)
+	seriesHandler := series.NewSeriesHandler(deps.DB, deps.AuthStore, deps.Catalog)
+	coverHandler := cover.NewCoverHandler(deps.Blobs)
+	reviewHandler := review.NewReviewHandler(deps.DB, deps.AuthStore, deps.Catalog)
+	lendingHandler := lending.NewLendingHandler(deps.DB, deps.AuthStore, deps.Blobs, deps.Keys, deps.LoanPeriod, deps.DownloadLinkTTL)
+	authHandler := auth.NewAuthHandler(deps.AuthStore, deps.Mailer, deps.OIDC)
+	userHandler := user.NewUserHandler(deps.DB, deps.AuthStore, deps.Mailer)
+	apiKeyHandler := auth.NewAPIKeyHandler(deps.AuthStore)
+	openapiHandler := openapi.NewOpenAPIHandler()
+	defaultLimiter := ratelimit.NewLimiter(ratelimit.Policy{Name: "default", Rate: 10, Burst: 20})
+	authLimiter := ratelimit.NewLimiter(ratelimit.Policy{Name: "auth", Rate: 0.2, Burst: 5})
+
+	server := router.New()
+	server.Group(func(r chi.Router) {
+		r.Use(instrument)
+		r.Group(func(r chi.Router) {
+			r.Use(limit(defaultLimiter, deps.AuthStore))
+			r.Group(func(r chi.Router) {
+				r.Use(idempotent(deps.Idempotency, deps.AuthStore))
+				bookHandler.Routes(r)
+				authorHandler.Routes(r)
+				seriesHandler.Routes(r)
+				lendingHandler.Routes(r)
+				reviewHandler.Routes(r)
+			})
+			userHandler.Routes(r)
+			apiKeyHandler.Routes(r)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(limit(authLimiter, deps.AuthStore))
+			authHandler.Routes(r)
+			userHandler.PasswordRoutes(r)
+		})
+		r.Method(http.MethodGet, utils.JWKSPath, auth.NewJWKSHandler(deps.Keys))
+		// Covers are loaded in bulk by img tags, so they aren't rate limited.
+		coverHandler.Routes(r)
+	})
+	server.Method(http.MethodGet, "/metrics", metrics.Handler())
+	openapiHandler.Routes(server)
+	deps.Health.Routes(server)
+
+	return server
+}
+
+func instrument(h http.Handler) http.Handler {
+	return metrics.Middleware(router.Pattern, tracing.Middleware(router.Pattern, logging.RedactPathMiddleware(h)))
+}
+
+func limit(limiter *ratelimit.Limiter, authStore *auth.AuthStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return ratelimit.Middleware(limiter, authStore, next)
+	}
+}
+
+// idempotent scopes idempotency keys to the caller authenticated with the
+// scope the matched route documents.
+func idempotent(store *idempotency.IdempotencyStore, authStore *auth.AuthStore) func(http.Handler) http.Handler {
+	authorize := func(r *http.Request) (entity.User, error) {
+		return auth.Authenticate(r, authStore, openapi.ScopeOf(r.Method, router.Pattern(r)))
+	}
+	return func(next http.Handler) http.Handler {
+		return idempotency.Middleware(store, authorize, next)
+	}
+}
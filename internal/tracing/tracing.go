@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"example/library-service/internal/logging"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName    = "library-service"
+	instrumentName = "example/library-service"
+)
+
+var tracer = otel.Tracer(instrumentName)
+
+// httpTargetKey is the attribute otelhttp records the request path with.
+const httpTargetKey = attribute.Key("http.target")
+
+// Setup configures the global tracer provider and W3C trace-context
+// propagation. The exporter is selected with OTEL_TRACES_EXPORTER:
+//
+//   - otlp: OTLP over HTTP, endpoint taken from OTEL_EXPORTER_OTLP_ENDPOINT
+//     (defaults to a local collector on localhost:4318)
+//   - stdout: pretty printed spans, for development
+//   - none (default): spans are created for propagation but not exported
+//
+// The returned function flushes and stops the provider.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	exporterName := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER"))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "", "none":
+		slog.Info("tracing.Setup() - trace export disabled")
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporterName)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	slog.Info("tracing.Setup() - exporting traces", "exporter", exporterName)
+	return provider.Shutdown, nil
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// from the incoming traceparent header when present. Spans are named after
+// the route pattern returned by route, which has to be matched already. The
+// target recorded by otelhttp is replaced by the redacted path, as path
+// parameters may be credentials.
+func Middleware(route func(*http.Request) string, next http.Handler) http.Handler {
+	withRoute := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			semconv.HTTPRoute(route(r)),
+			httpTargetKey.String(logging.RedactPath(r)),
+		)
+		next.ServeHTTP(w, r)
+	})
+
+	return otelhttp.NewHandler(withRoute, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + route(r)
+		}),
+	)
+}
+
+// StartSpan starts an internal span named after the traced function,
+// e.g. "auth.ValidateToken".
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartQuery starts a client span around a store query.
+func StartQuery(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"example/library-service/internal/router"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	recorder = tracetest.NewSpanRecorder()
+	setup    sync.Once
+)
+
+// record makes the global provider record spans and returns those ended
+// since. The provider is only set once, as the tracer of the package keeps
+// the first one.
+func record() func() []sdktrace.ReadOnlySpan {
+	setup.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+
+	start := len(recorder.Ended())
+	return func() []sdktrace.ReadOnlySpan {
+		return recorder.Ended()[start:]
+	}
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	attrs := map[attribute.Key]string{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestMiddlewareSpans(t *testing.T) {
+	ended := record()
+
+	mux := router.New()
+	mux.Group(func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler { return Middleware(router.Pattern, next) })
+		r.Get("/downloads/{token}", func(w http.ResponseWriter, r *http.Request) {
+			_, span := StartQuery(r.Context(), "TestStore.Query")
+			span.End()
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "/downloads/secret-token", nil)
+	r.Header.Set("traceparent", traceparent)
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	query, server := spans[0], spans[1]
+
+	// The server span continues the incoming trace and is named after the
+	// route, without the credential in the path.
+	if server.Name() != "GET /downloads/{token}" || server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span = %q of kind %v", server.Name(), server.SpanKind())
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("server span doesn't continue the trace of %s", traceparent)
+	}
+	attrs := attributes(server)
+	if attrs["http.route"] != "/downloads/{token}" {
+		t.Errorf("http.route = %q", attrs["http.route"])
+	}
+	for key, value := range attrs {
+		if strings.Contains(value, "secret-token") {
+			t.Errorf("%s = %q contains the token", key, value)
+		}
+	}
+
+	if query.Name() != "TestStore.Query" || query.SpanKind() != trace.SpanKindClient {
+		t.Errorf("query span = %q of kind %v", query.Name(), query.SpanKind())
+	}
+	if query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("query span isn't a child of the server span")
+	}
+	if attributes(query)["db.system"] != "postgresql" {
+		t.Errorf("db.system = %q", attributes(query)["db.system"])
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	ended := record()
+
+	_, span := StartSpan(context.Background(), "auth.ValidateToken", attribute.String("token.kind", "jwt"))
+	span.End()
+
+	spans := ended()
+	if len(spans) != 1 || spans[0].Name() != "auth.ValidateToken" || attributes(spans[0])["token.kind"] != "jwt" {
+		t.Errorf("spans = %v", spans)
+	}
+}
@@ -0,0 +1,219 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"example/library-service/internal/auth"
+	"example/library-service/internal/entity"
+	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+func (userHandler *UserHandler) getMe(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersRead); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.getMe() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	var me entity.User
+	if me, err = userHandler.userStore.GetUser(r.Context(), invoker.Id); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(me)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "UserHandler.getMe() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if etag.NotModified(w, r, etag.Of(me.Id, me.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (userHandler *UserHandler) updateMe(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.updateMe() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	var req UpdateMeRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.updateMe() - received decode error", "err", err)
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	var current entity.User
+	if current, err = userHandler.userStore.GetUser(r.Context(), invoker.Id); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	var ok bool
+	if current.Version, ok = etag.CheckIfMatch(w, r, current.Id, current.Version); !ok {
+		return
+	}
+
+	name, mail := current.Name, current.Mail
+	if req.Name != nil {
+		name = *req.Name
+	}
+	if req.Mail != nil {
+		mail = *req.Mail
+	}
+
+	if name == "" || mail == "" {
+		errors.HandleError(400, "name and mail can't be empty", w)
+		return
+	}
+
+	var exists bool
+	if exists, err = userHandler.userStore.ExistsWithNameOrMailExcept(r.Context(), invoker.Id, name, mail); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if exists {
+		errors.HandleError(409, "name or mail is already taken", w)
+		return
+	}
+
+	var updatedUser entity.User
+	if updatedUser, err = userHandler.userStore.UpdateProfile(r.Context(), invoker.Id, name, mail, current.Version); err != nil {
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if mail != current.Mail {
+		if err := auth.SendVerificationMail(r.Context(), userHandler.authStore, userHandler.mailer, updatedUser); err != nil {
+			slog.WarnContext(r.Context(), "UserHandler.updateMe() - verification mail wasn't sent", "err", err)
+		}
+	}
+
+	jsonBytes, err := json.Marshal(updatedUser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "UserHandler.updateMe() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "UserHandler.updateMe() - successfully finished req", "id", invoker.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag.Of(updatedUser.Id, updatedUser.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+func (userHandler *UserHandler) changePassword(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.changePassword() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errors.HandleError(400, "invalid request body", w)
+		return
+	}
+
+	if len(req.NewPassword) < minPasswordLength {
+		errors.HandleError(400, fmt.Sprintf("password must be at least %v characters long", minPasswordLength), w)
+		return
+	}
+
+	var current string
+	if current, err = userHandler.userStore.GetPassword(r.Context(), invoker.Id); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(current), []byte(req.CurrentPassword)); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.changePassword() - wrong current password", "id", invoker.Id)
+		errors.HandleError(403, "wrong password", w)
+		return
+	}
+
+	var hash string
+	if hash, err = auth.HashAndSalt([]byte(req.NewPassword)); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	if err = userHandler.authStore.RevokeUserTokensWith(r.Context(), invoker.Id, func(tx utils.DBTX) error {
+		return userHandler.userStore.WithTx(tx).UpdatePassword(r.Context(), invoker.Id, hash)
+	}); err != nil {
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "UserHandler.changePassword() - password changed", "id", invoker.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (userHandler *UserHandler) deleteMe(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.deleteMe() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if err = userHandler.authStore.RevokeUserTokensWith(r.Context(), invoker.Id, func(tx utils.DBTX) error {
+		return userHandler.userStore.WithTx(tx).AnonymizeUser(r.Context(), invoker.Id)
+	}); err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("user with id %v wasn't found", invoker.Id), w)
+			return
+		}
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "UserHandler.deleteMe() - account anonymized", "id", invoker.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type UpdateMeRequest struct {
+	Name *string `json:"name"`
+	Mail *string `json:"mail"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
@@ -4,86 +4,102 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"strings"
 
 	"example/library-service/internal/auth"
 	"example/library-service/internal/entity"
 	"example/library-service/internal/errors"
+	"example/library-service/internal/etag"
+	"example/library-service/internal/mail"
+	"example/library-service/internal/patch"
 	"example/library-service/internal/utils"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
 type UserHandler struct {
 	userStore *UserStore
 	authStore *auth.AuthStore
+	mailer    mail.Mailer
 }
 
-func NewUserHandler(db *sql.DB, authStore *auth.AuthStore) *UserHandler {
+func NewUserHandler(db *sql.DB, authStore *auth.AuthStore, mailer mail.Mailer) *UserHandler {
 	store := NewUserStore(db)
-	return &UserHandler{store, authStore}
+	return &UserHandler{store, authStore, mailer}
 }
 
-func (userHandler *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == http.MethodGet && utils.UserRe.Match([]byte(r.URL.Path)):
-		userHandler.getUsers(w, r)
-		return
-	case r.Method == http.MethodGet && utils.UserReWithID.Match([]byte(r.URL.Path)):
-		userHandler.getUser(w, r)
-		return
-	case r.Method == http.MethodPut && utils.UserRe.Match([]byte(r.URL.Path)):
-		userHandler.updateUser(w, r)
-		return
-	case r.Method == http.MethodDelete && utils.UserReWithID.Match([]byte(r.URL.Path)):
-		userHandler.deleteUser(w, r)
-		return
-	default:
-		errors.HandleError(405, fmt.Sprintf("Method %v not allowed", r.URL.Path), w)
-		return
-	}
+// Routes registers the user routes. PUT /users, with the id in the body, is
+// kept for existing clients.
+func (userHandler *UserHandler) Routes(r chi.Router) {
+	r.Get("/users", userHandler.getUsers)
+	r.Put("/users", userHandler.updateUser)
+	r.Get("/users/{id}", userHandler.getUser)
+	r.Put("/users/{id}", userHandler.updateUser)
+	r.Patch("/users/{id}", userHandler.patchUser)
+	r.Delete("/users/{id}", userHandler.deleteUser)
+	r.Post("/users/{id}/unlock", userHandler.unlockUser)
+	r.Get(utils.MePath, userHandler.getMe)
+	r.Patch(utils.MePath, userHandler.updateMe)
+	r.Delete(utils.MePath, userHandler.deleteMe)
+}
+
+// PasswordRoutes registers the password change separately, so it can be
+// rate limited like the auth routes.
+func (userHandler *UserHandler) PasswordRoutes(r chi.Router) {
+	r.Post(utils.MePasswordPath, userHandler.changePassword)
 }
 
 func (userHandler *UserHandler) getUser(w http.ResponseWriter, r *http.Request) {
 	var id uuid.UUID
 	var err error
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("UserHandler.getUser() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "UserHandler.getUser() - processing request", "path", r.URL.Path)
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), userHandler.authStore); err != nil {
-		log.Println("UserHandler.getUser() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersRead); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.getUser() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("UserHandler.getUser() - received error", err)
-		errors.HandleError(500, "Internal Server Error", w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.getUser() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	if invoker.Role != entity.ADMIN && invoker.Id != id {
+		errors.HandleError(403, "403 Forbidden", w)
 		return
 	}
 
 	var User entity.User
-	if User, err = userHandler.userStore.GetUser(id); err != nil {
+	if User, err = userHandler.userStore.GetUser(r.Context(), id); err != nil {
 		if err == sql.ErrNoRows {
 			errors.HandleError(404, fmt.Sprintf("user with id %v wasn't found", id), w)
 			return
 		}
-		log.Println("UserHandler.getUser() - received error from db", err)
+		slog.ErrorContext(r.Context(), "UserHandler.getUser() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(User)
 	if err != nil {
-		log.Println("UserHandler.getUser() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "UserHandler.getUser() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("UserHandler.getUser() - successfully finished req", User)
+	slog.InfoContext(r.Context(), "UserHandler.getUser() - successfully finished req", "user", User)
+
+	if etag.NotModified(w, r, etag.Of(User.Id, User.Version)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -96,7 +112,7 @@ func (userHandler *UserHandler) getUsers(w http.ResponseWriter, r *http.Request)
 	values := r.URL.Query()
 
 	queryMap := utils.ToMap(values)
-	log.Println("UserHandler.getUsers() - received req", queryMap)
+	slog.DebugContext(r.Context(), "UserHandler.getUsers() - received req", "params", queryMap)
 
 	if !utils.ValidParams("user", queryMap) {
 		errors.HandleError(400, "Invalid request params", w)
@@ -104,9 +120,9 @@ func (userHandler *UserHandler) getUsers(w http.ResponseWriter, r *http.Request)
 	}
 
 	var invoker entity.User
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), userHandler.authStore); err != nil {
-		log.Println("UserHandler.getUsers() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersRead); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.getUsers() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
@@ -116,20 +132,20 @@ func (userHandler *UserHandler) getUsers(w http.ResponseWriter, r *http.Request)
 	}
 
 	var Users []entity.User
-	if Users, err = userHandler.userStore.GetUsers(queryMap); err != nil {
-		log.Println("UserHandler.getUsers() - received error from db", err)
+	if Users, err = userHandler.userStore.GetUsers(r.Context(), queryMap); err != nil {
+		slog.ErrorContext(r.Context(), "UserHandler.getUsers() - received error from db", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
 	jsonBytes, err := json.Marshal(Users)
 	if err != nil {
-		log.Println("UserHandler.getUsers() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "UserHandler.getUsers() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("UserHandler.getUsers() - successfully finished req", Users)
+	slog.InfoContext(r.Context(), "UserHandler.getUsers() - successfully finished req", "users", Users)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -139,9 +155,9 @@ func (userHandler *UserHandler) getUsers(w http.ResponseWriter, r *http.Request)
 func (userHandler *UserHandler) updateUser(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var invoker entity.User
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), userHandler.authStore); err != nil {
-		log.Println("UserHandler.updateUser() - invalid token: ", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.updateUser() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
@@ -153,18 +169,31 @@ func (userHandler *UserHandler) updateUser(w http.ResponseWriter, r *http.Reques
 	var user entity.User
 
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		log.Println("UserHandler.updateUser() - received decode error", err)
+		slog.ErrorContext(r.Context(), "UserHandler.updateUser() - received decode error", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("UserHandler.updateUser() - received req", user)
+	if utils.PathParam(r, "id") != "" {
+		if user.Id, err = utils.PathUUID(r, "id"); err != nil {
+			slog.WarnContext(r.Context(), "UserHandler.updateUser() - received invalid id", "err", err)
+			errors.HandleError(400, "invalid id", w)
+			return
+		}
+	}
+
+	slog.DebugContext(r.Context(), "UserHandler.updateUser() - received req", "user", user)
+
+	previous, ok := userHandler.currentUser(w, r, user.Id)
+	if !ok {
+		return
+	}
 
 	var updatedUser entity.User
-	if updatedUser, err = userHandler.userStore.UpdateUser(user); err != nil {
-		log.Println("UserHandler.updateUser() - received error from db", err)
+	if updatedUser, err = userHandler.userStore.UpdateUser(r.Context(), user, previous.Version); err != nil {
+		slog.ErrorContext(r.Context(), "UserHandler.updateUser() - received error from db", "err", err)
 		if err == sql.ErrNoRows {
-			errors.HandleError(404, fmt.Sprintf("user with id %v wasn't found", user.Id), w)
+			etag.Changed(w)
 			return
 		}
 
@@ -172,14 +201,22 @@ func (userHandler *UserHandler) updateUser(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Tokens carry the role, so they have to be reissued after a change.
+	if updatedUser.Role != previous.Role {
+		if err = userHandler.authStore.RevokeUserTokens(r.Context(), updatedUser.Id); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
 	jsonBytes, err := json.Marshal(updatedUser)
 	if err != nil {
-		log.Println("UserHandler.updateUser() - received error while marshaling", err)
+		slog.ErrorContext(r.Context(), "UserHandler.updateUser() - received error while marshaling", "err", err)
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	log.Println("UserHandler.updateUser() - successfully finished req", updatedUser)
+	slog.InfoContext(r.Context(), "UserHandler.updateUser() - successfully finished req", "user", updatedUser)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonBytes)
@@ -190,13 +227,12 @@ func (userHandler *UserHandler) updateUser(w http.ResponseWriter, r *http.Reques
 func (userHandler *UserHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
 	var id uuid.UUID
 	var err error
-	strs := strings.Split(r.URL.Path, "/")
 
-	log.Println("deleteUser() - processing request", r.URL.Path)
+	slog.DebugContext(r.Context(), "deleteUser() - processing request", "path", r.URL.Path)
 	var invoker entity.User
-	if invoker, err = auth.ValidateTokenAndGetUser(r.Header.Get("Authorization"), userHandler.authStore); err != nil {
-		log.Println("UserHandler.updateUser() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.updateUser() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
 		return
 	}
 
@@ -205,20 +241,63 @@ func (userHandler *UserHandler) deleteUser(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err = auth.ValidateToken(r.Header.Get("Authorization"), userHandler.authStore); err != nil {
-		log.Println("UserHandler.deleteUser() - invalid token", err)
-		errors.HandleError(401, err.Error(), w)
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "deleteUser() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	current, ok := userHandler.currentUser(w, r, id)
+	if !ok {
+		return
+	}
+
+	if err = userHandler.userStore.DeleteUser(r.Context(), id, current.Version); err != nil {
+		slog.ErrorContext(r.Context(), "deleteUser() - received error from db", "err", err)
+		if err == sql.ErrNoRows {
+			etag.Changed(w)
+			return
+		}
+
+		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	if id, err = uuid.Parse(strs[len(strs)-1]); err != nil {
-		log.Println("deleteUser() - received error", err)
+	if err = userHandler.authStore.RevokeUserTokens(r.Context(), id); err != nil {
 		errors.HandleError(500, "Internal Server Error", w)
 		return
 	}
 
-	if err = userHandler.userStore.DeleteUser(id); err != nil {
-		log.Println("deleteUser() - received error from db", err)
+	slog.InfoContext(r.Context(), "UserHandler.deleteUser() - successfully finished req", "id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (userHandler *UserHandler) unlockUser(w http.ResponseWriter, r *http.Request) {
+	var id uuid.UUID
+	var err error
+
+	slog.DebugContext(r.Context(), "UserHandler.unlockUser() - processing request", "path", r.URL.Path)
+
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.unlockUser() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if invoker.Role != entity.ADMIN {
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.unlockUser() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid user id", w)
+		return
+	}
+
+	if err = userHandler.userStore.UnlockUser(r.Context(), id); err != nil {
 		if err == sql.ErrNoRows {
 			errors.HandleError(404, fmt.Sprintf("user with id %v wasn't found", id), w)
 			return
@@ -228,7 +307,160 @@ func (userHandler *UserHandler) deleteUser(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	log.Println("UserHandler.deleteUser() - successfully finished req", id)
+	slog.InfoContext(r.Context(), "UserHandler.unlockUser() - successfully finished req", "id", id, "invoker", invoker.Id)
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (userHandler *UserHandler) patchUser(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var invoker entity.User
+	if invoker, err = auth.Authenticate(r, userHandler.authStore, auth.ScopeUsersWrite); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.patchUser() - invalid token", "err", err)
+		errors.HandleError(auth.ErrorStatus(err), err.Error(), w)
+		return
+	}
+
+	if invoker.Role != entity.ADMIN {
+		errors.HandleError(403, "403 Forbidden", w)
+		return
+	}
+
+	var id uuid.UUID
+	if id, err = utils.PathUUID(r, "id"); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.patchUser() - received invalid id", "err", err)
+		errors.HandleError(400, "invalid id", w)
+		return
+	}
+
+	if !patch.Supported(r) {
+		errors.HandleError(415, fmt.Sprintf("Content-Type must be %v", patch.ContentType), w)
+		return
+	}
+
+	var set map[string]any
+	if set, err = userColumns(r.Body); err != nil {
+		slog.WarnContext(r.Context(), "UserHandler.patchUser() - received invalid patch", "err", err)
+		errors.HandleError(400, err.Error(), w)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "UserHandler.patchUser() - received req", "id", id, "set", set)
+
+	previous, ok := userHandler.currentUser(w, r, id)
+	if !ok {
+		return
+	}
+
+	name, nameChanged := set["name"].(string)
+	mail, mailChanged := set["mail"].(string)
+	if nameChanged || mailChanged {
+		if !nameChanged {
+			name = previous.Name
+		}
+		if !mailChanged {
+			mail = previous.Mail
+		}
+
+		var exists bool
+		if exists, err = userHandler.userStore.ExistsWithNameOrMailExcept(r.Context(), id, name, mail); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+
+		if exists {
+			errors.HandleError(409, "name or mail is already taken", w)
+			return
+		}
+	}
+
+	// A new mail has to be verified again.
+	if mailChanged && mail != previous.Mail {
+		set["mail_verified"] = false
+	}
+
+	patchedUser := previous
+	if len(set) > 0 {
+		if patchedUser, err = userHandler.userStore.PatchUser(r.Context(), id, previous.Version, set); err != nil {
+			slog.ErrorContext(r.Context(), "UserHandler.patchUser() - received error from db", "err", err)
+			if err == sql.ErrNoRows {
+				etag.Changed(w)
+				return
+			}
+
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	// Tokens carry the role, so they have to be reissued after a change.
+	if patchedUser.Role != previous.Role {
+		if err = userHandler.authStore.RevokeUserTokens(r.Context(), id); err != nil {
+			errors.HandleError(500, "Internal Server Error", w)
+			return
+		}
+	}
+
+	jsonBytes, err := json.Marshal(patchedUser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "UserHandler.patchUser() - received error while marshaling", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "UserHandler.patchUser() - successfully finished req", "id", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonBytes)
+}
+
+// currentUser loads the user a write applies to and checks that the client
+// has seen its current state.
+func (userHandler *UserHandler) currentUser(w http.ResponseWriter, r *http.Request, id uuid.UUID) (user entity.User, ok bool) {
+	user, err := userHandler.userStore.GetUser(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			errors.HandleError(404, fmt.Sprintf("user with id %v wasn't found", id), w)
+			return user, false
+		}
+		slog.ErrorContext(r.Context(), "UserHandler.currentUser() - received error from db", "err", err)
+		errors.HandleError(500, "Internal Server Error", w)
+		return user, false
+	}
+
+	user.Version, ok = etag.CheckIfMatch(w, r, user.Id, user.Version)
+	return user, ok
+}
+
+// userColumns maps a merge patch of a user to the columns it changes.
+func userColumns(body io.Reader) (map[string]any, error) {
+	p, err := patch.Decode(body, "name", "mail", "role")
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]any{}
+	if name, ok, err := p.String("name"); err != nil {
+		return nil, err
+	} else if ok {
+		set["name"] = name
+	}
+
+	if mail, ok, err := p.String("mail"); err != nil {
+		return nil, err
+	} else if ok {
+		set["mail"] = mail
+	}
+
+	if role, ok, err := p.Int("role"); err != nil {
+		return nil, err
+	} else if ok {
+		if role < entity.USER || role > entity.ADMIN {
+			return nil, &patch.Error{Field: "role", Message: "isn't a known role"}
+		}
+		set["role"] = role
+	}
+
+	return set, nil
+}
@@ -0,0 +1,115 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"example/library-service/internal/auth"
+	"example/library-service/internal/entity"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+func bearer(t *testing.T, role int) string {
+	t.Helper()
+	token, err := auth.GenerateToken(uuid.New(), role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func unlock(handler *UserHandler, id string, authHeader string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	handler.Routes(router)
+
+	r := httptest.NewRequest(http.MethodPost, "/users/"+id+"/unlock", nil)
+	if authHeader != "" {
+		r.Header.Set("Authorization", authHeader)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// These requests are rejected before the user is looked up, so they need no
+// database.
+func TestUnlockUserRejects(t *testing.T) {
+	handler := NewUserHandler(nil, auth.NewAuthStore(nil), nil)
+
+	tests := []struct {
+		name   string
+		id     string
+		header string
+		status int
+	}{
+		{"anonymous", uuid.NewString(), "", http.StatusUnauthorized},
+		{"invalid token", uuid.NewString(), "Bearer forged", http.StatusUnauthorized},
+		{"user", uuid.NewString(), bearer(t, entity.USER), http.StatusForbidden},
+		{"moderator", uuid.NewString(), bearer(t, entity.MODERATOR), http.StatusForbidden},
+		{"invalid id", "1", bearer(t, entity.ADMIN), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := unlock(handler, tt.id, tt.header); w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, which has to have
+// the schema of migrations/create_db.sql, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUnlockUser(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	handler := NewUserHandler(db, auth.NewAuthStore(db), nil)
+
+	var id uuid.UUID
+	name := uuid.NewString()
+	if err := db.QueryRowContext(ctx, `
+		insert into users(name, mail, password, role, created_at, failed_logins, locked_until)
+		values($1, $2, 'hash', 0, now(), 7, $3) returning id
+	`, name, name+"@example.com", time.Now().UTC().Add(time.Hour)).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := unlock(handler, id.String(), bearer(t, entity.ADMIN)); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	var failedLogins int
+	var lockedUntil sql.NullTime
+	if err := db.QueryRowContext(ctx, `select failed_logins, locked_until from users where id=$1`, id).Scan(&failedLogins, &lockedUntil); err != nil {
+		t.Fatal(err)
+	}
+	if failedLogins != 0 || lockedUntil.Valid {
+		t.Errorf("failed_logins = %d, locked_until = %v after unlocking", failedLogins, lockedUntil)
+	}
+
+	if w := unlock(handler, uuid.NewString(), bearer(t, entity.ADMIN)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown user status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -1,46 +1,65 @@
 package user
 
 import (
+	"context"
 	"database/sql"
 	"example/library-service/internal/entity"
+	"example/library-service/internal/metrics"
+	"example/library-service/internal/patch"
+	"example/library-service/internal/tracing"
+	"example/library-service/internal/utils"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type UserStore struct {
-	db *sql.DB
+	db utils.DBTX
 }
 
 func NewUserStore(db *sql.DB) *UserStore {
 	return &UserStore{db}
 }
 
-func (store *UserStore) GetUser(id uuid.UUID) (u entity.User, e error) {
-	statement, err := store.db.Prepare(`
-		select id, name, mail, role, created_at from users where id=$1 
+// WithTx returns a store running its queries in tx.
+func (store *UserStore) WithTx(tx utils.DBTX) *UserStore {
+	return &UserStore{tx}
+}
+
+func (store *UserStore) GetUser(ctx context.Context, id uuid.UUID) (u entity.User, e error) {
+	defer metrics.ObserveQuery("UserStore.GetUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.GetUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select id, name, mail, mail_verified, role, created_at, locked_until, totp_enabled, version from users where id=$1 
 	`)
 
 	if err != nil {
-		log.Println("UserStore.GetUser() - received error from db", err)
+		slog.ErrorContext(ctx, "UserStore.GetUser() - received error from db", "err", err)
 		return u, err
 	}
 
-	rows := statement.QueryRow(id.String())
+	rows := statement.QueryRowContext(ctx, id.String())
 
-	if scanErr := rows.Scan(&u.Id, &u.Name, &u.Mail, &u.Role, &u.CreatedAt); scanErr != nil {
-		log.Println("UserStore.GetUser() - received error from db", scanErr)
+	if scanErr := rows.Scan(&u.Id, &u.Name, &u.Mail, &u.MailVerified, &u.Role, &u.CreatedAt, &u.LockedUntil, &u.TOTPEnabled, &u.Version); scanErr != nil {
+		slog.ErrorContext(ctx, "UserStore.GetUser() - received error from db", "err", scanErr)
 		return u, scanErr
 	}
 
-	log.Println("UserStore.GetUser() - received from db", u)
+	slog.DebugContext(ctx, "UserStore.GetUser() - received from db", "user", u)
 	return u, nil
 }
 
-func (store *UserStore) GetUsers(m map[string]string) ([]entity.User, error) {
-	query := "select id, name, mail, role, created_at from users"
+func (store *UserStore) GetUsers(ctx context.Context, m map[string]string) ([]entity.User, error) {
+	defer metrics.ObserveQuery("UserStore.GetUsers", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.GetUsers")
+	defer span.End()
+
+	query := "select id, name, mail, role, created_at, locked_until from users"
 	params := make([]any, len(m))
 
 	if len(m) != 0 {
@@ -61,25 +80,25 @@ func (store *UserStore) GetUsers(m map[string]string) ([]entity.User, error) {
 		query = strings.Join(queryArr[:len(queryArr)-1], " ")
 	}
 
-	log.Println("UserStore.GetUsers() - executing query", query, params)
+	slog.DebugContext(ctx, "UserStore.GetUsers() - executing query", "query", query, "params", params)
 
-	statement, err := store.db.Prepare(query)
+	statement, err := store.db.PrepareContext(ctx, query)
 
 	if err != nil {
-		log.Println("UserStore.GetUsers() - received error from db", err)
+		slog.ErrorContext(ctx, "UserStore.GetUsers() - received error from db", "err", err)
 		return nil, err
 	}
 
 	var queryRows *sql.Rows
 	var queryError error
 	if len(params) == 0 {
-		queryRows, queryError = statement.Query()
+		queryRows, queryError = statement.QueryContext(ctx)
 	} else {
-		queryRows, queryError = statement.Query(params...)
+		queryRows, queryError = statement.QueryContext(ctx, params...)
 	}
 
 	if queryError != nil {
-		log.Println("UserStore.GetUsers() - received error from db", queryError)
+		slog.ErrorContext(ctx, "UserStore.GetUsers() - received error from db", "err", queryError)
 		return nil, queryError
 	}
 
@@ -88,28 +107,34 @@ func (store *UserStore) GetUsers(m map[string]string) ([]entity.User, error) {
 	users := make([]entity.User, 0)
 	for queryRows.Next() {
 		var user entity.User
-		if scanErr := queryRows.Scan(&user.Id, &user.Name, &user.Mail, &user.Role, &user.CreatedAt); scanErr != nil {
-			log.Println("UserStore.GetUsers() - received error while scanning", err)
+		if scanErr := queryRows.Scan(&user.Id, &user.Name, &user.Mail, &user.Role, &user.CreatedAt, &user.LockedUntil); scanErr != nil {
+			slog.ErrorContext(ctx, "UserStore.GetUsers() - received error while scanning", "err", scanErr)
 		}
 		users = append(users, user)
 	}
 
 	if err := queryRows.Err(); err != nil {
-		log.Println("UserStore.GetUsers() - received error from db", err)
+		slog.ErrorContext(ctx, "UserStore.GetUsers() - received error from db", "err", err)
 		return nil, err
 	}
 
 	return users, nil
 }
 
-func (store *UserStore) UpdateUser(user entity.User) (updatedUser entity.User, err error) {
-	statement, err := store.db.Prepare(`
-		update users set name=$1, mail=$2, role=$3 where id=$4
-		returning id, name, mail, role, created_at
+// UpdateUser replaces the user's name, mail and role if it's still at the
+// given version.
+func (store *UserStore) UpdateUser(ctx context.Context, user entity.User, version int) (updatedUser entity.User, err error) {
+	defer metrics.ObserveQuery("UserStore.UpdateUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.UpdateUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set name=$1, mail=$2, role=$3, version=version+1 where id=$4 and version=$5
+		returning id, name, mail, role, created_at, version
 	`)
 
 	if err != nil {
-		log.Println("UserStore.UpdateUser() - received error from db", err)
+		slog.ErrorContext(ctx, "UserStore.UpdateUser() - received error from db", "err", err)
 		return updatedUser, err
 	}
 
@@ -118,29 +143,221 @@ func (store *UserStore) UpdateUser(user entity.User) (updatedUser entity.User, e
 	// 	return updatedUser, err
 	// }
 
-	row := statement.QueryRow(&user.Name, &user.Mail, &user.Role, &user.Id)
+	row := statement.QueryRowContext(ctx, &user.Name, &user.Mail, &user.Role, &user.Id, version)
 
-	if scanError := row.Scan(&updatedUser.Id, &updatedUser.Name, &updatedUser.Mail, &updatedUser.Role, &updatedUser.CreatedAt); scanError != nil {
-		log.Println("UserStore.UpdateUser() - received error from db", scanError)
+	if scanError := row.Scan(&updatedUser.Id, &updatedUser.Name, &updatedUser.Mail, &updatedUser.Role, &updatedUser.CreatedAt, &updatedUser.Version); scanError != nil {
+		slog.ErrorContext(ctx, "UserStore.UpdateUser() - received error from db", "err", scanError)
 		return updatedUser, scanError
 	}
 
 	return updatedUser, nil
 }
 
-func (store *UserStore) DeleteUser(id uuid.UUID) error {
+// PatchUser updates only the given columns of the user if it's still at the
+// given version.
+func (store *UserStore) PatchUser(ctx context.Context, id uuid.UUID, version int, set map[string]any) (u entity.User, err error) {
+	defer metrics.ObserveQuery("UserStore.PatchUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.PatchUser")
+	defer span.End()
+
+	update, args := patch.Update("users", id, version, set)
+	statement, err := store.db.PrepareContext(ctx, `
+		with patched_user as (`+update+`)
+		select id, name, mail, mail_verified, role, created_at, locked_until, totp_enabled, version from patched_user
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.PatchUser() - received error from db", "err", err)
+		return u, err
+	}
+
+	row := statement.QueryRowContext(ctx, args...)
+
+	if scanErr := row.Scan(&u.Id, &u.Name, &u.Mail, &u.MailVerified, &u.Role, &u.CreatedAt, &u.LockedUntil, &u.TOTPEnabled, &u.Version); scanErr != nil {
+		slog.ErrorContext(ctx, "UserStore.PatchUser() - received error from db", "err", scanErr)
+		return u, scanErr
+	}
+
+	return u, nil
+}
+
+// DeleteUser deletes the user if it's still at the given version.
+func (store *UserStore) DeleteUser(ctx context.Context, id uuid.UUID, version int) error {
+	defer metrics.ObserveQuery("UserStore.DeleteUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.DeleteUser")
+	defer span.End()
 
-	deleteStatement, deleteErr := store.db.Prepare(`delete from users where id=$1`)
+	deleteStatement, deleteErr := store.db.PrepareContext(ctx, `delete from users where id=$1 and version=$2`)
 
 	if deleteErr != nil {
-		log.Println("UserStore.DeleteUser() - received error from db", deleteErr)
+		slog.ErrorContext(ctx, "UserStore.DeleteUser() - received error from db", "err", deleteErr)
 		return deleteErr
 	}
 
-	if _, execErr := deleteStatement.Exec(id); execErr != nil {
-		log.Println("UserStore.DeleteUser() - received error from db", execErr)
+	result, execErr := deleteStatement.ExecContext(ctx, id, version)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "UserStore.DeleteUser() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (store *UserStore) UnlockUser(ctx context.Context, id uuid.UUID) error {
+	defer metrics.ObserveQuery("UserStore.UnlockUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.UnlockUser")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `update users set failed_logins=0, locked_until=null, version=version+1 where id=$1`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.UnlockUser() - received error from db", "err", err)
+		return err
+	}
+
+	result, execErr := statement.ExecContext(ctx, id)
+	if execErr != nil {
+		slog.ErrorContext(ctx, "UserStore.UnlockUser() - received error from db", "err", execErr)
 		return execErr
 	}
 
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
+
+func (store *UserStore) ExistsWithNameOrMailExcept(ctx context.Context, id uuid.UUID, name string, mail string) (bool, error) {
+	defer metrics.ObserveQuery("UserStore.ExistsWithNameOrMailExcept", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.ExistsWithNameOrMailExcept")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		select count(*) from users where (name=$1 or mail=$2) and id<>$3
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.ExistsWithNameOrMailExcept() - received error from db", "err", err)
+		return true, err
+	}
+
+	var count int
+	if scanErr := statement.QueryRowContext(ctx, name, mail, id).Scan(&count); scanErr != nil {
+		slog.ErrorContext(ctx, "UserStore.ExistsWithNameOrMailExcept() - received error from db", "err", scanErr)
+		return true, scanErr
+	}
+
+	return count > 0, nil
+}
+
+// UpdateProfile changes the self-service fields of a user if it's still at
+// version. Changing the mail address resets its verification.
+func (store *UserStore) UpdateProfile(ctx context.Context, id uuid.UUID, name string, mail string, version int) (updatedUser entity.User, err error) {
+	defer metrics.ObserveQuery("UserStore.UpdateProfile", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.UpdateProfile")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `
+		update users set name=$1, mail=$2, mail_verified=(mail_verified and mail=$2), version=version+1 where id=$3 and version=$4
+		returning id, name, mail, mail_verified, role, created_at, locked_until, totp_enabled, version
+	`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.UpdateProfile() - received error from db", "err", err)
+		return updatedUser, err
+	}
+
+	row := statement.QueryRowContext(ctx, name, mail, id, version)
+
+	if scanError := row.Scan(&updatedUser.Id, &updatedUser.Name, &updatedUser.Mail, &updatedUser.MailVerified, &updatedUser.Role, &updatedUser.CreatedAt, &updatedUser.LockedUntil, &updatedUser.TOTPEnabled, &updatedUser.Version); scanError != nil {
+		slog.ErrorContext(ctx, "UserStore.UpdateProfile() - received error from db", "err", scanError)
+		return updatedUser, scanError
+	}
+
+	return updatedUser, nil
+}
+
+func (store *UserStore) GetPassword(ctx context.Context, id uuid.UUID) (password string, err error) {
+	defer metrics.ObserveQuery("UserStore.GetPassword", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.GetPassword")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `select password from users where id=$1`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.GetPassword() - received error from db", "err", err)
+		return password, err
+	}
+
+	if scanErr := statement.QueryRowContext(ctx, id).Scan(&password); scanErr != nil {
+		slog.ErrorContext(ctx, "UserStore.GetPassword() - received error from db", "err", scanErr)
+		return password, scanErr
+	}
+
+	return password, nil
+}
+
+func (store *UserStore) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	defer metrics.ObserveQuery("UserStore.UpdatePassword", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.UpdatePassword")
+	defer span.End()
+
+	statement, err := store.db.PrepareContext(ctx, `update users set password=$1 where id=$2`)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "UserStore.UpdatePassword() - received error from db", "err", err)
+		return err
+	}
+
+	if _, execErr := statement.ExecContext(ctx, password, id); execErr != nil {
+		slog.ErrorContext(ctx, "UserStore.UpdatePassword() - received error from db", "err", execErr)
+		return execErr
+	}
+
+	return nil
+}
+
+// AnonymizeUser erases personal data of a user instead of deleting the row,
+// so records referencing the user keep their history but can no longer be
+// linked to a person. The account can't be logged into afterwards.
+func (store *UserStore) AnonymizeUser(ctx context.Context, id uuid.UUID) error {
+	defer metrics.ObserveQuery("UserStore.AnonymizeUser", time.Now())
+	ctx, span := tracing.StartQuery(ctx, "UserStore.AnonymizeUser")
+	defer span.End()
+
+	err := utils.InTx(ctx, store.db, func(tx utils.DBTX) error {
+		result, err := tx.ExecContext(ctx, `
+			update users set name='deleted-' || id, mail='', password='', token=null,
+				mail_verified=false, role=$1, failed_logins=0, locked_until=null, deleted_at=$2,
+				oidc_issuer=null, oidc_subject=null, totp_secret=null, totp_enabled=false, totp_last_step=0,
+				version=version+1
+			where id=$3 and deleted_at is null
+		`, entity.USER, time.Now().UTC(), id)
+		if err != nil {
+			return err
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return sql.ErrNoRows
+		}
+
+		// The row is kept, so the credentials hanging off it aren't deleted
+		// by their foreign keys.
+		for _, table := range []string{"user_tokens", "recovery_codes", "api_keys"} {
+			if _, err = tx.ExecContext(ctx, `delete from `+table+` where user_id=$1`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(ctx, "UserStore.AnonymizeUser() - received error from db", "err", err)
+	}
+	return err
+}
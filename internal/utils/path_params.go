@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// PathParam returns the value of a {name} segment of the matched route.
+func PathParam(r *http.Request, name string) string {
+	return chi.URLParam(r, name)
+}
+
+// PathUUID parses a {name} segment of the matched route as an id.
+func PathUUID(r *http.Request, name string) (uuid.UUID, error) {
+	return uuid.Parse(chi.URLParam(r, name))
+}
@@ -2,25 +2,40 @@ package utils
 
 import (
 	"net/url"
-	"regexp"
+	"sort"
 )
 
 var (
-	BookRe         = regexp.MustCompile(`^/books/*$`)
-	BookReWithID   = regexp.MustCompile(`^/books/([a-z0-9]+(?:-[a-z0-9]+)+)$`)
-	AuthorRe       = regexp.MustCompile(`^/authors/*$`)
-	AuthorReWithID = regexp.MustCompile(`^/authors/([a-z0-9]+(?:-[a-z0-9]+)+)$`)
-	UserRe         = regexp.MustCompile(`^/users/*$`)
-	UserReWithID   = regexp.MustCompile(`^/users/([a-z0-9]+(?:-[a-z0-9]+)+)$`)
-	RegisterPath   = "/auth/register"
-	LoginPath      = "/auth/login"
-	LogoutPath     = "/auth/logout"
+	RegisterPath       = "/auth/register"
+	LoginPath          = "/auth/login"
+	LogoutPath         = "/auth/logout"
+	VerifyMailPath     = "/auth/verify"
+	ForgotPasswordPath = "/auth/forgot-password"
+	ResetPasswordPath  = "/auth/reset-password"
+	LoginMFAPath       = "/auth/login/mfa"
+	MFAEnrollPath      = "/auth/2fa/enroll"
+	MFAConfirmPath     = "/auth/2fa/confirm"
+	MFADisablePath     = "/auth/2fa/disable"
+	OIDCPathPrefix     = "/auth/oidc"
+	OIDCLoginPath      = "/auth/oidc/login"
+	OIDCCallbackPath   = "/auth/oidc/callback"
+	MePath             = "/me"
+	MePasswordPath     = "/me/password"
+	HealthPath         = "/healthz"
+	ReadyPath          = "/readyz"
+	VersionPath        = "/version"
+	JWKSPath           = "/.well-known/jwks.json"
+	OpenAPIPath        = "/openapi.json"
+	DocsPath           = "/docs"
 )
 
 var params = map[string]map[string]bool{
-	"author": {"book_name": true, "author_name": true, "genre": true},
-	"book":   {"book_name": true, "genre": true, "publication_date": true, "author_name": true},
-	"user":   {"name": true, "mail": true, "role": true},
+	"author":            {"book_name": true, "author_name": true, "genre": true},
+	"author_duplicates": {"threshold": true, "limit": true},
+	"book":              {"book_name": true, "genre": true, "publication_date": true, "author_name": true, "sort": true},
+	"loan_download":     {"format": true},
+	"series":            {"name": true},
+	"user":              {"name": true, "mail": true, "role": true},
 }
 
 func ToMap(values url.Values) map[string]string {
@@ -31,6 +46,16 @@ func ToMap(values url.Values) map[string]string {
 	return res
 }
 
+// Params returns the query params accepted by the api in a stable order.
+func Params(api string) []string {
+	var names []string
+	for name := range params[api] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func ValidParams(api string, m map[string]string) bool {
 	var available_params = params[api]
 	for k := range m {
@@ -1,8 +1,28 @@
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
 
+drop table if exists user_tokens;
+drop table if exists recovery_codes;
+drop table if exists api_keys;
+drop table if exists token_revocations;
+drop table if exists idempotency_keys;
+drop table if exists reviews;
+drop table if exists loans;
+drop table if exists ebook_files;
+drop table if exists series_books;
+drop table if exists series;
 drop table if exists books;
+drop table if exists author_redirects;
+drop table if exists author_aliases;
 drop table if exists authors;
 drop table if exists users;
+drop table if exists schema_migrations;
+
+create table schema_migrations (
+    version int not null,
+    applied_at timestamp not null,
+    primary key(version)
+);
 
 create table users (
     id uuid DEFAULT uuid_generate_v4(),
@@ -12,14 +32,143 @@ create table users (
     role int not null,
     created_at timestamp not null,
     token varchar,
-    primary key(id)
+    failed_logins int not null default 0,
+    locked_until timestamp,
+    mail_verified boolean not null default false,
+    deleted_at timestamp,
+    totp_secret varchar,
+    totp_enabled boolean not null default false,
+    totp_last_step bigint not null default 0,
+    oidc_issuer varchar,
+    oidc_subject varchar,
+    version int not null default 1,
+    primary key(id),
+    unique(oidc_issuer, oidc_subject)
+);
+
+create table recovery_codes (
+    id uuid DEFAULT uuid_generate_v4(),
+    user_id uuid not null,
+    code_hash varchar not null,
+    used_at timestamp,
+    created_at timestamp not null,
+    primary key(id),
+    constraint fk_user
+        foreign key (user_id)
+            references users(id)
+            on delete cascade
+);
+
+create table user_tokens (
+    id uuid DEFAULT uuid_generate_v4(),
+    user_id uuid not null,
+    purpose varchar not null,
+    token_hash varchar not null unique,
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp not null,
+    primary key(id),
+    constraint fk_user
+        foreign key (user_id)
+            references users(id)
+            on delete cascade
+);
+
+create table api_keys (
+    id uuid DEFAULT uuid_generate_v4(),
+    name varchar not null,
+    prefix varchar not null unique,
+    secret_hash varchar not null,
+    user_id uuid not null,
+    scopes varchar[] not null,
+    expires_at timestamp,
+    last_used_at timestamp,
+    created_at timestamp not null,
+    created_by uuid not null,
+    primary key(id),
+    constraint fk_user
+        foreign key (user_id)
+            references users(id)
+            on delete cascade
 );
 
+create table token_revocations (
+    id uuid DEFAULT uuid_generate_v4(),
+    jti varchar,
+    user_id uuid,
+    revoked_at timestamp not null,
+    expires_at timestamp not null,
+    primary key(id),
+    check ((jti is null) <> (user_id is null))
+);
+
+create index token_revocations_expires_at on token_revocations(expires_at);
+
+create table idempotency_keys (
+    caller varchar not null,
+    key varchar not null,
+    request_hash varchar not null,
+    role int not null,
+    status int,
+    content_type varchar,
+    body bytea,
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    primary key (caller, key)
+);
+
+create index idempotency_keys_expires_at on idempotency_keys(expires_at);
+
 create table authors (
     id uuid DEFAULT uuid_generate_v4(),
     name varchar not null,
+    birth_date date,
+    death_date date,
+    nationality varchar(2),
+    biography text,
+    viaf varchar,
+    isni varchar(16),
+    wikidata varchar,
     created_at timestamp not null,
-    primary key(id)
+    version int not null default 1,
+    primary key(id),
+    constraint author_lifespan check (death_date >= birth_date)
+);
+
+-- normalized_name folds case and punctuation, so "H. P. Lovecraft" and
+-- "h p lovecraft" compare equal.
+create or replace function normalized_name(name varchar) returns varchar
+    language sql immutable
+    as $$ select trim(regexp_replace(lower(name), '[^[:alnum:]]+', ' ', 'g')) $$;
+
+create index authors_normalized_name on authors using gin (normalized_name(name) gin_trgm_ops);
+
+create table author_aliases (
+    id uuid DEFAULT uuid_generate_v4(),
+    author_id uuid not null,
+    name varchar not null,
+    created_at timestamp not null,
+    primary key(id),
+    unique (author_id, name),
+    constraint fk_author
+        foreign key (author_id)
+            references authors(id)
+            on delete cascade
+);
+
+create index author_aliases_name on author_aliases using gin (name gin_trgm_ops);
+create index author_aliases_normalized_name on author_aliases using gin (normalized_name(name) gin_trgm_ops);
+
+-- author_redirects keeps the ids of merged authors resolvable.
+create table author_redirects (
+    from_id uuid not null,
+    to_id uuid not null,
+    created_at timestamp not null,
+    primary key(from_id),
+    constraint fk_author
+        foreign key (to_id)
+            references authors(id)
+            on delete cascade
 );
 
 create table books (
@@ -29,6 +178,10 @@ create table books (
     publication_date date not null,
     created_at timestamp not null,
     author_id uuid,
+    -- cover_id names the cover images in the blob store; every upload gets
+    -- a new id.
+    cover_id uuid,
+    version int not null default 1,
     primary key (id),
     constraint fk_author
         foreign key (author_id)
@@ -36,6 +189,98 @@ create table books (
 );
 
 
+create table series (
+    id uuid DEFAULT uuid_generate_v4(),
+    name varchar not null,
+    description text,
+    created_at timestamp not null,
+    version int not null default 1,
+    primary key(id)
+);
+
+-- position orders the books of a series; fractional positions, e.g. 2.5,
+-- place books between others.
+create table series_books (
+    series_id uuid not null,
+    book_id uuid not null,
+    position numeric not null check (position > 0),
+    primary key(series_id, book_id),
+    unique (series_id, position),
+    constraint fk_series
+        foreign key (series_id)
+            references series(id)
+            on delete cascade,
+    constraint fk_book
+        foreign key (book_id)
+            references books(id)
+            on delete cascade
+);
+
+create index series_books_book_id on series_books(book_id);
+
+-- The files themselves are kept in the blob store under
+-- ebooks/<book_id>/<format>.
+create table ebook_files (
+    book_id uuid not null,
+    format varchar(8) not null check (format in ('epub', 'pdf')),
+    content_type varchar not null,
+    size bigint not null,
+    created_at timestamp not null,
+    primary key(book_id, format),
+    constraint fk_book
+        foreign key (book_id)
+            references books(id)
+            on delete cascade
+);
+
+-- A loan is active until ends_at; returning a book early moves ends_at to
+-- returned_at, which revokes its download links.
+create table loans (
+    id uuid DEFAULT uuid_generate_v4(),
+    user_id uuid not null,
+    book_id uuid not null,
+    started_at timestamp not null,
+    ends_at timestamp not null,
+    returned_at timestamp,
+    downloads int not null default 0,
+    primary key(id),
+    constraint fk_user
+        foreign key (user_id)
+            references users(id)
+            on delete cascade,
+    constraint fk_book
+        foreign key (book_id)
+            references books(id)
+            on delete cascade
+);
+
+create index loans_user_id on loans(user_id, ends_at);
+
+-- Reviews of anonymized users are kept, without showing who wrote them.
+-- Hidden reviews are only visible to moderators and don't count towards the
+-- rating of the book.
+create table reviews (
+    id uuid DEFAULT uuid_generate_v4(),
+    book_id uuid not null,
+    user_id uuid not null,
+    rating smallint not null check (rating between 1 and 5),
+    text text,
+    hidden boolean not null default false,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    version int not null default 1,
+    primary key(id),
+    unique (book_id, user_id),
+    constraint fk_book
+        foreign key (book_id)
+            references books(id)
+            on delete cascade,
+    constraint fk_user
+        foreign key (user_id)
+            references users(id)
+            on delete cascade
+);
+
 WITH new_author AS (
     insert into authors (name, created_At)
     values ('Lovecraft', current_timestamp) returning id
@@ -46,3 +291,5 @@ INSERT INTO books (name, genre, publication_date, created_at, author_id)
 INSERT INTO books (name, genre, publication_date, created_at, author_id)
     SELECT 'Зов Ктулху', 'Хоррор', '1921-10-02', current_timestamp, id
         FROM authors where name = 'Lovecraft';
+
+INSERT INTO schema_migrations (version, applied_at) VALUES (18, current_timestamp);